@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+)
+
+var (
+	accessLogPath   = commandLine.String("access-log", "", "Path of an access log of the broadcaster's own endpoints. Disabled by default.")
+	accessLogFormat = commandLine.String("access-log-format", "combined", "Access log format: common or combined.")
+)
+
+// accessLogger writes one line per served request, in the common
+// or combined log format followed by the duration in microseconds
+// and, for purges by key, the surrogate keys.
+type accessLogger struct {
+	mu       sync.Mutex
+	out      io.Writer
+	combined bool
+}
+
+func openAccessLog() (*accessLogger, error) {
+	if *accessLogFormat != "common" && *accessLogFormat != "combined" {
+		return nil, fmt.Errorf("Unknown access log format %q.", *accessLogFormat)
+	}
+
+	f, err := os.OpenFile(*accessLogPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogger{out: f, combined: *accessLogFormat == "combined"}, nil
+}
+
+// responseRecorder captures the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// wrap logs every request served by the handler.
+func (l *accessLogger) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+
+		h.ServeHTTP(rec, r)
+
+		l.log(r, rec, started, time.Since(started))
+	})
+}
+
+func (l *accessLogger) log(r *http.Request, rec *responseRecorder, started time.Time, took time.Duration) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	size := "-"
+	if rec.bytes > 0 {
+		size = fmt.Sprint(rec.bytes)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		host, user, started.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, r.URL.RequestURI(), r.Proto, status, size)
+
+	if l.combined {
+		line += fmt.Sprintf(" %s %s", quoteOrDash(r.Referer()), quoteOrDash(r.UserAgent()))
+	}
+
+	line += fmt.Sprintf(" %d", took.Microseconds())
+
+	if _, keys := broadcaster.SurrogateKeys(r.Header); keys != "" {
+		line += fmt.Sprintf(" keys=%q", keys)
+	}
+
+	line += "\n"
+
+	l.mu.Lock()
+	io.WriteString(l.out, line)
+	l.mu.Unlock()
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return "\"-\""
+	}
+	return fmt.Sprintf("%q", s)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var combinedLine = regexp.MustCompile(`^(\S+) - (\S+) \[([^\]]+)\] "(\S+) (\S+) (\S+)" (\d{3}) (\d+|-) "([^"]*)" "([^"]*)" (\d+)\n$`)
+
+func TestAccessLogLine(t *testing.T) {
+	var out bytes.Buffer
+	l := &accessLogger{out: &out, combined: true}
+
+	h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("hello"))
+	}))
+
+	r := httptest.NewRequest("PURGE", "/foo/bar?x=1", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("User-Agent", "cms/1.0")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	m := combinedLine.FindStringSubmatch(out.String())
+	if m == nil {
+		t.Fatalf("unexpected access log line %q", out.String())
+	}
+
+	if m[1] != "10.1.2.3" || m[2] != "-" || m[4] != "PURGE" || m[5] != "/foo/bar?x=1" || m[6] != "HTTP/1.1" {
+		t.Errorf("unexpected request fields %q", m[1:7])
+	}
+	if _, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[3]); err != nil {
+		t.Errorf("unexpected timestamp %q", m[3])
+	}
+	if m[7] != "202" || m[8] != "5" {
+		t.Errorf("expected status 202 and 5 bytes, got %s %s", m[7], m[8])
+	}
+	if m[9] != "-" || m[10] != "cms/1.0" {
+		t.Errorf("unexpected referer and user agent %q %q", m[9], m[10])
+	}
+	if us, _ := strconv.Atoi(m[11]); us < 2000 {
+		t.Errorf("expected a duration of at least 2ms, got %sus", m[11])
+	}
+}
+
+func TestCommonAccessLogLine(t *testing.T) {
+	var out bytes.Buffer
+	l := &accessLogger{out: &out}
+
+	l.wrap(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if !regexp.MustCompile(`^\S+ - - \[[^\]]+\] "GET / HTTP/1.1" 404 \d+ \d+\n$`).MatchString(out.String()) {
+		t.Errorf("unexpected access log line %q", out.String())
+	}
+}
+
+func TestAccessLogLineReportsSurrogateKeys(t *testing.T) {
+	var out bytes.Buffer
+	l := &accessLogger{out: &out}
+
+	r := httptest.NewRequest("PURGE", "/", nil)
+	r.Header.Set("Surrogate-Key", "a b")
+	l.wrap(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), r)
+
+	if !regexp.MustCompile(`^\S+ - - \[[^\]]+\] "PURGE / HTTP/1.1" 404 \d+ \d+ keys="a b"\n$`).MatchString(out.String()) {
+		t.Errorf("unexpected access log line %q", out.String())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+var (
+	allowedNets = cidrFlag("allow-cidr", "Comma-separated networks allowed to broadcast, e.g. 10.0.0.0/8,192.168.0.7. Repeatable. All addresses are allowed by default.")
+	trustProxy  = commandLine.Bool("trust-proxy", false, "Takes the client address from the last X-Forwarded-For entry, as set by a trusted load balancer, and sends its X-Forwarded-For chain on to the caches.")
+
+	rejectedSources = metrics.NewCounter("broadcaster_rejected_sources_total", "Broadcasts rejected because their source address isn't allowlisted.", "")
+)
+
+// cidrList is a repeatable flag of comma-separated networks,
+// single addresses standing for a network of their own.
+type cidrList []*net.IPNet
+
+func cidrFlag(name, usage string) *cidrList {
+	l := &cidrList{}
+	commandLine.Var(l, name, usage)
+	return l
+}
+
+func (l *cidrList) String() string {
+	var s []string
+	for _, n := range *l {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *cidrList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			*l = append(*l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+func (l cidrList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client, as reported by
+// the load balancer in front of the broadcaster with -trust-proxy.
+func clientIP(r *http.Request) net.IP {
+	if *trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			return net.ParseIP(strings.TrimSpace(hops[len(hops)-1]))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// requireAllowedSource rejects requests from addresses outside
+// of -allow-cidr with a 403. All addresses are allowed without it.
+func requireAllowedSource(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(*allowedNets) == 0 {
+			h(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		if ip == nil || !allowedNets.contains(ip) {
+			rejectedSources.Inc("")
+			sendToLogChannel("Source ", fmt.Sprint(ip), " not allowed, rejecting ", r.Method, " ", r.URL.Path, "\n")
+			http.Error(w, "Source address not allowed.", http.StatusForbidden)
+			return
+		}
+
+		h(w, r)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAllowedSource(t *testing.T) {
+	defer func(l cidrList, trust bool) { *allowedNets, *trustProxy = l, trust }(*allowedNets, *trustProxy)
+
+	*allowedNets = nil
+	if err := allowedNets.Set("10.1.0.0/16, 192.168.0.7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := allowedNets.Set("fd00::/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := requireAllowedSource(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		trust     bool
+		status    int
+	}{
+		{"10.1.2.3:1234", "", false, http.StatusOK},
+		{"192.168.0.7:1234", "", false, http.StatusOK},
+		{"192.168.0.8:1234", "", false, http.StatusForbidden},
+		{"[fd00::1]:1234", "", false, http.StatusOK},
+		{"10.2.0.1:1234", "", false, http.StatusForbidden},
+		// The forwarded address is only used when trusted.
+		{"10.9.0.1:1234", "10.1.2.3", false, http.StatusForbidden},
+		{"10.9.0.1:1234", "172.16.0.1, 10.1.2.3", true, http.StatusOK},
+		{"10.1.2.3:1234", "10.1.0.1, 172.16.0.1", true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		*trustProxy = tt.trust
+		rejected := rejectedSources.Value("")
+
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s (%q, trusted %v): expected %d, got %d", tt.remote, tt.forwarded, tt.trust, tt.status, w.Code)
+		}
+		if counted := rejectedSources.Value("") - rejected; (counted == 1) != (tt.status == http.StatusForbidden) {
+			t.Errorf("%s: unexpected rejection count %d", tt.remote, counted)
+		}
+	}
+}
+
+func TestCIDRListRejectsInvalidNetworks(t *testing.T) {
+	var l cidrList
+	for _, v := range []string{"10.0.0.0/33", "not-an-ip", ""} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestAllowCIDRFlagTakesList(t *testing.T) {
+	var l cidrList
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&l, "allow-cidr", "")
+
+	if err := fs.Parse([]string{"-allow-cidr", "10.0.0.0/8,192.168.0.7", "-allow-cidr", "fd00::/8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := l.String(); got != "10.0.0.0/8,192.168.0.7/32,fd00::/8" {
+		t.Errorf("unexpected networks %s", got)
+	}
+	if !l.contains(net.ParseIP("192.168.0.7")) || l.contains(net.ParseIP("192.168.0.8")) {
+		t.Error("expected the single address to be allowed on its own")
+	}
+}
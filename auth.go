@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+var (
+	authToken        = commandLine.String("auth-token", "", "Bearer token required to broadcast. Broadcasts are unauthenticated by default.")
+	basicAuth        = commandLine.String("basic-auth", "", "user:password allowed to broadcast with basic authentication. Disabled by default.")
+	authTokensFile   = commandLine.String("auth-tokens-file", "", "File of named bearer tokens allowed to broadcast, one name[ admin]:token per line. Reloaded on SIGHUP.")
+	metricsAuthToken = commandLine.String("metrics-auth-token", "", "Bearer token required to read /metrics. Open by default.")
+	adminAuthToken   = commandLine.String("admin-auth-token", "", "Bearer token required by the /admin endpoints. Open by default.")
+
+	// broadcastTokens are the tokens allowed to
+	// broadcast. Guarded by locker.
+	broadcastTokens []namedToken
+
+	unauthorizedRequests = metrics.NewCounter("broadcaster_unauthorized_requests_total", "Requests rejected for a missing or invalid token.", "endpoint")
+)
+
+// namedToken is a bearer token, known under a name which is
+// safe to log in its stead. Admin tokens may broadcast to any
+// group, regardless of the tokens the group allows. Basic tokens
+// are user:password credentials of basic authentication.
+type namedToken struct {
+	name  string
+	value []byte
+	admin bool
+	basic bool
+}
+
+// tokenKey is the context key of the token
+// a request was authorized with.
+type tokenKey struct{}
+
+// loadAuthTokens sets up the tokens allowed to broadcast from
+// -auth-token, -basic-auth and -auth-tokens-file. The former two
+// are admin tokens.
+func loadAuthTokens() error {
+	var tokens []namedToken
+
+	if *authToken != "" {
+		tokens = append(tokens, namedToken{name: "default", value: []byte(*authToken), admin: true})
+	}
+
+	if *basicAuth != "" {
+		user := strings.SplitN(*basicAuth, ":", 2)[0]
+		if user == "" || !strings.Contains(*basicAuth, ":") {
+			return fmt.Errorf("-basic-auth must be of the form user:password.")
+		}
+		tokens = append(tokens, namedToken{name: user, value: []byte(*basicAuth), admin: true, basic: true})
+	}
+
+	if *authTokensFile != "" {
+		fileTokens, err := readTokensFile(*authTokensFile)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+
+	locker.Lock()
+	broadcastTokens = tokens
+	locker.Unlock()
+
+	return nil
+}
+
+// readTokensFile reads a file of name:token lines, ignoring blank
+// lines and lines starting with #. Admin tokens are marked by
+// following their name with admin, as in "ops admin:token".
+func readTokensFile(path string) ([]namedToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []namedToken
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:token.", path, n)
+		}
+
+		fields := strings.Fields(parts[0])
+		token := namedToken{name: fields[0], value: []byte(strings.TrimSpace(parts[1]))}
+
+		for _, f := range fields[1:] {
+			if f != "admin" {
+				return nil, fmt.Errorf("%s:%d: unknown token option %s.", path, n, f)
+			}
+			token.admin = true
+		}
+
+		if seen[token.name] {
+			return nil, fmt.Errorf("%s:%d: duplicate token name %s.", path, n, token.name)
+		}
+		seen[token.name] = true
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, scanner.Err()
+}
+
+func currentBroadcastTokens() []namedToken {
+	locker.Lock()
+	defer locker.Unlock()
+	return broadcastTokens
+}
+
+// flagToken returns the tokens of an endpoint
+// protected by a single token flag.
+func flagToken(token *string) func() []namedToken {
+	return func() []namedToken {
+		if *token == "" {
+			return nil
+		}
+		return []namedToken{{name: "default", value: []byte(*token)}}
+	}
+}
+
+// presentedToken extracts the token of an Authorization header,
+// either a bearer token or user:password basic credentials.
+func presentedToken(r *http.Request) (token string, basic bool, ok bool) {
+	if user, password, ok := r.BasicAuth(); ok {
+		return user + ":" + password, true, true
+	}
+
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || parts[1] == "" {
+		return "", false, false
+	}
+	return strings.TrimSpace(parts[1]), false, true
+}
+
+// matchToken returns the token presented. Every token of the same
+// kind is compared in constant time, so that timings give none of
+// them away.
+func matchToken(tokens []namedToken, presented string, basic bool) (namedToken, bool) {
+	var match namedToken
+	found := false
+
+	for _, t := range tokens {
+		if t.basic == basic && subtle.ConstantTimeCompare(t.value, []byte(presented)) == 1 && !found {
+			match, found = t, true
+		}
+	}
+
+	return match, found
+}
+
+// wantsBasic tells whether any of the tokens are basic credentials.
+func wantsBasic(tokens []namedToken) bool {
+	for _, t := range tokens {
+		if t.basic {
+			return true
+		}
+	}
+	return false
+}
+
+// requireToken protects the handler with the given tokens, answering
+// 401 without a token or with invalid basic credentials, and 403 for
+// an unknown bearer token. Endpoints without tokens are left open.
+// The matching token is passed on in the request context.
+func requireToken(endpoint string, tokens func() []namedToken, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := tokens()
+		if len(allowed) == 0 {
+			h(w, r)
+			return
+		}
+
+		challenge := func() {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="broadcaster"`)
+			if wantsBasic(allowed) {
+				w.Header().Add("WWW-Authenticate", `Basic realm="broadcaster"`)
+			}
+		}
+
+		presented, basic, ok := presentedToken(r)
+		if !ok {
+			unauthorizedRequests.Inc(endpoint)
+			challenge()
+			http.Error(w, "Authentication required.", http.StatusUnauthorized)
+			return
+		}
+
+		token, ok := matchToken(allowed, presented, basic)
+		if !ok {
+			unauthorizedRequests.Inc(endpoint)
+			sendToLogChannel("Invalid credentials from ", r.RemoteAddr, ", rejecting ", r.Method, " ", r.URL.Path, "\n")
+
+			if basic {
+				challenge()
+				http.Error(w, "Invalid credentials.", http.StatusUnauthorized)
+			} else {
+				http.Error(w, "Invalid token.", http.StatusForbidden)
+			}
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	}
+}
+
+// guardBroadcast rejects broadcasts reaching a group which doesn't
+// allow the token of the request with a 403, before handing them
+// over to the broadcaster.
+func guardBroadcast(b *broadcaster.Broadcaster, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		markBroadcast()
+
+		group, _, _ := b.Target(r)
+		if denied, ok := deniedGroup(b.Groups(), r, group); ok {
+			var errText = fmt.Sprintf("Token not allowed to broadcast to group %s.", denied)
+			sendToLogChannel(errText, "\n")
+			http.Error(w, errText, http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+}
+
+// deniedGroup returns the first group reached by the broadcast
+// which doesn't allow the token of the request, an empty name
+// standing for all groups. Groups without tokens are open to any.
+func deniedGroup(groupList []dao.Group, r *http.Request, groupName string) (string, bool) {
+	token, _ := r.Context().Value(tokenKey{}).(namedToken)
+	if token.admin {
+		return "", false
+	}
+
+	groups := make(map[string]dao.Group, len(groupList))
+	for _, g := range groupList {
+		groups[g.Name] = g
+	}
+
+	names := []string{groupName}
+	if groupName == "" {
+		names = names[:0]
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		allowed := groups[name].Tokens
+		if len(allowed) > 0 && !containsString(allowed, token.name) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
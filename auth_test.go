@@ -0,0 +1,241 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestReadTokensFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	ioutil.WriteFile(path, []byte("# deploy runners\ndeploy admin: s3cr3t\n\ncms:other:token\n"), 0600)
+
+	tokens, err := readTokensFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].name != "deploy" || string(tokens[0].value) != "s3cr3t" || !tokens[0].admin {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+	if tokens[1].name != "cms" || string(tokens[1].value) != "other:token" || tokens[1].admin {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+
+	ioutil.WriteFile(path, []byte("deploy\n"), 0600)
+	if _, err = readTokensFile(path); err == nil {
+		t.Error("expected a line without a token to be rejected")
+	}
+
+	ioutil.WriteFile(path, []byte("a root:1\n"), 0600)
+	if _, err = readTokensFile(path); err == nil {
+		t.Error("expected unknown token options to be rejected")
+	}
+
+	ioutil.WriteFile(path, []byte("a:1\na:2\n"), 0600)
+	if _, err = readTokensFile(path); err == nil {
+		t.Error("expected duplicate token names to be rejected")
+	}
+
+	os.Remove(path)
+	if _, err = readTokensFile(path); err == nil {
+		t.Error("expected a missing file to be reported")
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	tokens := []namedToken{{name: "cms", value: []byte("abc")}, {name: "deploy", value: []byte("def")}}
+
+	var authorized string
+	h := requireToken("broadcast", func() []namedToken { return tokens }, func(w http.ResponseWriter, r *http.Request) {
+		authorized = r.Context().Value(tokenKey{}).(namedToken).name
+	})
+
+	tests := []struct {
+		header string
+		status int
+		name   string
+	}{
+		{"", http.StatusUnauthorized, ""},
+		{"Basic YTpi", http.StatusUnauthorized, ""},
+		{"Bearer nope", http.StatusForbidden, ""},
+		{"Bearer def", http.StatusOK, "deploy"},
+		{"bearer abc", http.StatusOK, "cms"},
+	}
+
+	for _, tt := range tests {
+		authorized = ""
+		rejected := unauthorizedRequests.Value("broadcast")
+
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tt.status || authorized != tt.name {
+			t.Errorf("%q: expected %d authorized as %q, got %d as %q", tt.header, tt.status, tt.name, w.Code, authorized)
+		}
+		if counted := unauthorizedRequests.Value("broadcast") - rejected; (counted == 1) != (tt.status != http.StatusOK) {
+			t.Errorf("%q: unexpected rejection count %d", tt.header, counted)
+		}
+	}
+}
+
+func TestRequireTokenLeavesOpenEndpoints(t *testing.T) {
+	token := ""
+	called := false
+	requireToken("metrics", flagToken(&token), func(w http.ResponseWriter, r *http.Request) { called = true })(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+	if !called {
+		t.Error("expected an endpoint without token to be open")
+	}
+}
+
+func TestGroupTokens(t *testing.T) {
+	defer func(tokens []namedToken) { broadcastTokens = tokens }(broadcastTokens)
+	broadcastTokens = []namedToken{
+		{name: "search", value: []byte("s")},
+		{name: "media", value: []byte("m")},
+		{name: "ops", value: []byte("o"), admin: true},
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	b, err := broadcaster.New(broadcaster.Config{Groups: []dao.Group{
+		{Name: "images", Tokens: []string{"media"}, Caches: []dao.Cache{{Name: "img", Address: backend.URL}}},
+		{Name: "search", Tokens: []string{"search", "media"}, Caches: []dao.Cache{{Name: "srch", Address: backend.URL}}},
+		{Name: "misc", Caches: []dao.Cache{{Name: "misc", Address: backend.URL}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	h := requireToken("broadcast", currentBroadcastTokens, guardBroadcast(b, b.Handler()))
+
+	tests := []struct {
+		token  string
+		group  string
+		status int
+		denied string
+	}{
+		{"s", "search", http.StatusOK, ""},
+		{"s", "images", http.StatusForbidden, "images"},
+		{"s", "misc", http.StatusOK, ""},
+		{"m", "images", http.StatusOK, ""},
+		// Broadcasts to all groups need every group to allow
+		// the token, or an admin token.
+		{"s", "", http.StatusForbidden, "images"},
+		{"m", "", http.StatusOK, ""},
+		{"o", "", http.StatusOK, ""},
+		{"o", "images", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		if tt.group != "" {
+			r.Header.Set("X-Group", tt.group)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("token %s, group %q: expected %d, got %d", tt.token, tt.group, tt.status, w.Code)
+		}
+		if tt.denied != "" && !strings.Contains(w.Body.String(), "group "+tt.denied+".") {
+			t.Errorf("token %s, group %q: expected group %s to be reported, got %q", tt.token, tt.group, tt.denied, w.Body.String())
+		}
+	}
+}
+
+func TestGroupTokensOfPathGroups(t *testing.T) {
+	defer func(tokens []namedToken) { broadcastTokens = tokens }(broadcastTokens)
+	broadcastTokens = []namedToken{{name: "search", value: []byte("s")}}
+
+	b, err := broadcaster.New(broadcaster.Config{
+		Groups:           []dao.Group{{Name: "images", Tokens: []string{"media"}}},
+		PathGroupsPrefix: "/_group/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	r := httptest.NewRequest("PURGE", "/_group/images/foo", nil)
+	r.Header.Set("Authorization", "Bearer s")
+	w := httptest.NewRecorder()
+	requireToken("broadcast", currentBroadcastTokens, guardBroadcast(b, b.Handler()))(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the group of the path to be guarded, got %d", w.Code)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	defer func(tokens []namedToken, basic string) { broadcastTokens, *basicAuth = tokens, basic }(broadcastTokens, *basicAuth)
+
+	*basicAuth = "cms"
+	if err := loadAuthTokens(); err == nil {
+		t.Error("expected credentials without password to be rejected")
+	}
+
+	*basicAuth = "cms:pa:ss"
+	if err := loadAuthTokens(); err != nil {
+		t.Fatal(err)
+	}
+
+	var authorized string
+	h := requireToken("broadcast", currentBroadcastTokens, func(w http.ResponseWriter, r *http.Request) {
+		authorized = r.Context().Value(tokenKey{}).(namedToken).name
+	})
+
+	tests := []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"cms", "wrong", http.StatusUnauthorized},
+		{"other", "pa:ss", http.StatusUnauthorized},
+		{"cms", "pa:ss", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		authorized = ""
+
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s:%s: expected %d, got %d", tt.user, tt.password, tt.status, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && !strings.Contains(strings.Join(w.Header().Values("WWW-Authenticate"), ","), "Basic") {
+			t.Errorf("%s:%s: expected a basic challenge, got %v", tt.user, tt.password, w.Header())
+		}
+		if w.Code == http.StatusOK && authorized != "cms" {
+			t.Errorf("expected the broadcast to be authorized as cms, got %q", authorized)
+		}
+	}
+
+	// A bearer token can't pass as basic credentials.
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("Authorization", "Bearer cms:pa:ss")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the bearer token to be rejected, got %d", w.Code)
+	}
+}
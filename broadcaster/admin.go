@@ -0,0 +1,247 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// broadcastTargets resolves the caches a broadcast against the
+// group is sent to, an empty name standing for all caches. Caches
+// which are disabled, belong to a disabled group, or are within
+// a maintenance window, are returned
+// separately. found is false for an unknown group.
+func (b *Broadcaster) broadcastTargets(groupName string) (targets []dao.Cache, skipped []dao.Cache, found bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	caches := b.allCaches
+	if groupName != "" {
+		g, found := b.groups[groupName]
+		if !found {
+			return nil, nil, false
+		}
+		caches = g.Caches
+	}
+
+	inDisabledGroup := make(map[string]bool)
+	for name := range b.disabledGroups {
+		for _, cache := range b.groups[name].Caches {
+			inDisabledGroup[cache.Name] = true
+		}
+	}
+
+	now := time.Now()
+	for _, cache := range caches {
+		if b.disabledCaches[cache.Name] || inDisabledGroup[cache.Name] || cache.InMaintenance(now) {
+			skipped = append(skipped, cache)
+			continue
+		}
+		targets = append(targets, cache)
+	}
+
+	return targets, skipped, true
+}
+
+// group returns the configuration of the group, the zero
+// group when broadcasting to all caches.
+func (b *Broadcaster) group(groupName string) dao.Group {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.groups[groupName]
+}
+
+// syncDisabled carries the state of the caches and groups disabled
+// at runtime over a reload, as long as they're still configured. New
+// caches, and those whose disabled option changed since the previous
+// configuration, take the configured state. The caller must hold mu.
+func (b *Broadcaster) syncDisabled(previous map[string]dao.Cache) {
+	disabledCaches := make(map[string]bool)
+	for _, cache := range b.allCaches {
+		p, found := previous[cache.Name]
+		if found && p.Disabled == cache.Disabled {
+			if b.disabledCaches[cache.Name] {
+				disabledCaches[cache.Name] = true
+			}
+		} else if cache.Disabled {
+			disabledCaches[cache.Name] = true
+		}
+	}
+
+	disabledGroups := make(map[string]bool)
+	for name := range b.disabledGroups {
+		if _, found := b.groups[name]; found {
+			disabledGroups[name] = true
+		}
+	}
+
+	b.disabledCaches, b.disabledGroups = disabledCaches, disabledGroups
+}
+
+// cacheDisabled tells whether the cache itself is disabled,
+// whatever the state of its groups.
+func (b *Broadcaster) cacheDisabled(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.disabledCaches[name]
+}
+
+// setDisabled flags a cache or group as disabled or enabled,
+// returning false if no such cache or group is configured.
+func (b *Broadcaster) setDisabled(cacheName, groupName string, disabled bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if groupName != "" {
+		if _, found := b.groups[groupName]; !found {
+			return false
+		}
+		if disabled {
+			b.disabledGroups[groupName] = true
+		} else {
+			delete(b.disabledGroups, groupName)
+		}
+		return true
+	}
+
+	for _, cache := range b.allCaches {
+		if cache.Name == cacheName {
+			if disabled {
+				b.disabledCaches[cacheName] = true
+			} else {
+				delete(b.disabledCaches, cacheName)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// AdminStateHandler returns the handler of POST /admin/disable, or
+// /admin/enable when disabled is false. It takes either a cache or
+// a group query parameter. Caches in disabled groups are reported as
+// skipped until enabled again.
+func (b *Broadcaster) AdminStateHandler(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cacheName := r.URL.Query().Get("cache")
+		groupName := r.URL.Query().Get("group")
+
+		if (cacheName == "") == (groupName == "") {
+			http.Error(w, "Exactly one of the cache or group parameters is required.", http.StatusBadRequest)
+			return
+		}
+
+		if !b.setDisabled(cacheName, groupName, disabled) {
+			http.Error(w, fmt.Sprintf("Cache or group %s%s not found.", cacheName, groupName), http.StatusNotFound)
+			return
+		}
+
+		state := "enabled"
+		if disabled {
+			state = "disabled"
+		}
+		b.log("Admin ", state, " cache/group ", cacheName, groupName, "\n")
+
+		out, _ := json.MarshalIndent(map[string]interface{}{
+			"cache":    cacheName,
+			"group":    groupName,
+			"disabled": disabled,
+		}, "", "  ")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+}
+
+// AdminCacheStateHandler serves PUT /admin/caches/<name>/disable and
+// /admin/caches/<name>/enable, taking a single cache out of broadcasts,
+// e.g. while under maintenance, or back in, and
+// /admin/caches/<name>/reconnect, replacing its client.
+func (b *Broadcaster) AdminCacheStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cacheName, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/caches/"), "/")
+	if cacheName == "" || (action != "disable" && action != "enable" && action != "reconnect") {
+		http.Error(w, "Expected /admin/caches/<name>/disable, /admin/caches/<name>/enable or /admin/caches/<name>/reconnect.", http.StatusNotFound)
+		return
+	}
+
+	if action == "reconnect" {
+		found, err := b.reconnect(cacheName)
+		if !found {
+			http.Error(w, fmt.Sprintf("Cache %s not found.", cacheName), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b.log("Admin reconnected cache ", cacheName, "\n")
+
+		out, _ := json.MarshalIndent(map[string]interface{}{
+			"cache":       cacheName,
+			"reconnected": true,
+		}, "", "  ")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
+	disabled := action == "disable"
+
+	if !b.setDisabled(cacheName, "", disabled) {
+		http.Error(w, fmt.Sprintf("Cache %s not found.", cacheName), http.StatusNotFound)
+		return
+	}
+	b.log("Admin ", action, "d cache ", cacheName, "\n")
+
+	out, _ := json.MarshalIndent(map[string]interface{}{
+		"cache":    cacheName,
+		"disabled": disabled,
+	}, "", "  ")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// AdminGroupsHandler serves GET /admin/groups, the configured groups
+// with their caches, included groups being resolved to their caches.
+// Caches disabled, by the configuration or at runtime, are flagged so.
+func (b *Broadcaster) AdminGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	groupList := b.Groups()
+	sort.Slice(groupList, func(i, j int) bool { return groupList[i].Name < groupList[j].Name })
+
+	b.mu.Lock()
+	for i := range groupList {
+		caches := make([]dao.Cache, len(groupList[i].Caches))
+		for j, cache := range groupList[i].Caches {
+			cache.Disabled = b.disabledCaches[cache.Name]
+			caches[j] = cache
+		}
+		groupList[i].Caches = caches
+	}
+	b.mu.Unlock()
+
+	out, _ := json.MarshalIndent(groupList, "", "  ")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,259 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// setTestGroups replaces the groups of the broadcaster, leaving
+// the clients registered by newTestCache alone.
+func setTestGroups(b *Broadcaster, groupList ...dao.Group) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.groups = make(map[string]dao.Group)
+	for _, g := range groupList {
+		b.groups[g.Name] = g
+	}
+	b.rebuildAllCaches()
+	b.syncDisabled(nil)
+}
+
+func TestDisabledCacheIsNotBroadcastTo(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+	setTestGroups(b,
+		dao.Group{Name: "edge", Caches: []dao.Cache{{Name: "c1"}, {Name: "c2"}}},
+		dao.Group{Name: "shield", Caches: []dao.Cache{{Name: "c3"}}},
+	)
+
+	disable := func(query string) int {
+		w := httptest.NewRecorder()
+		b.AdminStateHandler(true)(w, httptest.NewRequest(http.MethodPost, "/admin/disable?"+query, nil))
+		return w.Code
+	}
+
+	if code := disable("cache=c1"); code != http.StatusOK {
+		t.Fatalf("expected the cache to be disabled, got %d", code)
+	}
+
+	targets, skipped, _ := b.broadcastTargets("edge")
+	if len(targets) != 1 || targets[0].Name != "c2" {
+		t.Errorf("expected c2 as only target, got %+v", targets)
+	}
+	if len(skipped) != 1 || skipped[0].Name != "c1" {
+		t.Errorf("expected c1 to be skipped, got %+v", skipped)
+	}
+
+	if code := disable("group=shield"); code != http.StatusOK {
+		t.Fatalf("expected the group to be disabled, got %d", code)
+	}
+
+	targets, skipped, _ = b.broadcastTargets("")
+	if len(targets) != 1 || len(skipped) != 2 {
+		t.Errorf("expected c1 and c3 to be skipped, got targets %+v", targets)
+	}
+
+	if code := disable("cache=unknown"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown cache, got %d", code)
+	}
+	if code := disable(""); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without cache or group, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	b.AdminStateHandler(false)(w, httptest.NewRequest(http.MethodPost, "/admin/enable?group=shield", nil))
+	if targets, _, _ = b.broadcastTargets("shield"); len(targets) != 1 {
+		t.Error("expected the group to be enabled again")
+	}
+}
+
+func TestReqHandlerReportsSkippedCaches(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{{Name: "c1"}}})
+	b.setDisabled("c1", "", true)
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "edge")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	var body map[string]Result
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["c1"].Reason != reasonDisabled {
+		t.Errorf("expected c1 to be reported as disabled, got %+v", body)
+	}
+	if b.queuedJobs() != 0 {
+		t.Error("expected no job to be enqueued")
+	}
+}
+
+func TestReqHandlerSkipsCachesInMaintenance(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- "c1" })
+	c2 := newTestCache(t, b, "c2", func(w http.ResponseWriter, r *http.Request) { received <- "c2" })
+
+	// A window from an hour ago to an hour from now, every day.
+	now := time.Now().UTC()
+	window, err := dao.ParseWindow(now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Maintenance = []dao.Window{window}
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1, c2}})
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "edge")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	var body map[string]Result
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["c1"].Reason != reasonMaintenance || body["c2"].Status != http.StatusOK {
+		t.Errorf("expected c1 to be reported in maintenance, got %+v", body)
+	}
+	if got := <-received; got != "c2" {
+		t.Errorf("expected only c2 to be broadcast to, got %s", got)
+	}
+	select {
+	case got := <-received:
+		t.Errorf("expected c1 not to be broadcast to, got %s", got)
+	default:
+	}
+}
+
+func TestAdminGroupsHandler(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+	c1 := dao.Cache{Name: "c1", Address: "http://c1"}
+	setTestGroups(b,
+		dao.Group{Name: "edge", Caches: []dao.Cache{c1}},
+		dao.Group{Name: "all", Include: []string{"edge"}, Caches: []dao.Cache{c1, {Name: "c2", Address: "http://c2"}}},
+	)
+
+	w := httptest.NewRecorder()
+	b.AdminGroupsHandler(w, httptest.NewRequest(http.MethodGet, "/admin/groups", nil))
+
+	var groups []dao.Group
+	if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("unexpected body %q: %v", w.Body.String(), err)
+	}
+	if len(groups) != 2 || groups[0].Name != "all" || len(groups[0].Caches) != 2 {
+		t.Errorf("expected the groups by name with their caches, got %+v", groups)
+	}
+
+	if targets, _, _ := b.broadcastTargets(""); len(targets) != 2 {
+		t.Errorf("expected caches of several groups to be broadcast to once, got %+v", targets)
+	}
+}
+
+func TestAdminCacheStateHandler(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{{Name: "c1"}, {Name: "c2"}}})
+
+	put := func(path string) int {
+		w := httptest.NewRecorder()
+		b.AdminCacheStateHandler(w, httptest.NewRequest(http.MethodPut, path, nil))
+		return w.Code
+	}
+
+	if code := put("/admin/caches/c1/disable"); code != http.StatusOK {
+		t.Fatalf("expected the cache to be disabled, got %d", code)
+	}
+	if _, skipped, _ := b.broadcastTargets("edge"); len(skipped) != 1 || skipped[0].Name != "c1" {
+		t.Errorf("expected c1 to be skipped, got %+v", skipped)
+	}
+	if got := b.Stats().DisabledCaches; len(got) != 1 || got[0] != "c1" {
+		t.Errorf("expected c1 to be reported disabled, got %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	b.AdminGroupsHandler(w, httptest.NewRequest("GET", "/admin/groups", nil))
+	var groups []dao.Group
+	if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil {
+		t.Fatal(err)
+	}
+	if c := groups[0].Caches; !c[0].Disabled || c[1].Disabled {
+		t.Errorf("expected only c1 to be listed disabled, got %+v", c)
+	}
+
+	if code := put("/admin/caches/c1/enable"); code != http.StatusOK {
+		t.Fatalf("expected the cache to be enabled, got %d", code)
+	}
+	if targets, _, _ := b.broadcastTargets("edge"); len(targets) != 2 {
+		t.Errorf("expected c1 to be enabled again, got %+v", targets)
+	}
+
+	b.mu.RLock()
+	client := b.clients["c1"]
+	b.mu.RUnlock()
+	if code := put("/admin/caches/c1/reconnect"); code != http.StatusOK {
+		t.Fatalf("expected the cache to be reconnected, got %d", code)
+	}
+	b.mu.RLock()
+	if b.clients["c1"] == client || b.clients["c1"] == nil {
+		t.Error("expected the client of c1 to be replaced")
+	}
+	b.mu.RUnlock()
+
+	for path, want := range map[string]int{
+		"/admin/caches/unknown/reconnect": http.StatusNotFound,
+		"/admin/caches/unknown/disable":   http.StatusNotFound,
+		"/admin/caches/c1/pause":          http.StatusNotFound,
+		"/admin/caches//disable":          http.StatusNotFound,
+	} {
+		if code := put(path); code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	b.AdminCacheStateHandler(w, httptest.NewRequest(http.MethodPost, "/admin/caches/c1/disable", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %d", w.Code)
+	}
+}
+
+func TestDisabledStateSurvivesReload(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	groups := func(c1Disabled bool) []dao.Group {
+		return []dao.Group{{Name: "edge", Caches: []dao.Cache{
+			{Name: "c1", Address: "http://c1", Disabled: c1Disabled},
+			{Name: "c2", Address: "http://c2", Disabled: true},
+			{Name: "c3", Address: "http://c3"},
+		}}}
+	}
+
+	if err := b.Reload(groups(false)); err != nil {
+		t.Fatal(err)
+	}
+	b.setDisabled("c3", "", true)
+	b.setDisabled("c2", "", false)
+
+	// The runtime state is kept, the configuration being unchanged.
+	if err := b.Reload(groups(false)); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Stats().DisabledCaches; !reflect.DeepEqual(got, []string{"c3"}) {
+		t.Errorf("expected c3 only to stay disabled, got %v", got)
+	}
+
+	// A changed disabled option wins.
+	if err := b.Reload(groups(true)); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Stats().DisabledCaches; !reflect.DeepEqual(got, []string{"c1", "c3"}) {
+		t.Errorf("expected c1 to be disabled by the configuration, got %v", got)
+	}
+}
@@ -0,0 +1,58 @@
+package broadcaster
+
+import (
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// defaultBanHeader carries the ban expression of translated
+// requests unless the group names another header.
+const defaultBanHeader = "X-Ban-Expression"
+
+// SentRequest describes the request a translated
+// broadcast actually sent to a cache.
+type SentRequest struct {
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// banTranslation returns the header and expression of the BAN a
+// PURGE is sent to the cache as. ok is false for requests which
+// are sent untouched.
+func banTranslation(cache dao.Cache) (header, expression string, ok bool) {
+	if cache.BanExpression == "" || cache.Method != "PURGE" {
+		return "", "", false
+	}
+
+	header = cache.BanHeader
+	if header == "" {
+		header = defaultBanHeader
+	}
+
+	return header, strings.Replace(cache.BanExpression, "{path}", rewritePath(cache), -1), true
+}
+
+// translatedRequest reports the request sent to the cache if it
+// was translated, or its method mapped from that of the broadcast,
+// nil otherwise.
+func translatedRequest(cache dao.Cache, method string) *SentRequest {
+	header, expression, ok := banTranslation(cache)
+	if !ok {
+		if cache.Method != method {
+			return &SentRequest{Method: cache.Method}
+		}
+		return nil
+	}
+
+	return &SentRequest{Method: "BAN", Headers: map[string]string{header: expression}}
+}
+
+// methodLog logs the method of a broadcast along with
+// the one it was mapped to for a cache, if any.
+func methodLog(method, mapped string) string {
+	if mapped != method {
+		return method + " (as " + mapped + ")"
+	}
+	return method
+}
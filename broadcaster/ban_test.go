@@ -0,0 +1,100 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestPurgeIsTranslatedToBan(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	type seen struct{ method, expression string }
+	plainSeen := make(chan seen, 1)
+	banSeen := make(chan seen, 1)
+
+	plain := newTestCache(t, b, "plain", func(w http.ResponseWriter, r *http.Request) {
+		plainSeen <- seen{r.Method, r.Header.Get("X-Ban")}
+	})
+	banning := newTestCache(t, b, "banning", func(w http.ResponseWriter, r *http.Request) {
+		banSeen <- seen{r.Method, r.Header.Get("X-Ban")}
+	})
+
+	setTestGroups(b,
+		dao.Group{Name: "edge", Caches: []dao.Cache{plain}},
+		dao.Group{Name: "shield", Caches: []dao.Cache{{
+			Name:          banning.Name,
+			Address:       banning.Address,
+			BanExpression: "obj.http.x-url ~ ^{path}",
+			BanHeader:     "X-Ban",
+		}}},
+	)
+
+	r := httptest.NewRequest("PURGE", "/foo/.*", nil)
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if s := <-plainSeen; s.method != "PURGE" || s.expression != "" {
+		t.Errorf("expected the plain cache to receive the untouched PURGE, got %+v", s)
+	}
+	if s := <-banSeen; s.method != "BAN" || s.expression != "obj.http.x-url ~ ^/foo/.*" {
+		t.Errorf("expected the banning cache to receive a BAN, got %+v", s)
+	}
+
+	var body map[string]Result
+	json.Unmarshal(w.Body.Bytes(), &body)
+
+	if body["plain"].Sent != nil {
+		t.Errorf("expected no translation reported for the plain cache, got %+v", body["plain"].Sent)
+	}
+	if sent := body["banning"].Sent; sent == nil || sent.Method != "BAN" || sent.Headers["X-Ban"] != "obj.http.x-url ~ ^/foo/.*" {
+		t.Errorf("expected the translated request to be reported, got %+v", sent)
+	}
+}
+
+func TestBanTranslationDefaults(t *testing.T) {
+	cache := dao.Cache{Method: "PURGE", Item: "/foo", BanExpression: "req.url ~ {path}", PathPrefix: "/site"}
+
+	header, expression, ok := banTranslation(cache)
+	if !ok || header != defaultBanHeader || expression != "req.url ~ /site/foo" {
+		t.Errorf("unexpected translation %q: %q (%v)", header, expression, ok)
+	}
+
+	cache.Method = "GET"
+	if _, _, ok := banTranslation(cache); ok {
+		t.Error("expected only PURGE requests to be translated")
+	}
+}
+
+func TestMethodMap(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	received := make(chan string, 10)
+	legacy := newTestCache(t, b, "legacy", func(w http.ResponseWriter, r *http.Request) { received <- r.Method })
+	legacy.MethodMap = map[string]string{"GET": "PURGE"}
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{legacy}})
+
+	for _, tc := range []struct{ method, want string }{
+		{"GET", "PURGE"},
+		{"POST", "POST"},
+	} {
+		w := httptest.NewRecorder()
+		b.reqHandler(w, httptest.NewRequest(tc.method, "/foo", nil))
+
+		if got := <-received; got != tc.want {
+			t.Errorf("%s: expected the cache to be sent %s, got %s", tc.method, tc.want, got)
+		}
+
+		var body map[string]Result
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		sent := body["legacy"].Sent
+		if mapped := tc.method != tc.want; mapped != (sent != nil) || (mapped && sent.Method != tc.want) {
+			t.Errorf("%s: expected the mapped method to be reported, got %+v", tc.method, sent)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package broadcaster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// batchResult summarizes the broadcast of a single path of a batch.
+type batchResult struct {
+	Path   string   `json:"path"`
+	OK     bool     `json:"ok"`
+	Failed []string `json:"failed,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// batchSummary closes the response of a batch.
+type batchSummary struct {
+	Paths  int `json:"paths"`
+	OK     int `json:"ok"`
+	Failed int `json:"failed"`
+}
+
+// parseBatch reads the paths of a batch, given either as a
+// JSON array or as newline-delimited text.
+func parseBatch(r io.Reader) ([]string, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body = bytes.TrimSpace(body)
+
+	if bytes.HasPrefix(body, []byte("[")) {
+		var paths []string
+		if err = json.Unmarshal(body, &paths); err != nil {
+			return nil, fmt.Errorf("Invalid batch: %s", err.Error())
+		}
+		return paths, nil
+	}
+
+	var paths []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+
+	return paths, nil
+}
+
+// BatchHandler returns the handler of POST /batch, broadcasting
+// every path of the batch to the caches of the X-Group group, or
+// to those of Config.DefaultGroup. Paths are sent with the method query parameter,
+// PURGE by default. One result per path is streamed as it
+// completes, followed by a summary.
+func (b *Broadcaster) BatchHandler() http.Handler {
+	return b.recoverHandler(http.HandlerFunc(b.batchHandler))
+}
+
+func (b *Broadcaster) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if b.rejectLoop(w, r) {
+		return
+	}
+
+	// Batches are rejected while paused, whatever the mode.
+	if mode, _ := b.paused(); mode != "" {
+		rejectPaused(w)
+		return
+	}
+
+	body := r.Body
+	if b.cfg.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, r.Body, b.cfg.MaxBodySize)
+	}
+
+	paths, err := parseBatch(body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Batch larger than %d bytes.", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(paths) == 0 {
+		http.Error(w, "Empty batch.", http.StatusBadRequest)
+		return
+	}
+
+	if len(paths) > b.cfg.BatchMaxSize {
+		http.Error(w, fmt.Sprintf("Batch of %d paths exceeds the maximum of %d.", len(paths), b.cfg.BatchMaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	groupName := b.requestGroup(r.Header.Get("X-Group"))
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		method = "PURGE"
+	}
+
+	broadcastCaches, _, found := b.broadcastTargets(groupName)
+	if !found {
+		var errText = fmt.Sprintf("Group %s not found.", groupName)
+		b.log(errText)
+		http.Error(w, errText, http.StatusNotFound)
+		return
+	}
+
+	if b.rejectProtected(w, r, method, groupName, broadcastCaches, paths...) {
+		return
+	}
+
+	if ok, limit, wait := b.allowBroadcast(groupName); !ok {
+		rateLimitedRequests.Inc(limit)
+		b.log("Rate limit ", limit, " exceeded, rejecting batch\n")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Rate limit exceeded.", http.StatusTooManyRequests)
+		return
+	}
+
+	headers := b.forwardedHeader(r)
+	headers.Del("Content-Type")
+	headers.Del("Content-Length")
+	client := b.clientIP(r)
+
+	b.log("Batch of ", strconv.Itoa(len(paths)), " ", method, " paths\n")
+
+	pending := make(chan string)
+	results := make(chan batchResult)
+
+	go func() {
+		for _, path := range paths {
+			pending <- path
+		}
+		close(pending)
+	}()
+
+	workers := b.cfg.BatchConcurrency
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for path := range pending {
+				results <- b.broadcastPath(r.Context(), Request{
+					Method:  method,
+					Path:    path,
+					Group:   groupName,
+					Header:  headers,
+					Host:    r.Host,
+					Client:  client,
+					batched: true,
+				})
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	summary := batchSummary{Paths: len(paths)}
+	for range paths {
+		result := <-results
+		if result.OK {
+			summary.OK++
+		} else {
+			summary.Failed++
+		}
+
+		enc.Encode(result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	enc.Encode(summary)
+}
+
+// broadcastPath broadcasts a single path of a batch as any other
+// broadcast to its group, hashed, phased and journaled alike, the
+// batch being rate limited as a whole. Skipped caches don't fail it.
+func (b *Broadcaster) broadcastPath(ctx context.Context, req Request) batchResult {
+	result := batchResult{Path: req.Path, OK: true}
+
+	res, err := b.Broadcast(ctx, req)
+	if err != nil {
+		result.OK = false
+		result.Error = err.Error()
+	}
+
+	for name, r := range res.Caches {
+		switch r.Reason {
+		case reasonSkipped, reasonDisabled, reasonMaintenance:
+			continue
+		}
+		if !r.succeeded() {
+			result.OK = false
+			result.Failed = append(result.Failed, name)
+		}
+	}
+	sort.Strings(result.Failed)
+
+	if !result.OK {
+		b.log("Batch ", req.Method, " ", req.Path, " failed on ", strings.Join(result.Failed, ", "), "\n")
+	}
+
+	return result
+}
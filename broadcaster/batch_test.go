@@ -0,0 +1,138 @@
+package broadcaster
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestParseBatch(t *testing.T) {
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{`["/a", "/b"]`, []string{"/a", "/b"}},
+		{"/a\n\n  /b \r\n", []string{"/a", "/b"}},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := parseBatch(strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("parseBatch(%q): %v", tt.body, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseBatch(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+
+	if _, err := parseBatch(strings.NewReader(`["/a",`)); err == nil {
+		t.Error("expected an invalid JSON batch to be rejected")
+	}
+}
+
+func TestBatchHandlerReportsFailedPaths(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	ok := newTestCache(t, b, "ok", func(w http.ResponseWriter, r *http.Request) {})
+	flaky := newTestCache(t, b, "flaky", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{ok, flaky}})
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader("/good\n/bad\n"))
+	r.Header.Set("X-Group", "edge")
+	w := httptest.NewRecorder()
+	b.batchHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected a line per path and a summary, got %q", lines)
+	}
+
+	results := make(map[string]batchResult)
+	for _, line := range lines[:2] {
+		var res batchResult
+		json.Unmarshal([]byte(line), &res)
+		results[res.Path] = res
+	}
+
+	if !results["/good"].OK {
+		t.Errorf("expected /good to succeed, got %+v", results["/good"])
+	}
+	if res := results["/bad"]; res.OK || !reflect.DeepEqual(res.Failed, []string{"flaky"}) {
+		t.Errorf("expected /bad to fail on flaky, got %+v", res)
+	}
+
+	var summary batchSummary
+	json.Unmarshal([]byte(lines[2]), &summary)
+	if summary != (batchSummary{Paths: 2, OK: 1, Failed: 1}) {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+func TestBatchHandlerRejectsOversizedBatch(t *testing.T) {
+	b := newTestBroadcaster(t, Config{BatchMaxSize: 1})
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`["/a", "/b"]`))
+	w := httptest.NewRecorder()
+	b.batchHandler(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", w.Code)
+	}
+}
+
+func TestBatchHandlerBoundsBody(t *testing.T) {
+	b := newTestBroadcaster(t, Config{MaxBodySize: 8})
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader("/a\n/b\n/c\n/d\n"))
+	w := httptest.NewRecorder()
+	b.batchHandler(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "8 bytes") {
+		t.Errorf("expected 413 for a body over max-body-size, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBatchHandlerHashesPaths(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	var requests int32
+	var caches []dao.Cache
+	for _, name := range []string{"c0", "c1", "c2"} {
+		caches = append(caches, newTestCache(t, b, name, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+		}))
+	}
+	setTestGroups(b, dao.Group{Name: "preload", Mode: dao.ModeHash, Caches: caches})
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader("/a\n/b\n/c\n/d\n"))
+	r.Header.Set("X-Group", "preload")
+	w := httptest.NewRecorder()
+	b.batchHandler(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ok":4`) {
+		t.Fatalf("expected every path to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if got := atomic.LoadInt32(&requests); got != 4 {
+		t.Errorf("expected every path to be sent to its cache only, got %d requests", got)
+	}
+}
@@ -0,0 +1,48 @@
+package broadcaster
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// requestBody returns the body forwarded to the cache, transformed
+// as its body_transform asks, along with the Content-Encoding it is
+// sent with. Requests without a body are sent without one.
+func requestBody(cache dao.Cache) (io.Reader, string, error) {
+	if len(cache.Body) == 0 {
+		return nil, "", nil
+	}
+
+	switch cache.BodyTransform {
+	case dao.BodyTransformGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(cache.Body); err != nil {
+			return nil, "", err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", err
+		}
+		return &buf, "gzip", nil
+	}
+
+	return bytes.NewReader(cache.Body), "", nil
+}
+
+// readBody reads the body of an incoming request, up to max bytes
+// when max is positive.
+func readBody(w http.ResponseWriter, r *http.Request, max int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body := r.Body
+	if max > 0 {
+		body = http.MaxBytesReader(w, r.Body, max)
+	}
+	return ioutil.ReadAll(body)
+}
@@ -0,0 +1,69 @@
+package broadcaster
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestBodyTransformGzip(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	bodies := make(chan []byte, 2)
+	encodings := make(chan string, 2)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+		encodings <- r.Header.Get("Content-Encoding")
+	}
+	zipped := newTestCache(t, b, "zipped", handler)
+	plain := newTestCache(t, b, "plain", handler)
+	plain.BodyTransform = dao.BodyTransformNone
+
+	group := dao.Group{Name: "edge", BodyTransform: dao.BodyTransformGzip, Caches: []dao.Cache{zipped}}
+	group.ApplyDefaults(&group.Caches[0])
+	setTestGroups(b, group, dao.Group{Name: "origin", Caches: []dao.Cache{plain}})
+
+	r := httptest.NewRequest("PURGE", "/foo", strings.NewReader(`{"tags": ["a"]}`))
+	r.Header.Set("X-Group", "edge")
+	b.reqHandler(httptest.NewRecorder(), r)
+
+	if enc := <-encodings; enc != "gzip" {
+		t.Errorf("expected a gzip Content-Encoding, got %q", enc)
+	}
+	zr, err := gzip.NewReader(strings.NewReader(string(<-bodies)))
+	if err != nil {
+		t.Fatalf("expected a gzipped body: %s", err)
+	}
+	if body, _ := ioutil.ReadAll(zr); string(body) != `{"tags": ["a"]}` {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	r = httptest.NewRequest("PURGE", "/foo", strings.NewReader("raw"))
+	r.Header.Set("X-Group", "origin")
+	b.reqHandler(httptest.NewRecorder(), r)
+
+	if enc := <-encodings; enc != "" {
+		t.Errorf("expected no Content-Encoding, got %q", enc)
+	}
+	if body := <-bodies; string(body) != "raw" {
+		t.Errorf("expected the body as is, got %q", body)
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	b := newTestBroadcaster(t, Config{MaxBodySize: 4})
+
+	r := httptest.NewRequest("PURGE", "/foo", strings.NewReader("too large"))
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a 413, got %d", w.Code)
+	}
+}
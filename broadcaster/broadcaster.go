@@ -0,0 +1,1247 @@
+// Package broadcaster fans requests, typically purges and bans, out
+// to groups of caches and reports the outcome of every cache.
+//
+//	b, err := broadcaster.New(broadcaster.Config{Groups: groups})
+//	if err != nil {
+//		return err
+//	}
+//	defer b.Close()
+//
+//	http.Handle("/", b.Handler())
+package broadcaster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+	tracing "github.com/timothyclarke/http-request-broadcaster/tracing"
+)
+
+var (
+	// ErrGroupNotFound is returned for broadcasts to an unknown group.
+	ErrGroupNotFound = errors.New("group not found")
+
+	// ErrQueueSaturated is returned when the job queues can't take
+	// all the jobs of a broadcast, none of which is then sent.
+	ErrQueueSaturated = errors.New("job queue is saturated")
+
+	// ErrPaused is returned for broadcasts received while
+	// paused, see Pause, whatever their source.
+	ErrPaused = errors.New("broadcasts paused")
+)
+
+// RateLimitError is returned for broadcasts exceeding a rate limit.
+type RateLimitError struct {
+	// Limit is the name of the exceeded limit, either
+	// global or the name of the group.
+	Limit string
+
+	// Wait is the time until the next broadcast is allowed.
+	Wait time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit %s exceeded", e.Limit)
+}
+
+// Config configures a Broadcaster. The zero value of every
+// field but Groups is a usable default.
+type Config struct {
+	Groups []dao.Group
+
+	// Workers is the number of job handling goroutines of every
+	// cache. Purges only reach a cache in order with a single one.
+	Workers int
+
+	// MaxConcurrency bounds the requests in flight across all
+	// caches, unbounded when zero. Once it's reached, requests
+	// to caches of a higher priority are sent first.
+	MaxConcurrency int
+
+	// Retries is the number of times a failed request against a
+	// cache is retried. Only idempotent methods are retried, unless
+	// RetryUnsafe is set.
+	Retries     int
+	RetryUnsafe bool
+
+	// RetryOnStatus are the statuses of the caches retried like
+	// transport errors, e.g. 503. Groups may override them.
+	RetryOnStatus dao.StatusCodes
+
+	// SuccessCodes are the statuses of the caches counted as
+	// successes, 2xx when empty. Groups may override them.
+	SuccessCodes dao.StatusCodes
+
+	// MaxRetries caps the retries a broadcast may ask for with
+	// the X-Retries header, 10 by default, see Request.Retries.
+	MaxRetries int
+
+	// RetryBudget caps the retries of all the requests of a
+	// broadcast, unbounded when zero.
+	RetryBudget int
+
+	// CacheDeadline bounds the time spent on a cache by a broadcast,
+	// retries, their backoff and the fallback included, unbounded when
+	// zero. Attempts in flight once it passes are cut short.
+	CacheDeadline time.Duration
+
+	// InstanceID identifies the broadcaster in the X-Broadcaster
+	// header of its requests to the caches. Requests handled by
+	// Handler which already went through it, or through MaxHops
+	// broadcasters, are rejected with 508, as caught in a loop.
+	InstanceID string
+	MaxHops    int
+
+	// BroadcastTimeout bounds a whole broadcast, caches which
+	// haven't answered by then are reported as cancelled.
+	BroadcastTimeout time.Duration
+
+	// StatusPolicy decides the status of a broadcast from the
+	// caches: ok, first-error, all-ok, majority or worst.
+	StatusPolicy string
+
+	// PathGroupsPrefix, when set, lets requests name their group
+	// in their path rather than in X-Group, see Target.
+	PathGroupsPrefix string
+
+	// DefaultGroup is the group of the requests which don't name
+	// theirs, all caches being broadcast to when empty. Requests
+	// naming the * group are broadcast to all caches regardless.
+	DefaultGroup string
+
+	// PathTemplate lays out the path broadcast for incoming
+	// requests, {path} and {query} standing for their path and
+	// raw query. Requests are broadcast their path when empty.
+	PathTemplate string
+
+	// MaxRequestTimeout clamps the timeout a request
+	// may set itself, see Request.Timeout.
+	MaxRequestTimeout time.Duration
+
+	// ConnectTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout
+	// bound the steps of a request to a cache until its response
+	// headers arrive. RequestTimeout bounds the whole request,
+	// including its body, and is unbounded when zero.
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+
+	// MaxResponseBody is the number of bytes of the responses of the
+	// caches read, 4 KiB by default, and ResponseBodyTimeout how long
+	// reading them may take, 5 seconds by default. Only the status
+	// of a cache matters, the rest of a body is left unread.
+	MaxResponseBody     int64
+	ResponseBodyTimeout time.Duration
+
+	// RequireCaches refuses configurations defining no caches, at
+	// start and on reload, rather than logging a warning.
+	RequireCaches bool
+
+	// DNSRefresh is the interval at which the SRV names of caches
+	// are resolved again, 30 seconds by default. SRVResolver looks
+	// them up, net.DefaultResolver by default.
+	DNSRefresh  time.Duration
+	SRVResolver SRVResolver
+
+	// KeepaliveProbe, when set, is the interval of the HEAD requests
+	// sent to every cache to keep its pooled connections warm.
+	KeepaliveProbe time.Duration
+
+	// MaxRedirects is the number of redirects followed by requests
+	// to the caches. Redirects beyond it, any by default, are
+	// reported with the redirect status.
+	MaxRedirects int
+
+	// EnqueueTimeout is how long a broadcast may wait for room in
+	// the job queues, CacheQueueTimeout how long a job may wait
+	// for its cache to process earlier jobs.
+	EnqueueTimeout    time.Duration
+	CacheQueueTimeout time.Duration
+
+	// QueueFull is the policy of broadcasts finding the job queues
+	// full: QueueFullReject, the default, QueueFullBlock or
+	// QueueFullDropOldest.
+	QueueFull string
+
+	// RateLimit is the maximum number of broadcasts per second
+	// allowed to exceed it in bursts of RateBurst.
+	RateLimit float64
+	RateBurst int
+
+	// ForwardHeaders lists the incoming headers sent on to the
+	// caches, all of them when empty. Groups may override it.
+	ForwardHeaders []string
+
+	// ProtectedPaths lists the paths only purged or banned with the
+	// X-Broadcast-Confirm header, such as "/", see checkProtected.
+	ProtectedPaths []string
+
+	// UserAgent of the requests sent to the caches.
+	UserAgent string
+
+	// MaxBodySize is the largest body of an incoming request
+	// forwarded to the caches, unbounded when zero.
+	MaxBodySize int64
+
+	// BatchMaxSize is the maximum number of paths of a batch,
+	// BatchConcurrency the number broadcast at once.
+	BatchMaxSize     int
+	BatchConcurrency int
+
+	Consul ConsulConfig
+
+	// SlowThreshold is the duration past which broadcasts, and
+	// requests to caches without a threshold of their own, are
+	// logged as slow. Nothing is logged when zero.
+	SlowThreshold time.Duration
+
+	// DryRun turns every broadcast into a dry run, see Request.DryRun.
+	DryRun bool
+
+	// ResultWebhook, when set, is posted the JSON result of every
+	// broadcast handled by Handler once it answered, along with its
+	// request id and group. WebhookTimeout bounds the posts, 5
+	// seconds by default.
+	ResultWebhook  string
+	WebhookTimeout time.Duration
+
+	// StateDir, when set, keeps the requests failed by the caches,
+	// after their retries, to be replayed once they're back, until
+	// ReplayMaxAge old, an hour by default.
+	StateDir     string
+	ReplayMaxAge time.Duration
+
+	// DeadLetterFile, when set, is appended the requests failed by
+	// the caches, after their retries and fallback, as JSON lines.
+	DeadLetterFile string
+
+	// JournalFile, when set, is the write-ahead log of the broadcasts,
+	// telling on startup which were cut short by a crash and which of
+	// their caches answered. JournalSync is its fsync policy,
+	// JournalSyncPeriodic by default, and JournalMaxSize the size past
+	// which it's compacted, 64MB by default. RecoverMode decides the
+	// fate of the incomplete broadcasts, RecoverReport by default.
+	JournalFile    string
+	JournalSync    string
+	JournalMaxSize int64
+	RecoverMode    string
+
+	// HistorySize is the number of broadcasts kept in the history
+	// of AdminHistoryHandler, none when zero.
+	HistorySize int
+
+	// ResultCacheTTL is how long the results of GET broadcasts are
+	// kept to answer identical broadcasts with, none when zero.
+	ResultCacheTTL time.Duration
+
+	// PauseQueueSize is the number of broadcasts held while paused
+	// in PauseQueue mode, 10000 by default, see Pause.
+	PauseQueueSize int
+
+	// ClientIP returns the address of the client of a request
+	// handled by Handler, its remote address by default.
+	ClientIP func(r *http.Request) net.IP
+
+	// TrustProxy sends the X-Forwarded-For chain, X-Forwarded-Proto
+	// and X-Broadcast-Origin of incoming requests on to the caches,
+	// as set by a trusted load balancer, rather than replacing them.
+	TrustProxy bool
+
+	// Tracer, when set, traces every broadcast and its
+	// requests to the caches.
+	Tracer *tracing.Tracer
+
+	// Log, when set, receives the log entries of the broadcaster.
+	Log func(args ...string)
+}
+
+// Broadcaster sends requests to the caches of its groups.
+type Broadcaster struct {
+	cfg Config
+
+	// mu guards the configured groups and caches, their http
+	// clients and the state derived from the configuration.
+	mu        sync.RWMutex
+	allCaches []dao.Cache
+	groups    map[string]dao.Group
+	clients   map[string]*http.Client
+
+	// Caches and groups disabled by the configuration or through
+	// the admin endpoints, kept over reloads.
+	disabledCaches map[string]bool
+	disabledGroups map[string]bool
+
+	globalLimiter *tokenBucket
+
+	// groupLimiters holds the limiter of every group
+	// configuring its own rate limit.
+	groupLimiters map[string]*tokenBucket
+
+	// rings holds the hash ring of every hash mode
+	// group, keyed by group name.
+	rings map[string]*hashRing
+
+	// reloadMu serializes the reloads, configured holding the
+	// groups as configured and srvTargets the last-known targets
+	// of the SRV names of their caches, resolved again every
+	// Config.DNSRefresh until srvStop is closed.
+	reloadMu   sync.Mutex
+	configured []dao.Group
+	srvTargets map[string][]*net.SRV
+	srvStop    chan struct{}
+	srvDone    chan struct{}
+
+	// consulWatchers holds the running watcher of every
+	// consul backed group, keyed by group name.
+	consulWatchers map[string]*consulWatcher
+
+	// queuesLock guards queues and serializes enqueuers, so that
+	// the room found in the queues can't be taken by another broadcast.
+	queuesLock sync.Mutex
+	queues     map[string]*cacheQueue
+
+	// dispatch hands out the slots of Config.MaxConcurrency.
+	dispatch *dispatcher
+
+	// webhook posts the results of broadcasts, when configured.
+	webhook *resultWebhook
+
+	// replay holds the requests failed by the caches when
+	// Config.StateDir is set, replayed until replayStop is closed.
+	replay     *replayQueue
+	replayStop chan struct{}
+	replayDone chan struct{}
+
+	// keepaliveStop stops the keep-alive probes of
+	// Config.KeepaliveProbe.
+	keepaliveStop chan struct{}
+	keepaliveDone chan struct{}
+
+	// deadLetters logs the requests failed by the caches,
+	// when Config.DeadLetterFile is set.
+	deadLetters *deadLetterLog
+
+	// history keeps the last Config.HistorySize broadcasts.
+	history *history
+
+	// results caches the results of GET broadcasts,
+	// when Config.ResultCacheTTL is set.
+	results *resultCache
+
+	// journal logs the broadcasts ahead of sending them,
+	// when Config.JournalFile is set.
+	journal *journal
+
+	// pause holds the broadcasts received while paused.
+	pause pauseState
+
+	// counters holds the request counters of every cache
+	// broadcast to, guarded by mu along with the outcome
+	// of the last reload.
+	counters        map[string]*cacheCounters
+	lastReload      time.Time
+	lastReloadError string
+
+	// requestsServed, jobsProcessed and jobsFailed are
+	// the totals behind Stats, updated atomically.
+	requestsServed uint64
+	jobsProcessed  uint64
+	jobsFailed     uint64
+}
+
+// New sets up a broadcaster of the configured groups, warming
+// up connections to their caches.
+func New(cfg Config) (*Broadcaster, error) {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.StatusPolicy == "" {
+		cfg.StatusPolicy = policyOK
+	}
+	if cfg.QueueFull == "" {
+		cfg.QueueFull = QueueFullReject
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = "broadcaster"
+	}
+	if cfg.BatchMaxSize <= 0 {
+		cfg.BatchMaxSize = 10000
+	}
+	if cfg.BatchConcurrency <= 0 {
+		cfg.BatchConcurrency = 8
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = 30 * time.Second
+	}
+	if cfg.TLSHandshakeTimeout <= 0 {
+		cfg.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if cfg.ResponseHeaderTimeout <= 0 {
+		cfg.ResponseHeaderTimeout = 5 * time.Second
+	}
+	if cfg.MaxResponseBody <= 0 {
+		cfg.MaxResponseBody = 4 << 10
+	}
+	if cfg.ResponseBodyTimeout <= 0 {
+		cfg.ResponseBodyTimeout = 5 * time.Second
+	}
+	if cfg.PathGroupsPrefix != "" {
+		cfg.PathGroupsPrefix = "/" + strings.Trim(cfg.PathGroupsPrefix, "/") + "/"
+	}
+	if cfg.Consul.Wait <= 0 {
+		cfg.Consul.Wait = 5 * time.Minute
+	}
+	if cfg.ReplayMaxAge <= 0 {
+		cfg.ReplayMaxAge = time.Hour
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 10
+	}
+	if cfg.PauseQueueSize <= 0 {
+		cfg.PauseQueueSize = 10000
+	}
+	if cfg.JournalSync == "" {
+		cfg.JournalSync = JournalSyncPeriodic
+	}
+	if cfg.JournalMaxSize <= 0 {
+		cfg.JournalMaxSize = 64 << 20
+	}
+	if cfg.RecoverMode == "" {
+		cfg.RecoverMode = RecoverReport
+	}
+	if cfg.DNSRefresh <= 0 {
+		cfg.DNSRefresh = 30 * time.Second
+	}
+	if cfg.SRVResolver == nil {
+		cfg.SRVResolver = net.DefaultResolver
+	}
+
+	if errs := cfg.validateOptions(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	b := &Broadcaster{
+		cfg:            cfg,
+		groups:         make(map[string]dao.Group),
+		clients:        make(map[string]*http.Client),
+		disabledCaches: make(map[string]bool),
+		disabledGroups: make(map[string]bool),
+		groupLimiters:  make(map[string]*tokenBucket),
+		consulWatchers: make(map[string]*consulWatcher),
+		rings:          make(map[string]*hashRing),
+		queues:         make(map[string]*cacheQueue),
+		counters:       make(map[string]*cacheCounters),
+		dispatch:       newDispatcher(cfg.MaxConcurrency),
+	}
+
+	if cfg.ResultWebhook != "" {
+		webhook, err := newResultWebhook(cfg.ResultWebhook, cfg.WebhookTimeout)
+		if err != nil {
+			return nil, err
+		}
+		b.webhook = webhook
+	}
+
+	if cfg.HistorySize > 0 {
+		b.history = newHistory(cfg.HistorySize)
+	}
+
+	if cfg.ResultCacheTTL > 0 {
+		b.results = newResultCache(cfg.ResultCacheTTL)
+	}
+
+	if cfg.DeadLetterFile != "" {
+		deadLetters, err := openDeadLetterLog(cfg.DeadLetterFile)
+		if err != nil {
+			return nil, err
+		}
+		b.deadLetters = deadLetters
+	}
+
+	if cfg.JournalFile != "" {
+		journal, err := openJournal(cfg.JournalFile, cfg.JournalSync, cfg.JournalMaxSize)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.journal = journal
+	}
+
+	if err := b.Reload(cfg.Groups); err != nil {
+		b.Close()
+		return nil, err
+	}
+	if _, _, found := b.broadcastTargets(b.requestGroup(cfg.DefaultGroup)); !found {
+		b.Close()
+		return nil, fmt.Errorf("Default group %s not found.", cfg.DefaultGroup)
+	}
+
+	if cfg.StateDir != "" {
+		replay, err := openReplayQueue(filepath.Join(cfg.StateDir, replayFile))
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.replay = replay
+		b.replayStop, b.replayDone = make(chan struct{}), make(chan struct{})
+		go b.replayLoop(b.replayStop, b.replayDone)
+
+		metrics.NewGauge("broadcaster_replay_pending", "Requests failed by the caches waiting to be replayed.", func() float64 {
+			pending := 0
+			for _, n := range replay.counts() {
+				pending += n
+			}
+			return float64(pending)
+		})
+	}
+
+	b.srvStop, b.srvDone = make(chan struct{}), make(chan struct{})
+	go b.srvLoop(b.srvStop, b.srvDone)
+
+	if cfg.KeepaliveProbe > 0 {
+		b.keepaliveStop, b.keepaliveDone = make(chan struct{}), make(chan struct{})
+		go b.keepaliveLoop(b.keepaliveStop, b.keepaliveDone)
+	}
+
+	if b.journal != nil {
+		if incomplete := b.journal.incomplete(); len(incomplete) > 0 {
+			b.log("Journal holds ", strconv.Itoa(len(incomplete)), " incomplete broadcasts\n")
+			if cfg.RecoverMode == RecoverReplay {
+				go b.recoverJournal(context.Background(), "")
+			}
+		}
+
+		metrics.NewGauge("broadcaster_journal_incomplete", "Broadcasts left incomplete by a previous run, waiting to be recovered.", func() float64 {
+			return float64(len(b.journal.incomplete()))
+		})
+	}
+
+	metrics.NewGauge("broadcaster_disabled_caches", "Number of caches disabled, by the configuration or at runtime.", func() float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return float64(len(b.disabledCaches))
+	})
+	metrics.NewGauge("broadcaster_paused", "Whether broadcasts are paused.", func() float64 {
+		if mode, _ := b.paused(); mode != "" {
+			return 1
+		}
+		return 0
+	})
+	metrics.NewGauge("broadcaster_held_broadcasts", "Broadcasts held while paused, waiting to be resumed.", func() float64 {
+		_, held := b.paused()
+		return float64(held)
+	})
+	metrics.NewGauge("broadcaster_queue_depth", "Number of jobs waiting in the job queues.", func() float64 { return float64(b.queuedJobs()) })
+
+	return b, nil
+}
+
+// Reload replaces the configured groups, warming up connections
+// to their caches, only those of the caches whose addresses changed
+// being closed. Caches and groups disabled at runtime stay so while
+// configured, unless the disabled option of the cache changed.
+func (b *Broadcaster) Reload(groupList []dao.Group) (err error) {
+	defer func() {
+		b.mu.Lock()
+		b.lastReload = time.Now()
+		b.lastReloadError = ""
+		if err != nil {
+			b.lastReloadError = err.Error()
+		}
+		b.mu.Unlock()
+	}()
+
+	if errs := validateGroups(groupList); len(errs) > 0 {
+		return errs[0]
+	}
+
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+
+	b.resolveSRV(groupList)
+	expanded := b.expandSRV(groupList)
+	if err := checkCaches(expanded); err != nil {
+		if b.cfg.RequireCaches {
+			return err
+		}
+		b.log("WARN ", err.Error(), "\n")
+	}
+
+	b.configured = groupList
+	return b.applyGroups(expanded)
+}
+
+// applyGroups replaces the groups, the SRV names of their caches
+// being resolved. The caller must hold reloadMu.
+func (b *Broadcaster) applyGroups(groupList []dao.Group) error {
+	b.mu.Lock()
+	previous := make(map[string]dao.Cache, len(b.allCaches))
+	for _, cache := range b.allCaches {
+		previous[cache.Name] = cache
+	}
+	b.groups = make(map[string]dao.Group)
+	for _, g := range groupList {
+		b.groups[g.Name] = g
+	}
+	b.rebuildAllCaches()
+	b.syncDisabled(previous)
+	b.mu.Unlock()
+
+	b.setUpRateLimiters(groupList)
+	b.watchConsulGroups(groupList)
+	b.syncQueues()
+
+	b.log("Warming up connections.\n")
+
+	return b.setUpHttpClients(previous)
+}
+
+// Close stops watching consul and resolving SRV names, and
+// retires the workers once done with the jobs already enqueued.
+func (b *Broadcaster) Close() {
+	b.watchConsulGroups(nil)
+
+	if b.srvStop != nil {
+		close(b.srvStop)
+		<-b.srvDone
+	}
+
+	if b.replay != nil {
+		close(b.replayStop)
+		<-b.replayDone
+		b.replay.close()
+	}
+	if b.keepaliveStop != nil {
+		close(b.keepaliveStop)
+		<-b.keepaliveDone
+	}
+	if b.deadLetters != nil {
+		b.deadLetters.close()
+	}
+	if b.journal != nil {
+		b.journal.close()
+	}
+
+	b.queuesLock.Lock()
+	defer b.queuesLock.Unlock()
+
+	for name, q := range b.queues {
+		close(q.jobs)
+		delete(b.queues, name)
+	}
+}
+
+// Groups returns the configured groups.
+func (b *Broadcaster) Groups() []dao.Group {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	groupList := make([]dao.Group, 0, len(b.groups))
+	for _, g := range b.groups {
+		groupList = append(groupList, g)
+	}
+	return groupList
+}
+
+// rebuildAllCaches recomputes allCaches from the configured groups,
+// caches included in several groups being listed once. The caller
+// must hold mu.
+func (b *Broadcaster) rebuildAllCaches() {
+	b.allCaches = nil
+	seen := make(map[string]bool)
+	for _, g := range b.groups {
+		for _, c := range g.Caches {
+			if !seen[c.Name] {
+				seen[c.Name] = true
+				b.allCaches = append(b.allCaches, c)
+			}
+		}
+	}
+}
+
+func (b *Broadcaster) log(args ...string) {
+	if b.cfg.Log != nil {
+		b.cfg.Log(args...)
+	}
+}
+
+// newRequestID returns a random request id.
+func newRequestID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func fnv32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// Request is a request to broadcast.
+type Request struct {
+	Method string
+	Path   string
+
+	// Group is the name of the group to broadcast to,
+	// all caches being broadcast to when empty.
+	Group string
+
+	// Tags narrows the caches broadcast to down to those carrying
+	// any of the tags, or all of them with AllTags.
+	Tags    []string
+	AllTags bool
+
+	// Header and Host are sent on to the caches.
+	Header http.Header
+	Host   string
+
+	// Body is sent on to the caches, transformed
+	// as their body_transform asks.
+	Body []byte
+
+	// Verbose reports the final URL sent to every cache.
+	Verbose bool
+
+	// DryRun reports what would be sent to every cache, with its
+	// final URL and any translation, without sending anything.
+	DryRun bool
+
+	// SkipCanary broadcasts to the canary of the group
+	// along with the other caches, e.g. in emergencies.
+	SkipCanary bool
+
+	// Timeout bounds the broadcast, caches which haven't answered
+	// by then being reported as deadline_exceeded. It's clamped to
+	// Config.MaxRequestTimeout.
+	Timeout time.Duration
+
+	// Retries, when set, overrides Config.Retries for the requests
+	// of the broadcast, e.g. for a critical one.
+	Retries *int
+
+	// OnResult, when set, is called with the result of every
+	// cache as soon as it's known, e.g. to stream them, rather
+	// than once all of them are.
+	OnResult func(cache string, result Result)
+
+	// ID identifies the broadcast in the logs and the history,
+	// a random one being given when empty. Client is the address
+	// of the client asking for it, or the source of its event.
+	ID     string
+	Client string
+
+	// resumed is set on the broadcasts held while
+	// paused, sent on Resume.
+	resumed bool
+
+	// batched is set on the paths of a batch,
+	// rate limited as a whole by batchHandler.
+	batched bool
+}
+
+// setResult records the result of a cache, passing it on to
+// the OnResult of the request.
+func (req Request) setResult(res Results, cache string, result Result) {
+	res.Caches[cache] = result
+	if req.OnResult != nil {
+		req.OnResult(cache, result)
+	}
+}
+
+// Results is the outcome of a broadcast.
+type Results struct {
+	// Status is derived from the caches by the status policy.
+	Status int
+
+	// Caches holds the result of every cache, keyed by name.
+	Caches map[string]Result
+
+	// Phases holds the time taken by the phases of the broadcast,
+	// the canary and the fan-out to the other caches.
+	Phases []Phase
+
+	// BytesSent and BytesReceived total those of the caches.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// Broadcast sends the request to the caches of its group, waiting
+// for all of them to answer or for ctx to be done.
+func (b *Broadcaster) Broadcast(ctx context.Context, req Request) (Results, error) {
+	ctx, span := b.cfg.Tracer.Start(ctx, "broadcast", tracing.KindServer)
+	defer span.End()
+
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.path", req.Path)
+	span.SetAttribute("broadcaster.group", req.Group)
+
+	if req.ID == "" {
+		req.ID = newRequestID()
+	}
+	start := time.Now()
+
+	res, err := b.broadcast(ctx, req)
+
+	span.SetAttribute("http.response.status_code", res.Status)
+	span.SetError(err)
+
+	if b.history != nil && err == nil {
+		b.recordHistory(start, req, res)
+	}
+
+	return res, err
+}
+
+func (b *Broadcaster) broadcast(ctx context.Context, req Request) (Results, error) {
+	start := time.Now()
+
+	if b.cfg.BroadcastTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.BroadcastTimeout)
+		defer cancel()
+	}
+
+	// The caller's own deadline, clamped to MaxRequestTimeout.
+	var deadline context.Context
+	if req.Timeout > 0 {
+		timeout := req.Timeout
+		if b.cfg.MaxRequestTimeout > 0 && timeout > b.cfg.MaxRequestTimeout {
+			timeout = b.cfg.MaxRequestTimeout
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		deadline = ctx
+	}
+
+	res := Results{Caches: make(map[string]Result)}
+
+	broadcastCaches, skippedCaches, found := b.broadcastTargets(req.Group)
+	broadcastCaches = filterTags(broadcastCaches, req.Tags, req.AllTags)
+	skippedCaches = filterTags(skippedCaches, req.Tags, req.AllTags)
+	if !found {
+		b.log(fmt.Sprintf("Group %s not found.", req.Group))
+		return res, ErrGroupNotFound
+	}
+
+	if err := b.checkProtected(req.Method, req.Group, req.Header, req.Client, broadcastCaches, req.Path); err != nil {
+		return res, err
+	}
+
+	if mode, _ := b.paused(); mode != "" && !req.resumed {
+		return res, ErrPaused
+	}
+
+	// Hash mode groups send every path to a single
+	// cache, answering with its status.
+	group := b.group(req.Group)
+	hashed := group.Mode == dao.ModeHash
+	if hashed {
+		broadcastCaches, skippedCaches = b.hashTargets(req.Group, req.Path, broadcastCaches), nil
+	}
+
+	if req.DryRun || b.cfg.DryRun {
+		b.reportSkipped(req, res, skippedCaches)
+		return b.dryRun(req, broadcastCaches, res), nil
+	}
+
+	if !req.batched {
+		if ok, limit, wait := b.allowBroadcast(req.Group); !ok {
+			rateLimitedRequests.Inc(limit)
+			b.log("Rate limit ", limit, " exceeded, rejecting ", req.Method, " ", req.Path, "\n")
+			return res, &RateLimitError{Limit: limit, Wait: wait}
+		}
+	}
+
+	var cacheCount = len(broadcastCaches)
+
+	if cacheCount == 0 && len(skippedCaches) == 0 {
+		b.log("Group ", req.Group, " has no configured caches.")
+		res.Status = http.StatusNoContent
+		return res, nil
+	}
+
+	headers := req.Header.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if len(req.Host) != 0 {
+		headers.Add("Host", req.Host)
+	}
+	if headers.Get(originHeader) == "" && req.Client != "" {
+		headers.Set(originHeader, req.Client)
+	}
+
+	var jobs = make([]*Job, cacheCount)
+	budget := newRetryBudget(b.cfg.RetryBudget)
+
+	for idx, bc := range broadcastCaches {
+		bc.Method = bc.MappedMethod(req.Method)
+		bc.Item = req.Path
+		bc.Headers = headers
+		bc.Body = req.Body
+
+		jobs[idx] = newJob(ctx, bc)
+		jobs[idx].retryBudget = budget
+		jobs[idx].retries = req.Retries
+	}
+
+	if b.journal != nil {
+		b.journalBegin(req, headers, broadcastCaches)
+		defer b.journalEnd(req.ID)
+	}
+
+	phases := phasesOf(group, jobs, req.SkipCanary)
+	if len(phases) == 0 {
+		b.reportSkipped(req, res, skippedCaches)
+	}
+
+	var results []Result
+
+	// failed is the cache which failed a gating phase,
+	// the caches of the following phases aren't sent to.
+	var failed string
+
+	for p, ph := range phases {
+		if failed != "" {
+			for _, job := range ph.jobs {
+				req.setResult(res, job.Cache.Name, notAttemptedResult(failed))
+			}
+			continue
+		}
+
+		phaseStart := time.Now()
+
+		enqueued := b.enqueueJobs(ph.jobs)
+		if !enqueued {
+			saturatedBroadcasts.Inc("")
+			b.log("Job queue saturated, rejecting ", req.Method, " ", req.Path, "\n")
+			if p == 0 {
+				return res, ErrQueueSaturated
+			}
+		}
+		if p == 0 {
+			b.reportSkipped(req, res, skippedCaches)
+		}
+
+		// Results are reported as the caches answer, whatever the
+		// order of their jobs, but aggregated in the order of the
+		// jobs, for the status not to depend on the fastest cache.
+		type outcome struct {
+			idx    int
+			result Result
+		}
+		outcomes := make(chan outcome, len(ph.jobs))
+		for idx, job := range ph.jobs {
+			if !enqueued {
+				outcomes <- outcome{idx, Result{Status: http.StatusServiceUnavailable, Reason: reasonQueueSaturated, Error: ErrQueueSaturated.Error()}}
+				continue
+			}
+			go func(idx int, job *Job) {
+				outcomes <- outcome{idx, awaitResult(ctx, job)}
+			}(idx, job)
+		}
+
+		phaseResults := make([]Result, len(ph.jobs))
+		aggregated := make([]bool, len(ph.jobs))
+		for range ph.jobs {
+			o := <-outcomes
+			job, result := ph.jobs[o.idx], o.result
+
+			address := job.Cache.Address
+			if result.Endpoint != "" {
+				address = result.Endpoint
+			}
+
+			if req.Verbose {
+				result.URL = targetURL(address, job.Cache)
+			}
+			result.Sent = translatedRequest(job.Cache, req.Method)
+
+			// Caches cut short by the caller's deadline are left
+			// out of the status, which is that of the completed ones.
+			if deadline != nil && result.Reason == reasonCancelled && deadline.Err() == context.DeadlineExceeded {
+				result.Reason = reasonDeadlineExceeded
+			} else {
+				aggregated[o.idx] = true
+			}
+			phaseResults[o.idx] = result
+
+			req.setResult(res, job.Cache.Name, result)
+			if b.journal != nil {
+				b.journalDone(req.ID, job.Cache.Name)
+			}
+			res.BytesSent += result.BytesSent
+			res.BytesReceived += result.BytesReceived
+			b.log(req.ID, " ", methodLog(req.Method, job.Cache.Method), " ", targetURL(address, job.Cache), " sent=", strconv.FormatInt(result.BytesSent, 10), " received=", strconv.FormatInt(result.BytesReceived, 10), "\n")
+		}
+
+		for idx, result := range phaseResults {
+			if ph.gate && failed == "" && !result.succeeded() {
+				failed = ph.jobs[idx].Cache.Name
+			}
+			if aggregated[idx] {
+				results = append(results, result)
+			}
+		}
+
+		res.addPhase(ph.name, time.Since(phaseStart))
+	}
+
+	res.Status = aggregateStatus(b.cfg.StatusPolicy, results)
+	if hashed && len(results) == 1 {
+		res.Status = results[0].Status
+	}
+	// A failed canary aborts the broadcast with its status.
+	if len(phases) > 0 && phases[0].name == phaseCanary && failed == phases[0].jobs[0].Cache.Name {
+		if res.Status = res.Caches[failed].Status; res.Status == 0 {
+			res.Status = http.StatusBadGateway
+		}
+	}
+	if len(results) == 0 && len(jobs) > 0 && deadline != nil {
+		res.Status = http.StatusGatewayTimeout
+	}
+	b.checkSlowBroadcast(req, time.Since(start), res.Caches)
+
+	return res, nil
+}
+
+// reportSkipped reports the caches skipped by the broadcast, once it
+// can't be rejected any more, for a stream not to start beforehand.
+func (b *Broadcaster) reportSkipped(req Request, res Results, skipped []dao.Cache) {
+	for _, sc := range skipped {
+		reason := reasonSkipped
+		if b.cacheDisabled(sc.Name) {
+			reason = reasonDisabled
+		} else if sc.InMaintenance(time.Now()) {
+			reason = reasonMaintenance
+		}
+		req.setResult(res, sc.Name, Result{Reason: reason})
+	}
+}
+
+// dryRun fills in the results of the caches as they would be
+// broadcast to, without enqueueing any job.
+func (b *Broadcaster) dryRun(req Request, caches []dao.Cache, res Results) Results {
+	for _, c := range caches {
+		c.Method = c.MappedMethod(req.Method)
+		c.Item = req.Path
+
+		target := targetURL(c.Address, c)
+		req.setResult(res, c.Name, Result{DryRun: true, URL: target, Sent: translatedRequest(c, req.Method)})
+		b.log("Dry run ", methodLog(req.Method, c.Method), " ", target, "\n")
+	}
+
+	res.Status = http.StatusOK
+
+	return res
+}
+
+// Handler returns the handler broadcasting every incoming request
+// to the caches of the group named by its X-Group header, or to
+// all caches. It answers with the result of every cache.
+func (b *Broadcaster) Handler() http.Handler {
+	return b.recoverHandler(http.HandlerFunc(b.reqHandler))
+}
+
+// reqHandler handles any incoming http request. Its main purpose
+// is to distribute the request further to all required caches.
+func (b *Broadcaster) reqHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&b.requestsServed, 1)
+
+	if b.rejectLoop(w, r) {
+		return
+	}
+
+	groupName, path, err := b.Target(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid group path %s: %s.", r.URL.EscapedPath(), err), http.StatusBadRequest)
+		return
+	}
+
+	// Broadcasts continue the trace of the incoming request.
+	ctx := r.Context()
+	if b.cfg.Tracer != nil {
+		ctx = tracing.Extract(ctx, r.Header)
+	}
+
+	tags, allTags, err := tagTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var timeout time.Duration
+	if v := r.Header.Get("X-Broadcast-Timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid X-Broadcast-Timeout %q.", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var retries *int
+	if v := r.Header.Get("X-Retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("Invalid X-Retries %q.", v), http.StatusBadRequest)
+			return
+		}
+		if n > b.cfg.MaxRetries {
+			n = b.cfg.MaxRetries
+		}
+		retries = &n
+	}
+
+	body, err := readBody(w, r, b.cfg.MaxBodySize)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Body larger than %d bytes.", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Invalid body: %s.", err), http.StatusBadRequest)
+		return
+	}
+
+	reqID := requestID(r)
+	w.Header().Set("X-Request-Id", reqID)
+
+	// Streamed results are sent as each cache answers, a client
+	// leaving mid-stream cancelling the outstanding requests.
+	var stream *resultStream
+	var onResult func(string, Result)
+	streamed, query := wantsStream(r)
+	if streamed {
+		stream = newResultStream(w)
+		onResult = stream.result
+	}
+
+	broadcastPath := b.RenderPath(path, query)
+	req := Request{
+		Method:  r.Method,
+		Path:    broadcastPath,
+		Group:   groupName,
+		Tags:    tags,
+		AllTags: allTags,
+		Header:  b.forwardedHeader(r),
+		Host:    r.Host,
+		Body:    body,
+		Verbose: r.Header.Get("X-Broadcast-Verbose") == "true",
+		DryRun:  r.Header.Get("X-Broadcast-Dry-Run") == "true",
+		Timeout: timeout,
+		Retries: retries,
+
+		SkipCanary: r.Header.Get("X-Broadcast-Skip-Canary") == "true",
+		OnResult:   onResult,
+		ID:         reqID,
+		Client:     b.clientIP(r),
+	}
+
+	// Identical GET broadcasts are answered from the result cache.
+	key, cacheable := resultKey(req)
+	cacheable = cacheable && b.results != nil
+	if cacheable {
+		if res, found := b.results.get(key); found {
+			resultCacheHits.Inc("")
+			w.Header().Set("X-Cache", "HIT")
+			writeResults(w, res)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	res, err := b.Broadcast(ctx, req)
+
+	// Paused broadcasts are rejected, or held until resumed,
+	// once known to be valid.
+	if errors.Is(err, ErrPaused) {
+		paused, held, position := b.hold(req)
+		switch {
+		case held:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "{\"held\": %d}", position)
+			return
+		case paused:
+			rejectPaused(w)
+			return
+		}
+		// Resumed meanwhile.
+		res, err = b.Broadcast(ctx, req)
+	}
+
+	if stream != nil && stream.started {
+		stream.send("summary", streamSummary{RequestID: reqID, Status: res.Status, Caches: len(res.Caches)})
+		b.postResult(newWebhookResult(reqID, r.Method, broadcastPath, groupName, res))
+		return
+	}
+
+	var rateLimited *RateLimitError
+	var protected *ProtectedPathError
+
+	switch {
+	case errors.Is(err, ErrGroupNotFound):
+		http.Error(w, fmt.Sprintf("Group %s not found.", groupName), http.StatusNotFound)
+		return
+	case errors.As(err, &protected):
+		http.Error(w, protected.Error(), http.StatusPreconditionFailed)
+		return
+	case errors.As(err, &rateLimited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimited.Wait.Seconds()))))
+		http.Error(w, "Rate limit exceeded.", http.StatusTooManyRequests)
+		return
+	case errors.Is(err, ErrPaused):
+		rejectPaused(w)
+		return
+	case errors.Is(err, ErrQueueSaturated):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error": "Job queue is saturated."}`))
+		return
+	}
+
+	if cacheable && err == nil && isSuccess(res.Status) {
+		b.results.put(key, res)
+	}
+
+	writeResults(w, res)
+	if res.Status != http.StatusNoContent {
+		b.postResult(newWebhookResult(reqID, r.Method, broadcastPath, groupName, res))
+	}
+}
+
+// writeResults answers with the results of a broadcast.
+func writeResults(w http.ResponseWriter, res Results) {
+	if res.Status == http.StatusNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if len(res.Phases) > 0 {
+		w.Header().Set("Server-Timing", serverTiming(res.Phases))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Status)
+
+	out, _ := json.MarshalIndent(res.Caches, "", "  ")
+	w.Write(out)
+}
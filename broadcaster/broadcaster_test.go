@@ -0,0 +1,480 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	tracing "github.com/timothyclarke/http-request-broadcaster/tracing"
+)
+
+// newTestBroadcaster returns a broadcaster of the configured
+// groups, closed once the test is done.
+func newTestBroadcaster(t testing.TB, cfg Config) *Broadcaster {
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+
+	return b
+}
+
+func TestClientDisconnectCancelsCacheRequests(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	cache := newTestCache(t, b, "hanging", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(2 * time.Second):
+		}
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache}})
+
+	b.mu.Lock()
+	client := b.clients[cache.Name]
+	b.mu.Unlock()
+
+	server := httptest.NewServer(b.Handler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := http.NewRequestWithContext(ctx, "PURGE", server.URL+"/foo", nil)
+	r.Header.Set("X-Group", "edge")
+
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := http.DefaultClient.Do(r); err == nil {
+		t.Fatal("expected the broadcast to be cancelled")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the cache request to be cancelled")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients[cache.Name] != client {
+		t.Error("expected the cancellation to leave the cache's client alone")
+	}
+}
+
+func TestRetriesKeepTheClient(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Retries: 2})
+
+	var attempts int32
+	cache := newTestCache(t, b, "flapping", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache}})
+
+	b.mu.RLock()
+	client := b.clients[cache.Name]
+	b.mu.RUnlock()
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.Caches["flapping"]; r.Error == "" || atomic.LoadInt32(&attempts) != 3 {
+		t.Fatalf("expected the cache to fail its 3 attempts, got %+v after %d", r, attempts)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.clients[cache.Name] != client {
+		t.Error("expected the retries to reuse the cache's client")
+	}
+}
+
+func TestCancelledBroadcastDropsQueuedJobs(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	var requests int32
+	cache := newTestCache(t, b, "busy", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(150 * time.Millisecond)
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache}})
+
+	broadcast := func(ctx context.Context) map[string]Result {
+		r := httptest.NewRequest("PURGE", "/foo", nil).WithContext(ctx)
+		r.Header.Set("X-Group", "edge")
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+
+		var body map[string]Result
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body
+	}
+
+	// Keep the cache's single worker busy.
+	done := make(chan struct{})
+	go func() {
+		broadcast(context.Background())
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	if res := broadcast(ctx)["busy"]; res.Reason != reasonCancelled {
+		t.Errorf("expected the queued job to be cancelled, got %+v", res)
+	}
+
+	<-done
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the dropped job not to be sent, got %d requests", n)
+	}
+}
+
+func TestHandlerBroadcastsToGroup(t *testing.T) {
+	seen := make(chan string, 2)
+	backend := func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Method + " " + r.URL.Path + " " + r.Host
+	}
+	c1 := httptest.NewServer(http.HandlerFunc(backend))
+	defer c1.Close()
+	c2 := httptest.NewServer(http.HandlerFunc(backend))
+	defer c2.Close()
+
+	b := newTestBroadcaster(t, Config{Groups: []dao.Group{
+		{Name: "edge", Caches: []dao.Cache{{Name: "c1", Address: c1.URL}, {Name: "c2", Address: c2.URL}}},
+		{Name: "shield"},
+	}})
+
+	server := httptest.NewServer(b.Handler())
+	defer server.Close()
+
+	broadcast := func(group string) (*http.Response, map[string]Result) {
+		r, _ := http.NewRequest("PURGE", server.URL+"/foo", nil)
+		r.Host = "example.com"
+		r.Header.Set("X-Group", group)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var body map[string]Result
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+
+	resp, body := broadcast("edge")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if body["c1"].Status != http.StatusOK || body["c2"].Status != http.StatusOK {
+		t.Errorf("expected both caches to answer 200, got %+v", body)
+	}
+	for i := 0; i < 2; i++ {
+		if s := <-seen; s != "PURGE /foo example.com" {
+			t.Errorf("unexpected cache request %q", s)
+		}
+	}
+
+	if resp, _ = broadcast("shield"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204 for a group without caches, got %d", resp.StatusCode)
+	}
+	if resp, _ = broadcast("unknown"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown group, got %d", resp.StatusCode)
+	}
+}
+
+func TestBroadcastReportsUnknownGroup(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/foo", Group: "edge"}); err != ErrGroupNotFound {
+		t.Errorf("expected ErrGroupNotFound, got %v", err)
+	}
+}
+
+func TestDryRunSendsNothing(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	cache := newTestCache(t, b, "edge1", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected %s %s during a dry run", r.Method, r.URL.Path)
+	})
+	cache.PathPrefix = "/site"
+	cache.BanExpression = "req.url ~ {path}"
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache, {Name: "edge2"}}})
+	b.setDisabled("edge2", "", true)
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "edge")
+	r.Header.Set("X-Broadcast-Dry-Run", "true")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var body map[string]Result
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := body["edge1"]
+	if !plan.DryRun || plan.URL != cache.Address+"/site/foo" {
+		t.Errorf("expected the final URL to be planned, got %+v", plan)
+	}
+	if plan.Sent == nil || plan.Sent.Method != "BAN" || plan.Sent.Headers[defaultBanHeader] != "req.url ~ /site/foo" {
+		t.Errorf("expected the BAN translation to be planned, got %+v", plan.Sent)
+	}
+	if body["edge2"].Reason != reasonDisabled {
+		t.Errorf("expected the disabled cache to be reported as disabled, got %+v", body["edge2"])
+	}
+	if b.queuedJobs() != 0 {
+		t.Error("expected no job to be enqueued")
+	}
+
+	b.cfg.DryRun = true
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/bar", Group: "edge"})
+	if err != nil || !res.Caches["edge1"].DryRun {
+		t.Errorf("expected Config.DryRun to turn broadcasts into dry runs, got %+v %v", res, err)
+	}
+}
+
+func TestBroadcastsContinueIncomingTrace(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+
+	tracer, err := tracing.New(collector.URL, "broadcaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracer.Shutdown()
+
+	b := newTestBroadcaster(t, Config{Tracer: tracer})
+
+	traceparent := make(chan string, 1)
+	cache := newTestCache(t, b, "edge1", func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache}})
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "edge")
+	r.Header.Set("traceparent", incoming)
+	b.reqHandler(httptest.NewRecorder(), r)
+
+	sent, ok := tracing.ParseTraceparent(<-traceparent)
+	if !ok {
+		t.Fatal("expected a traceparent to be sent to the cache")
+	}
+	if in, _ := tracing.ParseTraceparent(incoming); sent.TraceID != in.TraceID || sent.SpanID == in.SpanID {
+		t.Errorf("expected the cache request to be a span of the incoming trace, got %+v", sent)
+	}
+}
+
+func TestBroadcastTimeoutHeader(t *testing.T) {
+	b := newTestBroadcaster(t, Config{StatusPolicy: policyAllOK, MaxRequestTimeout: 100 * time.Millisecond})
+
+	release := make(chan struct{})
+	defer close(release)
+
+	fast := newTestCache(t, b, "fast", func(w http.ResponseWriter, r *http.Request) {})
+	hanging := newTestCache(t, b, "hanging", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{fast, hanging}})
+
+	broadcast := func(timeout string) (*httptest.ResponseRecorder, time.Duration) {
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		r.Header.Set("X-Group", "edge")
+		r.Header.Set("X-Broadcast-Timeout", timeout)
+		w := httptest.NewRecorder()
+
+		start := time.Now()
+		b.reqHandler(w, r)
+		return w, time.Since(start)
+	}
+
+	w, took := broadcast("50ms")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the status of the completed cache, got %d", w.Code)
+	}
+	var body map[string]Result
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["hanging"].Reason != reasonDeadlineExceeded || body["fast"].Status != http.StatusOK {
+		t.Errorf("expected the hanging cache to exceed the deadline, got %+v", body)
+	}
+	if took > time.Second {
+		t.Errorf("expected the broadcast to stop at its deadline, took %s", took)
+	}
+
+	if _, took = broadcast("1h"); took > time.Second {
+		t.Errorf("expected the timeout to be clamped, took %s", took)
+	}
+
+	for _, invalid := range []string{"soon", "-1s", "0"} {
+		if w, _ = broadcast(invalid); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", invalid, w.Code)
+		}
+	}
+}
+
+func TestSequentialGroupIsBroadcastInOrder(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	edge := newTestCache(t, b, "edge", func(w http.ResponseWriter, r *http.Request) {
+		record("edge started")
+		time.Sleep(50 * time.Millisecond)
+		record("edge done")
+	})
+	origin := newTestCache(t, b, "origin", func(w http.ResponseWriter, r *http.Request) {
+		record("origin started")
+	})
+	setTestGroups(b, dao.Group{Name: "layers", Sequential: true, Caches: []dao.Cache{edge, origin}})
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/foo", Group: "layers"})
+	if err != nil || res.Caches["edge"].Status != http.StatusOK || res.Caches["origin"].Status != http.StatusOK {
+		t.Fatalf("expected both caches to answer, got %+v %v", res, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(events, ", "); got != "edge started, edge done, origin started" {
+		t.Errorf("expected origin to be purged once edge was done, got %s", got)
+	}
+}
+
+func TestStopOnFailureSkipsRemainingCaches(t *testing.T) {
+	b := newTestBroadcaster(t, Config{StatusPolicy: policyAllOK})
+
+	shield := newTestCache(t, b, "shield", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	edge := newTestCache(t, b, "edge", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the edge not to be purged once the shield failed")
+	})
+	setTestGroups(b, dao.Group{Name: "tiers", StopOnFailure: true, Caches: []dao.Cache{shield, edge}})
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "tiers")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", w.Code)
+	}
+
+	var body map[string]Result
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if got := body["edge"]; got.Reason != reasonNotAttempted || !strings.Contains(got.Error, "shield") {
+		t.Errorf("expected the edge to be reported as not attempted because of the shield, got %+v", got)
+	}
+	if body["shield"].Status != http.StatusInternalServerError {
+		t.Errorf("expected the status of the shield, got %+v", body["shield"])
+	}
+}
+
+func TestReloadKeepsUnchangedClients(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Groups: []dao.Group{
+		{Name: "edge", Caches: []dao.Cache{
+			{Name: "c1", Address: "http://c1"},
+			{Name: "c2", Address: "http://c2"},
+			{Name: "c3", Address: "http://c3"},
+		}},
+	}})
+
+	clients := func() map[string]*http.Client {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		m := make(map[string]*http.Client, len(b.clients))
+		for name, client := range b.clients {
+			m[name] = client
+		}
+		return m
+	}
+	before := clients()
+
+	err := b.Reload([]dao.Group{
+		{Name: "edge", Caches: []dao.Cache{
+			{Name: "c1", Address: "http://c1"},
+			{Name: "c2", Address: "http://c2-new"},
+		}},
+		{Name: "shield", Caches: []dao.Cache{{Name: "c1", Address: "http://c1"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := clients()
+
+	if after["c1"] != before["c1"] {
+		t.Error("expected the client of the unchanged cache to be kept")
+	}
+	if after["c2"] == nil || after["c2"] == before["c2"] {
+		t.Error("expected the client of the changed cache to be replaced")
+	}
+	if _, found := after["c3"]; found || len(after) != 2 {
+		t.Errorf("expected the client of the removed cache to be closed, got %v", after)
+	}
+}
+
+func TestEmptyConfiguration(t *testing.T) {
+	var logs []string
+	var mu sync.Mutex
+	logger := func(args ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, strings.Join(args, ""))
+	}
+
+	newTestBroadcaster(t, Config{Groups: []dao.Group{{Name: "edge"}}, Log: logger})
+	mu.Lock()
+	if joined := strings.Join(logs, ""); !strings.Contains(joined, "WARN The configuration defines no caches") {
+		t.Errorf("expected an empty configuration to be warned about, got %q", joined)
+	}
+	mu.Unlock()
+
+	if _, err := New(Config{Groups: []dao.Group{{Name: "edge"}}, RequireCaches: true}); err == nil {
+		t.Error("expected an empty configuration to be refused with RequireCaches")
+	}
+	if errs := Validate(Config{RequireCaches: true}); len(errs) != 1 {
+		t.Errorf("expected an empty configuration to be invalid, got %v", errs)
+	}
+
+	groups := []dao.Group{{Name: "edge", Caches: []dao.Cache{{Name: "c1", Address: "http://127.0.0.1:1"}}}}
+	b := newTestBroadcaster(t, Config{Groups: groups, RequireCaches: true})
+	if err := b.Reload([]dao.Group{{Name: "edge"}}); err == nil {
+		t.Error("expected a reload to an empty configuration to be refused")
+	}
+	if s := b.Stats(); s.Caches != 1 {
+		t.Errorf("expected the caches to be kept, got %d", s.Caches)
+	}
+}
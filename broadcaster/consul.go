@@ -0,0 +1,326 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// consulSourcePrefix marks a group whose caches are taken
+// from the consul catalog, e.g. source = consul:varnish?tag=edge
+const consulSourcePrefix = "consul:"
+
+var consulClient = &http.Client{}
+
+// ConsulConfig locates the consul agent of consul backed groups.
+type ConsulConfig struct {
+	// Addr is the agent address, defaulting to
+	// $CONSUL_HTTP_ADDR or 127.0.0.1:8500.
+	Addr string
+
+	// Token is the ACL token, defaulting to $CONSUL_HTTP_TOKEN.
+	Token string
+
+	// Datacenter defaults to $CONSUL_DATACENTER
+	// or the agent's own datacenter.
+	Datacenter string
+
+	// Wait is the maximum duration of a blocking query.
+	Wait time.Duration
+}
+
+type consulSource struct {
+	Service string
+	Tag     string
+}
+
+// parseConsulSource parses the value of a group's source
+// option, which is of the form consul:<service>[?tag=x].
+func parseConsulSource(source string) (consulSource, error) {
+	var src consulSource
+
+	if !strings.HasPrefix(source, consulSourcePrefix) {
+		return src, fmt.Errorf("Unsupported group source %q.", source)
+	}
+
+	spec := strings.TrimPrefix(source, consulSourcePrefix)
+	query := ""
+	if i := strings.Index(spec, "?"); i >= 0 {
+		spec, query = spec[:i], spec[i+1:]
+	}
+
+	if spec == "" {
+		return src, fmt.Errorf("Group source %q names no consul service.", source)
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return src, fmt.Errorf("Group source %q: %s", source, err.Error())
+	}
+
+	src.Service = spec
+	src.Tag = values.Get("tag")
+
+	return src, nil
+}
+
+// consulSetting returns the configured value if set, falling
+// back to the given environment variable and default.
+func consulSetting(flagValue, env, def string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	return def
+}
+
+func (c ConsulConfig) baseURL() string {
+	addr := consulSetting(c.Addr, "CONSUL_HTTP_ADDR", "127.0.0.1:8500")
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimRight(addr, "/")
+}
+
+type consulCatalogEntry struct {
+	Node           string
+	Address        string
+	ServiceID      string
+	ServiceAddress string
+	ServicePort    int
+}
+
+// queryConsulCatalog fetches the nodes registered for the service.
+// A non-zero index turns the call into a blocking query which only
+// returns once the catalog changes or the wait time elapses.
+func (c ConsulConfig) queryCatalog(ctx context.Context, src consulSource, index uint64) ([]dao.Cache, uint64, error) {
+	params := url.Values{}
+	if src.Tag != "" {
+		params.Set("tag", src.Tag)
+	}
+	if dc := consulSetting(c.Datacenter, "CONSUL_DATACENTER", ""); dc != "" {
+		params.Set("dc", dc)
+	}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", c.Wait.String())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Wait+15*time.Second)
+	defer cancel()
+
+	reqString := c.baseURL() + "/v1/catalog/service/" + url.PathEscape(src.Service) + "?" + params.Encode()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, reqString, nil)
+	if err != nil {
+		return nil, index, err
+	}
+
+	if token := consulSetting(c.Token, "CONSUL_HTTP_TOKEN", ""); token != "" {
+		r.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := consulClient.Do(r)
+	if err != nil {
+		return nil, index, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, index, fmt.Errorf("consul answered %s", resp.Status)
+	}
+
+	var entries []consulCatalogEntry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, index, err
+	}
+
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, index, errors.New("consul answered without a valid X-Consul-Index")
+	}
+
+	caches := make([]dao.Cache, 0, len(entries))
+	for _, e := range entries {
+		host := e.ServiceAddress
+		if host == "" {
+			host = e.Address
+		}
+		caches = append(caches, dao.Cache{
+			Name:    e.Node + "/" + e.ServiceID,
+			Address: "http://" + net.JoinHostPort(host, strconv.Itoa(e.ServicePort)),
+		})
+	}
+
+	return caches, newIndex, nil
+}
+
+// consulWatcher keeps the caches of a single group in
+// sync with the consul catalog.
+type consulWatcher struct {
+	b       *Broadcaster
+	group   string
+	source  string
+	src     consulSource
+	members []dao.Cache
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// poll runs a single catalog query and applies its result. Errors
+// leave the last-known member list untouched.
+func (w *consulWatcher) poll(ctx context.Context, index uint64) (uint64, error) {
+	members, newIndex, err := w.b.cfg.Consul.queryCatalog(ctx, w.src, index)
+	if err != nil {
+		return index, err
+	}
+
+	// Consul indexes are only guaranteed to be increasing,
+	// start over should they ever go backwards.
+	if newIndex < index {
+		newIndex = 0
+	}
+
+	w.apply(members)
+
+	return newIndex, nil
+}
+
+func (w *consulWatcher) run(ctx context.Context, index uint64) {
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		var err error
+
+		started := time.Now()
+		index, err = w.poll(ctx, index)
+
+		pause := time.Second - time.Since(started)
+		if err == nil {
+			backoff = time.Second
+		} else if ctx.Err() == nil {
+			w.b.log("Consul watch of group ", w.group, " failed, keeping last-known caches: ", err.Error(), "\n")
+
+			pause = backoff
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+
+		// Never query more than once a second, even if
+		// consul answers blocking queries right away.
+		if pause > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(pause):
+			}
+		}
+	}
+}
+
+// apply swaps the group's caches for the given members, creating
+// http clients for new caches and dropping those of removed ones.
+func (w *consulWatcher) apply(members []dao.Cache) {
+	b := w.b
+	defer b.syncQueues()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A reload may have replaced this watcher in the meantime.
+	if b.consulWatchers[w.group] != w {
+		return
+	}
+
+	g, found := b.groups[w.group]
+	if !found {
+		return
+	}
+
+	for i := range members {
+		g.ApplyDefaults(&members[i])
+	}
+
+	w.members = members
+	g.Caches = members
+	b.groups[w.group] = g
+
+	b.rebuildAllCaches()
+
+	configured := make(map[string]bool, len(b.allCaches))
+	for _, cache := range b.allCaches {
+		configured[cache.Name] = true
+		if _, found := b.clients[cache.Name]; !found {
+			b.clients[cache.Name] = b.createHTTPClient(cache)
+		}
+	}
+
+	for name, client := range b.clients {
+		if !configured[name] {
+			client.CloseIdleConnections()
+			delete(b.clients, name)
+		}
+	}
+}
+
+// watchConsulGroups stops the watchers of a previous configuration
+// and starts one for every consul backed group. A group which was
+// already watched starts off with its last-known caches.
+func (b *Broadcaster) watchConsulGroups(groupList []dao.Group) {
+	b.mu.Lock()
+	previous := b.consulWatchers
+	b.consulWatchers = make(map[string]*consulWatcher)
+
+	var started []*consulWatcher
+
+	for _, g := range groupList {
+		if g.Source == "" {
+			continue
+		}
+
+		src, _ := parseConsulSource(g.Source)
+		w := &consulWatcher{b: b, group: g.Name, source: g.Source, src: src}
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+
+		if old, found := previous[g.Name]; found && old.source == g.Source {
+			w.members = old.members
+			g.Caches = old.members
+			b.groups[g.Name] = g
+		}
+
+		b.consulWatchers[g.Name] = w
+		started = append(started, w)
+	}
+
+	for _, w := range previous {
+		w.cancel()
+	}
+
+	b.rebuildAllCaches()
+	b.mu.Unlock()
+
+	for _, w := range started {
+		// Query once up front so the group is populated
+		// before the first broadcast reaches it.
+		initCtx, initCancel := context.WithTimeout(w.ctx, 10*time.Second)
+		index, err := w.poll(initCtx, 0)
+		initCancel()
+
+		if err != nil {
+			b.log("Consul lookup of group ", w.group, " failed: ", err.Error(), "\n")
+		}
+
+		go w.run(w.ctx, index)
+	}
+}
@@ -0,0 +1,73 @@
+package broadcaster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestParseConsulSource(t *testing.T) {
+	src, err := parseConsulSource("consul:varnish?tag=edge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Service != "varnish" || src.Tag != "edge" {
+		t.Errorf("unexpected source %+v", src)
+	}
+
+	for _, bad := range []string{"consul:", "consul:?tag=x", "zookeeper:varnish"} {
+		if _, err := parseConsulSource(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestConsulWatcherKeepsMembersWhenUnreachable(t *testing.T) {
+	var down int32
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "no leader", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path != "/v1/catalog/service/varnish" || r.URL.Query().Get("tag") != "edge" {
+			t.Errorf("unexpected query %s", r.URL)
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		w.Write([]byte(`[{"Node":"n1","Address":"10.0.0.1","ServiceID":"varnish","ServicePort":6081},
+			{"Node":"n2","Address":"10.0.0.2","ServiceID":"varnish","ServiceAddress":"10.1.0.2","ServicePort":6081}]`))
+	}))
+	defer consul.Close()
+
+	groupList := []dao.Group{{Name: "edge", Source: "consul:varnish?tag=edge"}}
+	b := newTestBroadcaster(t, Config{Groups: groupList, Consul: ConsulConfig{Addr: consul.URL}})
+
+	b.mu.Lock()
+	w := b.consulWatchers["edge"]
+	caches := b.groups["edge"].Caches
+	_, hasClient := b.clients["n2/varnish"]
+	b.mu.Unlock()
+
+	if len(caches) != 2 || caches[1].Address != "http://10.1.0.2:6081" {
+		t.Fatalf("unexpected caches %+v", caches)
+	}
+	if !hasClient {
+		t.Error("expected a client for the discovered cache")
+	}
+
+	atomic.StoreInt32(&down, 1)
+	if _, err := w.poll(context.Background(), 0); err == nil {
+		t.Fatal("expected the poll to fail")
+	}
+
+	b.mu.Lock()
+	caches = b.groups["edge"].Caches
+	b.mu.Unlock()
+
+	if len(caches) != 2 {
+		t.Errorf("expected the last-known caches to be kept, got %+v", caches)
+	}
+}
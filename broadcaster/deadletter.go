@@ -0,0 +1,225 @@
+package broadcaster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// maxDeadLetterUpload bounds the dead-letter files posted to
+// /admin/replay.
+const maxDeadLetterUpload = 64 << 20
+
+// deadLetter is a line of the dead-letter file, a request a
+// cache failed for good.
+type deadLetter struct {
+	Time    time.Time   `json:"time"`
+	Cache   string      `json:"cache"`
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Path    string      `json:"path"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Reason  string      `json:"reason,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// deadLetterLog appends the requests failed by the caches
+// to Config.DeadLetterFile.
+type deadLetterLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openDeadLetterLog(path string) (*deadLetterLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterLog{path: path, file: f}, nil
+}
+
+func (l *deadLetterLog) write(d deadLetter) error {
+	line, _ := json.Marshal(d)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := l.file.Write(append(line, '\n'))
+	return err
+}
+
+// read returns the entries of the dead-letter file.
+func (l *deadLetterLog) read() ([]deadLetter, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readDeadLetters(f)
+}
+
+func (l *deadLetterLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.file.Close()
+}
+
+// readDeadLetters reads the entries of a dead-letter file,
+// skipping blank lines.
+func readDeadLetters(r io.Reader) ([]deadLetter, error) {
+	var entries []deadLetter
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxDeadLetterUpload)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var d deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if d.Cache == "" || d.Method == "" {
+			return nil, fmt.Errorf("line %d: missing cache or method", line)
+		}
+		entries = append(entries, d)
+	}
+
+	return entries, scanner.Err()
+}
+
+// recordDeadLetter writes the request the cache failed, after its
+// retries and fallback, to the dead-letter file.
+func (b *Broadcaster) recordDeadLetter(cache dao.Cache, result Result) {
+	err := b.deadLetters.write(deadLetter{
+		Time:    time.Now(),
+		Cache:   cache.Name,
+		Method:  cache.Method,
+		URL:     targetURL(cache.Address, cache),
+		Path:    cache.Item,
+		Headers: cache.Headers,
+		Body:    cache.Body,
+		Status:  result.Status,
+		Reason:  result.Reason,
+		Error:   result.Error,
+	})
+	if err != nil {
+		b.log("Failed to write the dead letter of ", cache.Method, " ", cache.Item, " to ", cache.Name, ": ", err.Error(), "\n")
+	}
+}
+
+// replayDeadLetters sends the entries to their caches again, as
+// configured now, through their job queues. Entries of caches which
+// aren't configured any more are reported as unknown_cache.
+func (b *Broadcaster) replayDeadLetters(ctx context.Context, entries []deadLetter) []streamedResult {
+	configured := make(map[string]dao.Cache)
+	b.mu.Lock()
+	for _, c := range b.allCaches {
+		configured[c.Name] = c
+	}
+	b.mu.Unlock()
+
+	results := make([]streamedResult, len(entries))
+	pending := make(chan int)
+	go func() {
+		for i := range entries {
+			pending <- i
+		}
+		close(pending)
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < b.cfg.BatchConcurrency && w < len(entries); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				results[i] = b.replayDeadLetter(ctx, configured, entries[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (b *Broadcaster) replayDeadLetter(ctx context.Context, configured map[string]dao.Cache, d deadLetter) streamedResult {
+	cache, found := configured[d.Cache]
+	if !found {
+		return streamedResult{Cache: d.Cache, Result: Result{Reason: reasonUnknownCache, Error: fmt.Sprintf("Cache %s not configured.", d.Cache)}}
+	}
+
+	cache.Method, cache.Item, cache.Headers, cache.Body = d.Method, d.Path, d.Headers, d.Body
+	if cache.Headers == nil {
+		cache.Headers = http.Header{}
+	}
+
+	job := newJob(ctx, cache)
+	var result Result
+	if b.enqueueJobs([]*Job{job}) {
+		result = awaitResult(ctx, job)
+	} else {
+		result = Result{Status: http.StatusServiceUnavailable, Reason: reasonQueueSaturated, Error: ErrQueueSaturated.Error()}
+	}
+	result.URL = targetURL(cache.Address, cache)
+
+	return streamedResult{Cache: d.Cache, Result: result, DurationMs: float64(result.Duration) / float64(time.Millisecond)}
+}
+
+// replayDeadLetterHandler serves POST /admin/replay, replaying the
+// dead-letter file posted, or the live one when the body is empty.
+// It answers with the result of every entry, in order, as streamed
+// broadcasts report them.
+func (b *Broadcaster) replayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r, maxDeadLetterUpload)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Dead-letter file larger than %d bytes.", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Invalid body: %s.", err), http.StatusBadRequest)
+		return
+	}
+
+	var entries []deadLetter
+	switch {
+	case len(body) > 0:
+		entries, err = readDeadLetters(bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid dead-letter file: %s.", err), http.StatusBadRequest)
+			return
+		}
+	case b.deadLetters == nil:
+		http.Error(w, "No dead-letter file posted, nor configured.", http.StatusBadRequest)
+		return
+	default:
+		if entries, err = b.deadLetters.read(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read the dead-letter file: %s.", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	b.log("Admin replaying ", strconv.Itoa(len(entries)), " dead letters\n")
+	out, _ := json.MarshalIndent(b.replayDeadLetters(r.Context(), entries), "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
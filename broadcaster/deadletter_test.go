@@ -0,0 +1,103 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestDeadLettersAreWrittenAndReplayed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	b := newTestBroadcaster(t, Config{DeadLetterFile: path})
+
+	var up int32
+	received := make(chan string, 10)
+	c1 := flakyCache(t, b, "c1", &up, received)
+	ok := newTestCache(t, b, "ok", func(w http.ResponseWriter, r *http.Request) {})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1, ok}})
+
+	header := http.Header{"Xkey": {"product-42"}}
+	if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/foo", Group: "edge", Header: header}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readDeadLetters(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the failure of c1 only, got %s", data)
+	}
+	d := entries[0]
+	if d.Cache != "c1" || d.Method != "PURGE" || d.URL != c1.Address+"/foo" || d.Status != http.StatusServiceUnavailable || d.Headers.Get("Xkey") != "product-42" || d.Time.IsZero() {
+		t.Errorf("unexpected dead letter %s", data)
+	}
+
+	// The live file is replayed when nothing is posted.
+	atomic.StoreInt32(&up, 1)
+	w := httptest.NewRecorder()
+	b.AdminReplayHandler(w, httptest.NewRequest("POST", "/admin/replay", nil))
+
+	var results []streamedResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Cache != "c1" || results[0].Status != http.StatusOK {
+		t.Errorf("expected c1 to be replayed, got %s", w.Body.String())
+	}
+	if got := <-received; got != "PURGE /foo" {
+		t.Errorf("expected the purge to be replayed, got %s", got)
+	}
+}
+
+func TestReplayPostedDeadLetters(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	received := make(chan string, 1)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Method + " " + r.URL.Path + " " + r.Header.Get("Xkey")
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	upload := `{"cache": "c1", "method": "BAN", "path": "/bar", "headers": {"Xkey": ["k1"]}}
+
+{"cache": "gone", "method": "PURGE", "path": "/bar"}
+`
+	w := httptest.NewRecorder()
+	b.AdminReplayHandler(w, httptest.NewRequest("POST", "/admin/replay", strings.NewReader(upload)))
+
+	var results []streamedResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != http.StatusOK || results[1].Reason != reasonUnknownCache {
+		t.Errorf("expected c1 to be replayed and gone to be unknown, got %s", w.Body.String())
+	}
+	if got := <-received; got != "BAN /bar k1" {
+		t.Errorf("expected the dead letter to be replayed, got %s", got)
+	}
+}
+
+func TestReplayRejectsInvalidDeadLetters(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	for _, body := range []string{"", "not json", `{"path": "/foo"}`} {
+		w := httptest.NewRecorder()
+		b.AdminReplayHandler(w, httptest.NewRequest("POST", "/admin/replay", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected %q to be rejected, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package broadcaster
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// originHeader names the client a broadcast originates from, its
+// address or the source of its event, whatever the hops since.
+const originHeader = "X-Broadcast-Origin"
+
+// forwardedHeaders describe the client of a broadcast to the caches.
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", originHeader}
+
+func isForwardedHeader(name string) bool {
+	for _, h := range forwardedHeaders {
+		if http.CanonicalHeaderKey(name) == h {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeader returns a copy of the headers of r with the
+// forwarded headers describing its client. The address r came from
+// is appended to the X-Forwarded-For chain with Config.TrustProxy,
+// and replaces it otherwise, since anyone can make one up.
+func (b *Broadcaster) forwardedHeader(r *http.Request) http.Header {
+	h := r.Header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	var chain []string
+	if b.cfg.TrustProxy {
+		for _, v := range h.Values("X-Forwarded-For") {
+			chain = append(chain, dao.SplitList(v)...)
+		}
+		if p := h.Get("X-Forwarded-Proto"); p != "" {
+			proto = p
+		}
+	} else {
+		h.Del(originHeader)
+	}
+	if peer != "" {
+		chain = append(chain, peer)
+	}
+
+	h.Del("X-Forwarded-For")
+	if len(chain) > 0 {
+		h.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+	h.Set("X-Forwarded-Proto", proto)
+	if h.Get(originHeader) == "" {
+		if client := b.clientIP(r); client != "" {
+			h.Set(originHeader, client)
+		}
+	}
+	return h
+}
+
+// setForwarded sets the forwarded headers of the broadcast on the
+// request to the cache, unless its forwarded_headers option is off,
+// e.g. for backends choking on unexpected headers. They're sent
+// whatever the forward_headers allowlist.
+func setForwarded(r *http.Request, cache dao.Cache) {
+	if cache.ForwardedHeaders != nil && !*cache.ForwardedHeaders {
+		return
+	}
+	for _, name := range forwardedHeaders {
+		if v := cache.Headers.Get(name); v != "" {
+			r.Header.Set(name, v)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		trustProxy bool
+		wantFor    string
+		wantProto  string
+		wantOrigin string
+	}{
+		{"untrusted", false, "192.0.2.1", "http", "192.0.2.1"},
+		{"trusted", true, "198.51.100.7, 10.0.0.1, 192.0.2.1", "https", "198.51.100.7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroadcaster(t, Config{TrustProxy: tc.trustProxy})
+
+			received := make(chan http.Header, 1)
+			c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.Header })
+			setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+			r := httptest.NewRequest("PURGE", "/foo", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			r.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set(originHeader, "198.51.100.7")
+			b.reqHandler(httptest.NewRecorder(), r)
+
+			h := <-received
+			if got := h.Get("X-Forwarded-For"); got != tc.wantFor {
+				t.Errorf("expected X-Forwarded-For %q, got %q", tc.wantFor, got)
+			}
+			if got := h.Get("X-Forwarded-Proto"); got != tc.wantProto {
+				t.Errorf("expected X-Forwarded-Proto %q, got %q", tc.wantProto, got)
+			}
+			if got := h.Get(originHeader); got != tc.wantOrigin {
+				t.Errorf("expected %s %q, got %q", originHeader, tc.wantOrigin, got)
+			}
+		})
+	}
+}
+
+func TestForwardedHeadersCanBeTurnedOff(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ForwardHeaders: []string{"X-Purge-Reason"}})
+
+	off := false
+	received := make(chan http.Header, 2)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.Header })
+	c2 := newTestCache(t, b, "c2", func(w http.ResponseWriter, r *http.Request) { received <- r.Header })
+	c2.ForwardedHeaders = &off
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}}, dao.Group{Name: "legacy", Caches: []dao.Cache{c2}})
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "edge")
+	b.reqHandler(httptest.NewRecorder(), r)
+	if h := <-received; h.Get("X-Forwarded-For") == "" || h.Get(originHeader) == "" {
+		t.Errorf("expected the forwarded headers whatever the allowlist, got %v", h)
+	}
+
+	r = httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "legacy")
+	b.reqHandler(httptest.NewRecorder(), r)
+	h := <-received
+	for _, name := range forwardedHeaders {
+		if h.Get(name) != "" {
+			t.Errorf("expected no %s with forwarded_headers off, got %q", name, h.Get(name))
+		}
+	}
+}
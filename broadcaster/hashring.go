@@ -0,0 +1,92 @@
+package broadcaster
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// ringReplicas is the number of points of every cache on a hash
+// ring, spreading the keys evenly across the caches.
+const ringReplicas = 160
+
+// hashRing maps keys onto caches by consistent hashing, so that
+// adding or removing a cache only moves the keys it gains or loses.
+type hashRing struct {
+	// members identifies the caches the ring was built from.
+	members string
+
+	points []uint32
+	caches map[uint32]dao.Cache
+}
+
+func newHashRing(caches []dao.Cache) *hashRing {
+	r := &hashRing{
+		members: ringMembers(caches),
+		points:  make([]uint32, 0, len(caches)*ringReplicas),
+		caches:  make(map[uint32]dao.Cache, len(caches)*ringReplicas),
+	}
+
+	for _, c := range caches {
+		for i := 0; i < ringReplicas; i++ {
+			p := fnv32(c.Name + "#" + strconv.Itoa(i))
+			// A point two caches hash to goes to the first
+			// by name, whatever the order of the caches.
+			if owner, taken := r.caches[p]; taken && owner.Name < c.Name {
+				continue
+			} else if !taken {
+				r.points = append(r.points, p)
+			}
+			r.caches[p] = c
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+
+	return r
+}
+
+// get returns the cache owning the key, the first
+// one clockwise of its hash on the ring.
+func (r *hashRing) get(key string) (dao.Cache, bool) {
+	if len(r.points) == 0 {
+		return dao.Cache{}, false
+	}
+
+	h := fnv32(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.caches[r.points[i]], true
+}
+
+func ringMembers(caches []dao.Cache) string {
+	names := make([]string, len(caches))
+	for i, c := range caches {
+		names[i] = c.Name + "=" + c.Address
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// hashTargets narrows the enabled caches of a hash mode group down
+// to the one owning the path. The ring of the group is rebuilt
+// whenever they change, be it by reload, consul or admin endpoints.
+func (b *Broadcaster) hashTargets(groupName, path string, caches []dao.Cache) []dao.Cache {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r := b.rings[groupName]
+	if r == nil || r.members != ringMembers(caches) {
+		r = newHashRing(caches)
+		b.rings[groupName] = r
+	}
+
+	if c, ok := r.get(path); ok {
+		return []dao.Cache{c}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package broadcaster
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func ringCaches(names ...string) []dao.Cache {
+	caches := make([]dao.Cache, len(names))
+	for i, name := range names {
+		caches[i] = dao.Cache{Name: name, Address: "http://" + name}
+	}
+	return caches
+}
+
+func ringOwners(r *hashRing, keys int) []string {
+	owners := make([]string, keys)
+	for i := range owners {
+		c, _ := r.get("/products/" + strconv.Itoa(i))
+		owners[i] = c.Name
+	}
+	return owners
+}
+
+func TestHashRingSpreadsKeys(t *testing.T) {
+	const keys = 10000
+
+	counts := make(map[string]int)
+	for _, owner := range ringOwners(newHashRing(ringCaches("c1", "c2", "c3", "c4")), keys) {
+		counts[owner]++
+	}
+
+	for _, name := range []string{"c1", "c2", "c3", "c4"} {
+		if counts[name] < keys/4*2/3 || counts[name] > keys/4*4/3 {
+			t.Errorf("expected about a quarter of the keys on %s, got %d", name, counts[name])
+		}
+	}
+
+	if _, ok := newHashRing(nil).get("/foo"); ok {
+		t.Error("expected an empty ring to own nothing")
+	}
+}
+
+func TestHashRingIsStable(t *testing.T) {
+	const keys = 10000
+
+	before := ringOwners(newHashRing(ringCaches("c1", "c2", "c3")), keys)
+
+	reordered := ringOwners(newHashRing(ringCaches("c3", "c1", "c2")), keys)
+	for i := range before {
+		if before[i] != reordered[i] {
+			t.Fatalf("expected the order of the caches not to matter, key %d moved from %s to %s", i, before[i], reordered[i])
+		}
+	}
+
+	// Removing a cache only moves its own keys.
+	removed := ringOwners(newHashRing(ringCaches("c1", "c3")), keys)
+	for i := range before {
+		if before[i] != "c2" && removed[i] != before[i] {
+			t.Fatalf("expected key %d to stay on %s, moved to %s", i, before[i], removed[i])
+		}
+	}
+
+	// Adding a cache only moves keys onto it, about a quarter of them.
+	moved := 0
+	added := ringOwners(newHashRing(ringCaches("c1", "c2", "c3", "c4")), keys)
+	for i := range before {
+		if added[i] != before[i] {
+			if added[i] != "c4" {
+				t.Fatalf("expected key %d to stay on %s or move to c4, moved to %s", i, before[i], added[i])
+			}
+			moved++
+		}
+	}
+	if moved < keys/4*2/3 || moved > keys/4*4/3 {
+		t.Errorf("expected about a quarter of the keys to move, got %d", moved)
+	}
+}
+
+func TestHashModeSendsToOneCache(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	var requests [3]int32
+	var caches []dao.Cache
+	for i := range requests {
+		i := i
+		caches = append(caches, newTestCache(t, b, "c"+strconv.Itoa(i), func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests[i], 1)
+			w.WriteHeader(http.StatusNotFound)
+		}))
+	}
+	setTestGroups(b, dao.Group{Name: "preload", Mode: dao.ModeHash, Caches: caches})
+
+	var owner string
+	for i := 0; i < 3; i++ {
+		res, err := b.Broadcast(context.Background(), Request{Method: "GET", Path: "/products/42", Group: "preload"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Caches) != 1 {
+			t.Fatalf("expected a single cache, got %+v", res.Caches)
+		}
+		if res.Status != http.StatusNotFound {
+			t.Errorf("expected the status of the cache, got %d", res.Status)
+		}
+		for name := range res.Caches {
+			if owner != "" && name != owner {
+				t.Errorf("expected the path to stick to %s, got %s", owner, name)
+			}
+			owner = name
+		}
+	}
+
+	total := int32(0)
+	for i := range requests {
+		total += atomic.LoadInt32(&requests[i])
+	}
+	if total != 3 {
+		t.Errorf("expected 3 requests in all, got %d", total)
+	}
+}
@@ -0,0 +1,47 @@
+package broadcaster
+
+import (
+	"net/http"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// allowedHeaders returns the allowlist of the cache's group,
+// falling back to Config.ForwardHeaders. Empty allows all headers.
+func (b *Broadcaster) allowedHeaders(cache dao.Cache) []string {
+	if cache.ForwardHeaders != nil {
+		return cache.ForwardHeaders
+	}
+	return b.cfg.ForwardHeaders
+}
+
+// forwardsHeader tells whether the incoming header is sent on to
+// the cache, as allowed by the cache's group or Config.ForwardHeaders.
+func (b *Broadcaster) forwardsHeader(cache dao.Cache, name string) bool {
+	allowed := b.allowedHeaders(cache)
+	return len(allowed) == 0 || allowlisted(allowed, name)
+}
+
+// keepsUserAgent tells whether the incoming User-Agent is sent to
+// the cache instead of Config.UserAgent, which takes it being
+// explicitly allowlisted.
+func (b *Broadcaster) keepsUserAgent(cache dao.Cache) bool {
+	return cache.Headers.Get("User-Agent") != "" && allowlisted(b.allowedHeaders(cache), "User-Agent")
+}
+
+// overridesHeader tells whether the static header of the cache is
+// set over the header of the same name forwarded by the broadcast.
+func overridesHeader(cache dao.Cache, name string) bool {
+	return allowlisted(cache.OverrideHeaders, name)
+}
+
+func allowlisted(allowed []string, name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, a := range allowed {
+		if a == "*" || http.CanonicalHeaderKey(a) == name {
+			return true
+		}
+	}
+
+	return false
+}
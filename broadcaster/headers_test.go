@@ -0,0 +1,108 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestOnlyAllowlistedHeadersReachCaches(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ForwardHeaders: []string{"x-keep", "Cookie"}})
+
+	edgeSeen := make(chan http.Header, 1)
+	shieldSeen := make(chan http.Header, 1)
+
+	edge := newTestCache(t, b, "edge", func(w http.ResponseWriter, r *http.Request) { edgeSeen <- r.Header })
+	shield := newTestCache(t, b, "shield", func(w http.ResponseWriter, r *http.Request) { shieldSeen <- r.Header })
+	shield.ForwardHeaders = []string{"X-Drop"}
+
+	setTestGroups(b, dao.Group{Name: "all", Caches: []dao.Cache{edge, shield}})
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "all")
+	r.Header.Set("X-Keep", "1")
+	r.Header.Set("X-Drop", "1")
+	r.Header.Set("Authorization", "Bearer secret")
+	b.reqHandler(httptest.NewRecorder(), r)
+
+	h := <-edgeSeen
+	if h.Get("X-Keep") != "1" {
+		t.Errorf("expected the allowlisted X-Keep to reach the cache, got %v", h)
+	}
+	if h.Get("X-Drop") != "" || h.Get("Authorization") != "" || h.Get("X-Group") != "" {
+		t.Errorf("expected headers outside the allowlist to be dropped, got %v", h)
+	}
+
+	h = <-shieldSeen
+	if h.Get("X-Drop") != "1" || h.Get("X-Keep") != "" {
+		t.Errorf("expected the group allowlist to override the global one, got %v", h)
+	}
+}
+
+func TestStaticHeadersReachCaches(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	seen := make(chan http.Header, 1)
+	edge := newTestCache(t, b, "edge", func(w http.ResponseWriter, r *http.Request) { seen <- r.Header })
+	edge.StaticHeaders = dao.SecretHeaders{"X-Purge-Token": "s3cret", "X-Tenant": "shop", "X-Cluster": "eu"}
+	edge.OverrideHeaders = []string{"X-Tenant"}
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{edge}})
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Keep", "1")
+	r.Header.Set("X-Tenant", "other")
+	r.Header.Set("X-Cluster", "us")
+	b.reqHandler(httptest.NewRecorder(), r)
+
+	h := <-seen
+	if h.Get("X-Purge-Token") != "s3cret" || h.Get("X-Tenant") != "shop" {
+		t.Errorf("expected the static headers, overriding the forwarded X-Tenant, got %v", h)
+	}
+	if h.Get("X-Cluster") != "us" {
+		t.Errorf("expected the forwarded X-Cluster over the static one, got %v", h)
+	}
+	if h.Get("X-Keep") != "1" {
+		t.Errorf("expected the forwarded headers to be kept, got %v", h)
+	}
+}
+
+func TestForwardsHeader(t *testing.T) {
+	b := &Broadcaster{}
+	if !b.forwardsHeader(dao.Cache{}, "X-Anything") {
+		t.Error("expected all headers to be forwarded without an allowlist")
+	}
+
+	b.cfg.ForwardHeaders = []string{"X-Keep"}
+	if b.forwardsHeader(dao.Cache{}, "X-Other") {
+		t.Error("expected X-Other to be dropped")
+	}
+	if !b.forwardsHeader(dao.Cache{ForwardHeaders: []string{"*"}}, "X-Other") {
+		t.Error("expected a group allowing * to forward X-Other")
+	}
+}
+
+func TestCachesSeeConfiguredUserAgent(t *testing.T) {
+	b := newTestBroadcaster(t, Config{UserAgent: "broadcaster/test"})
+
+	seen := make(chan string, 1)
+	cache := newTestCache(t, b, "ua", func(w http.ResponseWriter, r *http.Request) { seen <- r.UserAgent() })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache}})
+
+	broadcast := func() string {
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		r.Header.Set("User-Agent", "curl/7.68.0")
+		b.reqHandler(httptest.NewRecorder(), r)
+		return <-seen
+	}
+
+	if ua := broadcast(); ua != "broadcaster/test" {
+		t.Errorf("expected the configured user agent, got %q", ua)
+	}
+
+	b.cfg.ForwardHeaders = []string{"User-Agent"}
+	if ua := broadcast(); ua != "curl/7.68.0" {
+		t.Errorf("expected the forwarded incoming user agent, got %q", ua)
+	}
+}
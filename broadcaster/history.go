@@ -0,0 +1,189 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a broadcast kept in the history.
+type HistoryEntry struct {
+	// ID is the request id of the broadcast, that of its log entries.
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Group  string    `json:"group,omitempty"`
+	Status int       `json:"status"`
+	DryRun bool      `json:"dry_run,omitempty"`
+
+	// Caches holds the outcome of every cache, keyed by name.
+	Caches map[string]HistoryOutcome `json:"caches"`
+}
+
+// HistoryOutcome is the outcome of a cache in the history,
+// the status, reason and error of its result.
+type HistoryOutcome struct {
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// history keeps the last broadcasts in a ring of fixed size.
+type history struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+	next    int
+	full    bool
+}
+
+func newHistory(size int) *history {
+	return &history{entries: make([]HistoryEntry, size)}
+}
+
+// add records the entry, overwriting the oldest one once full.
+func (h *history) add(e HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// query returns the entries matching match, newest first,
+// up to limit of them when it's positive.
+func (h *history) query(match func(HistoryEntry) bool, limit int) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := h.next
+	if h.full {
+		n = len(h.entries)
+	}
+
+	found := []HistoryEntry{}
+	for i := 1; i <= n && (limit <= 0 || len(found) < limit); i++ {
+		e := h.entries[(h.next-i+len(h.entries))%len(h.entries)]
+		if match(e) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// recordHistory keeps the broadcast in the history.
+func (b *Broadcaster) recordHistory(start time.Time, req Request, res Results) {
+	e := HistoryEntry{
+		ID:     req.ID,
+		Time:   start,
+		Client: req.Client,
+		Method: req.Method,
+		Path:   req.Path,
+		Group:  req.Group,
+		Status: res.Status,
+		DryRun: req.DryRun || b.cfg.DryRun,
+		Caches: make(map[string]HistoryOutcome, len(res.Caches)),
+	}
+	for name, r := range res.Caches {
+		e.Caches[name] = HistoryOutcome{Status: r.Status, Reason: r.Reason, Error: r.Error}
+	}
+
+	b.history.add(e)
+}
+
+// clientIP returns the address of the client of the request.
+func (b *Broadcaster) clientIP(r *http.Request) string {
+	if b.cfg.ClientIP != nil {
+		if ip := b.cfg.ClientIP(r); ip != nil {
+			return ip.String()
+		}
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// historyFilter returns the filter of the history query: path is a
+// path, with or without its query, or a prefix followed by a *, since
+// a duration or an RFC 3339 time, and group and id match exactly.
+func historyFilter(q map[string][]string, now time.Time) (func(HistoryEntry) bool, error) {
+	get := func(name string) string {
+		if v := q[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	var after time.Time
+	if v := get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			after = now.Add(-d)
+		} else if after, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("Invalid since %q, expected a duration or an RFC 3339 time.", v)
+		}
+	}
+
+	path, group, id := get("path"), get("group"), get("id")
+	prefix := strings.HasSuffix(path, "*")
+	path = strings.TrimSuffix(path, "*")
+
+	return func(e HistoryEntry) bool {
+		switch {
+		case e.Time.Before(after):
+			return false
+		case group != "" && e.Group != group:
+			return false
+		case id != "" && e.ID != id:
+			return false
+		case path == "":
+			return true
+		case prefix:
+			return strings.HasPrefix(e.Path, path)
+		default:
+			p, _, _ := strings.Cut(e.Path, "?")
+			return e.Path == path || p == path
+		}
+	}, nil
+}
+
+// AdminHistoryHandler serves GET /admin/history, the last broadcasts,
+// newest first, filtered by the path, since, group and id query
+// parameters, up to limit of them.
+func (b *Broadcaster) AdminHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if b.history == nil {
+		http.Error(w, "History not enabled.", http.StatusNotFound)
+		return
+	}
+
+	match, err := historyFilter(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit %q.", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	out, _ := json.MarshalIndent(b.history.query(match, limit), "", "  ")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
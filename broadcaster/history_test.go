@@ -0,0 +1,110 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestHistoryIsBounded(t *testing.T) {
+	h := newHistory(3)
+	for i := 0; i < 5; i++ {
+		h.add(HistoryEntry{ID: strconv.Itoa(i)})
+	}
+
+	all := func(HistoryEntry) bool { return true }
+	entries := h.query(all, 0)
+	if len(entries) != 3 || entries[0].ID != "4" || entries[2].ID != "2" {
+		t.Errorf("expected the last 3 entries, newest first, got %+v", entries)
+	}
+	if entries := h.query(all, 1); len(entries) != 1 || entries[0].ID != "4" {
+		t.Errorf("expected the newest entry only, got %+v", entries)
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	now := time.Now()
+	old := HistoryEntry{Time: now.Add(-2 * time.Hour), Path: "/pricing", Group: "edge"}
+	recent := HistoryEntry{Time: now.Add(-time.Minute), Path: "/pricing?page=2", Group: "edge", ID: "abc"}
+	other := HistoryEntry{Time: now, Path: "/pricing/eu", Group: "shield"}
+
+	for query, want := range map[string][]bool{
+		"":               {true, true, true},
+		"path=/pricing":  {true, true, false},
+		"path=/pricing*": {true, true, true},
+		"since=1h":       {false, true, true},
+		"since=" + now.Add(-time.Hour).Format(time.RFC3339) + "&group=edge": {false, true, false},
+		"id=abc": {false, true, false},
+	} {
+		r := httptest.NewRequest("GET", "/admin/history?"+query, nil)
+		match, err := historyFilter(r.URL.Query(), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, e := range []HistoryEntry{old, recent, other} {
+			if match(e) != want[i] {
+				t.Errorf("expected %q to match %s: %v", query, e.Path, want[i])
+			}
+		}
+	}
+
+	if _, err := historyFilter(map[string][]string{"since": {"yesterday"}}, now); err == nil {
+		t.Error("expected an invalid since to be rejected")
+	}
+}
+
+func TestAdminHistoryHandler(t *testing.T) {
+	b := newTestBroadcaster(t, Config{HistorySize: 10})
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	r := httptest.NewRequest("PURGE", "/pricing", nil)
+	r.Header.Set("X-Group", "edge")
+	r.Header.Set("X-Request-Id", "req-1")
+	r.RemoteAddr = "10.0.0.7:51234"
+	b.reqHandler(httptest.NewRecorder(), r)
+
+	if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/other", Group: "edge"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	b.AdminHistoryHandler(w, httptest.NewRequest("GET", "/admin/history?path=/pricing&since=1h", nil))
+
+	var entries []HistoryEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the purge of /pricing only, got %s", w.Body.String())
+	}
+	e := entries[0]
+	if e.ID != "req-1" || e.Client != "10.0.0.7" || e.Method != "PURGE" || e.Group != "edge" || e.Status != http.StatusOK {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Caches["c1"].Status != http.StatusOK {
+		t.Errorf("expected the outcome of c1, got %+v", e.Caches)
+	}
+
+	w = httptest.NewRecorder()
+	b.AdminHistoryHandler(w, httptest.NewRequest("GET", "/admin/history?limit=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid limit to be rejected, got %d", w.Code)
+	}
+}
+
+func TestAdminHistoryHandlerDisabled(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	w := httptest.NewRecorder()
+	b.AdminHistoryHandler(w, httptest.NewRequest("GET", "/admin/history", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a history, got %d", w.Code)
+	}
+}
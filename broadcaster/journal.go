@@ -0,0 +1,474 @@
+package broadcaster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// Policies of the journal syncing its writes to disk: every
+// write, every journalSyncInterval, or when the system sees fit.
+const (
+	JournalSyncAlways   = "always"
+	JournalSyncPeriodic = "periodic"
+	JournalSyncNever    = "never"
+)
+
+// Modes of the recovery of the broadcasts left incomplete in the
+// journal by a previous run: reported until dismissed or replayed
+// through AdminRecoveryHandler, or replayed on startup.
+const (
+	RecoverReport = "report"
+	RecoverReplay = "replay"
+)
+
+// journalSyncInterval is how often a journal
+// synced periodically is synced.
+const journalSyncInterval = time.Second
+
+// journalEntry is a broadcast in the journal.
+type journalEntry struct {
+	ID      string      `json:"id"`
+	Time    time.Time   `json:"time"`
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Group   string      `json:"group,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+	Caches  []string    `json:"caches"`
+
+	// Done lists the caches which answered.
+	Done []string `json:"done,omitempty"`
+}
+
+// pending returns the caches of the broadcast which didn't answer.
+func (e journalEntry) pending() []string {
+	done := make(map[string]bool, len(e.Done))
+	for _, name := range e.Done {
+		done[name] = true
+	}
+
+	var pending []string
+	for _, name := range e.Caches {
+		if !done[name] {
+			pending = append(pending, name)
+		}
+	}
+	return pending
+}
+
+// journalRecord is a line of the journal: a broadcast begun, a cache
+// of a broadcast which answered, or a broadcast ended.
+type journalRecord struct {
+	Begin *journalEntry `json:"begin,omitempty"`
+	Done  string        `json:"done,omitempty"`
+	Cache string        `json:"cache,omitempty"`
+	End   string        `json:"end,omitempty"`
+}
+
+// journal is the write-ahead log of the broadcasts, telling after a
+// crash which broadcasts were cut short and which of their caches
+// were reached.
+type journal struct {
+	path     string
+	syncMode string
+	maxSize  int64
+
+	mu    sync.Mutex
+	file  *os.File
+	size  int64
+	dirty bool
+
+	// open holds the broadcasts in flight, recovered those
+	// left incomplete by a previous run.
+	open      map[string]*journalEntry
+	recovered map[string]*journalEntry
+
+	syncStop chan struct{}
+	syncDone chan struct{}
+}
+
+// openJournal loads the broadcasts left incomplete in the journal,
+// creating it if need be, then compacts it.
+func openJournal(path, syncMode string, maxSize int64) (*journal, error) {
+	j := &journal{
+		path:      path,
+		syncMode:  syncMode,
+		maxSize:   maxSize,
+		open:      make(map[string]*journalEntry),
+		recovered: make(map[string]*journalEntry),
+	}
+
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		err = j.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid journal %s: %s", path, err)
+		}
+	}
+
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+
+	if syncMode == JournalSyncPeriodic {
+		j.syncStop, j.syncDone = make(chan struct{}), make(chan struct{})
+		go j.syncLoop()
+	}
+	return j, nil
+}
+
+func (j *journal) load(f *os.File) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A record cut short by a crash can only be the last one.
+			continue
+		}
+		switch {
+		case rec.Begin != nil:
+			j.recovered[rec.Begin.ID] = rec.Begin
+		case rec.Done != "":
+			if e, found := j.recovered[rec.Done]; found {
+				e.Done = append(e.Done, rec.Cache)
+			}
+		case rec.End != "":
+			delete(j.recovered, rec.End)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with the incomplete broadcasts only,
+// replacing it atomically.
+func (j *journal) compact() error {
+	tmp, err := os.OpenFile(j.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	w := bufio.NewWriter(tmp)
+	for _, entries := range []map[string]*journalEntry{j.recovered, j.open} {
+		for _, e := range entries {
+			line, _ := json.Marshal(journalRecord{Begin: e})
+			n, _ := w.Write(append(line, '\n'))
+			size += int64(n)
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(j.path+".tmp", j.path)
+	}
+	if err != nil {
+		os.Remove(j.path + ".tmp")
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	j.size, j.dirty = size, false
+	return err
+}
+
+// write appends a record to the journal, syncing it with
+// JournalSyncAlways, and compacts the journal once larger than
+// its maximum size. The caller must hold mu.
+func (j *journal) write(rec journalRecord) error {
+	line, _ := json.Marshal(rec)
+	n, err := j.file.Write(append(line, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if j.syncMode == JournalSyncAlways {
+		err = j.file.Sync()
+	} else {
+		j.dirty = true
+	}
+
+	if err == nil && j.maxSize > 0 && j.size > j.maxSize {
+		err = j.compact()
+	}
+	return err
+}
+
+// syncLoop syncs the journal every journalSyncInterval
+// until syncStop is closed.
+func (j *journal) syncLoop() {
+	defer close(j.syncDone)
+
+	ticker := time.NewTicker(journalSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.syncStop:
+			return
+		case <-ticker.C:
+			j.mu.Lock()
+			if j.dirty {
+				j.file.Sync()
+				j.dirty = false
+			}
+			j.mu.Unlock()
+		}
+	}
+}
+
+// begin records a broadcast about to be sent to the caches.
+func (j *journal) begin(e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.open[e.ID] = &e
+	return j.write(journalRecord{Begin: &e})
+}
+
+// done records the answer of the cache to the broadcast.
+func (j *journal) done(id, cacheName string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e, found := j.open[id]
+	if !found {
+		e = j.recovered[id]
+	}
+	if e != nil {
+		e.Done = append(e.Done, cacheName)
+	}
+	return j.write(journalRecord{Done: id, Cache: cacheName})
+}
+
+// end records the end of the broadcast, whatever its outcome.
+func (j *journal) end(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.open, id)
+	delete(j.recovered, id)
+	return j.write(journalRecord{End: id})
+}
+
+// incomplete returns the broadcasts recovered from a previous run
+// which are still incomplete, oldest first.
+func (j *journal) incomplete() []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]journalEntry, 0, len(j.recovered))
+	for _, e := range j.recovered {
+		c := *e
+		c.Done = append([]string(nil), e.Done...)
+		entries = append(entries, c)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Time.Before(entries[b].Time) })
+	return entries
+}
+
+func (j *journal) close() {
+	if j.syncStop != nil {
+		close(j.syncStop)
+		<-j.syncDone
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file != nil {
+		j.file.Sync()
+		j.file.Close()
+	}
+}
+
+// journalBegin records the broadcast in the journal.
+func (b *Broadcaster) journalBegin(req Request, headers http.Header, caches []dao.Cache) {
+	e := journalEntry{
+		ID:      req.ID,
+		Time:    time.Now(),
+		Method:  req.Method,
+		Path:    req.Path,
+		Group:   req.Group,
+		Headers: headers,
+		Body:    req.Body,
+	}
+	for _, c := range caches {
+		e.Caches = append(e.Caches, c.Name)
+	}
+
+	if err := b.journal.begin(e); err != nil {
+		b.log("Failed to journal ", req.ID, " ", req.Method, " ", req.Path, ": ", err.Error(), "\n")
+	}
+}
+
+// journalDone records the answer of the cache in the journal.
+func (b *Broadcaster) journalDone(id, cacheName string) {
+	if err := b.journal.done(id, cacheName); err != nil {
+		b.log("Failed to journal ", id, " answered by ", cacheName, ": ", err.Error(), "\n")
+	}
+}
+
+// journalEnd records the end of the broadcast in the journal.
+func (b *Broadcaster) journalEnd(id string) {
+	if err := b.journal.end(id); err != nil {
+		b.log("Failed to journal the end of ", id, ": ", err.Error(), "\n")
+	}
+}
+
+// recoverBroadcast sends the broadcast recovered from the journal to
+// its caches which didn't answer, as configured now, through their job
+// queues, then ends it. Caches which aren't configured any more are
+// reported as unknown_cache.
+func (b *Broadcaster) recoverBroadcast(ctx context.Context, e journalEntry) map[string]Result {
+	configured := make(map[string]dao.Cache)
+	b.mu.Lock()
+	for _, c := range b.allCaches {
+		configured[c.Name] = c
+	}
+	b.mu.Unlock()
+
+	results := make(map[string]Result)
+	var caches []dao.Cache
+	for _, name := range e.pending() {
+		cache, found := configured[name]
+		if !found {
+			results[name] = Result{Reason: reasonUnknownCache, Error: fmt.Sprintf("Cache %s not configured.", name)}
+			continue
+		}
+		caches = append(caches, cache)
+	}
+
+	// The caches may map the method to a wiping one since.
+	if err := b.checkProtected(e.Method, e.Group, e.Headers, "journal", caches, e.Path); err != nil {
+		for _, cache := range caches {
+			results[cache.Name] = Result{Reason: reasonProtected, Error: err.Error()}
+		}
+		b.journalEnd(e.ID)
+		return results
+	}
+
+	var jobs []*Job
+	for _, cache := range caches {
+		cache.Method, cache.Item, cache.Headers, cache.Body = cache.MappedMethod(e.Method), e.Path, e.Headers, e.Body
+		if cache.Headers == nil {
+			cache.Headers = http.Header{}
+		}
+		jobs = append(jobs, newJob(ctx, cache))
+	}
+
+	if len(jobs) > 0 && !b.enqueueJobs(jobs) {
+		for _, job := range jobs {
+			results[job.Cache.Name] = Result{Status: http.StatusServiceUnavailable, Reason: reasonQueueSaturated, Error: ErrQueueSaturated.Error()}
+		}
+		// Left in the journal, to be recovered later on.
+		return results
+	}
+
+	for _, job := range jobs {
+		result := awaitResult(ctx, job)
+		results[job.Cache.Name] = result
+		b.journalDone(e.ID, job.Cache.Name)
+		b.log("Recovered ", e.ID, " ", e.Method, " ", targetURL(job.Cache.Address, job.Cache), " ", strconv.Itoa(result.Status), "\n")
+	}
+	b.journalEnd(e.ID)
+
+	return results
+}
+
+// recoverJournal sends the broadcasts recovered from the journal, or
+// the one of the id only, to their caches which didn't answer,
+// returning the results of every broadcast by id.
+func (b *Broadcaster) recoverJournal(ctx context.Context, id string) map[string]map[string]Result {
+	recovered := make(map[string]map[string]Result)
+	for _, e := range b.journal.incomplete() {
+		if id == "" || e.ID == id {
+			recovered[e.ID] = b.recoverBroadcast(ctx, e)
+		}
+	}
+	return recovered
+}
+
+// recoveredView is a broadcast recovered from the journal as listed
+// by AdminRecoveryHandler, without its headers and body.
+type recoveredView struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Group   string    `json:"group,omitempty"`
+	Done    []string  `json:"done"`
+	Pending []string  `json:"pending"`
+}
+
+// AdminRecoveryHandler serves /admin/recovery, the broadcasts left
+// incomplete in the journal by a previous run: GET lists them, POST
+// sends them to the caches which didn't answer and DELETE dismisses
+// them, all of them or the one of the id query parameter.
+func (b *Broadcaster) AdminRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if b.journal == nil {
+		http.Error(w, "Journal not enabled.", http.StatusNotFound)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+
+	var out []byte
+	switch r.Method {
+	case http.MethodGet:
+		views := []recoveredView{}
+		for _, e := range b.journal.incomplete() {
+			if id == "" || e.ID == id {
+				views = append(views, recoveredView{ID: e.ID, Time: e.Time, Method: e.Method, Path: e.Path, Group: e.Group, Done: e.Done, Pending: e.pending()})
+			}
+		}
+		out, _ = json.MarshalIndent(views, "", "  ")
+
+	case http.MethodPost:
+		b.log("Admin recovering broadcasts ", id, "\n")
+		out, _ = json.MarshalIndent(b.recoverJournal(r.Context(), id), "", "  ")
+
+	case http.MethodDelete:
+		dismissed := 0
+		for _, e := range b.journal.incomplete() {
+			if id == "" || e.ID == id {
+				b.journalEnd(e.ID)
+				dismissed++
+			}
+		}
+		b.log("Admin dismissed ", strconv.Itoa(dismissed), " recovered broadcasts ", id, "\n")
+		out, _ = json.MarshalIndent(map[string]int{"dismissed": dismissed}, "", "  ")
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
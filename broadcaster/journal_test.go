@@ -0,0 +1,235 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// writeTestJournal writes a journal of a broadcast to c1 and c2 which
+// c1 answered before a crash, and of another which completed.
+func writeTestJournal(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	content := `{"begin":{"id":"a1","time":"2026-10-15T10:00:00Z","method":"PURGE","path":"/a","caches":["c1","c2"]}}
+{"begin":{"id":"b2","time":"2026-10-15T10:00:01Z","method":"PURGE","path":"/b","caches":["c1"]}}
+{"done":"a1","cache":"c1"}
+{"done":"b2","cache":"c1"}
+{"end":"b2"}
+{"begin":{"id":"c3","ti`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJournalRecordsBroadcasts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	b := newTestBroadcaster(t, Config{JournalFile: path, JournalSync: JournalSyncAlways})
+
+	release := make(chan struct{})
+	fast := newTestCache(t, b, "fast", func(w http.ResponseWriter, r *http.Request) {})
+	hanging := newTestCache(t, b, "hanging", func(w http.ResponseWriter, r *http.Request) { <-release })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{fast, hanging}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge", ID: "a1"})
+	}()
+
+	// A crash now leaves the broadcast incomplete, reached by fast only.
+	var incomplete []journalEntry
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		j, err := openJournalCopy(t, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if incomplete = j.incomplete(); len(incomplete) == 1 && len(incomplete[0].Done) == 1 {
+			break
+		}
+	}
+	if len(incomplete) != 1 || !reflect.DeepEqual(incomplete[0].pending(), []string{"hanging"}) {
+		t.Fatalf("expected the broadcast to be pending on hanging, got %+v", incomplete)
+	}
+
+	close(release)
+	<-done
+
+	j, err := openJournalCopy(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incomplete := j.incomplete(); len(incomplete) != 0 {
+		t.Errorf("expected the broadcast to be complete, got %+v", incomplete)
+	}
+}
+
+// openJournalCopy opens a copy of the journal, as a restart would.
+func openJournalCopy(t *testing.T, path string) (*journal, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cp := filepath.Join(t.TempDir(), "journal.jsonl")
+	if err := os.WriteFile(cp, content, 0600); err != nil {
+		return nil, err
+	}
+
+	j, err := openJournal(cp, JournalSyncNever, 0)
+	if err == nil {
+		j.close()
+	}
+	return j, err
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	b := newTestBroadcaster(t, Config{JournalFile: path, JournalMaxSize: 1024})
+
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	for i := 0; i < 50; i++ {
+		if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 1024 {
+		t.Errorf("expected the journal to be compacted, got %d bytes", info.Size())
+	}
+}
+
+func TestAdminRecoveryHandler(t *testing.T) {
+	b := newTestBroadcaster(t, Config{JournalFile: writeTestJournal(t)})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- "c1 " + r.URL.Path })
+	c2 := newTestCache(t, b, "c2", func(w http.ResponseWriter, r *http.Request) { received <- "c2 " + r.URL.Path })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1, c2}})
+
+	w := httptest.NewRecorder()
+	b.AdminRecoveryHandler(w, httptest.NewRequest("GET", "/admin/recovery", nil))
+
+	var views []recoveredView
+	if err := json.Unmarshal(w.Body.Bytes(), &views); err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 1 || views[0].ID != "a1" || !reflect.DeepEqual(views[0].Pending, []string{"c2"}) {
+		t.Fatalf("expected a1 to be pending on c2, got %+v", views)
+	}
+
+	w = httptest.NewRecorder()
+	b.AdminRecoveryHandler(w, httptest.NewRequest("POST", "/admin/recovery?id=a1", nil))
+
+	var recovered map[string]map[string]Result
+	if err := json.Unmarshal(w.Body.Bytes(), &recovered); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered["a1"]) != 1 || recovered["a1"]["c2"].Status != http.StatusOK {
+		t.Errorf("expected a1 to be sent to c2, got %+v", recovered)
+	}
+	if got := <-received; got != "c2 /a" {
+		t.Errorf("expected /a to be sent to c2, got %s", got)
+	}
+	if incomplete := b.journal.incomplete(); len(incomplete) != 0 {
+		t.Errorf("expected nothing left to recover, got %+v", incomplete)
+	}
+}
+
+func TestAdminRecoveryHandlerDismisses(t *testing.T) {
+	path := writeTestJournal(t)
+	b, err := New(Config{JournalFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	b.AdminRecoveryHandler(w, httptest.NewRequest("DELETE", "/admin/recovery", nil))
+	if w.Body.String() != "{\n  \"dismissed\": 1\n}" {
+		t.Errorf("expected a1 to be dismissed, got %s", w.Body.String())
+	}
+	b.Close()
+
+	b = newTestBroadcaster(t, Config{JournalFile: path})
+	if incomplete := b.journal.incomplete(); len(incomplete) != 0 {
+		t.Errorf("expected the dismissal to survive restarts, got %+v", incomplete)
+	}
+}
+
+func TestJournalReplaysOnStartup(t *testing.T) {
+	received := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Method + " " + r.URL.Path
+	}))
+	defer backend.Close()
+
+	newTestBroadcaster(t, Config{
+		JournalFile: writeTestJournal(t),
+		RecoverMode: RecoverReplay,
+		Groups: []dao.Group{{Name: "edge", Caches: []dao.Cache{
+			{Name: "c1", Address: backend.URL},
+			{Name: "c2", Address: backend.URL},
+		}}},
+	})
+
+	select {
+	case got := <-received:
+		if got != "PURGE /a" {
+			t.Errorf("expected /a to be replayed, got %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the incomplete broadcast to be replayed")
+	}
+	select {
+	case got := <-received:
+		t.Errorf("expected c1 not to be sent /a again, got %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestJournalConfigIsValidated(t *testing.T) {
+	if _, err := New(Config{JournalSync: "sometimes"}); err == nil {
+		t.Error("expected an invalid sync policy to be an error")
+	}
+	if _, err := New(Config{RecoverMode: "ignore"}); err == nil {
+		t.Error("expected an invalid recover mode to be an error")
+	}
+}
+
+func TestRecoveryChecksProtectedPaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	content := `{"begin":{"id":"a1","time":"2026-10-15T10:00:00Z","method":"GET","path":"/","group":"legacy","caches":["c1"]}}
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBroadcaster(t, Config{JournalFile: path, ProtectedPaths: []string{"/"}})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.Method + " " + r.URL.Path })
+	c1.MethodMap = map[string]string{"GET": "PURGE"}
+	setTestGroups(b, dao.Group{Name: "legacy", Caches: []dao.Cache{c1}})
+
+	recovered := b.recoverJournal(context.Background(), "a1")
+	if got := recovered["a1"]["c1"]; got.Reason != reasonProtected {
+		t.Errorf("expected the mapped purge of / to be blocked, got %+v", got)
+	}
+	select {
+	case got := <-received:
+		t.Errorf("expected nothing to be sent, got %s", got)
+	default:
+	}
+}
@@ -0,0 +1,100 @@
+package broadcaster
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+var (
+	keepaliveProbes        = metrics.NewCounter("broadcaster_keepalive_probes_total", "Keep-alive probes sent to a cache.", "cache")
+	keepaliveProbeFailures = metrics.NewCounter("broadcaster_keepalive_probe_failures_total", "Keep-alive probes a cache didn't answer.", "cache")
+)
+
+// keepaliveLoop probes the caches every Config.KeepaliveProbe
+// until stop is closed.
+func (b *Broadcaster) keepaliveLoop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(b.cfg.KeepaliveProbe)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			b.probeCaches(ctx)
+		}
+	}
+}
+
+// probeCaches sends a HEAD request to the address of every enabled
+// cache at once, keeping its pooled connections from going stale,
+// e.g. behind a firewall dropping idle connections, so that the next
+// broadcast doesn't spend a retry on a dead one.
+func (b *Broadcaster) probeCaches(ctx context.Context) {
+	type probe struct {
+		cache  dao.Cache
+		client *http.Client
+	}
+
+	var probes []probe
+	b.mu.Lock()
+	for _, cache := range b.allCaches {
+		if client := b.clients[cache.Name]; client != nil && !b.disabledCaches[cache.Name] {
+			probes = append(probes, probe{cache, client})
+		}
+	}
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, b.cfg.KeepaliveProbe)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		wg.Add(1)
+		go func(p probe) {
+			defer wg.Done()
+
+			keepaliveProbes.Inc(p.cache.Name)
+			if err := b.probe(ctx, p.client, p.cache); err != nil && ctx.Err() == nil {
+				keepaliveProbeFailures.Inc(p.cache.Name)
+				b.log("Keep-alive probe of ", p.cache.Name, " failed: ", err.Error(), "\n")
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+// probe sends a HEAD request to the cache's address, draining the
+// response so that the connection goes back to the pool. Any answer
+// will do.
+func (b *Broadcaster) probe(ctx context.Context, client *http.Client, cache dao.Cache) error {
+	ctx, address := dialAddress(ctx, cache.Address)
+	r, err := http.NewRequestWithContext(ctx, http.MethodHead, address+"/", nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("User-Agent", b.cfg.UserAgent)
+
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
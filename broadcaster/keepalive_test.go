@@ -0,0 +1,35 @@
+package broadcaster
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestKeepaliveProbes(t *testing.T) {
+	b := newTestBroadcaster(t, Config{KeepaliveProbe: 20 * time.Millisecond})
+
+	var probes, disabledProbes int32
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && r.URL.Path == "/" {
+			atomic.AddInt32(&probes, 1)
+		}
+	})
+	c2 := newTestCache(t, b, "c2", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&disabledProbes, 1)
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1, c2}})
+	b.setDisabled("c2", "", true)
+
+	time.Sleep(110 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&probes); n < 3 || n > 6 {
+		t.Errorf("expected a probe every 20ms, got %d in 110ms", n)
+	}
+	if n := atomic.LoadInt32(&disabledProbes); n != 0 {
+		t.Errorf("expected the disabled cache not to be probed, got %d probes", n)
+	}
+}
@@ -0,0 +1,49 @@
+package broadcaster
+
+import (
+	"net/http"
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// surrogateKeyHeaders carry the surrogate keys of a purge by key,
+// the first one present in the incoming request being used.
+var surrogateKeyHeaders = []string{"Xkey", "Surrogate-Key"}
+
+func isSurrogateKeyHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, h := range surrogateKeyHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SurrogateKeys returns the header carrying the surrogate keys of
+// the request along with the keys, verbatim. keys is empty for
+// requests which don't purge by key.
+func SurrogateKeys(h http.Header) (header, keys string) {
+	for _, name := range surrogateKeyHeaders {
+		if values := h.Values(name); len(values) > 0 {
+			return name, strings.Join(values, " ")
+		}
+	}
+	return "", ""
+}
+
+// setSurrogateKeys copies the surrogate keys of the broadcast to the
+// cache request, under the cache's key_header if it renames them.
+// Keys are sent regardless of the header allowlist.
+func setSurrogateKeys(r *http.Request, cache dao.Cache) {
+	header, keys := SurrogateKeys(cache.Headers)
+	if keys == "" {
+		return
+	}
+
+	if cache.KeyHeader != "" {
+		header = cache.KeyHeader
+	}
+	r.Header.Set(header, keys)
+}
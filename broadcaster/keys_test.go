@@ -0,0 +1,35 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestSurrogateKeysAreRenamedPerGroup(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ForwardHeaders: []string{"Cookie"}})
+
+	varnishSeen := make(chan http.Header, 1)
+	fastlySeen := make(chan http.Header, 1)
+
+	varnish := newTestCache(t, b, "varnish", func(w http.ResponseWriter, r *http.Request) { varnishSeen <- r.Header })
+	fastly := newTestCache(t, b, "fastly", func(w http.ResponseWriter, r *http.Request) { fastlySeen <- r.Header })
+	fastly.KeyHeader = "Surrogate-Key"
+
+	setTestGroups(b, dao.Group{Name: "all", Caches: []dao.Cache{varnish, fastly}})
+
+	r := httptest.NewRequest("PURGE", "/", nil)
+	r.Header.Set("xkey", "product-1  category-7")
+	b.reqHandler(httptest.NewRecorder(), r)
+
+	if h := <-varnishSeen; h.Get("Xkey") != "product-1  category-7" {
+		t.Errorf("expected the keys to reach the cache verbatim, got %v", h)
+	}
+
+	h := <-fastlySeen
+	if h.Get("Surrogate-Key") != "product-1  category-7" || h.Get("Xkey") != "" {
+		t.Errorf("expected the keys to be sent as Surrogate-Key, got %v", h)
+	}
+}
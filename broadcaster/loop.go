@@ -0,0 +1,68 @@
+package broadcaster
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+// hopHeader lists the broadcasters a request went through, comma
+// separated, the last one having sent it.
+const hopHeader = "X-Broadcaster"
+
+var loopsDetected = metrics.NewCounter("broadcaster_loops_detected_total", "Requests rejected as they already went through the broadcaster, or through too many.", "")
+
+// hops returns the broadcasters listed by the hop headers.
+func hops(h http.Header) []string {
+	var list []string
+	for _, v := range h.Values(hopHeader) {
+		list = append(list, dao.SplitList(v)...)
+	}
+	return list
+}
+
+// checkLoop returns an error for requests which already went through
+// this broadcaster, or through more than Config.MaxHops broadcasters,
+// e.g. two broadcasters configured as caches of each other.
+func (b *Broadcaster) checkLoop(h http.Header) error {
+	list := hops(h)
+	for _, id := range list {
+		if b.cfg.InstanceID != "" && id == b.cfg.InstanceID {
+			return fmt.Errorf("Loop detected, the request already went through %s.", id)
+		}
+	}
+	if b.cfg.MaxHops > 0 && len(list) >= b.cfg.MaxHops {
+		return fmt.Errorf("Loop detected, the request went through %d broadcasters.", len(list))
+	}
+	return nil
+}
+
+// rejectLoop answers 508 to requests caught in a loop,
+// returning false for the others.
+func (b *Broadcaster) rejectLoop(w http.ResponseWriter, r *http.Request) bool {
+	err := b.checkLoop(r.Header)
+	if err == nil {
+		return false
+	}
+
+	loopsDetected.Inc("")
+	b.log("Rejecting ", r.Method, " ", r.URL.RequestURI(), " through ", strconv.Itoa(len(hops(r.Header))), " broadcasters: ", strings.Join(hops(r.Header), ", "), "\n")
+	http.Error(w, err.Error(), http.StatusLoopDetected)
+	return true
+}
+
+// setHops sets the hop header of the request to the cache, the
+// broadcasters the broadcast went through followed by this one.
+func (b *Broadcaster) setHops(r *http.Request, cache dao.Cache) {
+	list := hops(cache.Headers)
+	if b.cfg.InstanceID != "" {
+		list = append(list, b.cfg.InstanceID)
+	}
+	if len(list) > 0 {
+		r.Header.Set(hopHeader, strings.Join(list, ", "))
+	}
+}
@@ -0,0 +1,60 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestHopsAreSentToCaches(t *testing.T) {
+	b := newTestBroadcaster(t, Config{InstanceID: "b1:8088", ForwardHeaders: []string{"X-Other"}})
+
+	sent := make(chan string, 1)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { sent <- r.Header.Get(hopHeader) })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set(hopHeader, "b0:8088")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got := <-sent; got != "b0:8088, b1:8088" {
+		t.Errorf("expected the broadcaster to be appended to the hops, got %q", got)
+	}
+}
+
+func TestLoopsAreRejected(t *testing.T) {
+	b := newTestBroadcaster(t, Config{InstanceID: "b1:8088", MaxHops: 3})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{{Name: "c1"}}})
+
+	for hops, want := range map[string]int{
+		"b0:8088, b1:8088": http.StatusLoopDetected,
+		"a, b, c":          http.StatusLoopDetected,
+	} {
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		r.Header.Set(hopHeader, hops)
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+		if w.Code != want {
+			t.Errorf("%s: expected %d, got %d", hops, want, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", nil)
+	r.Header.Add(hopHeader, "b0:8088")
+	r.Header.Add(hopHeader, "b1:8088")
+	w := httptest.NewRecorder()
+	b.batchHandler(w, r)
+	if w.Code != http.StatusLoopDetected {
+		t.Errorf("expected batches caught in a loop to be rejected, got %d", w.Code)
+	}
+
+	if err := b.checkLoop(http.Header{hopHeader: {"a, b"}}); err != nil {
+		t.Errorf("expected 2 hops to be allowed, got %v", err)
+	}
+}
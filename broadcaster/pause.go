@@ -0,0 +1,174 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Modes of a paused broadcaster, deciding the fate
+// of the broadcasts it receives.
+const (
+	PauseReject = "reject"
+	PauseQueue  = "queue"
+)
+
+// pauseRetryAfter is the Retry-After, in seconds, of the
+// broadcasts rejected while paused.
+const pauseRetryAfter = 30
+
+// pauseState holds the broadcasts received while paused in
+// PauseQueue mode, until resumed.
+type pauseState struct {
+	mu       sync.Mutex
+	paused   bool
+	mode     string
+	resuming bool
+	held     []Request
+
+	// resumeMu serializes the resumes, draining
+	// the held broadcasts in order.
+	resumeMu sync.Mutex
+}
+
+// Pause stops the broadcasts, Broadcast failing with ErrPaused. Handler
+// rejects them with PauseReject or holds them until resumed, up to
+// Config.PauseQueueSize of them, with PauseQueue.
+func (b *Broadcaster) Pause(mode string) error {
+	if mode != PauseReject && mode != PauseQueue {
+		return fmt.Errorf("Invalid pause mode %q, expected %s or %s.", mode, PauseReject, PauseQueue)
+	}
+
+	b.pause.mu.Lock()
+	defer b.pause.mu.Unlock()
+
+	b.pause.paused = true
+	b.pause.mode = mode
+	b.pause.resuming = false
+
+	return nil
+}
+
+// Resume broadcasts the held broadcasts, in the order they were
+// received, before letting the others through again, returning the
+// number drained. Those received meanwhile are held after them.
+func (b *Broadcaster) Resume() int {
+	b.pause.resumeMu.Lock()
+	defer b.pause.resumeMu.Unlock()
+
+	b.pause.mu.Lock()
+	b.pause.resuming = true
+	b.pause.mu.Unlock()
+
+	drained := 0
+	for {
+		b.pause.mu.Lock()
+		if !b.pause.resuming {
+			// Paused again meanwhile.
+			b.pause.mu.Unlock()
+			return drained
+		}
+		if len(b.pause.held) == 0 {
+			b.pause.paused = false
+			b.pause.resuming = false
+			b.pause.mu.Unlock()
+			return drained
+		}
+		req := b.pause.held[0]
+		b.pause.held[0] = Request{}
+		b.pause.held = b.pause.held[1:]
+		b.pause.mu.Unlock()
+
+		b.broadcastHeld(req)
+		drained++
+	}
+}
+
+// paused returns the pause mode, and the number of
+// held broadcasts, empty when not paused.
+func (b *Broadcaster) paused() (mode string, held int) {
+	b.pause.mu.Lock()
+	defer b.pause.mu.Unlock()
+
+	if !b.pause.paused {
+		return "", 0
+	}
+	return b.pause.mode, len(b.pause.held)
+}
+
+// hold holds the broadcast when paused in PauseQueue mode with room
+// left, returning its position. paused is false when broadcasts
+// aren't paused, held false when the broadcast is to be rejected.
+func (b *Broadcaster) hold(req Request) (paused, held bool, position int) {
+	b.pause.mu.Lock()
+	defer b.pause.mu.Unlock()
+
+	if !b.pause.paused {
+		return false, false, 0
+	}
+	if b.pause.mode != PauseQueue || len(b.pause.held) >= b.cfg.PauseQueueSize {
+		return true, false, 0
+	}
+
+	req.OnResult = nil
+	req.resumed = true
+	b.pause.held = append(b.pause.held, req)
+	return true, true, len(b.pause.held)
+}
+
+// broadcastHeld broadcasts a broadcast held while paused, its
+// client being long gone: the outcome is only logged, and posted
+// to the result webhook.
+func (b *Broadcaster) broadcastHeld(req Request) {
+	res, err := b.Broadcast(context.Background(), req)
+	if err != nil {
+		b.log("Held broadcast ", req.ID, " of ", req.Method, " ", req.Path, " failed: ", err.Error(), "\n")
+		return
+	}
+	b.postResult(newWebhookResult(req.ID, req.Method, req.Path, req.Group, res))
+}
+
+// rejectPaused answers a broadcast rejected while paused.
+func rejectPaused(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(pauseRetryAfter))
+	http.Error(w, "Broadcasts paused.", http.StatusServiceUnavailable)
+}
+
+// AdminPauseHandler returns the handler of POST /admin/pause, taking
+// a mode query parameter, reject by default, or of /admin/resume when
+// paused is false, which answers once the held broadcasts are drained.
+func (b *Broadcaster) AdminPauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var state map[string]interface{}
+		if paused {
+			mode := r.URL.Query().Get("mode")
+			if mode == "" {
+				mode = PauseReject
+			}
+			if err := b.Pause(mode); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b.log("Admin paused broadcasts, mode ", mode, "\n")
+			state = map[string]interface{}{"paused": true, "mode": mode}
+		} else {
+			drained := b.Resume()
+			b.log("Admin resumed broadcasts, drained ", strconv.Itoa(drained), "\n")
+			state = map[string]interface{}{"paused": false, "drained": drained}
+		}
+
+		out, _ := json.MarshalIndent(state, "", "  ")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+}
@@ -0,0 +1,155 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestPauseRejectsBroadcasts(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.URL.Path })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	w := httptest.NewRecorder()
+	b.AdminPauseHandler(true)(w, httptest.NewRequest(http.MethodPost, "/admin/pause", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the broadcasts to be paused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	b.reqHandler(w, httptest.NewRequest("PURGE", "/foo", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with a Retry-After, got %d %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	b.batchHandler(w, httptest.NewRequest(http.MethodPost, "/batch", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected batches to be rejected, got %d", w.Code)
+	}
+
+	if drained := b.Resume(); drained != 0 {
+		t.Errorf("expected nothing to be drained, got %d", drained)
+	}
+	w = httptest.NewRecorder()
+	b.reqHandler(w, httptest.NewRequest("PURGE", "/foo", nil))
+	if w.Code != http.StatusOK || <-received != "/foo" {
+		t.Errorf("expected the broadcast to go through once resumed, got %d", w.Code)
+	}
+}
+
+func TestPauseQueuesBroadcastsInOrder(t *testing.T) {
+	b := newTestBroadcaster(t, Config{PauseQueueSize: 2})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.URL.Path })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	if err := b.Pause(PauseQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/a", http.StatusAccepted},
+		{"/b", http.StatusAccepted},
+		{"/c", http.StatusServiceUnavailable},
+	} {
+		w := httptest.NewRecorder()
+		b.reqHandler(w, httptest.NewRequest("PURGE", tc.path, nil))
+		if w.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.want, w.Code)
+		}
+	}
+
+	if s := b.Stats(); s.PauseMode != PauseQueue || s.HeldBroadcasts != 2 {
+		t.Errorf("expected 2 held broadcasts, got %+v", s)
+	}
+	select {
+	case path := <-received:
+		t.Fatalf("expected nothing to be broadcast while paused, got %s", path)
+	default:
+	}
+
+	w := httptest.NewRecorder()
+	b.AdminPauseHandler(false)(w, httptest.NewRequest(http.MethodPost, "/admin/resume", nil))
+	if w.Body.String() != "{\n  \"drained\": 2,\n  \"paused\": false\n}" {
+		t.Errorf("expected 2 broadcasts to be drained, got %s", w.Body.String())
+	}
+	for _, want := range []string{"/a", "/b"} {
+		if got := <-received; got != want {
+			t.Errorf("expected %s to be broadcast, got %s", want, got)
+		}
+	}
+	if s := b.Stats(); s.PauseMode != "" || s.HeldBroadcasts != 0 {
+		t.Errorf("expected the broadcaster to be resumed, got %+v", s)
+	}
+}
+
+func TestPauseRejectsInvalidMode(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	w := httptest.NewRecorder()
+	b.AdminPauseHandler(true)(w, httptest.NewRequest(http.MethodPost, "/admin/pause?mode=drop", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid mode, got %d", w.Code)
+	}
+	if mode, _ := b.paused(); mode != "" {
+		t.Errorf("expected the broadcaster not to be paused, got %s", mode)
+	}
+}
+
+func TestPauseStopsEveryBroadcast(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ProtectedPaths: []string{"/"}})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.URL.Path })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	if err := b.Pause(PauseQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events and gRPC calls go through Broadcast only.
+	if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/foo", Group: "edge", Header: http.Header{}}); !errors.Is(err, ErrPaused) {
+		t.Errorf("expected the broadcast to be paused, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		group, path string
+		want        int
+	}{
+		{"missing", "/foo", http.StatusNotFound},
+		{"edge", "/", http.StatusPreconditionFailed},
+		{"edge", "/foo", http.StatusAccepted},
+	} {
+		r := httptest.NewRequest("PURGE", tc.path, nil)
+		r.Header.Set("X-Group", tc.group)
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s: expected %d, got %d", tc.group, tc.path, tc.want, w.Code)
+		}
+	}
+	if _, held := b.paused(); held != 1 {
+		t.Errorf("expected only the valid broadcast to be held, got %d", held)
+	}
+
+	select {
+	case path := <-received:
+		t.Fatalf("expected nothing to be broadcast while paused, got %s", path)
+	default:
+	}
+	if drained := b.Resume(); drained != 1 || <-received != "/foo" {
+		t.Errorf("expected the held broadcast to be sent on resume, got %d", drained)
+	}
+}
@@ -0,0 +1,86 @@
+package broadcaster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// Names of the phases of a broadcast.
+const (
+	phaseCanary = "canary"
+	phaseFanOut = "fanout"
+)
+
+// phase is a batch of jobs sent at once, once the previous
+// phases are done. A gating phase with a failed cache stops
+// the broadcast, the following phases aren't sent.
+type phase struct {
+	name string
+	jobs []*Job
+	gate bool
+}
+
+// Phase is the time taken by a phase of a broadcast.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// phasesOf splits the jobs of a broadcast to the group into phases.
+// The canary of the group, unless skipped, is sent to on its own
+// first, and the other caches only if it succeeded. Sequential
+// groups then send to their caches one at a time, gating when
+// stopping on failure, other groups to all at once.
+func phasesOf(group dao.Group, jobs []*Job, skipCanary bool) []phase {
+	var phases []phase
+
+	rest := jobs
+	if group.Canary != "" && !skipCanary {
+		rest = nil
+		for _, job := range jobs {
+			if job.Cache.Name == group.Canary {
+				phases = append(phases, phase{name: phaseCanary, jobs: []*Job{job}, gate: true})
+			} else {
+				rest = append(rest, job)
+			}
+		}
+	}
+
+	if len(rest) == 0 {
+		return phases
+	}
+
+	if !group.Sequential && !group.StopOnFailure {
+		return append(phases, phase{name: phaseFanOut, jobs: rest})
+	}
+
+	for _, job := range rest {
+		phases = append(phases, phase{name: phaseFanOut, jobs: []*Job{job}, gate: group.StopOnFailure})
+	}
+	return phases
+}
+
+// addPhase adds the time taken by a phase to the
+// results, summing up phases of the same name.
+func (res *Results) addPhase(name string, took time.Duration) {
+	for i := range res.Phases {
+		if res.Phases[i].Name == name {
+			res.Phases[i].Duration += took
+			return
+		}
+	}
+	res.Phases = append(res.Phases, Phase{Name: name, Duration: took})
+}
+
+// serverTiming formats the phases as a Server-Timing
+// header, in milliseconds.
+func serverTiming(phases []Phase) string {
+	timings := make([]string, len(phases))
+	for i, p := range phases {
+		timings[i] = fmt.Sprintf("%s;dur=%.1f", p.Name, float64(p.Duration)/float64(time.Millisecond))
+	}
+	return strings.Join(timings, ", ")
+}
@@ -0,0 +1,104 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestPhasesOf(t *testing.T) {
+	var jobs []*Job
+	for _, name := range []string{"c1", "c2", "c3"} {
+		jobs = append(jobs, newJob(context.Background(), dao.Cache{Name: name}))
+	}
+
+	describe := func(phases []phase) string {
+		var out []string
+		for _, p := range phases {
+			var names []string
+			for _, job := range p.jobs {
+				names = append(names, job.Cache.Name)
+			}
+			gate := ""
+			if p.gate {
+				gate = "!"
+			}
+			out = append(out, p.name+gate+":"+strings.Join(names, ","))
+		}
+		return strings.Join(out, " ")
+	}
+
+	tests := []struct {
+		group dao.Group
+		skip  bool
+		want  string
+	}{
+		{dao.Group{}, false, "fanout:c1,c2,c3"},
+		{dao.Group{Canary: "c2"}, false, "canary!:c2 fanout:c1,c3"},
+		{dao.Group{Canary: "c2"}, true, "fanout:c1,c2,c3"},
+		{dao.Group{Canary: "gone"}, false, "fanout:c1,c2,c3"},
+		{dao.Group{Sequential: true}, false, "fanout:c1 fanout:c2 fanout:c3"},
+		{dao.Group{StopOnFailure: true, Canary: "c3"}, false, "canary!:c3 fanout!:c1 fanout!:c2"},
+	}
+
+	for _, tt := range tests {
+		if got := describe(phasesOf(tt.group, jobs, tt.skip)); got != tt.want {
+			t.Errorf("%+v, skip %v: expected %s, got %s", tt.group, tt.skip, tt.want, got)
+		}
+	}
+}
+
+func TestCanaryGatesBroadcast(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	var canaryStatus int32 = http.StatusOK
+	var edgeRequests int32
+	canary := newTestCache(t, b, "canary", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&canaryStatus)))
+	})
+	edge := newTestCache(t, b, "edge", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&edgeRequests, 1)
+	})
+	setTestGroups(b, dao.Group{Name: "edges", Canary: "canary", Caches: []dao.Cache{edge, canary}})
+
+	broadcast := func(skip bool) (*httptest.ResponseRecorder, map[string]Result) {
+		r := httptest.NewRequest("BAN", "/foo", nil)
+		r.Header.Set("X-Group", "edges")
+		if skip {
+			r.Header.Set("X-Broadcast-Skip-Canary", "true")
+		}
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+
+		var body map[string]Result
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	w, _ := broadcast(false)
+	if w.Code != http.StatusOK || atomic.LoadInt32(&edgeRequests) != 1 {
+		t.Errorf("expected the broadcast to go on past the canary, got %d", w.Code)
+	}
+	if timing := w.Header().Get("Server-Timing"); !strings.HasPrefix(timing, "canary;dur=") || !strings.Contains(timing, ", fanout;dur=") {
+		t.Errorf("expected the phases to be timed, got %q", timing)
+	}
+
+	atomic.StoreInt32(&canaryStatus, http.StatusForbidden)
+	w, body := broadcast(false)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the status of the canary, got %d", w.Code)
+	}
+	if body["edge"].Reason != reasonNotAttempted || atomic.LoadInt32(&edgeRequests) != 1 {
+		t.Errorf("expected the edge not to be attempted, got %+v", body["edge"])
+	}
+
+	if w, _ = broadcast(true); w.Code != http.StatusOK || atomic.LoadInt32(&edgeRequests) != 2 {
+		t.Errorf("expected skipping the canary to broadcast to all caches, got %d", w.Code)
+	}
+}
@@ -0,0 +1,143 @@
+package broadcaster
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// dispatcher bounds the number of requests in flight across all
+// caches, see Config.MaxConcurrency. Workers waiting for a slot are
+// granted one in the order of the priority of their cache, first
+// come first served within a priority. A nil dispatcher is unbounded.
+type dispatcher struct {
+	mu      sync.Mutex
+	slots   int
+	busy    int
+	seq     uint64
+	waiting waiters
+}
+
+func newDispatcher(slots int) *dispatcher {
+	if slots <= 0 {
+		return nil
+	}
+	return &dispatcher{slots: slots}
+}
+
+// acquire waits for a slot, returning false if
+// the context is done before one is granted.
+func (d *dispatcher) acquire(ctx context.Context, priority int) bool {
+	if d == nil {
+		return true
+	}
+
+	d.mu.Lock()
+	if d.busy < d.slots && len(d.waiting) == 0 {
+		d.busy++
+		d.mu.Unlock()
+		return true
+	}
+	w := &waiter{priority: priority, seq: d.seq, ready: make(chan struct{})}
+	d.seq++
+	heap.Push(&d.waiting, w)
+	d.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if w.index >= 0 {
+		heap.Remove(&d.waiting, w.index)
+		return false
+	}
+
+	// The slot was granted as the context got done,
+	// hand it over to the next waiter.
+	d.grant()
+	return false
+}
+
+// release frees a slot acquired by the caller.
+func (d *dispatcher) release() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	d.grant()
+	d.mu.Unlock()
+}
+
+// grant passes a busy slot on to the first waiter, or frees it
+// if there's none. The caller must hold mu.
+func (d *dispatcher) grant() {
+	if len(d.waiting) == 0 {
+		d.busy--
+		return
+	}
+	w := heap.Pop(&d.waiting).(*waiter)
+	close(w.ready)
+}
+
+// waitingByPriority returns the number of workers
+// waiting for a slot, keyed by priority.
+func (d *dispatcher) waitingByPriority() map[int]int {
+	depths := make(map[int]int)
+	if d == nil {
+		return depths
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, w := range d.waiting {
+		depths[w.priority]++
+	}
+	return depths
+}
+
+// waiter is a worker waiting for a slot, index being
+// its position in the heap, -1 once popped.
+type waiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	index    int
+}
+
+// waiters is a heap of waiters, highest priority first.
+type waiters []*waiter
+
+func (h waiters) Len() int { return len(h) }
+
+func (h waiters) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiters) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiters) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiters) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
@@ -0,0 +1,109 @@
+package broadcaster
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestDispatcherGrantsByPriority(t *testing.T) {
+	d := newDispatcher(1)
+	if !d.acquire(context.Background(), 0) {
+		t.Fatal("expected a free slot")
+	}
+
+	granted := make(chan string, 4)
+	wait := func(name string, priority int) {
+		go func() {
+			d.acquire(context.Background(), priority)
+			granted <- name
+		}()
+		// Queue the waiters in a known order.
+		for n := sum(d.waitingByPriority()); ; {
+			if got := d.waitingByPriority(); got[priority] > 0 && sum(got) > n {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wait("edge1", 0)
+	wait("edge2", 0)
+	wait("shield", 10)
+
+	if got := d.waitingByPriority(); !reflect.DeepEqual(got, map[int]int{0: 2, 10: 1}) {
+		t.Errorf("unexpected depths %v", got)
+	}
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		d.release()
+		order = append(order, <-granted)
+	}
+	if want := []string{"shield", "edge1", "edge2"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("expected %v, got %v", want, order)
+	}
+}
+
+func TestDispatcherGivesUpOnDoneContext(t *testing.T) {
+	d := newDispatcher(1)
+	d.acquire(context.Background(), 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if d.acquire(ctx, 5) {
+		t.Fatal("expected no slot")
+	}
+
+	d.release()
+	if !d.acquire(context.Background(), 0) {
+		t.Error("expected the slot back")
+	}
+}
+
+func TestStatsQueuedByPriority(t *testing.T) {
+	b := newTestBroadcaster(t, Config{MaxConcurrency: 1})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := newTestCache(t, b, "slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	shield := newTestCache(t, b, "shield", func(w http.ResponseWriter, r *http.Request) {})
+	shield.Priority = 10
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{slow}}, dao.Group{Name: "shield", Caches: []dao.Cache{shield}})
+
+	done := make(chan struct{}, 2)
+	broadcast := func(group string) {
+		go func() {
+			b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/foo", Group: group})
+			done <- struct{}{}
+		}()
+	}
+	broadcast("edge")
+	<-started
+	broadcast("shield")
+
+	deadline := time.Now().Add(time.Second)
+	for b.Stats().QueuedByPriority[10] != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := b.Stats().QueuedByPriority; !reflect.DeepEqual(got, map[int]int{10: 1}) {
+		t.Errorf("expected the shield to wait for the slow cache, got %v", got)
+	}
+
+	close(release)
+	<-done
+	<-done
+}
+
+func sum(depths map[int]int) int {
+	n := 0
+	for _, d := range depths {
+		n += d
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package broadcaster
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+// confirmHeader must be set to confirmValue to broadcast
+// a protected path.
+const (
+	confirmHeader = "X-Broadcast-Confirm"
+	confirmValue  = "yes-i-mean-it"
+)
+
+var protectedBlocked = metrics.NewCounter("broadcaster_protected_blocked_total", "Broadcasts of protected paths blocked for lack of confirmation.", "")
+
+// protectedPattern returns the protected path the path matches.
+// Paths match with or without their leading slash, so that "/.*"
+// matches the ".*" regular expression of BAN translations.
+func (b *Broadcaster) protectedPattern(path string) (string, bool) {
+	for _, p := range b.cfg.ProtectedPaths {
+		if p == path || p == strings.TrimPrefix(path, "/") {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// ProtectedPathError is returned for broadcasts of protected paths
+// lacking the confirmation header.
+type ProtectedPathError struct {
+	// Path is the protected path, and Pattern
+	// the protected path it matched.
+	Path    string
+	Pattern string
+}
+
+func (e *ProtectedPathError) Error() string {
+	return fmt.Sprintf("%s is protected, as it would wipe the caches. Set %s: %s to broadcast it.", e.Path, confirmHeader, confirmValue)
+}
+
+// wipingMethod tells whether broadcasting the method to a protected
+// path may wipe the caches, only purges and bans doing so.
+func wipingMethod(method string) bool {
+	return strings.EqualFold(method, "PURGE") || strings.EqualFold(method, "BAN")
+}
+
+// wipingBroadcast tells whether the broadcast of the method may wipe
+// any of the caches, as it's sent or once mapped by their method_map,
+// e.g. a GET mapped to a PURGE.
+func wipingBroadcast(method string, caches []dao.Cache) bool {
+	if wipingMethod(method) {
+		return true
+	}
+	for _, c := range caches {
+		if wipingMethod(c.MappedMethod(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProtected returns an error for purges and bans of protected
+// paths to the caches, e.g. "/" wiping every cache once translated to
+// a BAN, unless confirmed with the confirmation header or sent to a
+// group allowing wipes. Blocked broadcasts are logged with their client.
+func (b *Broadcaster) checkProtected(method, groupName string, header http.Header, client string, caches []dao.Cache, paths ...string) error {
+	if !wipingBroadcast(method, caches) || header.Get(confirmHeader) == confirmValue {
+		return nil
+	}
+	if groupName != "" && b.group(groupName).AllowWipes {
+		return nil
+	}
+
+	for _, path := range paths {
+		pattern, protected := b.protectedPattern(path)
+		if !protected {
+			continue
+		}
+
+		protectedBlocked.Inc("")
+		b.log("WARN Blocked ", method, " ", path, " from ", client, ", matching the protected path ", pattern, ", without ", confirmHeader, "\n")
+		return &ProtectedPathError{Path: path, Pattern: pattern}
+	}
+	return nil
+}
+
+// rejectProtected answers 412 to batches of protected paths,
+// see checkProtected, returning false for the others.
+func (b *Broadcaster) rejectProtected(w http.ResponseWriter, r *http.Request, method, groupName string, caches []dao.Cache, paths ...string) bool {
+	err := b.checkProtected(method, groupName, r.Header, b.clientIP(r), caches, paths...)
+	if err == nil {
+		return false
+	}
+	http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	return true
+}
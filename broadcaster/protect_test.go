@@ -0,0 +1,162 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestProtectedPathsNeedConfirmation(t *testing.T) {
+	var mu sync.Mutex
+	var logged []string
+	b := newTestBroadcaster(t, Config{
+		ProtectedPaths: []string{"/", ".*"},
+		Log: func(args ...string) {
+			mu.Lock()
+			defer mu.Unlock()
+			logged = append(logged, strings.Join(args, ""))
+		},
+	})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.URL.Path })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	for _, path := range []string{"/", "/.*"} {
+		r := httptest.NewRequest("PURGE", path, nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+		if w.Code != http.StatusPreconditionFailed || !strings.Contains(w.Body.String(), confirmHeader) {
+			t.Errorf("%s: expected 412 asking for confirmation, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	select {
+	case path := <-received:
+		t.Fatalf("expected nothing to be broadcast, got %s", path)
+	default:
+	}
+
+	mu.Lock()
+	if !strings.Contains(strings.Join(logged, ""), "WARN Blocked PURGE / from 192.0.2.1") {
+		t.Errorf("expected the blocked purge to be logged with the client, got %q", logged)
+	}
+	mu.Unlock()
+
+	r := httptest.NewRequest("PURGE", "/", nil)
+	r.Header.Set(confirmHeader, confirmValue)
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+	if w.Code != http.StatusOK || <-received != "/" {
+		t.Errorf("expected the confirmed purge to be broadcast, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	b.reqHandler(w, httptest.NewRequest("PURGE", "/foo", nil))
+	if w.Code != http.StatusOK || <-received != "/foo" {
+		t.Errorf("expected other paths to be broadcast, got %d", w.Code)
+	}
+}
+
+func TestProtectedPathsGroupOptOut(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ProtectedPaths: []string{"/"}})
+
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {})
+	c2 := newTestCache(t, b, "c2", func(w http.ResponseWriter, r *http.Request) {})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}}, dao.Group{Name: "scratch", AllowWipes: true, Caches: []dao.Cache{c2}})
+
+	for group, want := range map[string]int{"edge": http.StatusPreconditionFailed, "scratch": http.StatusOK} {
+		r := httptest.NewRequest("PURGE", "/", nil)
+		r.Header.Set("X-Group", group)
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+		if w.Code != want {
+			t.Errorf("%s: expected %d, got %d", group, want, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader("/foo\n/\n"))
+	r.Header.Set("X-Group", "edge")
+	w := httptest.NewRecorder()
+	b.batchHandler(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected a batch with a protected path to be blocked, got %d", w.Code)
+	}
+}
+
+func TestBroadcastChecksProtectedPaths(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ProtectedPaths: []string{"/"}})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.Method + " " + r.URL.Path })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	// Broadcasts of events or gRPC calls go through Broadcast only.
+	_, err := b.Broadcast(context.Background(), Request{Method: "BAN", Path: "/", Group: "edge", Header: http.Header{}})
+	var protected *ProtectedPathError
+	if !errors.As(err, &protected) || protected.Pattern != "/" {
+		t.Fatalf("expected the ban to be blocked, got %v", err)
+	}
+
+	confirmed := http.Header{}
+	confirmed.Set(confirmHeader, confirmValue)
+	if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/", Group: "edge", Header: confirmed}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != "PURGE /" {
+		t.Errorf("expected the confirmed purge to be broadcast, got %s", got)
+	}
+
+	// Only purges and bans can wipe the caches.
+	w := httptest.NewRecorder()
+	b.reqHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || <-received != "GET /" {
+		t.Errorf("expected a GET of / to be broadcast, got %d", w.Code)
+	}
+}
+
+func TestProtectedPathsFollowMethodMap(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ProtectedPaths: []string{"/"}})
+
+	received := make(chan string, 10)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { received <- r.Method + " " + r.URL.Path })
+	c1.MethodMap = map[string]string{"GET": "PURGE"}
+	setTestGroups(b, dao.Group{Name: "legacy", Caches: []dao.Cache{c1}})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Group", "legacy")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected a GET mapped to a PURGE to be blocked, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/batch?method=GET", strings.NewReader("/\n"))
+	r.Header.Set("X-Group", "legacy")
+	w = httptest.NewRecorder()
+	b.batchHandler(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected a batch mapped to a PURGE to be blocked, got %d", w.Code)
+	}
+
+	select {
+	case got := <-received:
+		t.Fatalf("expected nothing to be broadcast, got %s", got)
+	default:
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Group", "legacy")
+	r.Header.Set(confirmHeader, confirmValue)
+	w = httptest.NewRecorder()
+	b.reqHandler(w, r)
+	if w.Code != http.StatusOK || <-received != "PURGE /" {
+		t.Errorf("expected the confirmed GET to be broadcast as a PURGE, got %d", w.Code)
+	}
+}
@@ -0,0 +1,302 @@
+package broadcaster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+// reasonQueuedTooLong reports a job which waited in its cache's
+// queue for longer than Config.CacheQueueTimeout, reasonDropped
+// one dropped from a full queue for newer jobs.
+const (
+	reasonQueuedTooLong = "queued_too_long"
+	reasonDropped       = "dropped"
+)
+
+// Policies of broadcasts finding the job queues full.
+const (
+	QueueFullReject     = "reject"
+	QueueFullBlock      = "block"
+	QueueFullDropOldest = "drop-oldest"
+)
+
+// Job states, a queued job is either started by a worker, expires
+// or is dropped by its broadcast, whichever comes first.
+const (
+	jobQueued int32 = iota
+	jobStarted
+	jobExpired
+	jobDropped
+)
+
+var (
+	// cacheQueueSize is the capacity of every cache's job queue.
+	cacheQueueSize = 2 << 12
+
+	saturatedBroadcasts = metrics.NewCounter("broadcaster_queue_rejected_broadcasts_total", "Broadcasts rejected because the job queue was full.", "")
+	droppedJobs         = metrics.NewCounter("broadcaster_queue_dropped_jobs_total", "Queued jobs dropped from a full queue for newer ones.", "cache")
+)
+
+// Job is the request of a broadcast to a single cache.
+type Job struct {
+	Ctx    context.Context
+	Cache  dao.Cache
+	Result chan Result
+
+	// retryBudget is shared by the jobs of a broadcast,
+	// nil when their retries are unbounded.
+	retryBudget *retryBudget
+
+	// retries overrides Config.Retries for the
+	// broadcast when set, see Request.Retries.
+	retries *int
+
+	state int32
+	timer *time.Timer
+}
+
+func newJob(ctx context.Context, cache dao.Cache) *Job {
+	job := Job{}
+	job.Ctx = ctx
+	job.Cache = cache
+	job.Result = make(chan Result, 1)
+	return &job
+}
+
+// cacheQueue feeds the jobs of a single cache to workers of
+// its own, in the order they were enqueued. Caches are thus
+// broadcast to independently of each other.
+type cacheQueue struct {
+	jobs     chan *Job
+	workers  int
+	priority int
+}
+
+// cacheWorkers returns the number of workers of the cache's queue,
+// those of the cache or its group, or Config.Workers, capped by the
+// cache's MaxInFlight. Purges reach a cache in order with a single
+// worker.
+func (b *Broadcaster) cacheWorkers(cache dao.Cache) int {
+	workers := b.cfg.Workers
+	if cache.Workers > 0 {
+		workers = cache.Workers
+	}
+	if cache.MaxInFlight > 0 && cache.MaxInFlight < workers {
+		workers = cache.MaxInFlight
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// queueFor returns the queue of the cache, starting it on first
+// use. The caller must hold queuesLock.
+func (b *Broadcaster) queueFor(cache dao.Cache) *cacheQueue {
+	q, found := b.queues[cache.Name]
+	if found {
+		return q
+	}
+
+	q = &cacheQueue{jobs: make(chan *Job, cacheQueueSize), workers: b.cacheWorkers(cache), priority: cache.Priority}
+	for i := 0; i < q.workers; i++ {
+		go b.jobWorker(q.jobs)
+	}
+	b.queues[cache.Name] = q
+
+	return q
+}
+
+// syncQueues stops the queues of caches which are no longer
+// configured, or whose number of workers or priority changed.
+// Their workers exit once done with the jobs already enqueued.
+func (b *Broadcaster) syncQueues() {
+	b.mu.Lock()
+	workers := make(map[string]int, len(b.allCaches))
+	priorities := make(map[string]int, len(b.allCaches))
+	for _, cache := range b.allCaches {
+		workers[cache.Name] = b.cacheWorkers(cache)
+		priorities[cache.Name] = cache.Priority
+	}
+	b.mu.Unlock()
+
+	b.queuesLock.Lock()
+	defer b.queuesLock.Unlock()
+
+	for name, q := range b.queues {
+		if workers[name] != q.workers || priorities[name] != q.priority {
+			close(q.jobs)
+			delete(b.queues, name)
+		}
+	}
+}
+
+// queuedJobs returns the number of jobs waiting in all queues.
+func (b *Broadcaster) queuedJobs() int {
+	b.queuesLock.Lock()
+	defer b.queuesLock.Unlock()
+
+	n := 0
+	for _, q := range b.queues {
+		n += len(q.jobs)
+	}
+	return n
+}
+
+// queuedByPriority returns the number of jobs waiting in the
+// queues or for a slot of Config.MaxConcurrency, keyed by the
+// priority of their cache.
+func (b *Broadcaster) queuedByPriority() map[int]int {
+	depths := b.dispatch.waitingByPriority()
+
+	b.queuesLock.Lock()
+	defer b.queuesLock.Unlock()
+
+	for _, q := range b.queues {
+		if n := len(q.jobs); n > 0 {
+			depths[q.priority] += n
+		}
+	}
+	return depths
+}
+
+// enqueueJobs hands all the jobs of a broadcast over to the
+// workers of their caches. If the queues can't take all of them,
+// Config.QueueFull decides: with reject none is enqueued once
+// Config.EnqueueTimeout passed, block waits for room until the
+// broadcast is done, and drop-oldest drops the oldest queued jobs.
+// It returns false if the jobs weren't enqueued.
+func (b *Broadcaster) enqueueJobs(jobs []*Job) bool {
+	b.queuesLock.Lock()
+	defer b.queuesLock.Unlock()
+
+	if b.cfg.QueueFull == QueueFullDropOldest {
+		b.makeRoom(jobs)
+	}
+
+	deadline := time.Now().Add(b.cfg.EnqueueTimeout)
+
+	for !b.haveRoom(jobs) {
+		if b.cfg.QueueFull == QueueFullBlock {
+			if len(jobs) > 0 && jobs[0].Ctx.Err() != nil {
+				return false
+			}
+		} else if !time.Now().Before(deadline) {
+			return false
+		}
+
+		// Let the workers make some room.
+		b.queuesLock.Unlock()
+		time.Sleep(time.Millisecond)
+		b.queuesLock.Lock()
+	}
+
+	for _, job := range jobs {
+		job.expireAfter(b.cfg.CacheQueueTimeout)
+		b.queueFor(job.Cache).jobs <- job
+	}
+
+	return true
+}
+
+// haveRoom tells whether the queues can take all the jobs. The
+// caller must hold queuesLock.
+func (b *Broadcaster) haveRoom(jobs []*Job) bool {
+	wanted := make(map[string]int)
+	for _, job := range jobs {
+		wanted[job.Cache.Name]++
+	}
+
+	for _, job := range jobs {
+		q := b.queueFor(job.Cache)
+		if cap(q.jobs)-len(q.jobs) < wanted[job.Cache.Name] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// makeRoom drops the oldest jobs of the queues which can't take
+// all the jobs, reporting them as dropped to their broadcasts.
+// The caller must hold queuesLock.
+func (b *Broadcaster) makeRoom(jobs []*Job) {
+	wanted := make(map[string]int)
+	for _, job := range jobs {
+		wanted[job.Cache.Name]++
+	}
+
+	for _, job := range jobs {
+		q := b.queueFor(job.Cache)
+		for cap(q.jobs)-len(q.jobs) < wanted[job.Cache.Name] {
+			var oldest *Job
+			select {
+			case oldest = <-q.jobs:
+			default:
+			}
+			if oldest == nil {
+				// The queue is empty, too small
+				// for the broadcast to make room.
+				break
+			}
+
+			// Jobs which expired or were dropped by their
+			// broadcast already got their result.
+			if oldest.drop() {
+				droppedJobs.Inc(oldest.Cache.Name)
+				oldest.Result <- Result{
+					Status: http.StatusServiceUnavailable,
+					Reason: reasonDropped,
+					Error:  fmt.Sprintf("Dropped from the full queue of cache %s for newer requests.", oldest.Cache.Name),
+				}
+			}
+		}
+	}
+}
+
+// expireAfter reports the job as queued too long unless a
+// worker starts it within the given duration.
+func (job *Job) expireAfter(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	job.timer = time.AfterFunc(d, func() {
+		if atomic.CompareAndSwapInt32(&job.state, jobQueued, jobExpired) {
+			job.Result <- Result{
+				Status: http.StatusServiceUnavailable,
+				Reason: reasonQueuedTooLong,
+				Error:  fmt.Sprintf("Waited more than %s for cache %s to process earlier requests.", d, job.Cache.Name),
+			}
+		}
+	})
+}
+
+// start claims the job for a worker, returning false if
+// it already expired.
+func (job *Job) start() bool {
+	if !atomic.CompareAndSwapInt32(&job.state, jobQueued, jobStarted) {
+		return false
+	}
+	if job.timer != nil {
+		job.timer.Stop()
+	}
+	return true
+}
+
+// drop withdraws the job if no worker started it yet.
+func (job *Job) drop() bool {
+	if !atomic.CompareAndSwapInt32(&job.state, jobQueued, jobDropped) {
+		return false
+	}
+	if job.timer != nil {
+		job.timer.Stop()
+	}
+	return true
+}
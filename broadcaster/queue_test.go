@@ -0,0 +1,364 @@
+package broadcaster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// newTestCache starts a backend served by the handler, and
+// registers a client for it with the broadcaster.
+func newTestCache(t testing.TB, b *Broadcaster, name string, handler http.HandlerFunc) dao.Cache {
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+
+	b.mu.Lock()
+	b.clients[name] = b.createHTTPClient(dao.Cache{})
+	b.mu.Unlock()
+
+	return dao.Cache{Name: name, Address: backend.URL, Method: "PURGE", Item: "/", Headers: http.Header{}}
+}
+
+func TestReqHandlerRejectsWhenQueueIsFull(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{{Name: "c1"}, {Name: "c2"}}})
+
+	// A queue without workers, which has room for a single job.
+	b.queuesLock.Lock()
+	b.queues["c2"] = &cacheQueue{jobs: make(chan *Job, 1), workers: 1}
+	b.queues["c2"].jobs <- newJob(context.Background(), dao.Cache{Name: "c2"})
+	b.queuesLock.Unlock()
+
+	rejected := saturatedBroadcasts.Value("")
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "edge")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if n := b.queuedJobs(); n != 1 {
+		t.Errorf("expected no job of the broadcast to be enqueued, got %d", n-1)
+	}
+	if saturatedBroadcasts.Value("") != rejected+1 {
+		t.Error("expected the rejection to be counted")
+	}
+}
+
+func TestEnqueueJobsWaitsForRoom(t *testing.T) {
+	b := newTestBroadcaster(t, Config{EnqueueTimeout: time.Second})
+
+	b.queuesLock.Lock()
+	q := &cacheQueue{jobs: make(chan *Job, 1), workers: 1}
+	q.jobs <- newJob(context.Background(), dao.Cache{Name: "c1"})
+	b.queues["c1"] = q
+	b.queuesLock.Unlock()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-q.jobs
+	}()
+
+	if !b.enqueueJobs([]*Job{newJob(context.Background(), dao.Cache{Name: "c1"})}) {
+		t.Error("expected the job to be enqueued once room was made")
+	}
+}
+
+// fullTestQueue registers a queue without workers for the cache,
+// holding a single job, which fills it.
+func fullTestQueue(b *Broadcaster, name string) (*cacheQueue, *Job) {
+	b.queuesLock.Lock()
+	defer b.queuesLock.Unlock()
+
+	old := newJob(context.Background(), dao.Cache{Name: name})
+	q := &cacheQueue{jobs: make(chan *Job, 1), workers: 1}
+	q.jobs <- old
+	b.queues[name] = q
+
+	return q, old
+}
+
+func TestQueueFullDropsOldest(t *testing.T) {
+	b := newTestBroadcaster(t, Config{QueueFull: QueueFullDropOldest})
+	q, old := fullTestQueue(b, "c1")
+
+	job := newJob(context.Background(), dao.Cache{Name: "c1"})
+	if !b.enqueueJobs([]*Job{job}) {
+		t.Fatal("expected the job to be enqueued")
+	}
+
+	if res := <-old.Result; res.Reason != reasonDropped {
+		t.Errorf("expected the oldest job to be dropped, got %+v", res)
+	}
+	if queued := <-q.jobs; queued != job {
+		t.Error("expected the new job to take its place")
+	}
+}
+
+func TestQueueFullBlocks(t *testing.T) {
+	b := newTestBroadcaster(t, Config{QueueFull: QueueFullBlock})
+	q, _ := fullTestQueue(b, "c1")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-q.jobs
+	}()
+
+	if !b.enqueueJobs([]*Job{newJob(context.Background(), dao.Cache{Name: "c1"})}) {
+		t.Error("expected the broadcast to wait for room")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if b.enqueueJobs([]*Job{newJob(ctx, dao.Cache{Name: "c1"})}) {
+		t.Error("expected a broadcast done waiting not to be enqueued")
+	}
+}
+
+func TestUnknownQueueFullPolicyIsRejected(t *testing.T) {
+	if _, err := New(Config{QueueFull: "drop-newest"}); err == nil {
+		t.Error("expected New to reject an unknown policy")
+	}
+}
+
+func TestSlowCacheDoesNotHoldUpOthers(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	slow := newTestCache(t, b, "slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	fast := newTestCache(t, b, "fast", func(w http.ResponseWriter, r *http.Request) {})
+
+	var jobs []*Job
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, newJob(context.Background(), slow))
+	}
+	fastJob := newJob(context.Background(), fast)
+	b.enqueueJobs(append(jobs, fastJob))
+
+	select {
+	case res := <-fastJob.Result:
+		if res.Status != http.StatusOK {
+			t.Errorf("expected the fast cache to answer 200, got %+v", res)
+		}
+	case <-time.After(80 * time.Millisecond):
+		t.Fatal("the fast cache was held up by the slow one")
+	}
+
+	for _, job := range jobs {
+		<-job.Result
+	}
+}
+
+func TestCacheQueueKeepsOrder(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	var mu sync.Mutex
+	var received []string
+	cache := newTestCache(t, b, "ordered", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.URL.Path)
+		mu.Unlock()
+	})
+
+	var jobs []*Job
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		c := cache
+		c.Item = path
+		jobs = append(jobs, newJob(context.Background(), c))
+	}
+	b.enqueueJobs(jobs)
+
+	for _, job := range jobs {
+		<-job.Result
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, path := range []string{"/a", "/b", "/c", "/d"} {
+		if received[i] != path {
+			t.Fatalf("expected the purges in order, got %v", received)
+		}
+	}
+}
+
+func TestMaxInFlightCapsWorkers(t *testing.T) {
+	b := &Broadcaster{cfg: Config{Workers: 8}}
+
+	if n := b.cacheWorkers(dao.Cache{MaxInFlight: 2}); n != 2 {
+		t.Errorf("expected max_inflight to cap the workers, got %d", n)
+	}
+	if n := b.cacheWorkers(dao.Cache{}); n != 8 {
+		t.Errorf("expected Config.Workers workers, got %d", n)
+	}
+	if n := b.cacheWorkers(dao.Cache{Workers: 16, MaxInFlight: 4}); n != 4 {
+		t.Errorf("expected max_inflight to cap the cache's workers, got %d", n)
+	}
+	if n := b.cacheWorkers(dao.Cache{Workers: 2}); n != 2 {
+		t.Errorf("expected the cache's workers, got %d", n)
+	}
+}
+
+func TestSlowGroupDoesNotHoldUpOthers(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	slow := newTestCache(t, b, "slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	fast := newTestCache(t, b, "fast", func(w http.ResponseWriter, r *http.Request) {})
+	slow.Workers = 2
+	setTestGroups(b,
+		dao.Group{Name: "shield", Caches: []dao.Cache{slow}},
+		dao.Group{Name: "edge", Caches: []dao.Cache{fast}},
+	)
+
+	// A backlog of the slow group.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/slow", Group: "shield"})
+		}()
+	}
+	defer wg.Wait()
+
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/fast", Group: "edge"})
+		if err != nil || res.Status != http.StatusOK {
+			t.Fatalf("expected the fast group to answer, got %+v %v", res, err)
+		}
+		if d := time.Since(start); d > 40*time.Millisecond {
+			t.Errorf("the fast group was held up by the slow one's backlog for %s", d)
+		}
+	}
+
+	b.queuesLock.Lock()
+	workers := b.queues["slow"].workers
+	b.queuesLock.Unlock()
+	if workers != 2 {
+		t.Errorf("expected the slow cache to have 2 workers, got %d", workers)
+	}
+}
+
+func TestMaxInFlightIsRespected(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Workers: 8})
+
+	var inFlight, peak int32
+	cache := newTestCache(t, b, "capped", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	})
+	cache.MaxInFlight = 2
+
+	var jobs []*Job
+	for i := 0; i < 10; i++ {
+		jobs = append(jobs, newJob(context.Background(), cache))
+	}
+	b.enqueueJobs(jobs)
+
+	for _, job := range jobs {
+		if res := <-job.Result; res.Status != http.StatusOK {
+			t.Errorf("expected the waiting requests to be sent eventually, got %+v", res)
+		}
+	}
+
+	if p := atomic.LoadInt32(&peak); p > 2 {
+		t.Errorf("expected at most 2 requests in flight, got %d", p)
+	}
+}
+
+func TestWaitingJobReportsQueuedTooLong(t *testing.T) {
+	b := newTestBroadcaster(t, Config{CacheQueueTimeout: 20 * time.Millisecond})
+
+	var requests int32
+	stuck := newTestCache(t, b, "stuck", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	first, second := newJob(context.Background(), stuck), newJob(context.Background(), stuck)
+	b.enqueueJobs([]*Job{first, second})
+
+	res := <-second.Result
+	if res.Reason != reasonQueuedTooLong {
+		t.Errorf("expected the waiting job to be reported as %s, got %+v", reasonQueuedTooLong, res)
+	}
+	<-first.Result
+
+	// Give the worker a chance to pick the expired job up.
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the expired job not to be sent, got %d requests", n)
+	}
+}
+
+// benchmarkFanOut broadcasts to 50 caches answering after a
+// millisecond, using the given dispatch function.
+func benchmarkFanOut(b *testing.B, bc *Broadcaster, dispatch func([]*Job)) {
+	var caches []dao.Cache
+	for i := 0; i < 50; i++ {
+		caches = append(caches, newTestCache(b, bc, "bench"+strconv.Itoa(i), func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Millisecond)
+		}))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			jobs := make([]*Job, len(caches))
+			for i, cache := range caches {
+				jobs[i] = newJob(context.Background(), cache)
+			}
+			dispatch(jobs)
+			for _, job := range jobs {
+				<-job.Result
+			}
+		}
+	})
+}
+
+// BenchmarkFanOutSharedPool dispatches through a single queue
+// feeding 8 workers, the layout used before per cache queues.
+func BenchmarkFanOutSharedPool(b *testing.B) {
+	bc := newTestBroadcaster(b, Config{})
+
+	shared := make(chan *Job, 2<<12)
+	defer close(shared)
+	for i := 0; i < 8; i++ {
+		go bc.jobWorker(shared)
+	}
+
+	benchmarkFanOut(b, bc, func(jobs []*Job) {
+		for _, job := range jobs {
+			shared <- job
+		}
+	})
+}
+
+func BenchmarkFanOutPerCacheQueues(b *testing.B) {
+	bc := newTestBroadcaster(b, Config{})
+
+	benchmarkFanOut(b, bc, func(jobs []*Job) {
+		bc.enqueueJobs(jobs)
+	})
+}
@@ -0,0 +1,130 @@
+package broadcaster
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+var rateLimitedRequests = metrics.NewCounter("broadcaster_rate_limited_requests_total", "Requests rejected by a rate limit.", "limit")
+
+// tokenBucket is a rate limiter refilling rate tokens per
+// second up to a maximum of burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	burst = bucketBurst(rate, burst)
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// bucketBurst returns the burst of a bucket, defaulting
+// to a second's worth of tokens.
+func bucketBurst(rate float64, burst int) int {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return burst
+}
+
+// configured tells whether the bucket has the rate and burst.
+func (b *tokenBucket) configured(rate float64, burst int) bool {
+	return b.rate == rate && b.burst == float64(bucketBurst(rate, burst))
+}
+
+// take consumes a token. When none is left it returns false
+// along with the time until the next token becomes available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// putBack returns a token taken for a broadcast
+// which another limit then rejected.
+func (b *tokenBucket) putBack() {
+	b.mu.Lock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+	b.mu.Unlock()
+}
+
+// setUpRateLimiters creates the global limiter along with the
+// limiters of every group configuring a rate limit. The limiters of
+// groups whose limit didn't change are kept, with their tokens, for
+// reloads not to reset the limits.
+func (b *Broadcaster) setUpRateLimiters(groupList []dao.Group) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	limiters := make(map[string]*tokenBucket)
+	for _, g := range groupList {
+		if g.RateLimit <= 0 {
+			continue
+		}
+		if previous := b.groupLimiters[g.Name]; previous != nil && previous.configured(g.RateLimit, g.RateBurst) {
+			limiters[g.Name] = previous
+		} else {
+			limiters[g.Name] = newTokenBucket(g.RateLimit, g.RateBurst)
+		}
+	}
+
+	if b.cfg.RateLimit > 0 && b.globalLimiter == nil {
+		b.globalLimiter = newTokenBucket(b.cfg.RateLimit, b.cfg.RateBurst)
+	}
+	b.groupLimiters = limiters
+}
+
+// allowBroadcast checks a broadcast against the global limit and
+// the limit of the targeted group. When rejected it returns the
+// name of the exceeded limit and the time to wait before retrying.
+func (b *Broadcaster) allowBroadcast(groupName string) (bool, string, time.Duration) {
+	now := time.Now()
+
+	b.mu.Lock()
+	global := b.globalLimiter
+	group := b.groupLimiters[groupName]
+	b.mu.Unlock()
+
+	if group != nil {
+		if ok, wait := group.take(now); !ok {
+			return false, groupName, wait
+		}
+	}
+
+	if global != nil {
+		if ok, wait := global.take(now); !ok {
+			if group != nil {
+				group.putBack()
+			}
+			return false, "global", wait
+		}
+	}
+
+	return true, "", 0
+}
@@ -0,0 +1,111 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(2, 3)
+	bucket.last = now
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := bucket.take(now); !ok {
+			t.Fatalf("take %d: expected the burst to be allowed", i)
+		}
+	}
+
+	ok, wait := bucket.take(now)
+	if ok {
+		t.Fatal("expected the bucket to be empty")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %s", wait)
+	}
+
+	if ok, _ := bucket.take(now.Add(wait)); !ok {
+		t.Error("expected a token to be refilled")
+	}
+}
+
+func TestReqHandlerRateLimitsGroup(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Groups: []dao.Group{{Name: "bans", RateLimit: 0.001, RateBurst: 1}}})
+
+	rejected := rateLimitedRequests.Value("bans")
+
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("BAN", "/foo", nil)
+		r.Header.Set("X-Group", "bans")
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+		return w
+	}
+
+	if w := send(); w.Code != http.StatusNoContent {
+		t.Fatalf("expected the first broadcast to pass, got %d", w.Code)
+	}
+
+	w := send()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if got := rateLimitedRequests.Value("bans"); got != rejected+1 {
+		t.Errorf("expected the rejection to be counted, got %d", got-rejected)
+	}
+	if b.queuedJobs() != 0 {
+		t.Errorf("expected no jobs to be enqueued, got %d", b.queuedJobs())
+	}
+}
+
+func TestGlobalRejectionKeepsGroupToken(t *testing.T) {
+	b := newTestBroadcaster(t, Config{RateLimit: 0.001, RateBurst: 1})
+	b.setUpRateLimiters([]dao.Group{{Name: "bans", RateLimit: 0.001, RateBurst: 1}})
+
+	if ok, _, _ := b.allowBroadcast("other"); !ok {
+		t.Fatal("expected the first broadcast to pass")
+	}
+
+	ok, limit, _ := b.allowBroadcast("bans")
+	if ok || limit != "global" {
+		t.Fatalf("expected the global limit to reject, got %v %q", ok, limit)
+	}
+
+	b.globalLimiter = newTokenBucket(0.001, 1)
+	if ok, limit, _ := b.allowBroadcast("bans"); !ok {
+		t.Errorf("expected the group token to be kept, rejected by %q", limit)
+	}
+}
+
+func TestSetUpRateLimitersKeepsUnchangedLimiters(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+	b.setUpRateLimiters([]dao.Group{
+		{Name: "bans", RateLimit: 0.001, RateBurst: 1},
+		{Name: "purges", RateLimit: 0.001, RateBurst: 1},
+	})
+
+	for _, name := range []string{"bans", "purges"} {
+		if ok, _, _ := b.allowBroadcast(name); !ok {
+			t.Fatalf("expected the first broadcast to %s to pass", name)
+		}
+	}
+
+	b.setUpRateLimiters([]dao.Group{
+		{Name: "bans", RateLimit: 0.001, RateBurst: 1},
+		{Name: "purges", RateLimit: 0.001, RateBurst: 2},
+	})
+
+	if ok, _, _ := b.allowBroadcast("bans"); ok {
+		t.Error("expected the unchanged limit of bans to be kept")
+	}
+	if ok, _, _ := b.allowBroadcast("purges"); !ok {
+		t.Error("expected the changed limit of purges to be reset")
+	}
+}
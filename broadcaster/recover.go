@@ -0,0 +1,41 @@
+package broadcaster
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+var panicsRecovered = metrics.NewCounter("broadcaster_panics_total", "Panics recovered from, by where they happened: worker or handler.", "where")
+
+// recoverHandler wraps the handler so that a panic answers its
+// request with a 500 carrying its request id, rather than taking
+// down the process with every broadcast in flight.
+func (b *Broadcaster) recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			// The handler sets the request id once it has read the request.
+			reqID := w.Header().Get("X-Request-Id")
+			if reqID == "" {
+				reqID = requestID(r)
+				w.Header().Set("X-Request-Id", reqID)
+			}
+
+			panicsRecovered.Inc("handler")
+			b.log("ERROR Recovered from panic handling ", r.Method, " ", r.URL.RequestURI(), " (request ", reqID, "): ", fmt.Sprint(p), "\n", string(debug.Stack()))
+			http.Error(w, fmt.Sprintf("Internal error, request %s.", reqID), http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
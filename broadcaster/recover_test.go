@@ -0,0 +1,52 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestHandlerSurvivesPanic(t *testing.T) {
+	var logs []string
+	var mu sync.Mutex
+	b := newTestBroadcaster(t, Config{Log: func(args ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, strings.Join(args, ""))
+	}})
+
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	// The hook stands for a bug of the handler, e.g. a nil map.
+	panics := panicsRecovered.Value("handler")
+	fragile := b.recoverHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "r1")
+		var m map[string]int
+		m["boom"]++
+	}))
+
+	w := httptest.NewRecorder()
+	fragile.ServeHTTP(w, httptest.NewRequest("PURGE", "/a", nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "request r1") {
+		t.Errorf("expected a 500 with the request id, got %d %q", w.Code, w.Body.String())
+	}
+	if got := panicsRecovered.Value("handler"); got != panics+1 {
+		t.Errorf("expected the panic to be counted, got %d", got-panics)
+	}
+	mu.Lock()
+	if joined := strings.Join(logs, ""); !strings.Contains(joined, "ERROR Recovered from panic handling PURGE /a (request r1)") || !strings.Contains(joined, "goroutine") {
+		t.Errorf("expected the panic to be logged with its stack, got %q", joined)
+	}
+	mu.Unlock()
+
+	w = httptest.NewRecorder()
+	b.Handler().ServeHTTP(w, httptest.NewRequest("PURGE", "/a", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected broadcasts to go on after the panic, got %d", w.Code)
+	}
+}
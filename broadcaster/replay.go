@@ -0,0 +1,466 @@
+package broadcaster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// replayFile is the file of the replay queue under Config.StateDir.
+const replayFile = "replay.jsonl"
+
+const (
+	// replayInterval is how often the replay queue is looked
+	// through, and the first delay before a failed replay is
+	// tried again, doubling up to maxReplayDelay.
+	replayInterval = 5 * time.Second
+	maxReplayDelay = 5 * time.Minute
+
+	// compactAfter is the number of removed entries past which
+	// the replay file is rewritten with the pending ones only.
+	compactAfter = 1000
+)
+
+// replayEntry is a request a cache failed, kept to be sent
+// to it again once it's back.
+type replayEntry struct {
+	ID       uint64      `json:"id"`
+	Cache    string      `json:"cache"`
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Headers  http.Header `json:"headers,omitempty"`
+	Body     []byte      `json:"body,omitempty"`
+	FailedAt time.Time   `json:"failed_at"`
+}
+
+// replayRecord is a line of the replay file, an entry
+// added or the id of one replayed or dropped.
+type replayRecord struct {
+	Add    *replayEntry `json:"add,omitempty"`
+	Remove uint64       `json:"remove,omitempty"`
+}
+
+// replayBackoff delays the replays to a cache which failed them.
+type replayBackoff struct {
+	delay time.Duration
+	next  time.Time
+}
+
+// replayQueue holds the requests failed by the caches, in memory
+// and in an append-only file surviving restarts.
+type replayQueue struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	lastID  uint64
+	entries map[string][]replayEntry
+	backoff map[string]replayBackoff
+	removed int
+}
+
+// openReplayQueue loads the entries pending in the replay file,
+// creating it if need be, then compacts it.
+func openReplayQueue(path string) (*replayQueue, error) {
+	q := &replayQueue{
+		path:    path,
+		entries: make(map[string][]replayEntry),
+		backoff: make(map[string]replayBackoff),
+	}
+
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		err = q.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid replay queue %s: %s", path, err)
+		}
+	}
+
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *replayQueue) load(f *os.File) error {
+	pending := make(map[uint64]replayEntry)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var rec replayRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A record cut short by a crash can only be the last one.
+			continue
+		}
+		if rec.Add != nil {
+			pending[rec.Add.ID] = *rec.Add
+			if rec.Add.ID > q.lastID {
+				q.lastID = rec.Add.ID
+			}
+		}
+		delete(pending, rec.Remove)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ids := make([]uint64, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		e := pending[id]
+		q.entries[e.Cache] = append(q.entries[e.Cache], e)
+	}
+	return nil
+}
+
+// compact rewrites the replay file with the pending entries only,
+// replacing it atomically.
+func (q *replayQueue) compact() error {
+	tmp, err := os.OpenFile(q.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, entries := range q.entries {
+		for i := range entries {
+			line, _ := json.Marshal(replayRecord{Add: &entries[i]})
+			w.Write(append(line, '\n'))
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(q.path+".tmp", q.path)
+	}
+	if err != nil {
+		os.Remove(q.path + ".tmp")
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, err = os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0600)
+	q.removed = 0
+	return err
+}
+
+// write appends a record to the replay file. Additions are synced,
+// a removal being lost only replaying its entry once more.
+func (q *replayQueue) write(rec replayRecord) error {
+	line, _ := json.Marshal(rec)
+	if _, err := q.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if rec.Add != nil {
+		return q.file.Sync()
+	}
+	return nil
+}
+
+// add records a request failed by the cache.
+func (q *replayQueue) add(cache dao.Cache, failedAt time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.lastID++
+	e := replayEntry{
+		ID:       q.lastID,
+		Cache:    cache.Name,
+		Method:   cache.Method,
+		Path:     cache.Item,
+		Headers:  cache.Headers,
+		Body:     cache.Body,
+		FailedAt: failedAt,
+	}
+	q.entries[e.Cache] = append(q.entries[e.Cache], e)
+
+	return q.write(replayRecord{Add: &e})
+}
+
+// remove drops the entries of the cache for which drop returns
+// true, returning how many it dropped.
+func (q *replayQueue) remove(cacheName string, drop func(replayEntry) bool) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var kept []replayEntry
+	var err error
+	n := 0
+	for _, e := range q.entries[cacheName] {
+		if !drop(e) {
+			kept = append(kept, e)
+			continue
+		}
+		n++
+		if writeErr := q.write(replayRecord{Remove: e.ID}); err == nil {
+			err = writeErr
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(q.entries, cacheName)
+		delete(q.backoff, cacheName)
+	} else {
+		q.entries[cacheName] = kept
+	}
+
+	q.removed += n
+	if q.removed > compactAfter && err == nil {
+		err = q.compact()
+	}
+	return n, err
+}
+
+// pending returns the entries of the cache, oldest first.
+func (q *replayQueue) pending(cacheName string) []replayEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]replayEntry(nil), q.entries[cacheName]...)
+}
+
+// counts returns the number of entries pending for every cache.
+func (q *replayQueue) counts() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	counts := make(map[string]int, len(q.entries))
+	for name, entries := range q.entries {
+		counts[name] = len(entries)
+	}
+	return counts
+}
+
+// due tells whether the replays to the cache aren't backing off.
+func (q *replayQueue) due(cacheName string, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return !now.Before(q.backoff[cacheName].next)
+}
+
+// failed backs off the replays to the cache.
+func (q *replayQueue) failed(cacheName string, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bo := q.backoff[cacheName]
+	bo.delay *= 2
+	if bo.delay < replayInterval {
+		bo.delay = replayInterval
+	}
+	if bo.delay > maxReplayDelay {
+		bo.delay = maxReplayDelay
+	}
+	bo.next = now.Add(bo.delay)
+	q.backoff[cacheName] = bo
+}
+
+// healthy resets the backoff of the cache, which just succeeded
+// a request, so that its entries are replayed right away.
+func (q *replayQueue) healthy(cacheName string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.backoff, cacheName)
+}
+
+func (q *replayQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file != nil {
+		q.file.Close()
+	}
+}
+
+// replayable tells whether the request failed by the cache is
+// recorded to be replayed: failures which the cache coming back
+// would answer, of requests safe to send twice.
+func (b *Broadcaster) replayable(cache dao.Cache, status int, err error) bool {
+	if b.replay == nil || (err == nil && (status < 500 || b.successful(cache, status))) {
+		return false
+	}
+	return b.idempotent(cache) || b.cfg.RetryUnsafe
+}
+
+// recordFailure records the request failed by the cache in the
+// replay queue.
+func (b *Broadcaster) recordFailure(cache dao.Cache) {
+	if err := b.replay.add(cache, time.Now()); err != nil {
+		b.log("Failed to persist the replay of ", cache.Method, " ", cache.Item, " to ", cache.Name, ": ", err.Error(), "\n")
+	}
+}
+
+// replayLoop replays the queued requests until stop is closed.
+func (b *Broadcaster) replayLoop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			b.replayPending(ctx, time.Now())
+		}
+	}
+}
+
+// replayPending replays the entries of every cache not backing off,
+// oldest first, dropping those older than Config.ReplayMaxAge. A
+// cache failing a replay backs off, its later entries waiting for
+// the next try. The entries of disabled caches, or of caches not
+// configured, e.g. consul members yet to be found, wait as well.
+func (b *Broadcaster) replayPending(ctx context.Context, now time.Time) {
+	configured := make(map[string]dao.Cache)
+	b.mu.Lock()
+	for _, c := range b.allCaches {
+		if !b.disabledCaches[c.Name] {
+			configured[c.Name] = c
+		}
+	}
+	b.mu.Unlock()
+
+	for name := range b.replay.counts() {
+		if n, _ := b.replay.remove(name, func(e replayEntry) bool { return now.Sub(e.FailedAt) > b.cfg.ReplayMaxAge }); n > 0 {
+			b.log("Dropped ", strconv.Itoa(n), " replays to ", name, " older than ", b.cfg.ReplayMaxAge.String(), "\n")
+		}
+
+		cache, found := configured[name]
+		if !found || !b.replay.due(name, now) {
+			continue
+		}
+
+		for _, e := range b.replay.pending(name) {
+			if ctx.Err() != nil {
+				return
+			}
+
+			c := cache
+			c.Method, c.Item, c.Headers, c.Body = e.Method, e.Path, e.Headers, e.Body
+			if c.Headers == nil {
+				c.Headers = http.Header{}
+			}
+
+			status, err := b.doRequest(ctx, c, 0, nil)
+			if err != nil || status >= 500 {
+				b.replay.failed(name, now)
+				break
+			}
+
+			b.replay.remove(name, func(p replayEntry) bool { return p.ID == e.ID })
+			b.log("Replayed ", e.Method, " ", targetURL(c.Address, c), " ", strconv.Itoa(status), "\n")
+		}
+	}
+}
+
+// replayView is an entry of the replay queue as listed by
+// AdminReplayHandler, without its headers and body.
+type replayView struct {
+	ID       uint64    `json:"id"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// AdminReplayHandler serves /admin/replay: GET lists the requests
+// waiting to be replayed by cache, narrowed with the cache query
+// parameter, and DELETE purges them, those of the cache or the
+// single one of the id parameter. POST replays dead letters, see
+// replayDeadLetterHandler.
+func (b *Broadcaster) AdminReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		b.replayDeadLetterHandler(w, r)
+		return
+	}
+	if b.replay == nil {
+		http.Error(w, "Replay queue not enabled.", http.StatusNotFound)
+		return
+	}
+
+	cacheName := r.URL.Query().Get("cache")
+	names := []string{cacheName}
+	if cacheName == "" {
+		names = names[:0]
+		for name := range b.replay.counts() {
+			names = append(names, name)
+		}
+	}
+
+	var out []byte
+	switch r.Method {
+	case http.MethodGet:
+		backlog := make(map[string][]replayView)
+		for _, name := range names {
+			for _, e := range b.replay.pending(name) {
+				backlog[name] = append(backlog[name], replayView{ID: e.ID, Method: e.Method, Path: e.Path, FailedAt: e.FailedAt})
+			}
+		}
+		out, _ = json.MarshalIndent(backlog, "", "  ")
+
+	case http.MethodDelete:
+		drop := func(replayEntry) bool { return true }
+		if v := r.URL.Query().Get("id"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid id %q.", v), http.StatusBadRequest)
+				return
+			}
+			drop = func(e replayEntry) bool { return e.ID == id }
+		}
+
+		removed := 0
+		for _, name := range names {
+			n, err := b.replay.remove(name, drop)
+			removed += n
+			if err != nil {
+				b.log("Failed to persist the replay queue: ", err.Error(), "\n")
+			}
+		}
+		b.log("Admin purged ", strconv.Itoa(removed), " replays ", cacheName, "\n")
+		out, _ = json.MarshalIndent(map[string]int{"removed": removed}, "", "  ")
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE, POST")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
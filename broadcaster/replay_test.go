@@ -0,0 +1,169 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// flakyCache returns a cache answering 503 until up is set.
+func flakyCache(t *testing.T, b *Broadcaster, name string, up *int32, received chan<- string) dao.Cache {
+	return newTestCache(t, b, name, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- r.Method + " " + r.URL.Path
+	})
+}
+
+func TestReplayFailedRequestsOnceCacheIsBack(t *testing.T) {
+	stateDir := t.TempDir()
+
+	b, err := New(Config{StateDir: stateDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var up int32
+	received := make(chan string, 10)
+	c1 := flakyCache(t, b, "c1", &up, received)
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	for _, path := range []string{"/a", "/b"} {
+		if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: path, Group: "edge"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := b.Stats().PendingReplays["c1"]; got != 2 {
+		t.Fatalf("expected 2 pending replays, got %d", got)
+	}
+
+	// The queue survives restarts.
+	b.Close()
+	b = newTestBroadcaster(t, Config{StateDir: stateDir})
+	c1 = flakyCache(t, b, "c1", &up, received)
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	if got := b.Stats().PendingReplays["c1"]; got != 2 {
+		t.Fatalf("expected 2 pending replays after a restart, got %d", got)
+	}
+
+	// Replays back off while the cache is down.
+	now := time.Now()
+	b.replayPending(context.Background(), now)
+	atomic.StoreInt32(&up, 1)
+	b.replayPending(context.Background(), now.Add(time.Second))
+	if got := b.Stats().PendingReplays["c1"]; got != 2 {
+		t.Fatalf("expected the replays to back off, got %d pending", got)
+	}
+
+	b.replayPending(context.Background(), now.Add(replayInterval))
+	for _, want := range []string{"PURGE /a", "PURGE /b"} {
+		if got := <-received; got != want {
+			t.Errorf("expected %s to be replayed, got %s", want, got)
+		}
+	}
+	if pending := b.Stats().PendingReplays; len(pending) != 0 {
+		t.Errorf("expected no pending replays, got %v", pending)
+	}
+}
+
+func TestReplayDropsOldRequests(t *testing.T) {
+	b := newTestBroadcaster(t, Config{StateDir: t.TempDir(), ReplayMaxAge: time.Minute})
+
+	var up int32
+	received := make(chan string, 10)
+	c1 := flakyCache(t, b, "c1", &up, received)
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge"}); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&up, 1)
+	b.replayPending(context.Background(), time.Now().Add(2*time.Minute))
+
+	if pending := b.Stats().PendingReplays; len(pending) != 0 {
+		t.Errorf("expected the old request to be dropped, got %v", pending)
+	}
+	select {
+	case got := <-received:
+		t.Errorf("expected nothing to be replayed, got %s", got)
+	default:
+	}
+}
+
+func TestReplaySkipsUnsafeMethods(t *testing.T) {
+	b := newTestBroadcaster(t, Config{StateDir: t.TempDir()})
+
+	var up int32
+	c1 := flakyCache(t, b, "c1", &up, nil)
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	if _, err := b.Broadcast(context.Background(), Request{Method: "POST", Path: "/a", Group: "edge"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := b.Stats().PendingReplays; len(pending) != 0 {
+		t.Errorf("expected POST not to be replayed, got %v", pending)
+	}
+}
+
+func TestAdminReplayHandler(t *testing.T) {
+	b := newTestBroadcaster(t, Config{StateDir: t.TempDir()})
+
+	var up int32
+	c1 := flakyCache(t, b, "c1", &up, nil)
+	c2 := flakyCache(t, b, "c2", &up, nil)
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1, c2}})
+
+	for _, path := range []string{"/a", "/b"} {
+		if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: path, Group: "edge"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	b.AdminReplayHandler(w, httptest.NewRequest("GET", "/admin/replay?cache=c1", nil))
+
+	var backlog map[string][]replayView
+	if err := json.Unmarshal(w.Body.Bytes(), &backlog); err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || len(backlog["c1"]) != 2 || backlog["c1"][0].Path != "/a" {
+		t.Fatalf("expected the backlog of c1, got %+v", backlog)
+	}
+
+	w = httptest.NewRecorder()
+	b.AdminReplayHandler(w, httptest.NewRequest("DELETE", "/admin/replay?cache=c1&id="+strconv.FormatUint(backlog["c1"][0].ID, 10), nil))
+	if got := b.Stats().PendingReplays; got["c1"] != 1 || got["c2"] != 2 {
+		t.Errorf("expected a single request of c1 to be purged, got %v", got)
+	}
+
+	w = httptest.NewRecorder()
+	b.AdminReplayHandler(w, httptest.NewRequest("DELETE", "/admin/replay", nil))
+	if w.Body.String() != "{\n  \"removed\": 3\n}" {
+		t.Errorf("expected 3 requests to be purged, got %s", w.Body.String())
+	}
+	if pending := b.Stats().PendingReplays; len(pending) != 0 {
+		t.Errorf("expected the backlog to be purged, got %v", pending)
+	}
+}
+
+func TestAdminReplayHandlerWithoutStateDir(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	w := httptest.NewRecorder()
+	b.AdminReplayHandler(w, httptest.NewRequest("GET", "/admin/replay", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a replay queue, got %d", w.Code)
+	}
+}
@@ -0,0 +1,617 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+	tracing "github.com/timothyclarke/http-request-broadcaster/tracing"
+)
+
+const maxIdleConnections int = 100
+
+var defaultLocalAddr = net.IPAddr{IP: net.IPv4zero}
+
+// idempotentMethods may safely be sent to a cache more than
+// once, other methods are only retried with Config.RetryUnsafe.
+var idempotentMethods = map[string]bool{
+	"GET":    true,
+	"HEAD":   true,
+	"PUT":    true,
+	"DELETE": true,
+	"PURGE":  true,
+	"BAN":    true,
+}
+
+var (
+	retryBudgetExhausted  = metrics.NewCounter("broadcaster_retry_budget_exhausted_total", "Retries not attempted as their broadcast used up its retry budget.", "")
+	cacheDeadlineExceeded = metrics.NewCounter("broadcaster_cache_deadline_exceeded_total", "Requests to a cache cut short by the cache deadline, retries included.", "cache")
+)
+
+// retryBudget caps the retries of all the requests of a broadcast,
+// bounding the requests of broadcasts to many failing caches.
+type retryBudget struct {
+	left int64
+}
+
+// newRetryBudget returns a budget of n retries,
+// nil, unbounded, when n isn't positive.
+func newRetryBudget(n int) *retryBudget {
+	if n <= 0 {
+		return nil
+	}
+	return &retryBudget{left: int64(n)}
+}
+
+// take claims a retry, returning false once the budget is used up.
+func (rb *retryBudget) take() bool {
+	if rb == nil {
+		return true
+	}
+	return atomic.AddInt64(&rb.left, -1) >= 0
+}
+
+// createHTTPClient returns a client for a cache. Requests are bounded
+// by the connect, TLS handshake and response header timeouts, those
+// of the cache overriding Config's, a slow body is only bounded by
+// Config.RequestTimeout. Redirects are only followed up to
+// Config.MaxRedirects, so that broadcasts go where they're
+// configured to.
+func (b *Broadcaster) createHTTPClient(cache dao.Cache) *http.Client {
+	d := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: defaultLocalAddr.IP, Zone: defaultLocalAddr.Zone},
+		KeepAlive: 2 * time.Minute,
+		Timeout:   durationOr(cache.ConnectTimeout, b.cfg.ConnectTimeout),
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableCompression:    true,
+			Proxy:                 proxyFromEnvironment,
+			MaxIdleConnsPerHost:   maxIdleConnections,
+			DisableKeepAlives:     false,
+			DialContext:           dialContext(d),
+			TLSHandshakeTimeout:   durationOr(cache.TLSHandshakeTimeout, b.cfg.TLSHandshakeTimeout),
+			ResponseHeaderTimeout: durationOr(cache.ResponseHeaderTimeout, b.cfg.ResponseHeaderTimeout),
+		},
+		Timeout: b.cfg.RequestTimeout,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) > b.cfg.MaxRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	return client
+}
+
+// durationOr returns d, or def when d isn't set.
+func durationOr(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// transferred counts the bytes of the requests to a cache: the
+// bodies sent and those of the responses received, truncated when
+// a body wasn't read to its end. It also counts the requests sent,
+// and keeps the Retry-After of the last answer.
+type transferred struct {
+	sent      int64
+	received  int64
+	truncated bool
+
+	attempts   int
+	retryAfter time.Duration
+}
+
+// doRequest sends a request to the cache, attempt counting
+// the retries which preceded it. The bytes transferred are
+// added to t when it isn't nil.
+func (b *Broadcaster) doRequest(ctx context.Context, cache dao.Cache, attempt int, t *transferred) (status int, err error) {
+	ctx, span := b.cfg.Tracer.Start(ctx, "cache request", tracing.KindClient)
+	defer func() {
+		span.SetAttribute("http.response.status_code", status)
+		span.SetError(err)
+		span.End()
+	}()
+
+	b.mu.RLock()
+	client := b.clients[cache.Name]
+	b.mu.RUnlock()
+	if client == nil {
+		// The cache may be broadcast to before its client is
+		// warmed up, e.g. while the configuration is reloaded.
+		b.mu.Lock()
+		if client = b.clients[cache.Name]; client == nil {
+			client = b.createHTTPClient(cache)
+			b.clients[cache.Name] = client
+		}
+		b.mu.Unlock()
+	}
+
+	method := cache.Method
+	banHeader, banExpression, translated := banTranslation(cache)
+	if translated {
+		method = "BAN"
+	}
+
+	reqString := targetURL(cache.Address, cache)
+	span.SetAttribute("broadcaster.cache", cache.Name)
+	span.SetAttribute("http.request.method", method)
+	span.SetAttribute("url.full", reqString)
+	span.SetAttribute("http.request.resend_count", attempt)
+
+	body, encoding, err := requestBody(cache)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// The body of the response is only read for
+	// Config.ResponseBodyTimeout, see readResponseBody.
+	bodyCtx, cancelBody := context.WithCancel(ctx)
+	defer cancelBody()
+
+	dialCtx, address := dialAddress(bodyCtx, cache.Address)
+	r, err := http.NewRequestWithContext(dialCtx, method, targetURL(address, cache), body)
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Preserve the headers
+	for k, v := range cache.Headers {
+		if isSurrogateKeyHeader(k) || k == hopHeader || isForwardedHeader(k) || !b.forwardsHeader(cache, k) {
+			continue
+		}
+		r.Header.Set(k, strings.Join(v, " "))
+	}
+	for k, v := range cache.StaticHeaders {
+		if r.Header.Get(k) != "" && !overridesHeader(cache, k) {
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+	if translated {
+		r.Header.Set(banHeader, banExpression)
+	}
+	b.setHops(r, cache)
+	setForwarded(r, cache)
+	if encoding != "" {
+		r.Header.Set("Content-Encoding", encoding)
+	}
+	setSurrogateKeys(r, cache)
+	if !b.keepsUserAgent(cache) {
+		r.Header.Set("User-Agent", b.cfg.UserAgent)
+	}
+	// The "Host" header is the hardest
+	r.Header.Set("X-Host", cache.Headers.Get("Host"))
+	r.Host = cache.Headers.Get("Host")
+	if _, ok := socketPath(cache.Address); ok && r.Host == "" {
+		r.Host = "localhost"
+	}
+	tracing.Inject(ctx, r.Header)
+
+	signRequest(r, cache, time.Now())
+
+	resp, err := client.Do(r)
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer resp.Body.Close()
+
+	timer := time.AfterFunc(b.cfg.ResponseBodyTimeout, cancelBody)
+	received, truncated, err := readResponseBody(resp.Body, b.maxResponseBody(cache))
+	timer.Stop()
+	if err != nil && bodyCtx.Err() != nil && ctx.Err() == nil {
+		// The cache sent its body too slowly, its status stands.
+		truncated, err = true, nil
+	}
+	if t != nil {
+		// The body of the request was sent once answered.
+		if r.ContentLength > 0 {
+			t.sent += r.ContentLength
+		}
+		t.received += received
+		t.truncated = t.truncated || truncated
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if t != nil {
+		t.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+
+	return resp.StatusCode, err
+
+}
+
+// readResponseBody discards the body of a response, reading up to
+// max bytes of it so that a cache streaming a large or never-ending
+// body doesn't hold up the worker, and tells whether it was
+// truncated. The connection of a truncated body isn't reused.
+func readResponseBody(body io.Reader, max int64) (int64, bool, error) {
+	received, err := io.Copy(ioutil.Discard, io.LimitReader(body, max+1))
+	if received > max {
+		return received, true, nil
+	}
+	return received, false, err
+}
+
+// maxResponseBody returns the number of bytes of the responses of
+// the cache read, its own limit overriding Config.MaxResponseBody.
+func (b *Broadcaster) maxResponseBody(cache dao.Cache) int64 {
+	if cache.MaxResponseBody > 0 {
+		return cache.MaxResponseBody
+	}
+	return b.cfg.MaxResponseBody
+}
+
+// jobWorker listens on the jobs channel and handles
+// any incoming job.
+func (b *Broadcaster) jobWorker(jobs <-chan *Job) {
+	for job := range jobs {
+		b.dispatchJob(job)
+	}
+}
+
+// dispatchJob processes the job once granted a slot
+// of Config.MaxConcurrency.
+func (b *Broadcaster) dispatchJob(job *Job) {
+	if b.dispatch.acquire(job.Ctx, job.Cache.Priority) {
+		defer b.dispatch.release()
+	}
+
+	if !job.start() {
+		return
+	}
+	atomic.AddUint64(&b.jobsProcessed, 1)
+
+	if err := job.Ctx.Err(); err != nil {
+		atomic.AddUint64(&b.jobsFailed, 1)
+		job.Result <- cancelledResult(err)
+		return
+	}
+
+	if !b.safeProcessJob(job) {
+		atomic.AddUint64(&b.jobsFailed, 1)
+	}
+}
+
+// safeProcessJob processes the job, recovering from a panic
+// so that the worker lives on. The job then fails with a 500.
+func (b *Broadcaster) safeProcessJob(job *Job) (succeeded bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			panicsRecovered.Inc("worker")
+			b.log("ERROR Recovered from panic broadcasting to cache ", job.Cache.Name, ": ", fmt.Sprint(p), "\n", string(debug.Stack()))
+
+			// The result may have been sent before the panic.
+			select {
+			case job.Result <- Result{Status: http.StatusInternalServerError, Reason: reasonPanic, Error: fmt.Sprint(p)}:
+			default:
+			}
+			succeeded = false
+		}
+	}()
+
+	return b.processJob(job)
+}
+
+// processJob broadcasts the job to its cache, retrying failed
+// requests, and reports the outcome. It returns whether the
+// cache succeeded.
+func (b *Broadcaster) processJob(job *Job) bool {
+	cache := job.Cache
+	start := time.Now()
+
+	ctx := job.Ctx
+	if b.cfg.CacheDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.CacheDeadline)
+		defer cancel()
+	}
+
+	var t transferred
+	retries := b.retries(cache, job.retries)
+	out, err := b.doRequestWithRetries(ctx, cache, retries, job.retryBudget, &t)
+
+	// Give the fallback a go once the primary is exhausted.
+	if err != nil && cache.FallbackAddress != "" && ctx.Err() == nil {
+		b.log("Cache ", cache.Name, " failed, trying fallback ", cache.FallbackAddress, ": ", err.Error(), "\n")
+		cache.Address = cache.FallbackAddress
+		out, err = b.doRequestWithRetries(ctx, cache, retries, job.retryBudget, &t)
+	}
+
+	var result Result
+	if ctxErr := job.Ctx.Err(); err != nil && ctxErr != nil {
+		result = cancelledResult(ctxErr)
+	} else if err != nil && ctx.Err() != nil {
+		cacheDeadlineExceeded.Inc(cache.Name)
+		result = Result{Status: http.StatusGatewayTimeout, Reason: reasonCacheDeadline, Error: fmt.Sprintf("Cache deadline of %s exceeded after %d attempts.", b.cfg.CacheDeadline, t.attempts)}
+	} else if err != nil {
+		result = Result{Status: out, Reason: errorReason(err), Error: errorString(err)}
+	} else if isRedirect(out) {
+		result = Result{Status: out, Reason: reasonRedirected}
+	} else {
+		result = Result{Status: out}
+	}
+
+	if job.Cache.FallbackAddress != "" {
+		result.Endpoint = cache.Address
+	}
+
+	result.Duration = time.Since(start)
+	result.BytesSent, result.BytesReceived = t.sent, t.received
+	if t.attempts > 1 {
+		result.Attempts = t.attempts
+	}
+	result.Truncated = t.truncated
+	b.checkSlowCache(cache, result.Duration)
+
+	succeeded := err == nil && b.successful(cache, out)
+	result.Accepted = succeeded && !isSuccess(out)
+
+	if b.deadLetters != nil && !succeeded && job.Ctx.Err() == nil {
+		b.recordDeadLetter(cache, result)
+	}
+	if b.replay != nil && job.Ctx.Err() == nil {
+		if b.replayable(cache, out, err) {
+			b.recordFailure(job.Cache)
+		} else if err == nil {
+			b.replay.healthy(cache.Name)
+		}
+	}
+
+	counters := b.countersFor(cache.Name)
+	atomic.AddUint64(&counters.bytesSent, uint64(t.sent))
+	atomic.AddUint64(&counters.bytesReceived, uint64(t.received))
+	bytesSent.Add(cache.Name, uint64(t.sent))
+	bytesReceived.Add(cache.Name, uint64(t.received))
+	if succeeded {
+		atomic.AddUint64(&counters.succeeded, 1)
+	} else {
+		atomic.AddUint64(&counters.failed, 1)
+	}
+
+	job.Result <- result
+
+	return succeeded
+}
+
+// doRequestWithRetries sends the request to the cache, retrying it
+// on transport errors and on the statuses of retriedStatus, up to
+// retries times within the budget. A cache answering with a
+// Retry-After is given the time it asked for, up to maxRetryAfter.
+func (b *Broadcaster) doRequestWithRetries(ctx context.Context, cache dao.Cache, retries int, budget *retryBudget, t *transferred) (int, error) {
+	var out int
+	var err error
+
+	if t == nil {
+		t = &transferred{}
+	}
+
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			if !budget.take() {
+				retryBudgetExhausted.Inc("")
+				b.log("Retry budget exhausted, not retrying ", cache.Method, " ", cache.Item, " to ", cache.Name, "\n")
+				break
+			}
+			atomic.AddUint64(&b.countersFor(cache.Name).retried, 1)
+
+			if !waitRetryAfter(ctx, t.retryAfter) {
+				break
+			}
+		}
+
+		t.attempts++
+		t.retryAfter = 0
+		out, err = b.doRequest(ctx, cache, i, t)
+
+		if ctx.Err() != nil {
+			break
+		}
+		if err == nil && !b.retriedStatus(cache, out) {
+			break
+		}
+
+		// Retries reuse the client of the cache, its transport
+		// having dropped the failed connection. Clients are only
+		// replaced by reloads and by reconnect.
+	}
+
+	return out, err
+}
+
+// retriedStatus tells whether the status of the cache is retried, as
+// its retry_on_status or Config.RetryOnStatus say.
+func (b *Broadcaster) retriedStatus(cache dao.Cache, status int) bool {
+	codes := cache.RetryOnStatus
+	if codes == nil {
+		codes = b.cfg.RetryOnStatus
+	}
+	return codes.Contains(status)
+}
+
+// maxRetryAfter caps the time waited for before retrying a cache
+// which answered with a Retry-After, so that a broadcast isn't held
+// up for long by a single cache.
+const maxRetryAfter = 10 * time.Second
+
+// parseRetryAfter returns the time a Retry-After value, in seconds
+// or an HTTP date, asks for, 0 when it's invalid or empty.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// waitRetryAfter waits for d, up to maxRetryAfter, returning
+// false if the broadcast is cancelled meanwhile.
+func waitRetryAfter(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retries returns the number of times a failed request to the cache
+// may be retried, that of its broadcast overriding Config.Retries when
+// set, and none for non-idempotent methods whose side effects could
+// be applied twice.
+func (b *Broadcaster) retries(cache dao.Cache, override *int) int {
+	if !b.idempotent(cache) && !b.cfg.RetryUnsafe {
+		return 0
+	}
+	if override != nil {
+		return *override
+	}
+	return b.cfg.Retries
+}
+
+// idempotent tells whether the method sent to the cache, once
+// translated, may safely be sent more than once.
+func (b *Broadcaster) idempotent(cache dao.Cache) bool {
+	method := cache.Method
+	if _, _, translated := banTranslation(cache); translated {
+		method = "BAN"
+	}
+	return idempotentMethods[strings.ToUpper(method)]
+}
+
+// awaitResult waits for the outcome of the job, or for the
+// broadcast to be cancelled.
+func awaitResult(ctx context.Context, job *Job) Result {
+	select {
+	case result := <-job.Result:
+		return result
+	case <-ctx.Done():
+		// Jobs which haven't started yet are dropped,
+		// running ones are cancelled through ctx.
+		if job.drop() {
+			return cancelledResult(ctx.Err())
+		}
+		return <-job.Result
+	}
+}
+
+func (b *Broadcaster) warmUpHttpClient(cache dao.Cache) error {
+	client := b.createHTTPClient(cache)
+
+	b.mu.Lock()
+	previous := b.clients[cache.Name]
+	b.clients[cache.Name] = client
+	b.mu.Unlock()
+
+	// Requests in flight on the previous client finish on their
+	// connections, closed once back in its pool a while later.
+	if previous != nil {
+		previous.CloseIdleConnections()
+		time.AfterFunc(replacedClientGrace, previous.CloseIdleConnections)
+	}
+	return nil
+}
+
+// replacedClientGrace is the time given to the requests in flight on a
+// replaced client before the connections they leave behind are closed.
+const replacedClientGrace = time.Minute
+
+// reconnect replaces the client of the cache, dropping its pooled
+// connections, e.g. once a cache was replaced behind its address. It
+// returns false when the cache isn't configured.
+func (b *Broadcaster) reconnect(cacheName string) (bool, error) {
+	b.mu.RLock()
+	var cache dao.Cache
+	found := false
+	for _, c := range b.allCaches {
+		if c.Name == cacheName {
+			cache, found = c, true
+			break
+		}
+	}
+	b.mu.RUnlock()
+
+	if !found {
+		return false, nil
+	}
+	return true, b.warmUpHttpClient(cache)
+}
+
+// clientChanged tells whether the client of a cache must be replaced
+// for its new configuration. Clients only depend on the addresses and
+// timeouts of their cache, the TLS settings being those of Config.
+func clientChanged(previous, cache dao.Cache) bool {
+	return previous.Address != cache.Address || previous.FallbackAddress != cache.FallbackAddress ||
+		previous.ConnectTimeout != cache.ConnectTimeout ||
+		previous.TLSHandshakeTimeout != cache.TLSHandshakeTimeout ||
+		previous.ResponseHeaderTimeout != cache.ResponseHeaderTimeout
+}
+
+// setUpHttpClients warms up the clients of the caches which are new
+// or changed since the previous configuration, those of the others
+// keeping their pooled connections, and closes the clients of the
+// caches which are gone.
+func (b *Broadcaster) setUpHttpClients(previous map[string]dao.Cache) error {
+	b.mu.Lock()
+	var caches []dao.Cache
+	configured := make(map[string]bool, len(b.allCaches))
+	for _, cache := range b.allCaches {
+		configured[cache.Name] = true
+		old, found := previous[cache.Name]
+		if !found || clientChanged(old, cache) || b.clients[cache.Name] == nil {
+			caches = append(caches, cache)
+		}
+	}
+	for name, client := range b.clients {
+		if !configured[name] {
+			client.CloseIdleConnections()
+			delete(b.clients, name)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, cache := range caches {
+		err := b.warmUpHttpClient(cache)
+		if err != nil {
+			return errors.New(fmt.Sprintf("* Cache [%s] encountered an error when warming up connections.\n    - %s\n", cache.Name, err.Error()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// Reasons reported for requests which never got an answer from a cache.
+const (
+	reasonTimeout        = "timeout"
+	reasonRefused        = "connection_refused"
+	reasonDNS            = "dns_failure"
+	reasonTransportError = "transport_error"
+
+	// Broadcasting to the cache panicked.
+	reasonPanic = "panic"
+
+	// The cache belongs to a disabled group
+	// and wasn't broadcast to.
+	reasonSkipped = "skipped"
+
+	// The cache was disabled and not broadcast to.
+	reasonDisabled = "disabled"
+
+	// The cache was within a maintenance window
+	// and not broadcast to.
+	reasonMaintenance = "maintenance"
+
+	// The broadcast was cancelled, or ran out of time,
+	// before the cache answered.
+	reasonCancelled = "cancelled"
+
+	// The job queue of the cache had no room left when the
+	// broadcast of a sequential group reached the cache.
+	reasonQueueSaturated = "queue_saturated"
+
+	// The cache wasn't sent the broadcast, as an earlier
+	// cache of a group stopping on failure failed.
+	reasonNotAttempted = "not_attempted"
+
+	// The deadline set by the broadcast's caller
+	// passed before the cache answered.
+	reasonDeadlineExceeded = "deadline_exceeded"
+
+	// Config.CacheDeadline passed before the cache
+	// answered, retries included.
+	reasonCacheDeadline = "cache_deadline_exceeded"
+
+	// The cache answered with a redirect which wasn't
+	// followed, see Config.MaxRedirects.
+	reasonRedirected = "redirected"
+
+	// The cache of a replayed dead letter isn't
+	// configured any more.
+	reasonUnknownCache = "unknown_cache"
+
+	// The broadcast recovered from the journal wipes a protected
+	// path without confirmation, see checkProtected.
+	reasonProtected = "protected"
+)
+
+// Policies deciding the status code of a broadcast from its results.
+const (
+	policyOK         = "ok"
+	policyFirstError = "first-error"
+	policyAllOK      = "all-ok"
+	policyMajority   = "majority"
+	policyWorst      = "worst"
+)
+
+// Result is the outcome of a broadcast against a single cache.
+type Result struct {
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Endpoint is the address which handled the request, reported
+	// for caches with a fallback address only.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// URL is the final URL sent to the cache, reported
+	// in verbose responses only.
+	URL string `json:"url,omitempty"`
+
+	// Sent is the request actually sent to caches
+	// translating the broadcast, e.g. to a BAN.
+	Sent *SentRequest `json:"sent,omitempty"`
+
+	// DryRun marks the results of dry runs, which
+	// weren't sent to the cache.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Accepted marks statuses outside of 2xx counted as successes
+	// by the success codes of the cache, such as a 404 to a PURGE.
+	Accepted bool `json:"accepted,omitempty"`
+
+	// Truncated marks caches whose response body was cut short,
+	// as it went past its limit or took too long to read.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Attempts is the number of requests sent to the cache,
+	// fallback included, reported once retried.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Duration is the time taken by the cache to answer,
+	// retries and fallback included.
+	Duration time.Duration `json:"-"`
+
+	// BytesSent and BytesReceived count the bodies sent to the
+	// cache and received from it, retries and fallback included.
+	BytesSent     int64 `json:"-"`
+	BytesReceived int64 `json:"-"`
+}
+
+// errorReason classifies a failed cache request into
+// a machine-readable reason.
+func errorReason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return reasonDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return reasonRefused
+	case errors.Is(err, context.DeadlineExceeded):
+		return reasonTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return reasonTimeout
+	}
+
+	return reasonTransportError
+}
+
+func notAttemptedResult(failed string) Result {
+	return Result{Reason: reasonNotAttempted, Error: fmt.Sprintf("Not attempted as cache %s failed.", failed)}
+}
+
+// succeeded tells whether the cache answered with a 2xx,
+// or a status accepted as a success.
+func (r Result) succeeded() bool {
+	return r.Error == "" && (isSuccess(r.Status) || r.Accepted)
+}
+
+// classifiedStatus returns the status of the result, successes,
+// such as a 204 or an accepted 404, counting as 200 towards the
+// status of the broadcast.
+func (r Result) classifiedStatus() int {
+	if r.Error == "" && (isSuccess(r.Status) || r.Accepted) {
+		return http.StatusOK
+	}
+	return r.Status
+}
+
+// Phases of a request to a cache which may time out.
+const (
+	phaseConnect        = "connect timeout"
+	phaseTLSHandshake   = "TLS handshake timeout"
+	phaseResponseHeader = "response timeout"
+)
+
+// timeoutPhase tells which phase of a failed cache request
+// timed out, empty if it didn't time out in any of them.
+func timeoutPhase(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		return phaseConnect
+	}
+
+	// The transport only reports these by their message.
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "TLS handshake timeout"):
+		return phaseTLSHandshake
+	case strings.Contains(msg, "timeout awaiting response headers"):
+		return phaseResponseHeader
+	}
+	return ""
+}
+
+// errorString describes a failed cache request, prefixed
+// with the phase which timed out, if any.
+func errorString(err error) string {
+	if phase := timeoutPhase(err); phase != "" {
+		return phase + ": " + err.Error()
+	}
+	return err.Error()
+}
+
+func cancelledResult(err error) Result {
+	return Result{Status: http.StatusGatewayTimeout, Reason: reasonCancelled, Error: err.Error()}
+}
+
+func validateStatusPolicy(policy string) error {
+	switch policy {
+	case policyOK, policyFirstError, policyAllOK, policyMajority, policyWorst:
+		return nil
+	}
+	return fmt.Errorf("Unknown status policy %q.", policy)
+}
+
+// isRedirect tells whether the status is one of
+// the redirects a client would follow.
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func isSuccess(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// successful tells whether the status of the cache is counted as a
+// success, as its success codes or Config.SuccessCodes say, 2xx by
+// default.
+func (b *Broadcaster) successful(cache dao.Cache, status int) bool {
+	codes := cache.SuccessCodes
+	if codes == nil {
+		codes = b.cfg.SuccessCodes
+	}
+	if codes == nil {
+		return isSuccess(status)
+	}
+	return codes.Contains(status)
+}
+
+// aggregateStatus computes the status code of a broadcast from
+// the per cache results, in broadcast order.
+//
+//   - ok: always 200.
+//   - first-error: the first status which isn't a success.
+//   - all-ok: 200 if every cache succeeded, 502 otherwise.
+//   - majority: 200 if most caches succeeded, 502 otherwise.
+//   - worst: the highest status code, successes counting as 200.
+//
+// Successes are 2xx statuses and those accepted by the success
+// codes of their cache, see classifiedStatus.
+func aggregateStatus(policy string, results []Result) int {
+	status := http.StatusOK
+
+	switch policy {
+	case policyFirstError:
+		for _, r := range results {
+			if r.classifiedStatus() != http.StatusOK {
+				return r.Status
+			}
+		}
+	case policyAllOK:
+		for _, r := range results {
+			if !isSuccess(r.classifiedStatus()) {
+				return http.StatusBadGateway
+			}
+		}
+	case policyMajority:
+		ok := 0
+		for _, r := range results {
+			if isSuccess(r.classifiedStatus()) {
+				ok++
+			}
+		}
+		if ok*2 <= len(results) {
+			return http.StatusBadGateway
+		}
+	case policyWorst:
+		for _, r := range results {
+			if r.classifiedStatus() > status {
+				status = r.classifiedStatus()
+			}
+		}
+	}
+
+	return status
+}
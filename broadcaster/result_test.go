@@ -0,0 +1,669 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestErrorReason(t *testing.T) {
+	cases := map[string]error{
+		reasonDNS:            &net.DNSError{Err: "no such host", Name: "cache.invalid", IsNotFound: true},
+		reasonTransportError: errors.New("something else"),
+	}
+
+	for want, err := range cases {
+		if got := errorReason(err); got != want {
+			t.Errorf("%v: expected %s, got %s", err, want, got)
+		}
+	}
+}
+
+func TestDoRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	cache := dao.Cache{Name: "slow", Address: backend.URL, Method: "PURGE", Item: "/", Headers: http.Header{}}
+
+	b := newTestBroadcaster(t, Config{})
+
+	b.mu.Lock()
+	b.clients[cache.Name] = &http.Client{Timeout: 50 * time.Millisecond}
+	b.mu.Unlock()
+
+	_, err := b.doRequest(context.Background(), cache, 0, nil)
+	if err == nil {
+		t.Fatal("expected the request to time out")
+	}
+	if got := errorReason(err); got != reasonTimeout {
+		t.Errorf("expected %s, got %s (%v)", reasonTimeout, got, err)
+	}
+}
+
+func TestDoRequestWithoutClient(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+	cache := newTestCache(t, b, "cold", func(w http.ResponseWriter, r *http.Request) {})
+
+	b.mu.Lock()
+	delete(b.clients, cache.Name)
+	b.mu.Unlock()
+
+	if status, err := b.doRequest(context.Background(), cache, 0, nil); err != nil || status != http.StatusOK {
+		t.Errorf("expected the client to be warmed up on demand, got %d %v", status, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients[cache.Name] == nil {
+		t.Error("expected the client to be kept")
+	}
+}
+
+func TestDoRequestRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cache := dao.Cache{Name: "down", Address: "http://" + addr, Method: "PURGE", Item: "/", Headers: http.Header{}}
+
+	b := newTestBroadcaster(t, Config{})
+
+	b.mu.Lock()
+	b.clients[cache.Name] = b.createHTTPClient(cache)
+	b.mu.Unlock()
+
+	_, err = b.doRequest(context.Background(), cache, 0, nil)
+	if err == nil {
+		t.Fatal("expected the connection to be refused")
+	}
+	if got := errorReason(err); got != reasonRefused {
+		t.Errorf("expected %s, got %s (%v)", reasonRefused, got, err)
+	}
+}
+
+func TestTimeoutPhases(t *testing.T) {
+	// The listener accepts connections but never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	b := newTestBroadcaster(t, Config{})
+	silent := dao.Cache{Name: "silent", Address: "http://" + l.Addr().String(), Method: "PURGE", Item: "/", Headers: http.Header{}, ResponseHeaderTimeout: 50 * time.Millisecond}
+	// A deadline already past when dialing stands for a blackholed address.
+	blackholed := dao.Cache{Name: "blackholed", Address: "http://" + l.Addr().String(), Method: "PURGE", Item: "/", Headers: http.Header{}, ConnectTimeout: time.Nanosecond}
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{silent, blackholed}})
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge", Retries: new(int)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"silent": phaseResponseHeader, "blackholed": phaseConnect} {
+		if r := res.Caches[name]; r.Reason != reasonTimeout || !strings.HasPrefix(r.Error, want+": ") {
+			t.Errorf("%s: expected a %s, got %+v", name, want, r)
+		}
+	}
+}
+
+func TestAggregateStatus(t *testing.T) {
+	mixed := []Result{{Status: 200}, {Status: 204}, {Status: 404}, {Status: 500}, {Status: 200}}
+	failing := []Result{{Status: 200}, {Status: 503}, {Status: 500}}
+	accepted := []Result{{Status: 200}, {Status: 404, Accepted: true}}
+
+	cases := []struct {
+		policy  string
+		results []Result
+		want    int
+	}{
+		{policyOK, mixed, 200},
+		{policyFirstError, mixed, 404},
+		{policyFirstError, []Result{{Status: 200}}, 200},
+		{policyFirstError, []Result{{Status: 200}, {Status: 204}}, 200},
+		{policyAllOK, mixed, 502},
+		{policyAllOK, []Result{{Status: 200}, {Status: 204}}, 200},
+		{policyMajority, mixed, 200},
+		{policyMajority, failing, 502},
+		{policyWorst, mixed, 500},
+		{policyWorst, failing, 503},
+		{policyWorst, []Result{{Status: 204}, {Status: 202}}, 200},
+		{policyAllOK, accepted, 200},
+		{policyFirstError, accepted, 200},
+		{policyWorst, accepted, 200},
+	}
+
+	for _, c := range cases {
+		if got := aggregateStatus(c.policy, c.results); got != c.want {
+			t.Errorf("%s: expected %d, got %d", c.policy, c.want, got)
+		}
+	}
+}
+
+func TestUnknownStatusPolicyIsRejected(t *testing.T) {
+	if err := validateStatusPolicy("best"); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+	if _, err := New(Config{StatusPolicy: "best"}); err == nil {
+		t.Error("expected New to reject an unknown policy")
+	}
+}
+
+func TestProcessJobFallsBack(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := "http://" + l.Addr().String()
+	l.Close()
+
+	b := newTestBroadcaster(t, Config{})
+
+	cache := newTestCache(t, b, "backed-up", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	fallback := cache.Address
+	cache.Address, cache.FallbackAddress = primary, fallback
+
+	job := newJob(context.Background(), cache)
+	b.processJob(job)
+
+	res := <-job.Result
+	if res.Status != http.StatusNoContent || res.Error != "" {
+		t.Errorf("expected the fallback to answer 204, got %+v", res)
+	}
+	if res.Endpoint != fallback {
+		t.Errorf("expected the fallback %s to be reported as endpoint, got %s", fallback, res.Endpoint)
+	}
+}
+
+func TestOnlyIdempotentMethodsAreRetried(t *testing.T) {
+	for method, want := range map[string]int32{"GET": 2, "POST": 1} {
+		b := newTestBroadcaster(t, Config{Retries: 1})
+
+		var attempts int32
+		cache := newTestCache(t, b, "flaky", func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		})
+		cache.Method = method
+
+		if _, err := b.doRequestWithRetries(context.Background(), cache, b.retries(cache, nil), nil, nil); err == nil {
+			t.Fatalf("%s: expected the request to fail", method)
+		}
+		if n := atomic.LoadInt32(&attempts); n != want {
+			t.Errorf("%s: expected %d attempts, got %d", method, want, n)
+		}
+	}
+
+	b := newTestBroadcaster(t, Config{Retries: 1, RetryUnsafe: true})
+	if n := b.retries(dao.Cache{Method: "POST"}, nil); n != 1 {
+		t.Errorf("expected RetryUnsafe to retry POST, got %d retries", n)
+	}
+}
+
+func TestRetryBudgetCapsBroadcastRetries(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Retries: 3, RetryBudget: 5})
+
+	var attempts int32
+	var caches []dao.Cache
+	for i := 0; i < 20; i++ {
+		caches = append(caches, newTestCache(t, b, "failing"+strconv.Itoa(i), func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}))
+	}
+	setTestGroups(b, dao.Group{Name: "edge", Caches: caches})
+
+	exhausted := retryBudgetExhausted.Value("")
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Caches) != 20 {
+		t.Fatalf("expected the failures of all caches, got %d", len(res.Caches))
+	}
+	if n := atomic.LoadInt32(&attempts); n != 25 {
+		t.Errorf("expected 20 attempts and 5 retries, got %d attempts", n)
+	}
+	if n := retryBudgetExhausted.Value("") - exhausted; n == 0 {
+		t.Error("expected the exhausted budget to be counted")
+	}
+}
+
+func TestRetriesHeaderOverridesRetries(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Retries: 1, MaxRetries: 4, StatusPolicy: policyAllOK})
+
+	// The cache drops the connection of all but every fourth attempt.
+	var attempts int32
+	flaky := newTestCache(t, b, "flaky", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1)%4 != 0 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{flaky}})
+
+	for _, tc := range []struct {
+		retries      string
+		wantStatus   int
+		wantAttempts int32
+	}{
+		{"", http.StatusBadGateway, 2},
+		{"3", http.StatusOK, 4},
+		{"9", http.StatusOK, 4}, // Clamped to MaxRetries, succeeding on the fourth attempt.
+		{"-1", http.StatusBadRequest, 0},
+		{"many", http.StatusBadRequest, 0},
+	} {
+		atomic.StoreInt32(&attempts, 0)
+
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		if tc.retries != "" {
+			r.Header.Set("X-Retries", tc.retries)
+		}
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+
+		if w.Code != tc.wantStatus {
+			t.Errorf("X-Retries %q: expected %d, got %d", tc.retries, tc.wantStatus, w.Code)
+		}
+		if n := atomic.LoadInt32(&attempts); n != tc.wantAttempts {
+			t.Errorf("X-Retries %q: expected %d attempts, got %d", tc.retries, tc.wantAttempts, n)
+		}
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Retries: 3, RetryOnStatus: dao.StatusCodes{{From: 502, To: 504}}, StatusPolicy: policyAllOK})
+
+	// The cache is overloaded for its first two requests.
+	var attempts int32
+	bodies := make(chan string, 10)
+	overloaded := newTestCache(t, b, "overloaded", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	strict := newTestCache(t, b, "strict", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	strict.RetryOnStatus = dao.StatusCodes{}
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{overloaded}}, dao.Group{Name: "strict", Caches: []dao.Cache{strict}})
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge", Body: []byte("purge")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.Caches["overloaded"]; res.Status != http.StatusOK || r.Status != http.StatusOK || r.Attempts != 3 {
+		t.Errorf("expected the 503s to be retried, got %d %+v", res.Status, r)
+	}
+	for i := 0; i < 3; i++ {
+		if body := <-bodies; body != "purge" {
+			t.Errorf("expected every attempt to carry the body, got %q", body)
+		}
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	res, err = b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "strict"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.Caches["strict"]; r.Status != http.StatusServiceUnavailable || r.Attempts != 0 || atomic.LoadInt32(&attempts) != 1 {
+		t.Errorf("expected the 503 not to be retried without retry_on_status, got %+v", r)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{"Thu, 15 Oct 2026 10:00:05 GMT", 5 * time.Second},
+		{"Thu, 15 Oct 2026 09:00:00 GMT", 0},
+	} {
+		if got := parseRetryAfter(tc.value, now); got != tc.want {
+			t.Errorf("%q: expected %s, got %s", tc.value, tc.want, got)
+		}
+	}
+}
+
+func TestNoContentIsSuccess(t *testing.T) {
+	b := newTestBroadcaster(t, Config{StatusPolicy: policyFirstError})
+
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	w := httptest.NewRecorder()
+	b.reqHandler(w, httptest.NewRequest("PURGE", "/a", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the 204 to count as a success, got %d", w.Code)
+	}
+	if s := b.Stats().CacheStats["c1"]; s.Succeeded != 1 || s.Failed != 0 {
+		t.Errorf("expected c1 to have succeeded, got %+v", s)
+	}
+}
+
+func TestFirstErrorFollowsBroadcastOrder(t *testing.T) {
+	b := newTestBroadcaster(t, Config{StatusPolicy: policyFirstError})
+
+	// The first cache fails last.
+	slow := newTestCache(t, b, "slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	fast := newTestCache(t, b, "fast", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{slow, fast}})
+
+	var answered []string
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge", OnResult: func(cache string, result Result) {
+		answered = append(answered, cache)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != http.StatusInternalServerError {
+		t.Errorf("expected the status of the first cache, got %d", res.Status)
+	}
+	if !reflect.DeepEqual(answered, []string{"fast", "slow"}) {
+		t.Errorf("expected the results to be reported as the caches answer, got %v", answered)
+	}
+}
+
+func TestSuccessCodes(t *testing.T) {
+	b := newTestBroadcaster(t, Config{StatusPolicy: policyAllOK, StateDir: t.TempDir()})
+
+	missing := newTestCache(t, b, "missing", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) })
+	varnish := newTestCache(t, b, "varnish", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) })
+	varnish.SuccessCodes = dao.StatusCodes{{From: 200, To: 299}, {From: 404, To: 404}}
+	setTestGroups(b, dao.Group{Name: "strict", Caches: []dao.Cache{missing}}, dao.Group{Name: "varnish", Caches: []dao.Cache{varnish}})
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "varnish"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.Caches["varnish"]; res.Status != http.StatusOK || r.Status != http.StatusNotFound || !r.Accepted {
+		t.Errorf("expected the 404 to be accepted, got %d %+v", res.Status, r)
+	}
+
+	res, err = b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "strict"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.Caches["missing"]; res.Status != http.StatusBadGateway || r.Accepted {
+		t.Errorf("expected the 404 to fail without success codes, got %d %+v", res.Status, r)
+	}
+
+	b.cfg.SuccessCodes = dao.StatusCodes{{From: 200, To: 299}, {From: 503, To: 503}}
+	if b.replayable(dao.Cache{Method: "PURGE"}, http.StatusServiceUnavailable, nil) {
+		t.Error("expected accepted statuses not to be replayed")
+	}
+	if !b.replayable(dao.Cache{Method: "PURGE"}, http.StatusBadGateway, nil) {
+		t.Error("expected other failures to be replayed")
+	}
+}
+
+func TestRedirectsAreNotFollowed(t *testing.T) {
+	for max, want := range map[int]Result{0: {Status: http.StatusFound, Reason: reasonRedirected}, 1: {Status: http.StatusOK}} {
+		b := newTestBroadcaster(t, Config{MaxRedirects: max})
+
+		var followed int32
+		cache := newTestCache(t, b, "moved", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/elsewhere" {
+				atomic.AddInt32(&followed, 1)
+				return
+			}
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		})
+
+		job := newJob(context.Background(), cache)
+		b.processJob(job)
+
+		if res := <-job.Result; res.Status != want.Status || res.Reason != want.Reason {
+			t.Errorf("max %d: expected %+v, got %+v", max, want, res)
+		}
+		if n := atomic.LoadInt32(&followed); n != int32(max) {
+			t.Errorf("max %d: expected %d redirects followed, got %d", max, max, n)
+		}
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	b := newTestBroadcaster(t, Config{ResponseHeaderTimeout: 50 * time.Millisecond})
+	cache := dao.Cache{Name: "slow", Address: backend.URL, Method: "PURGE", Item: "/", Headers: http.Header{}}
+
+	b.mu.Lock()
+	b.clients[cache.Name] = b.createHTTPClient(cache)
+	b.mu.Unlock()
+
+	started := time.Now()
+	_, err := b.doRequest(context.Background(), cache, 0, nil)
+	if err == nil {
+		t.Fatal("expected the response headers to time out")
+	}
+	if got := errorReason(err); got != reasonTimeout {
+		t.Errorf("expected %s, got %s (%v)", reasonTimeout, got, err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("expected the timeout to fire after 50ms, took %s", elapsed)
+	}
+}
+
+func TestSlowBodyIsNotTimedOut(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	b := newTestBroadcaster(t, Config{ResponseHeaderTimeout: 50 * time.Millisecond})
+	cache := dao.Cache{Name: "trickling", Address: backend.URL, Method: "PURGE", Item: "/", Headers: http.Header{}}
+
+	b.mu.Lock()
+	b.clients[cache.Name] = b.createHTTPClient(cache)
+	b.mu.Unlock()
+
+	if status, err := b.doRequest(context.Background(), cache, 0, nil); err != nil || status != http.StatusOK {
+		t.Errorf("expected the slow body to be read, got %d %v", status, err)
+	}
+}
+
+func TestResponseBodyIsCapped(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ResponseBodyTimeout: 100 * time.Millisecond, StatusPolicy: policyAllOK})
+
+	large := newTestCache(t, b, "large", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1<<20))
+	})
+	large.MaxResponseBody = 16
+	dripping := newTestCache(t, b, "dripping", func(w http.ResponseWriter, r *http.Request) {
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+				w.Write([]byte("."))
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{large, dripping}})
+
+	start := time.Now()
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the dripping body to be cut short, took %s", elapsed)
+	}
+	if res.Status != http.StatusOK {
+		t.Errorf("expected truncated bodies to succeed, got %d %+v", res.Status, res.Caches)
+	}
+	for _, name := range []string{"large", "dripping"} {
+		if r := res.Caches[name]; r.Status != http.StatusOK || !r.Truncated || r.Error != "" {
+			t.Errorf("%s: expected a truncated 200, got %+v", name, r)
+		}
+	}
+	if r := res.Caches["large"]; r.BytesReceived > 17 {
+		t.Errorf("expected the large body to be read up to its limit, got %d bytes", r.BytesReceived)
+	}
+}
+
+// panickingTransport panics on its first request,
+// sending the following ones.
+type panickingTransport struct {
+	requests int32
+}
+
+func (t *panickingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&t.requests, 1) == 1 {
+		panic("broken transport")
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestWorkerSurvivesPanic(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	cache := newTestCache(t, b, "fragile", func(w http.ResponseWriter, r *http.Request) {})
+	b.mu.Lock()
+	b.clients[cache.Name] = &http.Client{Transport: &panickingTransport{}}
+	b.mu.Unlock()
+
+	panics := panicsRecovered.Value("worker")
+	first := newJob(context.Background(), cache)
+	second := newJob(context.Background(), cache)
+	if !b.enqueueJobs([]*Job{first, second}) {
+		t.Fatal("expected the jobs to be enqueued")
+	}
+
+	if res := <-first.Result; res.Status != http.StatusInternalServerError || res.Reason != reasonPanic {
+		t.Errorf("expected the panic to be reported, got %+v", res)
+	}
+	if got := panicsRecovered.Value("worker"); got != panics+1 {
+		t.Errorf("expected the panic to be counted, got %d", got-panics)
+	}
+
+	select {
+	case res := <-second.Result:
+		if res.Status != http.StatusOK {
+			t.Errorf("expected the next job to be sent, got %+v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the worker to survive the panic")
+	}
+}
+
+func TestCacheDeadline(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Retries: 5, ResponseHeaderTimeout: 100 * time.Millisecond, CacheDeadline: 250 * time.Millisecond})
+
+	// Without a deadline, its six attempts would take 600ms.
+	hanging := newTestCache(t, b, "hanging", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{hanging}})
+
+	exceeded := cacheDeadlineExceeded.Value("hanging")
+	start := time.Now()
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	took := time.Since(start)
+
+	if r := res.Caches["hanging"]; r.Reason != reasonCacheDeadline || r.Attempts < 2 {
+		t.Errorf("expected the cache to be retried up to its deadline, got %+v", r)
+	}
+	if took > 400*time.Millisecond {
+		t.Errorf("expected the cache to be given up at its deadline, took %s", took)
+	}
+	if cacheDeadlineExceeded.Value("hanging") != exceeded+1 {
+		t.Error("expected the exceeded deadline to be counted")
+	}
+}
+
+// brokenBody fails every read, recording whether it was closed.
+type brokenBody struct {
+	closed int32
+}
+
+func (b *brokenBody) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+func (b *brokenBody) Close() error             { atomic.StoreInt32(&b.closed, 1); return nil }
+
+// brokenBodyTransport answers every request with the body.
+type brokenBodyTransport struct {
+	body *brokenBody
+}
+
+func (t *brokenBodyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: t.body, Request: r}, nil
+}
+
+func TestDoRequestClosesFailedBodies(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	cache := newTestCache(t, b, "broken", func(w http.ResponseWriter, r *http.Request) {})
+	body := &brokenBody{}
+	b.mu.Lock()
+	b.clients[cache.Name] = &http.Client{Transport: &brokenBodyTransport{body}}
+	b.mu.Unlock()
+
+	if _, err := b.doRequest(context.Background(), cache, 0, nil); err == nil {
+		t.Error("expected the failed body to fail the request")
+	}
+	if atomic.LoadInt32(&body.closed) != 1 {
+		t.Error("expected the failed body to be closed")
+	}
+}
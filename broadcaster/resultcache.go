@@ -0,0 +1,75 @@
+package broadcaster
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+var resultCacheHits = metrics.NewCounter("broadcaster_result_cache_hits_total", "GET broadcasts answered with the results of an identical recent one.", "")
+
+// resultCache keeps the results of GET broadcasts for
+// Config.ResultCacheTTL, answering identical broadcasts
+// with them rather than sending them to the caches again.
+type resultCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedResults
+}
+
+type cachedResults struct {
+	res     Results
+	expires time.Time
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{ttl: ttl, entries: make(map[string]cachedResults)}
+}
+
+// resultKey returns the key of the results of the request, or false
+// for requests whose results aren't cached: those of other methods
+// than GET, dry runs, and verbose or streamed ones, whose responses
+// differ.
+func resultKey(req Request) (string, bool) {
+	if req.Method != http.MethodGet || req.DryRun || req.Verbose || req.OnResult != nil {
+		return "", false
+	}
+
+	// Tags narrow the caches broadcast to, as groups do.
+	tags := strings.Join(req.Tags, ",")
+	if req.AllTags {
+		tags += ";all"
+	}
+	// The host is sent on to the caches, whose virtual hosts answer
+	// the same path differently.
+	return req.Method + " " + req.Host + " " + req.Path + " " + req.Group + " " + tags, true
+}
+
+// get returns the results cached under the key, if not expired.
+func (c *resultCache) get(key string) (Results, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, found := c.entries[key]
+	if !found || time.Now().After(cached.expires) {
+		return Results{}, false
+	}
+	return cached.res, true
+}
+
+// put caches the results under the key, dropping expired ones.
+func (c *resultCache) put(key string, res Results) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, cached := range c.entries {
+		if now.After(cached.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedResults{res: res, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,86 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestResultCacheAnswersIdenticalBroadcasts(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ResultCacheTTL: 100 * time.Millisecond})
+
+	var hits int32
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { atomic.AddInt32(&hits, 1) })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	broadcast := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		b.reqHandler(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	if w := broadcast("GET", "/foo"); w.Header().Get("X-Cache") != "MISS" || w.Code != http.StatusOK {
+		t.Fatalf("expected the first broadcast to miss, got %d %v", w.Code, w.Header())
+	}
+	second := broadcast("GET", "/foo")
+	if second.Header().Get("X-Cache") != "HIT" || second.Code != http.StatusOK || second.Body.Len() == 0 {
+		t.Errorf("expected the second broadcast to hit, got %d %v", second.Code, second.Header())
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected the cache to be sent a single request, got %d", n)
+	}
+
+	broadcast("GET", "/bar")
+	broadcast("PURGE", "/foo")
+	broadcast("PURGE", "/foo")
+	if n := atomic.LoadInt32(&hits); n != 4 {
+		t.Errorf("expected other paths and methods to be broadcast, got %d requests", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if w := broadcast("GET", "/foo"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected the results to expire, got %v", w.Header())
+	}
+	if n := atomic.LoadInt32(&hits); n != 5 {
+		t.Errorf("expected the expired broadcast to be sent again, got %d requests", n)
+	}
+}
+
+func TestResultCacheKeepsHostsApart(t *testing.T) {
+	b := newTestBroadcaster(t, Config{ResultCacheTTL: time.Minute})
+
+	hosts := make(chan string, 3)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) { hosts <- r.Host })
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	broadcast := func(host string) string {
+		r := httptest.NewRequest("GET", "/foo", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+		return w.Header().Get("X-Cache")
+	}
+
+	if got := broadcast("a.example.com"); got != "MISS" {
+		t.Errorf("expected the first host to miss, got %s", got)
+	}
+	if got := broadcast("b.example.com"); got != "MISS" {
+		t.Errorf("expected another host of the same path to miss, got %s", got)
+	}
+	if got := broadcast("a.example.com"); got != "HIT" {
+		t.Errorf("expected the first host to hit, got %s", got)
+	}
+
+	close(hosts)
+	var sent []string
+	for host := range hosts {
+		sent = append(sent, host)
+	}
+	if len(sent) != 2 || sent[0] != "a.example.com" || sent[1] != "b.example.com" {
+		t.Errorf("expected each host to reach the cache once, got %v", sent)
+	}
+}
@@ -0,0 +1,40 @@
+package broadcaster
+
+import (
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// rewritePath returns the path the cache is sent for the broadcast
+// item: the cache's path_rewrite is applied first, its path_prefix
+// is then prepended.
+func rewritePath(cache dao.Cache) string {
+	path := cache.Item
+
+	if cache.PathRewrite != "" {
+		parts := strings.SplitN(cache.PathRewrite, "=", 2)
+		from, to := parts[0], parts[1]
+
+		// Only whole path segments match, /cdn doesn't rewrite /cdnjs.
+		if path == from || strings.HasPrefix(path, strings.TrimSuffix(from, "/")+"/") {
+			path = to + strings.TrimPrefix(path, from)
+		}
+	}
+
+	if cache.PathPrefix != "" {
+		path = strings.TrimSuffix(cache.PathPrefix, "/") + path
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return path
+}
+
+// targetURL returns the URL a broadcast of the item reaches the
+// cache under, at the given address of the cache.
+func targetURL(address string, cache dao.Cache) string {
+	return address + rewritePath(cache)
+}
@@ -0,0 +1,62 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestRewritePath(t *testing.T) {
+	cases := []struct {
+		prefix, rewrite, item, want string
+	}{
+		{"", "", "/products/42", "/products/42"},
+		{"/edge", "", "/products/42", "/edge/products/42"},
+		{"/edge/", "", "/", "/edge/"},
+		{"", "/cdn=", "/cdn/img.jpg", "/img.jpg"},
+		{"", "/cdn=", "/cdn", "/"},
+		{"", "/cdn=", "/cdnjs/lib.js", "/cdnjs/lib.js"},
+		{"", "/cdn=/static", "/cdn/img.jpg", "/static/img.jpg"},
+		{"/edge", "/cdn=", "/cdn/img.jpg", "/edge/img.jpg"},
+	}
+
+	for _, c := range cases {
+		cache := dao.Cache{PathPrefix: c.prefix, PathRewrite: c.rewrite, Item: c.item}
+		if got := rewritePath(cache); got != c.want {
+			t.Errorf("prefix %q rewrite %q of %s: expected %s, got %s", c.prefix, c.rewrite, c.item, c.want, got)
+		}
+	}
+}
+
+func TestVerboseResponseReportsFinalURL(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	var received string
+	cache := newTestCache(t, b, "edge1", func(w http.ResponseWriter, r *http.Request) {
+		received = r.URL.Path
+	})
+	cache.PathRewrite = "/cdn="
+	cache.PathPrefix = "/edge"
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache}})
+
+	r := httptest.NewRequest("PURGE", "/cdn/img.jpg", nil)
+	r.Header.Set("X-Group", "edge")
+	r.Header.Set("X-Broadcast-Verbose", "true")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	var body map[string]Result
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if received != "/edge/img.jpg" {
+		t.Errorf("expected the cache to receive /edge/img.jpg, got %s", received)
+	}
+	if want := cache.Address + "/edge/img.jpg"; body["edge1"].URL != want {
+		t.Errorf("expected the response to report %s, got %+v", want, body["edge1"])
+	}
+}
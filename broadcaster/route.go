@@ -0,0 +1,83 @@
+package broadcaster
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errNoPathGroup is returned for requests under the path
+// groups prefix which don't name a group.
+var errNoPathGroup = errors.New("no group in path")
+
+// AllCaches is the group name standing for all caches,
+// whatever Config.DefaultGroup.
+const AllCaches = "*"
+
+// requestGroup returns the group broadcast to for the group named
+// by a request: Config.DefaultGroup if it names none, and the empty
+// name of all caches for AllCaches.
+func (b *Broadcaster) requestGroup(name string) string {
+	if name == "" {
+		name = b.cfg.DefaultGroup
+	}
+	if name == AllCaches {
+		return ""
+	}
+	return name
+}
+
+// Target returns the group and the path a request is broadcast to.
+// Under Config.PathGroupsPrefix the group is the first segment of
+// the path, /_group/edge/products/42 broadcasting /products/42 to
+// edge. Other requests name their group in the X-Group header, or
+// are broadcast to Config.DefaultGroup.
+func (b *Broadcaster) Target(r *http.Request) (group, path string, err error) {
+	prefix := b.cfg.PathGroupsPrefix
+	escaped := r.URL.EscapedPath()
+
+	if prefix == "" || !strings.HasPrefix(escaped, prefix) {
+		for k, v := range r.Header {
+			if strings.ToLower(k) == "x-group" {
+				return b.requestGroup(v[0]), r.URL.Path, nil
+			}
+		}
+		return b.requestGroup(""), r.URL.Path, nil
+	}
+
+	// Split before unescaping, an escaped slash
+	// belongs to the name of the group.
+	rest := strings.TrimPrefix(escaped, prefix)
+	path = "/"
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest, path = rest[:i], rest[i:]
+	}
+
+	if group, err = url.PathUnescape(rest); err != nil {
+		return "", "", err
+	}
+	if group == "" {
+		return "", "", errNoPathGroup
+	}
+	if path, err = url.PathUnescape(path); err != nil {
+		return "", "", err
+	}
+
+	return b.requestGroup(group), path, nil
+}
+
+// RenderPath returns the path broadcast to the caches for the path
+// and raw query of a request, as laid out by Config.PathTemplate, e.g.
+// /invalidate{path}?{query}. The ? of an empty query is left out.
+func (b *Broadcaster) RenderPath(path, query string) string {
+	if b.cfg.PathTemplate == "" {
+		return path
+	}
+
+	rendered := strings.NewReplacer("{path}", path, "{query}", query).Replace(b.cfg.PathTemplate)
+	if query == "" {
+		rendered = strings.TrimSuffix(rendered, "?")
+	}
+	return rendered
+}
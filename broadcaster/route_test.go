@@ -0,0 +1,134 @@
+package broadcaster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestTarget(t *testing.T) {
+	b := newTestBroadcaster(t, Config{PathGroupsPrefix: "_group"})
+
+	tests := []struct {
+		path, header string
+		group, want  string
+		invalid      bool
+	}{
+		{path: "/_group/edge/products/42", group: "edge", want: "/products/42"},
+		{path: "/_group/edge", group: "edge", want: "/"},
+		{path: "/_group/edge%2Fwest/a/b//c", group: "edge/west", want: "/a/b//c"},
+		{path: "/_group/edge%20one/a%20b", group: "edge one", want: "/a b"},
+		{path: "/_group/edge/_group/shield/x", group: "edge", want: "/_group/shield/x"},
+		{path: "/products/42", header: "shield", group: "shield", want: "/products/42"},
+		{path: "/_groups/edge", want: "/_groups/edge"},
+		{path: "/_group/", invalid: true},
+		{path: "/_group//products", invalid: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PURGE", tt.path, nil)
+		if tt.header != "" {
+			r.Header.Set("X-Group", tt.header)
+		}
+
+		group, path, err := b.Target(r)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q %q", tt.path, group, path)
+			}
+			continue
+		}
+		if err != nil || group != tt.group || path != tt.want {
+			t.Errorf("%s: expected %q %q, got %q %q %v", tt.path, tt.group, tt.want, group, path, err)
+		}
+	}
+
+	b.cfg.PathGroupsPrefix = ""
+	if group, path, _ := b.Target(httptest.NewRequest("PURGE", "/_group/edge/x", nil)); group != "" || path != "/_group/edge/x" {
+		t.Errorf("expected paths to be left alone without prefix, got %q %q", group, path)
+	}
+}
+
+func TestPathGroupsAreStripped(t *testing.T) {
+	b := newTestBroadcaster(t, Config{PathGroupsPrefix: "/_group/"})
+
+	seen := make(chan string, 1)
+	cache := newTestCache(t, b, "edge1", func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.URL.Path
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache}})
+
+	w := httptest.NewRecorder()
+	b.reqHandler(w, httptest.NewRequest("PURGE", "/_group/edge/products/42", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if p := <-seen; p != "/products/42" {
+		t.Errorf("expected the prefix to be stripped, got %s", p)
+	}
+
+	w = httptest.NewRecorder()
+	b.reqHandler(w, httptest.NewRequest("PURGE", "/_group/", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without group, got %d", w.Code)
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	b := newTestBroadcaster(t, Config{PathTemplate: "/invalidate{path}?{query}"})
+
+	seen := make(chan string, 2)
+	cache := newTestCache(t, b, "edge1", func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.URL.RequestURI()
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{cache}})
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/img.jpg?w=100", "/invalidate/img.jpg?w=100"},
+		{"/img.jpg", "/invalidate/img.jpg"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PURGE", tt.path, nil)
+		r.Header.Set("X-Group", "edge")
+		b.reqHandler(httptest.NewRecorder(), r)
+
+		if got := <-seen; got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestDefaultGroup(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+	b.cfg.DefaultGroup = "edge"
+
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {})
+	c2 := newTestCache(t, b, "c2", func(w http.ResponseWriter, r *http.Request) {})
+	setTestGroups(b,
+		dao.Group{Name: "edge", Caches: []dao.Cache{c1}},
+		dao.Group{Name: "shield", Caches: []dao.Cache{c2}},
+	)
+
+	for group, want := range map[string][]string{"": {"c1"}, "*": {"c1", "c2"}, "shield": {"c2"}} {
+		if got := taggedCaches(t, b, group, "", ""); !reflect.DeepEqual(got, want) {
+			t.Errorf("X-Group %q: expected %v to be broadcast to, got %v", group, want, got)
+		}
+	}
+}
+
+func TestDefaultGroupMustExist(t *testing.T) {
+	if _, err := New(Config{DefaultGroup: "edge"}); err == nil {
+		t.Error("expected an unknown default group to be an error")
+	}
+	b := newTestBroadcaster(t, Config{DefaultGroup: AllCaches})
+	if group, _, _ := b.Target(httptest.NewRequest("PURGE", "/foo", nil)); group != "" {
+		t.Errorf("expected all caches to be broadcast to, got %q", group)
+	}
+}
@@ -0,0 +1,61 @@
+package broadcaster
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// Defaults of caches signing their requests.
+const (
+	defaultSignHeader    = "X-Purge-Signature"
+	defaultSignAlgorithm = "sha256"
+
+	// signTimestampHeader carries the unix time the signature
+	// was computed at, for caches to reject stale requests.
+	signTimestampHeader = "X-Purge-Timestamp"
+)
+
+// requestSignature returns the hex encoded HMAC of the method,
+// path and timestamp, each followed by a newline but the last.
+func requestSignature(algorithm string, secret []byte, method, path, timestamp string) string {
+	newHash := sha256.New
+	switch algorithm {
+	case "sha1":
+		newHash = sha1.New
+	case "sha512":
+		newHash = sha512.New
+	}
+
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest signs the request if the cache requires it. It's
+// called on every attempt, so that retries carry a fresh timestamp.
+func signRequest(r *http.Request, cache dao.Cache, now time.Time) {
+	if len(cache.SignSecret) == 0 {
+		return
+	}
+
+	header := cache.SignHeader
+	if header == "" {
+		header = defaultSignHeader
+	}
+	algorithm := cache.SignAlgorithm
+	if algorithm == "" {
+		algorithm = defaultSignAlgorithm
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	r.Header.Set(signTimestampHeader, timestamp)
+	r.Header.Set(header, requestSignature(algorithm, cache.SignSecret, r.Method, r.URL.EscapedPath(), timestamp))
+}
@@ -0,0 +1,82 @@
+package broadcaster
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestRequestSignature(t *testing.T) {
+	// Computed with python's hmac module.
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{"sha1", "2f17f92d4ce960670378972d5f5bc84b34f1b2e9"},
+		{"sha256", "d639f25ae9433f15f8041d0f0c7112fc30ed17935c138015cc873e68a8f6b7ee"},
+		{"sha512", "bf03e1f8a9337832b89a213ef674756fba998e65610bed43956ffee21b764edec611f0a9f3be296d2f5c967ad72487303bbbc5955359ef61635ad7216101e7ba"},
+	}
+
+	for _, tt := range tests {
+		if got := requestSignature(tt.algorithm, []byte("secret"), "PURGE", "/site/foo", "1600000000"); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.algorithm, tt.want, got)
+		}
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	cache := dao.Cache{Method: "PURGE", Item: "/foo", PathPrefix: "/site", SignSecret: []byte("secret")}
+	r, _ := http.NewRequest("PURGE", "http://cache"+rewritePath(cache), nil)
+
+	signRequest(r, cache, time.Unix(1600000000, 0))
+
+	if r.Header.Get(signTimestampHeader) != "1600000000" {
+		t.Errorf("unexpected timestamp %q", r.Header.Get(signTimestampHeader))
+	}
+	if got := r.Header.Get(defaultSignHeader); got != "d639f25ae9433f15f8041d0f0c7112fc30ed17935c138015cc873e68a8f6b7ee" {
+		t.Errorf("unexpected signature %q", got)
+	}
+
+	unsigned, _ := http.NewRequest("PURGE", "http://cache/foo", nil)
+	signRequest(unsigned, dao.Cache{}, time.Now())
+	if len(unsigned.Header) != 0 {
+		t.Errorf("expected caches without secret not to be signed, got %v", unsigned.Header)
+	}
+}
+
+func TestRetriesAreSignedAfresh(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Retries: 1})
+
+	var stamps []string
+	cache := newTestCache(t, b, "signed", func(w http.ResponseWriter, r *http.Request) {
+		stamp := r.Header.Get(signTimestampHeader)
+		stamps = append(stamps, stamp)
+
+		if r.Header.Get("X-Sig") != requestSignature("sha1", []byte("k"), r.Method, r.URL.Path, stamp) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// Fail the first attempt once a second went by.
+		if len(stamps) == 1 {
+			unix, _ := strconv.ParseInt(stamp, 10, 64)
+			time.Sleep(time.Until(time.Unix(unix+1, 0)))
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			conn.Close()
+		}
+	})
+	cache.SignSecret, cache.SignHeader, cache.SignAlgorithm = []byte("k"), "X-Sig", "sha1"
+
+	status, err := b.doRequestWithRetries(context.Background(), cache, b.retries(cache, nil), nil, nil)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d %v", status, err)
+	}
+	if len(stamps) != 2 || stamps[0] == stamps[1] {
+		t.Errorf("expected the retry to carry a fresh timestamp, got %v", stamps)
+	}
+}
@@ -0,0 +1,70 @@
+package broadcaster
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+// slowestReported is the number of caches named
+// in the log entry of a slow broadcast.
+const slowestReported = 3
+
+var (
+	slowBroadcasts    = metrics.NewCounter("broadcaster_slow_broadcasts_total", "Broadcasts which took longer than the slow threshold.", "")
+	slowCacheRequests = metrics.NewCounter("broadcaster_slow_cache_requests_total", "Requests to a cache which took longer than its slow threshold.", "cache")
+)
+
+// slowThreshold returns the duration past which a request
+// to the cache is slow, zero if it's never considered slow.
+func (b *Broadcaster) slowThreshold(cache dao.Cache) time.Duration {
+	if cache.SlowThreshold > 0 {
+		return cache.SlowThreshold
+	}
+	return b.cfg.SlowThreshold
+}
+
+// checkSlowCache logs the request to the cache
+// if it took longer than the cache's threshold.
+func (b *Broadcaster) checkSlowCache(cache dao.Cache, took time.Duration) {
+	if threshold := b.slowThreshold(cache); threshold <= 0 || took <= threshold {
+		return
+	}
+
+	slowCacheRequests.Inc(cache.Name)
+	b.log("WARN Slow cache ", cache.Name, ": ", cache.Method, " ", targetURL(cache.Address, cache), " took ", took.String(), "\n")
+}
+
+// checkSlowBroadcast logs the broadcast, along with its slowest
+// caches, if it took longer than Config.SlowThreshold.
+func (b *Broadcaster) checkSlowBroadcast(req Request, took time.Duration, results map[string]Result) {
+	if b.cfg.SlowThreshold <= 0 || took <= b.cfg.SlowThreshold {
+		return
+	}
+
+	slowBroadcasts.Inc("")
+
+	names := make([]string, 0, len(results))
+	for name, r := range results {
+		if r.Duration > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return results[names[i]].Duration > results[names[j]].Duration
+	})
+	if len(names) > slowestReported {
+		names = names[:slowestReported]
+	}
+
+	slowest := make([]string, len(names))
+	for i, name := range names {
+		slowest[i] = fmt.Sprintf("%s %s", name, results[name].Duration)
+	}
+
+	b.log("WARN Slow broadcast ", req.Method, " ", req.Path, " took ", took.String(), ", slowest caches: ", strings.Join(slowest, ", "), "\n")
+}
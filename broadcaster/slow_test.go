@@ -0,0 +1,59 @@
+package broadcaster
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestSlowBroadcastsAreLogged(t *testing.T) {
+	var mu sync.Mutex
+	var entries []string
+
+	b := newTestBroadcaster(t, Config{SlowThreshold: 100 * time.Millisecond, Log: func(args ...string) {
+		mu.Lock()
+		entries = append(entries, strings.Join(args, ""))
+		mu.Unlock()
+	}})
+
+	slow := newTestCache(t, b, "slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+	})
+	strict := newTestCache(t, b, "strict", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	})
+	strict.SlowThreshold = 10 * time.Millisecond
+	fast := newTestCache(t, b, "fast", func(w http.ResponseWriter, r *http.Request) {})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{slow, strict, fast}})
+
+	before := slowBroadcasts.Value("")
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/foo", Group: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := res.Caches["slow"].Duration; d < 150*time.Millisecond {
+		t.Errorf("expected the duration of the slow cache to be reported, got %s", d)
+	}
+
+	mu.Lock()
+	log := strings.Join(entries, "")
+	mu.Unlock()
+
+	for _, want := range []string{"WARN Slow cache slow: ", "WARN Slow cache strict: ", "WARN Slow broadcast PURGE /foo took ", "slowest caches: slow "} {
+		if !strings.Contains(log, want) {
+			t.Errorf("expected %q to be logged, got %q", want, log)
+		}
+	}
+	if strings.Contains(log, "Slow cache fast") {
+		t.Errorf("expected the fast cache not to be logged, got %q", log)
+	}
+	if n := slowBroadcasts.Value(""); n != before+1 {
+		t.Errorf("expected the slow broadcast to be counted, got %d", n-before)
+	}
+}
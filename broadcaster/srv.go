@@ -0,0 +1,167 @@
+package broadcaster
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// SRVResolver looks up the targets of the SRV names of caches,
+// net.DefaultResolver by default.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// srvLoop resolves the SRV names of the caches again every
+// Config.DNSRefresh until stop is closed.
+func (b *Broadcaster) srvLoop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(b.cfg.DNSRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			b.refreshSRV()
+		}
+	}
+}
+
+// refreshSRV resolves the SRV names of the configured groups,
+// applying them again should their targets have changed.
+func (b *Broadcaster) refreshSRV() {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+
+	if !b.resolveSRV(b.configured) {
+		return
+	}
+
+	b.log("SRV targets changed, updating the caches.\n")
+	if err := b.applyGroups(b.expandSRV(b.configured)); err != nil {
+		b.log("Updating the SRV caches failed: ", err.Error(), "\n")
+	}
+}
+
+// resolveSRV looks up the SRV names of the caches of the groups,
+// returning whether their targets changed. A name which can't be
+// resolved keeps its last-known targets. The caller must hold
+// reloadMu.
+func (b *Broadcaster) resolveSRV(groupList []dao.Group) bool {
+	changed := false
+	resolved := make(map[string][]*net.SRV)
+
+	for _, g := range groupList {
+		for _, c := range g.Caches {
+			if c.SRV == "" {
+				continue
+			}
+			if _, found := resolved[c.SRV]; found {
+				continue
+			}
+
+			previous, known := b.srvTargets[c.SRV]
+			targets, err := b.lookupSRV(c.SRV)
+			if err != nil {
+				b.log("WARN SRV lookup of ", c.SRV, " for cache ", c.Name, " failed, keeping last-known targets: ", err.Error(), "\n")
+				targets = previous
+			}
+			if !known || !sameTargets(previous, targets) {
+				changed = true
+			}
+			resolved[c.SRV] = targets
+		}
+	}
+
+	if len(resolved) != len(b.srvTargets) {
+		changed = true
+	}
+	b.srvTargets = resolved
+	return changed
+}
+
+// lookupSRV returns the targets of the SRV name ordered by
+// target and port, so that their caches are listed steadily.
+func (b *Broadcaster) lookupSRV(name string) ([]*net.SRV, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, targets, err := b.cfg.SRVResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Target != targets[j].Target {
+			return targets[i].Target < targets[j].Target
+		}
+		return targets[i].Port < targets[j].Port
+	})
+	return targets, nil
+}
+
+func sameTargets(a, b []*net.SRV) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Target != b[i].Target || a[i].Port != b[i].Port {
+			return false
+		}
+	}
+	return true
+}
+
+// expandSRV returns the groups with every cache naming an SRV record
+// replaced by a cache per target, named <cache>/<target>:<port> and
+// reached over https for _https services and over http otherwise.
+// The caller must hold reloadMu.
+func (b *Broadcaster) expandSRV(groupList []dao.Group) []dao.Group {
+	expanded := make([]dao.Group, len(groupList))
+	for i, g := range groupList {
+		expanded[i] = g
+
+		var caches []dao.Cache
+		hasSRV := false
+		for _, c := range g.Caches {
+			if c.SRV == "" {
+				caches = append(caches, c)
+				continue
+			}
+			hasSRV = true
+			caches = append(caches, srvCaches(c, b.srvTargets[c.SRV])...)
+		}
+		if hasSRV {
+			expanded[i].Caches = caches
+		}
+	}
+	return expanded
+}
+
+// srvCaches returns the caches standing for the targets of the
+// SRV name of the cache, with its options.
+func srvCaches(c dao.Cache, targets []*net.SRV) []dao.Cache {
+	scheme := "http"
+	if strings.HasPrefix(c.SRV, "_https.") {
+		scheme = "https"
+	}
+
+	caches := make([]dao.Cache, 0, len(targets))
+	for _, t := range targets {
+		hostPort := net.JoinHostPort(strings.TrimSuffix(t.Target, "."), strconv.Itoa(int(t.Port)))
+
+		target := c
+		target.Name = c.Name + "/" + hostPort
+		target.Address = scheme + "://" + strings.ToLower(hostPort)
+		caches = append(caches, target)
+	}
+	return caches
+}
@@ -0,0 +1,123 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// stubResolver answers SRV lookups with its targets,
+// or fails while err is set.
+type stubResolver struct {
+	mu      sync.Mutex
+	targets map[string][]*net.SRV
+	err     error
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return "", append([]*net.SRV(nil), r.targets[name]...), nil
+}
+
+func (r *stubResolver) set(name string, targets []*net.SRV, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.targets[name] = targets
+	r.err = err
+}
+
+// srvTarget returns the SRV target of a test server.
+func srvTarget(t *testing.T, server *httptest.Server) *net.SRV {
+	u, _ := url.Parse(server.URL)
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &net.SRV{Target: u.Hostname() + ".", Port: uint16(port)}
+}
+
+func cacheNames(caches []dao.Cache) []string {
+	var names []string
+	for _, c := range caches {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSRVCaches(t *testing.T) {
+	received := make(chan string, 10)
+	var servers []*httptest.Server
+	var targets []*net.SRV
+	for i := 0; i < 3; i++ {
+		name := strconv.Itoa(i)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { received <- name }))
+		defer server.Close()
+		servers = append(servers, server)
+		targets = append(targets, srvTarget(t, server))
+	}
+
+	resolver := &stubResolver{targets: map[string][]*net.SRV{"_http._tcp.varnish.internal": targets[:2]}}
+	b := newTestBroadcaster(t, Config{
+		SRVResolver: resolver,
+		Groups: []dao.Group{{Name: "edge", Caches: []dao.Cache{
+			{Name: "varnish", SRV: "_http._tcp.varnish.internal", MaxInFlight: 4},
+		}}},
+	})
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Caches) != 2 || len(received) != 2 {
+		t.Fatalf("expected both targets to be broadcast to, got %+v", res.Caches)
+	}
+	<-received
+	<-received
+
+	caches := b.Groups()[0].Caches
+	want := []string{"varnish/" + servers[0].Listener.Addr().String(), "varnish/" + servers[1].Listener.Addr().String()}
+	sort.Strings(want)
+	if names := cacheNames(caches); !reflect.DeepEqual(names, want) {
+		t.Errorf("expected a cache per target, got %v", names)
+	}
+	if caches[0].MaxInFlight != 4 || caches[0].Address == "" {
+		t.Errorf("expected the targets to take the options of the cache, got %+v", caches[0])
+	}
+
+	// A target coming up is picked up on the next refresh.
+	resolver.set("_http._tcp.varnish.internal", targets, nil)
+	b.refreshSRV()
+	if caches := b.Groups()[0].Caches; len(caches) != 3 {
+		t.Errorf("expected the new target to be added, got %v", cacheNames(caches))
+	}
+
+	// Failed lookups keep the last-known targets.
+	resolver.set("_http._tcp.varnish.internal", nil, errors.New("no such host"))
+	b.refreshSRV()
+	if caches := b.Groups()[0].Caches; len(caches) != 3 {
+		t.Errorf("expected the targets to be kept, got %v", cacheNames(caches))
+	}
+}
+
+func TestSRVCachesScheme(t *testing.T) {
+	c := dao.Cache{Name: "c1", SRV: "_https._tcp.varnish.internal"}
+	caches := srvCaches(c, []*net.SRV{{Target: "Varnish-1.internal.", Port: 443}})
+	if len(caches) != 1 || caches[0].Address != "https://varnish-1.internal:443" || caches[0].Name != "c1/Varnish-1.internal:443" {
+		t.Errorf("expected an https target, got %+v", caches)
+	}
+}
@@ -0,0 +1,148 @@
+package broadcaster
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+var (
+	bytesSent     = metrics.NewCounter("broadcaster_cache_bytes_sent_total", "Bytes of the request bodies sent to a cache.", "cache")
+	bytesReceived = metrics.NewCounter("broadcaster_cache_bytes_received_total", "Bytes of the response bodies received from a cache.", "cache")
+)
+
+// Stats is a snapshot of the state of a broadcaster.
+type Stats struct {
+	QueuedJobs int `json:"queued_jobs"`
+	Workers    int `json:"workers"`
+	Groups     int `json:"groups"`
+	Caches     int `json:"caches"`
+
+	// QueuedByPriority counts the jobs waiting to be sent, keyed
+	// by the priority of their cache, to spot starved priorities.
+	QueuedByPriority map[int]int `json:"queued_by_priority"`
+
+	// RequestsServed counts the requests broadcast by the handler,
+	// JobsProcessed the requests to single caches taken up by the
+	// workers and JobsFailed those which didn't succeed.
+	RequestsServed uint64 `json:"requests_served"`
+	JobsProcessed  uint64 `json:"jobs_processed"`
+	JobsFailed     uint64 `json:"jobs_failed"`
+
+	// LastReload is the time of the last configuration load,
+	// LastReloadError its error if it failed.
+	LastReload      time.Time `json:"last_reload"`
+	LastReloadError string    `json:"last_reload_error,omitempty"`
+
+	// CacheStats holds the counters of every cache
+	// broadcast to since start, keyed by name.
+	CacheStats map[string]CacheStats `json:"cache_stats"`
+
+	// PendingReplays counts the requests failed by every cache
+	// waiting to be replayed, with Config.StateDir only.
+	PendingReplays map[string]int `json:"pending_replays,omitempty"`
+
+	// DisabledCaches lists the caches disabled, by the
+	// configuration or at runtime, by name.
+	DisabledCaches []string `json:"disabled_caches,omitempty"`
+
+	// PauseMode is the mode of paused broadcasts, empty unless
+	// paused, HeldBroadcasts the number held until resumed.
+	PauseMode      string `json:"pause_mode,omitempty"`
+	HeldBroadcasts int    `json:"held_broadcasts,omitempty"`
+}
+
+// CacheStats counts the requests to a single cache. Retries
+// are counted on their own, a request succeeding on its retry
+// counts as a single success. The bytes are those of the bodies
+// sent and received.
+type CacheStats struct {
+	Succeeded     uint64 `json:"succeeded"`
+	Failed        uint64 `json:"failed"`
+	Retried       uint64 `json:"retried"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+}
+
+// cacheCounters are the live counters behind CacheStats.
+type cacheCounters struct {
+	succeeded     uint64
+	failed        uint64
+	retried       uint64
+	bytesSent     uint64
+	bytesReceived uint64
+}
+
+// countersFor returns the counters of the cache, creating them on
+// first use. Counters outlive reloads, as do the caches' names.
+func (b *Broadcaster) countersFor(name string) *cacheCounters {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, found := b.counters[name]
+	if !found {
+		c = &cacheCounters{}
+		b.counters[name] = c
+	}
+	return c
+}
+
+// workerCount returns the number of workers of all the queues.
+func (b *Broadcaster) workerCount() int {
+	b.queuesLock.Lock()
+	defer b.queuesLock.Unlock()
+
+	n := 0
+	for _, q := range b.queues {
+		n += q.workers
+	}
+	return n
+}
+
+// Stats returns a snapshot of the broadcaster's state.
+func (b *Broadcaster) Stats() Stats {
+	queued, workers, byPriority := b.queuedJobs(), b.workerCount(), b.queuedByPriority()
+	pauseMode, held := b.paused()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := Stats{
+		QueuedJobs:       queued,
+		Workers:          workers,
+		QueuedByPriority: byPriority,
+		RequestsServed:   atomic.LoadUint64(&b.requestsServed),
+		JobsProcessed:    atomic.LoadUint64(&b.jobsProcessed),
+		JobsFailed:       atomic.LoadUint64(&b.jobsFailed),
+		Groups:           len(b.groups),
+		Caches:           len(b.allCaches),
+		LastReload:       b.lastReload,
+		LastReloadError:  b.lastReloadError,
+		CacheStats:       make(map[string]CacheStats, len(b.counters)),
+		PauseMode:        pauseMode,
+		HeldBroadcasts:   held,
+	}
+
+	for name, c := range b.counters {
+		s.CacheStats[name] = CacheStats{
+			Succeeded:     atomic.LoadUint64(&c.succeeded),
+			Failed:        atomic.LoadUint64(&c.failed),
+			Retried:       atomic.LoadUint64(&c.retried),
+			BytesSent:     atomic.LoadUint64(&c.bytesSent),
+			BytesReceived: atomic.LoadUint64(&c.bytesReceived),
+		}
+	}
+
+	if b.replay != nil {
+		s.PendingReplays = b.replay.counts()
+	}
+
+	for name := range b.disabledCaches {
+		s.DisabledCaches = append(s.DisabledCaches, name)
+	}
+	sort.Strings(s.DisabledCaches)
+
+	return s
+}
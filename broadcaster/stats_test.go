@@ -0,0 +1,102 @@
+package broadcaster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestStatsCountCacheRequests(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Retries: 1})
+
+	ok := newTestCache(t, b, "ok", func(w http.ResponseWriter, r *http.Request) {})
+	failing := newTestCache(t, b, "failing", func(w http.ResponseWriter, r *http.Request) {
+		hj, _ := w.(http.Hijacker)
+		conn, _, _ := hj.Hijack()
+		conn.Close()
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{ok, failing}})
+
+	if _, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/foo", Group: "edge"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := b.Stats()
+	if s.Groups != 1 || s.Caches != 2 || s.QueuedJobs != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if got := s.CacheStats["ok"]; got != (CacheStats{Succeeded: 1}) {
+		t.Errorf("unexpected stats of ok %+v", got)
+	}
+	if got := s.CacheStats["failing"]; got != (CacheStats{Failed: 1, Retried: 1}) {
+		t.Errorf("unexpected stats of failing %+v", got)
+	}
+}
+
+func TestStatsCountBytesTransferred(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	response := strings.Repeat("x", 1234)
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "POST", Path: "/foo", Group: "edge", Body: []byte("invalidate")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := res.Caches["c1"]; got.BytesReceived != 1234 || got.BytesSent != 10 {
+		t.Errorf("expected 10 bytes sent and 1234 received, got %d and %d", got.BytesSent, got.BytesReceived)
+	}
+	if res.BytesReceived != 1234 || res.BytesSent != 10 {
+		t.Errorf("expected the broadcast to total the caches, got %d and %d", res.BytesSent, res.BytesReceived)
+	}
+	if got := b.Stats().CacheStats["c1"]; got.BytesReceived != 1234 || got.BytesSent != 10 {
+		t.Errorf("unexpected stats of c1 %+v", got)
+	}
+}
+
+func TestStatsReportLastReload(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	if s := b.Stats(); s.LastReload.IsZero() || s.LastReloadError != "" {
+		t.Errorf("expected the initial load to be reported, got %+v", s)
+	}
+
+	if err := b.Reload([]dao.Group{{Name: "edge", Source: "zookeeper:varnish"}}); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if s := b.Stats(); s.LastReloadError == "" {
+		t.Error("expected the failed reload to be reported")
+	}
+}
+
+func TestStatsCountBroadcasts(t *testing.T) {
+	b := newTestBroadcaster(t, Config{Workers: 2})
+
+	ok := newTestCache(t, b, "ok", func(w http.ResponseWriter, r *http.Request) {})
+	failing := newTestCache(t, b, "failing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{ok, failing}})
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("PURGE", "/foo", nil)
+		r.Header.Set("X-Group", "edge")
+		b.reqHandler(httptest.NewRecorder(), r)
+	}
+
+	s := b.Stats()
+	if s.RequestsServed != 2 || s.JobsProcessed != 4 || s.JobsFailed != 2 {
+		t.Errorf("expected 2 requests, 4 jobs and 2 failures, got %+v", s)
+	}
+	if s.Workers != 4 {
+		t.Errorf("expected 2 workers for each cache, got %d", s.Workers)
+	}
+}
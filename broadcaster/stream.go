@@ -0,0 +1,85 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// wantsStream tells whether the request asks for the results of
+// the caches to be streamed as server-sent events, by its Accept
+// header or ?stream=1. It returns the query broadcast, without
+// stream=1 which is meant for the broadcaster only.
+func wantsStream(r *http.Request) (bool, string) {
+	stream := false
+	var query []string
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		if param == "stream=1" {
+			stream = true
+		} else if param != "" {
+			query = append(query, param)
+		}
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "text/event-stream" {
+			stream = true
+		}
+	}
+	return stream, strings.Join(query, "&")
+}
+
+// streamedResult is the event of the result of a cache.
+type streamedResult struct {
+	Cache string `json:"cache"`
+	Result
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// streamSummary is the event ending a stream.
+type streamSummary struct {
+	RequestID string `json:"request_id"`
+	Status    int    `json:"status"`
+	Caches    int    `json:"caches"`
+}
+
+// resultStream streams the results of a broadcast as server-sent
+// events, answering once the first result is known so that the
+// broadcast can still fail as non-streamed ones do before then.
+type resultStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func newResultStream(w http.ResponseWriter) *resultStream {
+	flusher, _ := w.(http.Flusher)
+	return &resultStream{w: w, flusher: flusher}
+}
+
+func (s *resultStream) send(event string, data interface{}) {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.WriteHeader(http.StatusOK)
+	}
+
+	out, _ := json.Marshal(data)
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, out)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// result streams the result of a cache.
+func (s *resultStream) result(cache string, result Result) {
+	s.send("result", streamedResult{
+		Cache:      cache,
+		Result:     result,
+		DurationMs: float64(result.Duration) / float64(time.Millisecond),
+	})
+}
@@ -0,0 +1,153 @@
+package broadcaster
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// readEvent reads the next server-sent event of a stream.
+func readEvent(t *testing.T, r *bufio.Reader) (event string, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestStreamSendsResultsAsCachesAnswer(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	release := make(chan struct{})
+	fast := newTestCache(t, b, "fast", func(w http.ResponseWriter, r *http.Request) {})
+	slow := newTestCache(t, b, "slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{fast, slow}})
+
+	server := httptest.NewServer(b.Handler())
+	defer server.Close()
+
+	req, _ := http.NewRequest("PURGE", server.URL+"/foo", nil)
+	req.Header.Set("X-Group", "edge")
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+
+	// The slow cache is held until the fast one was streamed.
+	event, data := readEvent(t, events)
+	var result streamedResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		t.Fatal(err)
+	}
+	if event != "result" || result.Cache != "fast" || result.Status != http.StatusOK {
+		t.Errorf("expected the result of fast first, got %s %s", event, data)
+	}
+	close(release)
+
+	event, data = readEvent(t, events)
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		t.Fatal(err)
+	}
+	if event != "result" || result.Cache != "slow" || result.Status != http.StatusNotFound {
+		t.Errorf("expected the result of slow, got %s %s", event, data)
+	}
+
+	event, data = readEvent(t, events)
+	var summary streamSummary
+	if err := json.Unmarshal([]byte(data), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if event != "summary" || summary.Caches != 2 || summary.Status == 0 || summary.RequestID == "" {
+		t.Errorf("expected the summary, got %s %s", event, data)
+	}
+}
+
+func TestStreamReportsFailuresAsUsual(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	r := httptest.NewRequest("PURGE", "/foo?stream=1", nil)
+	r.Header.Set("X-Group", "missing")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected unknown groups to answer 404, got %d", w.Code)
+	}
+}
+
+func TestWantsStream(t *testing.T) {
+	for _, tc := range []struct {
+		target, accept string
+		query          string
+	}{
+		{"/foo?stream=1", "", ""},
+		{"/foo?a=1&stream=1&b=2", "", "a=1&b=2"},
+		{"/foo?a=1", "application/json, text/event-stream;q=0.9", "a=1"},
+	} {
+		r := httptest.NewRequest("PURGE", tc.target, nil)
+		r.Header.Set("Accept", tc.accept)
+		stream, query := wantsStream(r)
+		if !stream || query != tc.query {
+			t.Errorf("expected %s with Accept %q to be streamed with query %q, got %v %q", tc.target, tc.accept, tc.query, stream, query)
+		}
+	}
+
+	if stream, query := wantsStream(httptest.NewRequest("PURGE", "/foo?stream=0", nil)); stream || query != "stream=0" {
+		t.Error("expected results not to be streamed by default")
+	}
+}
+
+func TestStreamReportsRateLimitsAsUsual(t *testing.T) {
+	b := newTestBroadcaster(t, Config{})
+
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {})
+	c2 := newTestCache(t, b, "c2", func(w http.ResponseWriter, r *http.Request) {})
+	c2.Disabled = true
+	edge := dao.Group{Name: "edge", RateLimit: 0.001, RateBurst: 1, Caches: []dao.Cache{c1, c2}}
+	setTestGroups(b, edge)
+	b.setUpRateLimiters([]dao.Group{edge})
+
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PURGE", "/foo?stream=1", nil)
+		r.Header.Set("X-Group", "edge")
+		w := httptest.NewRecorder()
+		b.reqHandler(w, r)
+		return w
+	}
+
+	if w := send(); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "event: summary") {
+		t.Fatalf("expected the first broadcast to be streamed, got %d %s", w.Code, w.Body.String())
+	}
+
+	// The disabled cache isn't streamed ahead of the rejection.
+	w := send()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Content-Type") == "text/event-stream" {
+		t.Errorf("expected 429 rather than a stream, got %d %s", w.Code, w.Body.String())
+	}
+}
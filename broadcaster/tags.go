@@ -0,0 +1,68 @@
+package broadcaster
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// Tag matches of X-Tag-Match.
+const (
+	tagMatchAny = "any"
+	tagMatchAll = "all"
+)
+
+// tagTarget returns the tags a request targets, those of its X-Tag
+// header, and whether caches must carry all of them rather than any,
+// as its X-Tag-Match header asks.
+func tagTarget(r *http.Request) (tags []string, all bool, err error) {
+	for _, tag := range dao.SplitList(r.Header.Get("X-Tag")) {
+		tags = append(tags, strings.ToLower(tag))
+	}
+
+	switch match := strings.ToLower(r.Header.Get("X-Tag-Match")); match {
+	case "", tagMatchAny:
+	case tagMatchAll:
+		all = true
+	default:
+		return nil, false, fmt.Errorf("Invalid X-Tag-Match %q, expected any or all.", match)
+	}
+
+	return tags, all, nil
+}
+
+// hasTags tells whether the cache carries any of the tags,
+// or all of them.
+func hasTags(cache dao.Cache, tags []string, all bool) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range cache.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if found != all {
+			return found
+		}
+	}
+	return all
+}
+
+// filterTags returns the caches carrying the tags, all
+// of them when there are no tags.
+func filterTags(caches []dao.Cache, tags []string, all bool) []dao.Cache {
+	if len(tags) == 0 {
+		return caches
+	}
+
+	var matching []dao.Cache
+	for _, c := range caches {
+		if hasTags(c, tags, all) {
+			matching = append(matching, c)
+		}
+	}
+	return matching
+}
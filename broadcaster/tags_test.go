@@ -0,0 +1,94 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func newTaggedBroadcaster(t *testing.T) *Broadcaster {
+	b := newTestBroadcaster(t, Config{})
+
+	tagged := func(name string, tags ...string) dao.Cache {
+		c := newTestCache(t, b, name, func(w http.ResponseWriter, r *http.Request) {})
+		c.Tags = tags
+		return c
+	}
+	setTestGroups(b,
+		dao.Group{Name: "varnish", Caches: []dao.Cache{tagged("c1", "edge", "eu"), tagged("c2", "edge", "us")}},
+		dao.Group{Name: "nginx", Caches: []dao.Cache{tagged("c3", "eu"), tagged("c4")}},
+	)
+	return b
+}
+
+// taggedCaches returns the caches a broadcast with the
+// X-Tag and X-Tag-Match headers reached.
+func taggedCaches(t *testing.T, b *Broadcaster, group, tags, match string) []string {
+	t.Helper()
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", group)
+	r.Header.Set("X-Tag", tags)
+	r.Header.Set("X-Tag-Match", match)
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if w.Code == http.StatusNoContent {
+		return nil
+	}
+	var body map[string]Result
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: %s", err, w.Body.String())
+	}
+
+	var names []string
+	for name := range body {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestTagsMatchAny(t *testing.T) {
+	b := newTaggedBroadcaster(t)
+
+	if got := taggedCaches(t, b, "", "Edge, eu", ""); !reflect.DeepEqual(got, []string{"c1", "c2", "c3"}) {
+		t.Errorf("expected the caches of any tag, got %v", got)
+	}
+	if got := taggedCaches(t, b, "nginx", "eu", "any"); !reflect.DeepEqual(got, []string{"c3"}) {
+		t.Errorf("expected the tagged caches of the group, got %v", got)
+	}
+	if got := taggedCaches(t, b, "", "", ""); len(got) != 4 {
+		t.Errorf("expected all caches without tags, got %v", got)
+	}
+}
+
+func TestTagsMatchAll(t *testing.T) {
+	b := newTaggedBroadcaster(t)
+
+	if got := taggedCaches(t, b, "", "edge,eu", "all"); !reflect.DeepEqual(got, []string{"c1"}) {
+		t.Errorf("expected the caches of all tags, got %v", got)
+	}
+	if got := taggedCaches(t, b, "", "us,eu", "all"); got != nil {
+		t.Errorf("expected no cache to carry both tags, got %v", got)
+	}
+}
+
+func TestTagsInvalidMatch(t *testing.T) {
+	b := newTaggedBroadcaster(t)
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Tag", "eu")
+	r.Header.Set("X-Tag-Match", "some")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid X-Tag-Match to be rejected, got %d", w.Code)
+	}
+}
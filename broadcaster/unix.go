@@ -0,0 +1,62 @@
+package broadcaster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixScheme marks the addresses of caches listening on a unix
+// domain socket, e.g. unix:///var/run/varnish.sock
+const unixScheme = "unix://"
+
+// socketPathKey keys the socket path of the requests to a
+// cache listening on a unix domain socket in their context.
+type socketPathKey struct{}
+
+// socketPath returns the path of the socket of a unix:// address.
+func socketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, unixScheme), true
+}
+
+// dialAddress returns the address requests to the cache at address
+// are sent to, and the context to send them with. Those to a socket
+// are sent over http to a host standing for the socket, so that its
+// connections are pooled apart, the context carrying its path to
+// the dialer.
+func dialAddress(ctx context.Context, address string) (context.Context, string) {
+	path, ok := socketPath(address)
+	if !ok {
+		return ctx, address
+	}
+	host := fmt.Sprintf("unix-%08x", fnv32(path))
+	return context.WithValue(ctx, socketPathKey{}, path), "http://" + host
+}
+
+// dialContext dials the socket carried by the context of the
+// request, if any, and the address otherwise. Sockets are dialed
+// with the timeout of d only, its local address being a TCP one.
+func dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	socketDialer := &net.Dialer{Timeout: d.Timeout}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if path, ok := ctx.Value(socketPathKey{}).(string); ok {
+			return socketDialer.DialContext(ctx, "unix", path)
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// proxyFromEnvironment is http.ProxyFromEnvironment,
+// sockets being reached directly.
+func proxyFromEnvironment(r *http.Request) (*url.URL, error) {
+	if _, ok := r.Context().Value(socketPathKey{}).(string); ok {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(r)
+}
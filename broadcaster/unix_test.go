@@ -0,0 +1,41 @@
+package broadcaster
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestUnixSocketCaches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 10)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Method + " " + r.Host + r.URL.Path
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	b := newTestBroadcaster(t, Config{})
+	local := dao.Cache{Name: "local", Address: "unix://" + path, Method: "PURGE", Item: "/", Headers: http.Header{}, PathPrefix: "/control"}
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{local}})
+
+	res, err := b.Broadcast(context.Background(), Request{Method: "PURGE", Path: "/a", Group: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.Caches["local"]; r.Status != http.StatusOK {
+		t.Fatalf("expected the cache to be reached over its socket, got %+v", r)
+	}
+	if got := <-received; got != "PURGE localhost/control/a" {
+		t.Errorf("expected /control/a to be purged, got %s", got)
+	}
+}
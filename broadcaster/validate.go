@@ -0,0 +1,99 @@
+package broadcaster
+
+import (
+	"fmt"
+	"net/url"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// Validate checks the configuration without starting a broadcaster,
+// e.g. before deploying it, returning all of its errors rather than
+// the first one New would fail with.
+func Validate(cfg Config) []error {
+	errs := cfg.validateOptions()
+	errs = append(errs, validateGroups(cfg.Groups)...)
+
+	if cfg.RequireCaches {
+		if err := checkCaches(cfg.Groups); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if name := cfg.DefaultGroup; name != "" && name != AllCaches {
+		found := false
+		for _, g := range cfg.Groups {
+			found = found || g.Name == name
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("Default group %s not found.", name))
+		}
+	}
+	return errs
+}
+
+// validateOptions checks the policies of the configuration,
+// those left empty standing for their default.
+func (cfg Config) validateOptions() []error {
+	var errs []error
+
+	if cfg.StatusPolicy != "" {
+		if err := validateStatusPolicy(cfg.StatusPolicy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch cfg.QueueFull {
+	case "", QueueFullReject, QueueFullBlock, QueueFullDropOldest:
+	default:
+		errs = append(errs, fmt.Errorf("Unknown queue full policy %q.", cfg.QueueFull))
+	}
+	switch cfg.JournalSync {
+	case "", JournalSyncAlways, JournalSyncPeriodic, JournalSyncNever:
+	default:
+		errs = append(errs, fmt.Errorf("Invalid journal sync policy %s, expected %s, %s or %s.", cfg.JournalSync, JournalSyncAlways, JournalSyncPeriodic, JournalSyncNever))
+	}
+	switch cfg.RecoverMode {
+	case "", RecoverReport, RecoverReplay:
+	default:
+		errs = append(errs, fmt.Errorf("Invalid recover mode %s, expected %s or %s.", cfg.RecoverMode, RecoverReport, RecoverReplay))
+	}
+	return errs
+}
+
+// validateGroups checks the consul sources and the cache
+// addresses of the groups.
+func validateGroups(groupList []dao.Group) []error {
+	var errs []error
+
+	for _, g := range groupList {
+		if g.Source != "" {
+			if _, err := parseConsulSource(g.Source); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		for _, cache := range g.Caches {
+			if _, err := url.Parse(cache.Address); err != nil {
+				errs = append(errs, err)
+			}
+			if cache.FallbackAddress != "" {
+				if _, err := url.Parse(cache.FallbackAddress); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkCaches returns an error for groups defining no caches, which
+// broadcasts would answer without reaching any. Consul backed groups
+// count as defining caches, discovered at runtime.
+func checkCaches(groupList []dao.Group) error {
+	for _, g := range groupList {
+		if len(g.Caches) > 0 || g.Source != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("The configuration defines no caches, broadcasts would reach none.")
+}
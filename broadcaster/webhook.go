@@ -0,0 +1,108 @@
+package broadcaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxWebhookPosts bounds the results being posted to the webhook,
+// further ones being dropped while it's slow to answer.
+const maxWebhookPosts = 64
+
+// resultWebhook posts the results of broadcasts to Config.ResultWebhook.
+type resultWebhook struct {
+	url    string
+	client *http.Client
+	slots  chan struct{}
+}
+
+func newResultWebhook(address string, timeout time.Duration) (*resultWebhook, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid result webhook %q, expected an http or https URL.", address)
+	}
+
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	return &resultWebhook{
+		url:    address,
+		client: &http.Client{Timeout: timeout},
+		slots:  make(chan struct{}, maxWebhookPosts),
+	}, nil
+}
+
+// webhookResult is the result of a broadcast posted to the webhook.
+type webhookResult struct {
+	RequestID string            `json:"request_id"`
+	Time      time.Time         `json:"time"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Group     string            `json:"group"`
+	Status    int               `json:"status"`
+	Caches    map[string]Result `json:"caches"`
+}
+
+func newWebhookResult(requestID, method, path, group string, res Results) webhookResult {
+	return webhookResult{
+		RequestID: requestID,
+		Time:      time.Now(),
+		Method:    method,
+		Path:      path,
+		Group:     group,
+		Status:    res.Status,
+		Caches:    res.Caches,
+	}
+}
+
+// requestID returns the X-Request-Id of the request,
+// or a random one when it has none.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return newRequestID()
+}
+
+// postResult posts the result to the webhook in the background,
+// fire-and-forget: failures are only logged.
+func (b *Broadcaster) postResult(result webhookResult) {
+	w := b.webhook
+	if w == nil {
+		return
+	}
+
+	select {
+	case w.slots <- struct{}{}:
+	default:
+		b.log("Result webhook too slow, dropping the result of ", result.RequestID, "\n")
+		return
+	}
+
+	go func() {
+		defer func() { <-w.slots }()
+
+		body, _ := json.Marshal(result)
+		resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			b.log("Result webhook failed for ", result.RequestID, ": ", err.Error(), "\n")
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			b.log("Result webhook answered ", resp.Status, " for ", result.RequestID, "\n")
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestResultWebhookReceivesResults(t *testing.T) {
+	posted := make(chan webhookResult, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected a JSON result, got %q", ct)
+		}
+		var result webhookResult
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			t.Error(err)
+		}
+		posted <- result
+	}))
+	defer webhook.Close()
+
+	b := newTestBroadcaster(t, Config{ResultWebhook: webhook.URL})
+	c1 := newTestCache(t, b, "c1", func(w http.ResponseWriter, r *http.Request) {})
+	setTestGroups(b, dao.Group{Name: "edge", Caches: []dao.Cache{c1}})
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("X-Group", "edge")
+	r.Header.Set("X-Request-Id", "abc123")
+	w := httptest.NewRecorder()
+	b.reqHandler(w, r)
+
+	if id := w.Header().Get("X-Request-Id"); id != "abc123" {
+		t.Errorf("expected the request id to be echoed, got %q", id)
+	}
+
+	select {
+	case result := <-posted:
+		if result.RequestID != "abc123" || result.Group != "edge" {
+			t.Errorf("expected the request id and group, got %+v", result)
+		}
+		if result.Method != "PURGE" || result.Path != "/foo" || result.Status != http.StatusOK {
+			t.Errorf("expected the broadcast, got %+v", result)
+		}
+		if result.Caches["c1"].Status != http.StatusOK {
+			t.Errorf("expected the result of c1, got %+v", result.Caches)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the result to be posted")
+	}
+}
+
+func TestResultWebhookGeneratesRequestIds(t *testing.T) {
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	if id := requestID(r); len(id) != 16 || id == requestID(r) {
+		t.Errorf("expected random request ids, got %q", id)
+	}
+}
+
+func TestResultWebhookMustBeHTTP(t *testing.T) {
+	if _, err := New(Config{ResultWebhook: "ftp://results"}); err == nil {
+		t.Error("expected a non-http webhook to be rejected")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// remoteConfigCopy is the file of -state-dir keeping the last
+// remote configuration fetched.
+const remoteConfigCopy = "remote-config.json"
+
+// loadGroups loads the groups of -cfg. With -state-dir, a remote
+// configuration is kept there once fetched, and loaded from there
+// while the remote can't be reached, e.g. on a restart.
+func loadGroups() ([]dao.Group, error) {
+	if !dao.IsRemoteConfig(*cachesCfgFile) || *stateDir == "" {
+		return dao.LoadCaches(*cachesCfgFile)
+	}
+	copyPath := filepath.Join(*stateDir, remoteConfigCopy)
+
+	content, err := dao.FetchConfig(*cachesCfgFile)
+	if err != nil {
+		groups, copyErr := dao.LoadCachesFromJson(copyPath)
+		if copyErr != nil {
+			return nil, err
+		}
+		sendToLogChannel("WARN ", err.Error(), ", using the copy of ", copyPath, "\n")
+		return groups, nil
+	}
+
+	groups, err := dao.ParseCachesJson(content)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(*stateDir, 0700); err == nil {
+		err = os.WriteFile(copyPath, content, 0600)
+	}
+	if err != nil {
+		sendToLogChannel("WARN Keeping a copy of the configuration failed: ", err.Error(), "\n")
+	}
+	return groups, nil
+}
+
+// configPoller reloads the broadcaster when the groups of -cfg
+// change, e.g. those served by a service discovery system.
+type configPoller struct {
+	b      *broadcaster.Broadcaster
+	load   func() ([]dao.Group, error)
+	groups []dao.Group
+}
+
+// poll loads the groups again, reloading the broadcaster if they
+// changed. The current groups are kept on errors, e.g. while the
+// remote configuration can't be reached.
+func (p *configPoller) poll() (bool, error) {
+	groups, err := p.load()
+	if err != nil {
+		return false, err
+	}
+	if reflect.DeepEqual(groups, p.groups) {
+		return false, nil
+	}
+
+	if err = p.b.Reload(groups); err != nil {
+		return false, err
+	}
+	p.groups = groups
+	return true, nil
+}
+
+// pollConfig spawns a goroutine polling -cfg every -config-poll,
+// groups being the ones the broadcaster was started with.
+func pollConfig(b *broadcaster.Broadcaster, groups []dao.Group) {
+	if *configPoll <= 0 {
+		return
+	}
+	p := &configPoller{b: b, load: loadGroups, groups: groups}
+
+	go func() {
+		for range time.Tick(*configPoll) {
+			changed, err := p.poll()
+			switch {
+			case err != nil:
+				sendToLogChannel("WARN Polling the configuration failed, keeping the current one: ", err.Error(), "\n")
+			case changed:
+				sendToLogChannel("Configuration changed, reloaded.\n")
+			}
+		}
+	}()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// newTestConfigServer serves a configuration of the given version,
+// or a 503 when it's 0.
+func newTestConfigServer(t *testing.T, version *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := atomic.LoadInt32(version)
+		if v == 0 {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `[{"name": "edge", "caches": [`)
+		for i := int32(1); i <= v; i++ {
+			if i > 1 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `{"name": "c%d", "address": "http://127.0.0.1:1"}`, i)
+		}
+		fmt.Fprint(w, `]}]`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestConfigPollerReloadsChanges(t *testing.T) {
+	defer func(cfg, dir string) { *cachesCfgFile, *stateDir = cfg, dir }(*cachesCfgFile, *stateDir)
+
+	version := int32(1)
+	*cachesCfgFile = newTestConfigServer(t, &version).URL + "/caches.json"
+	*stateDir = t.TempDir()
+
+	groups, err := loadGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := broadcaster.New(broadcaster.Config{Groups: groups})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	p := &configPoller{b: b, load: loadGroups, groups: groups}
+
+	if changed, err := p.poll(); changed || err != nil {
+		t.Errorf("expected nothing to change, got %t %v", changed, err)
+	}
+
+	atomic.StoreInt32(&version, 2)
+	if changed, err := p.poll(); !changed || err != nil {
+		t.Fatalf("expected the second version to be reloaded, got %t %v", changed, err)
+	}
+	if caches := b.Groups()[0].Caches; len(caches) != 2 {
+		t.Errorf("expected 2 caches once reloaded, got %+v", caches)
+	}
+
+	// The remote going away, the copy of -state-dir is used.
+	atomic.StoreInt32(&version, 0)
+	if changed, err := p.poll(); changed || err != nil {
+		t.Errorf("expected the copy to be used, got %t %v", changed, err)
+	}
+	if caches := b.Groups()[0].Caches; len(caches) != 2 {
+		t.Errorf("expected the caches to be kept, got %+v", caches)
+	}
+}
+
+func TestConfigPollerKeepsGroupsOnErrors(t *testing.T) {
+	version := int32(1)
+	url := newTestConfigServer(t, &version).URL + "/caches.json"
+	load := func() ([]dao.Group, error) { return dao.LoadCaches(url) }
+
+	groups, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := broadcaster.New(broadcaster.Config{Groups: groups})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	p := &configPoller{b: b, load: load, groups: groups}
+
+	atomic.StoreInt32(&version, 0)
+	if changed, err := p.poll(); changed || err == nil {
+		t.Errorf("expected the unreachable remote to be an error, got %t %v", changed, err)
+	}
+	if caches := b.Groups()[0].Caches; len(caches) != 1 {
+		t.Errorf("expected the caches to be kept, got %+v", caches)
+	}
+}
+
+func TestReloadKeepsGroupsOnErrors(t *testing.T) {
+	groups := []dao.Group{{Name: "edge", Caches: []dao.Cache{{Name: "c1", Address: "http://127.0.0.1:1"}}}}
+	b, err := broadcaster.New(broadcaster.Config{Groups: groups, RequireCaches: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	empty := func() ([]dao.Group, error) { return []dao.Group{{Name: "edge"}}, nil }
+	if err := reloadConfig(b, empty); err == nil {
+		t.Error("expected an empty configuration to fail the reload")
+	}
+	if got := b.Groups(); len(got) != 1 || len(got[0].Caches) != 1 {
+		t.Errorf("expected the previous groups to be kept, got %+v", got)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+var (
+	corsOrigins = commandLine.String("cors-origins", "", "Comma-separated origins allowed to broadcast from a browser, * for any. Cross-origin requests are refused by default.")
+	corsMethods = commandLine.String("cors-methods", "PURGE,BAN,GET,POST", "Comma-separated methods allowed in cross-origin broadcasts.")
+)
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight.
+const corsMaxAge = "600"
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin
+// for the origin, ok being false for origins outside -cors-origins.
+func allowedOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+
+	for _, o := range dao.SplitList(*corsOrigins) {
+		if o == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return origin, true
+		}
+	}
+
+	return "", false
+}
+
+// withCORS answers the preflights of browsers from -cors-origins
+// without broadcasting them, and adds the CORS headers to the
+// responses of their broadcasts. Preflights carry no credentials,
+// it thus has to come before the authentication.
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *corsOrigins == "" {
+			h(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		origin, ok := allowedOrigin(r.Header.Get("Origin"))
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			if !ok {
+				http.Error(w, "Origin not allowed.", http.StatusForbidden)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(dao.SplitList(*corsMethods), ", "))
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if ok {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+		}
+
+		h(w, r)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	defer func(origins string) { *corsOrigins = origins }(*corsOrigins)
+	*corsOrigins = "https://admin.example.com, https://ops.example.com"
+
+	token := "secret"
+	broadcasts := 0
+	h := withCORS(requireToken("broadcast", flagToken(&token), func(w http.ResponseWriter, r *http.Request) {
+		broadcasts++
+	}))
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, "/foo", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "PURGE")
+		r.Header.Set("Access-Control-Request-Headers", "authorization, x-group")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	w := preflight("https://admin.example.com")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the preflight to be answered with 204, got %d", w.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://admin.example.com",
+		"Access-Control-Allow-Methods": "PURGE, BAN, GET, POST",
+		"Access-Control-Allow-Headers": "authorization, x-group",
+		"Vary":                         "Origin",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("expected %s: %s, got %q", k, v, got)
+		}
+	}
+	if broadcasts != 0 {
+		t.Error("expected the preflight not to be broadcast")
+	}
+
+	if w = preflight("https://evil.example.com"); w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected an unknown origin to be refused, got %d %v", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest("PURGE", "/foo", nil)
+	r.Header.Set("Origin", "https://ops.example.com")
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h(w, r)
+	if broadcasts != 1 || w.Header().Get("Access-Control-Allow-Origin") != "https://ops.example.com" {
+		t.Errorf("expected the broadcast to carry the CORS headers, got %v", w.Header())
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	defer func(origins string) { *corsOrigins = origins }(*corsOrigins)
+	*corsOrigins = ""
+
+	r := httptest.NewRequest(http.MethodOptions, "/foo", nil)
+	r.Header.Set("Origin", "https://admin.example.com")
+	r.Header.Set("Access-Control-Request-Method", "PURGE")
+	w := httptest.NewRecorder()
+	withCORS(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers without -cors-origins, got %v", w.Header())
+	}
+}
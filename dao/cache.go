@@ -2,41 +2,407 @@ package dao
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
 	ini "github.com/timothyclarke/http-request-broadcaster/ini"
 )
 
 type Cache struct {
-	Name    string      `json:"name"`
-	Address string      `json:"address"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+
+	// SRV is a DNS SRV name standing for the cache in place of its
+	// Address, e.g. _http._tcp.varnish.internal, every target it
+	// resolves to being broadcast to as a cache of its own. It is
+	// set in INI files by an address of the form srv:<name>.
+	SRV string `json:"srv,omitempty"`
+
+	// FallbackAddress is tried once all attempts
+	// against Address failed.
+	FallbackAddress string `json:"fallback_address,omitempty"`
+
+	// PathRewrite replaces a leading path prefix, it is of the
+	// form <from>=<to>, an empty <to> stripping <from>. PathPrefix
+	// is then prepended to the path.
+	PathRewrite string `json:"path_rewrite,omitempty"`
+	PathPrefix  string `json:"path_prefix,omitempty"`
+
+	// MaxInFlight caps the number of concurrent requests
+	// against the cache, 0 meaning unlimited.
+	MaxInFlight int `json:"max_inflight,omitempty"`
+
+	// MaxResponseBody is the number of bytes of the cache's
+	// responses read, overriding -max-response-body when set.
+	MaxResponseBody int64 `json:"max_response_body,omitempty"`
+
+	// Workers is the number of workers of the cache's job
+	// queue, overriding -goroutines when set.
+	Workers int `json:"workers,omitempty"`
+
+	// Priority orders the requests to the caches once the
+	// concurrency limit is reached, higher ones first.
+	Priority int `json:"priority,omitempty"`
+
+	// ConnectTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout
+	// override -connect-timeout, -tls-handshake-timeout and
+	// -response-header-timeout for the cache when set, e.g. to fail
+	// fast on connection but let a slow BAN run.
+	ConnectTimeout        time.Duration `json:"connect_timeout,omitempty"`
+	TLSHandshakeTimeout   time.Duration `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `json:"response_header_timeout,omitempty"`
+
+	// SlowThreshold is the duration past which requests to the
+	// cache are logged as slow, overriding -slow-threshold.
+	SlowThreshold time.Duration `json:"slow_threshold,omitempty"`
+
+	// ForwardHeaders lists the incoming headers sent on to the
+	// cache, overriding the -forward-headers allowlist when set.
+	ForwardHeaders []string `json:"forward_headers,omitempty"`
+
+	// BanExpression turns PURGE requests into BANs carrying the
+	// expression, {path} standing for the purged path, in the
+	// BanHeader header.
+	BanExpression string `json:"ban_expression,omitempty"`
+	BanHeader     string `json:"ban_header,omitempty"`
+
+	// KeyHeader is the header surrogate keys are sent to the
+	// cache under, e.g. xkey or Surrogate-Key.
+	KeyHeader string `json:"key_header,omitempty"`
+
+	// SignSecret keys an HMAC of the method, path and timestamp
+	// of requests, sent in the SignHeader header.
+	SignSecret    []byte `json:"-"`
+	SignHeader    string `json:"sign_header,omitempty"`
+	SignAlgorithm string `json:"sign_algorithm,omitempty"`
+
+	// BodyTransform is applied to the body of the requests
+	// forwarded to the cache: none, the default, or gzip.
+	BodyTransform string `json:"body_transform,omitempty"`
+
+	// StaticHeaders are set on every request to the cache, e.g. an
+	// X-Purge-Token it requires, unless forwarded by the broadcast.
+	// Those listed by OverrideHeaders are set over forwarded ones.
+	StaticHeaders   SecretHeaders `json:"headers,omitempty"`
+	OverrideHeaders []string      `json:"override_headers,omitempty"`
+
+	// Tags label the cache, so that broadcasts can target the
+	// caches of some tags whatever their group. They're lowercased.
+	Tags []string `json:"tags,omitempty"`
+
+	// Disabled takes the cache out of broadcasts, e.g. while
+	// under maintenance, until enabled through the admin API.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Maintenance lists the windows the cache is taken out
+	// of broadcasts during, see Window.
+	Maintenance []Window `json:"maintenance,omitempty"`
+
+	// MethodMap maps the methods of broadcasts to those sent
+	// to the cache, e.g. GET to PURGE, see MappedMethod.
+	MethodMap map[string]string `json:"method_map,omitempty"`
+
+	// AllowedMethods are the methods the MethodMap may map to,
+	// DefaultAllowedMethods when empty.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+
+	// SuccessCodes are the statuses of the cache counted as
+	// successes, 2xx when empty, e.g. 404 for the PURGE of an
+	// object which wasn't cached.
+	SuccessCodes StatusCodes `json:"success_codes,omitempty"`
+
+	// RetryOnStatus are the statuses of the cache retried like
+	// transport errors, e.g. a 503 of an overloaded cache,
+	// overriding -retry-on-status when set.
+	RetryOnStatus StatusCodes `json:"retry_on_status,omitempty"`
+
+	// ForwardedHeaders, true when unset, sends the X-Forwarded-For,
+	// X-Forwarded-Proto and X-Broadcast-Origin headers describing
+	// the client of a broadcast on to the cache.
+	ForwardedHeaders *bool `json:"forwarded_headers,omitempty"`
+
 	Method  string      `json:"-"`
 	Item    string      `json:"-"`
 	Headers http.Header `json:"-"`
+	Body    []byte      `json:"-"`
 }
 
+// SecretHeaders are headers whose values are kept out of
+// the JSON they are marshalled to, only their names showing.
+type SecretHeaders map[string]string
+
+func (h SecretHeaders) MarshalJSON() ([]byte, error) {
+	redacted := make(map[string]string, len(h))
+	for name := range h {
+		redacted[name] = "REDACTED"
+	}
+	return json.Marshal(redacted)
+}
+
+// Modes of groups: broadcast sends requests to all the caches of the
+// group, hash to a single cache picked by consistent hashing of the path.
+const (
+	ModeBroadcast = "broadcast"
+	ModeHash      = "hash"
+)
+
 type Group struct {
-	Name   string  `json:"name"`
+	Name   string `json:"name"`
+	Source string `json:"source,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+
+	// Sequential groups are broadcast to one cache at a time, in
+	// the order of the configuration, rather than to all at once.
+	// Those stopping on failure, sequential as well, don't send to
+	// the caches following a failed one.
+	Sequential    bool `json:"sequential,omitempty"`
+	StopOnFailure bool `json:"stop_on_failure,omitempty"`
+
+	// Canary names a cache broadcast to on its own first, the
+	// other caches only being broadcast to if it succeeded.
+	Canary string `json:"canary,omitempty"`
+
+	// Include names groups whose caches are members of the group
+	// as well, see ResolveIncludes.
+	Include []string `json:"include,omitempty"`
+
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	RateBurst int     `json:"rate_burst,omitempty"`
+
+	// Tokens names the tokens allowed to broadcast to
+	// the group, any token being allowed when empty.
+	Tokens []string `json:"tokens,omitempty"`
+
+	// AllowWipes lets broadcasts of protected paths, such as "/",
+	// through to the group without confirmation, for groups whose
+	// caches are routinely wiped.
+	AllowWipes bool `json:"allow_wipes,omitempty"`
+
+	// MaxInFlight, MaxResponseBody, Workers, Priority, SlowThreshold,
+	// the timeouts, ForwardHeaders, ForwardedHeaders, MethodMap,
+	// AllowedMethods, the BAN translation, KeyHeader, the signing options, BodyTransform,
+	// OverrideHeaders, SuccessCodes and RetryOnStatus are the defaults
+	// of the group's caches, which StaticHeaders are merged with.
+	MaxInFlight           int               `json:"max_inflight,omitempty"`
+	MaxResponseBody       int64             `json:"max_response_body,omitempty"`
+	Workers               int               `json:"workers,omitempty"`
+	Priority              int               `json:"priority,omitempty"`
+	SlowThreshold         time.Duration     `json:"slow_threshold,omitempty"`
+	ConnectTimeout        time.Duration     `json:"connect_timeout,omitempty"`
+	TLSHandshakeTimeout   time.Duration     `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout time.Duration     `json:"response_header_timeout,omitempty"`
+	ForwardHeaders        []string          `json:"forward_headers,omitempty"`
+	ForwardedHeaders      *bool             `json:"forwarded_headers,omitempty"`
+	MethodMap             map[string]string `json:"method_map,omitempty"`
+	AllowedMethods        []string          `json:"allowed_methods,omitempty"`
+	BanExpression         string            `json:"ban_expression,omitempty"`
+	BanHeader             string            `json:"ban_header,omitempty"`
+	KeyHeader             string            `json:"key_header,omitempty"`
+	SignSecret            []byte            `json:"-"`
+	SignHeader            string            `json:"sign_header,omitempty"`
+	SignAlgorithm         string            `json:"sign_algorithm,omitempty"`
+	BodyTransform         string            `json:"body_transform,omitempty"`
+	StaticHeaders         SecretHeaders     `json:"headers,omitempty"`
+	OverrideHeaders       []string          `json:"override_headers,omitempty"`
+	SuccessCodes          StatusCodes       `json:"success_codes,omitempty"`
+	RetryOnStatus         StatusCodes       `json:"retry_on_status,omitempty"`
+
 	Caches []Cache `json:"caches"`
 }
 
-func LoadCachesFromJson(configPath string) ([]Group, error) {
-	var groups []Group
+// UnmarshalJSON reads the options of a cache as INI files take them,
+// durations such as "250ms", signing secrets as file:<path> or
+// env:<variable> references, and fallback along with fallback_address.
+func (c *Cache) UnmarshalJSON(data []byte) error {
+	type cache Cache
+	aux := struct {
+		*cache
+		SlowThreshold         Duration `json:"slow_threshold"`
+		ConnectTimeout        Duration `json:"connect_timeout"`
+		TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout"`
+		ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+		SignSecret            string   `json:"sign_secret"`
+		Fallback              string   `json:"fallback"`
+	}{cache: (*cache)(c)}
 
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	c.SlowThreshold = time.Duration(aux.SlowThreshold)
+	c.ConnectTimeout = time.Duration(aux.ConnectTimeout)
+	c.TLSHandshakeTimeout = time.Duration(aux.TLSHandshakeTimeout)
+	c.ResponseHeaderTimeout = time.Duration(aux.ResponseHeaderTimeout)
+	if aux.Fallback != "" {
+		c.FallbackAddress = aux.Fallback
+	}
+
+	var err error
+	if c.SignSecret, err = jsonSecret(aux.SignSecret); err != nil {
+		return fmt.Errorf("Cache %s: %s", c.Name, err.Error())
+	}
+	return nil
+}
+
+// UnmarshalJSON reads the options of a group as INI files take them,
+// see Cache.UnmarshalJSON, ordered standing for sequential.
+func (g *Group) UnmarshalJSON(data []byte) error {
+	type group Group
+	aux := struct {
+		*group
+		SlowThreshold         Duration `json:"slow_threshold"`
+		ConnectTimeout        Duration `json:"connect_timeout"`
+		TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout"`
+		ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+		SignSecret            string   `json:"sign_secret"`
+		Ordered               bool     `json:"ordered"`
+	}{group: (*group)(g)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	g.SlowThreshold = time.Duration(aux.SlowThreshold)
+	g.ConnectTimeout = time.Duration(aux.ConnectTimeout)
+	g.TLSHandshakeTimeout = time.Duration(aux.TLSHandshakeTimeout)
+	g.ResponseHeaderTimeout = time.Duration(aux.ResponseHeaderTimeout)
+	g.Sequential = g.Sequential || aux.Ordered
+
+	var err error
+	if g.SignSecret, err = jsonSecret(aux.SignSecret); err != nil {
+		return fmt.Errorf("Group %s: %s", g.Name, err.Error())
+	}
+	return nil
+}
+
+// jsonSecret resolves the sign_secret of a JSON file, if any.
+func jsonSecret(ref string) ([]byte, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	secret, err := resolveSecret(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sign_secret %q: %s", ref, err.Error())
+	}
+	return secret, nil
+}
+
+func LoadCachesFromJson(configPath string) ([]Group, error) {
 	_, err := os.Stat(configPath)
 	if err != nil {
-		return groups, err
+		return nil, err
 	}
 
 	fileContent, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseCachesJson(fileContent)
+}
+
+// ParseCachesJson parses the groups of a JSON configuration.
+func ParseCachesJson(content []byte) ([]Group, error) {
+	var groups []Group
+
+	err := json.Unmarshal(content, &groups)
 	if err != nil {
 		return groups, err
 	}
 
-	err = json.Unmarshal(fileContent, &groups)
+	// Options are checked as they are in INI files.
+	for i := range groups {
+		g := &groups[i]
+		if g.Mode != "" {
+			if _, err = groupMode(g.Mode); err != nil {
+				return groups, fmt.Errorf("Group %s: invalid mode %q: %s", g.Name, g.Mode, err.Error())
+			}
+		}
+		if g.BodyTransform != "" {
+			if _, err = bodyTransform(g.BodyTransform); err != nil {
+				return groups, fmt.Errorf("Group %s: invalid body_transform %q: %s", g.Name, g.BodyTransform, err.Error())
+			}
+		}
+		if g.StaticHeaders, err = resolveHeaders(g.StaticHeaders); err != nil {
+			return groups, fmt.Errorf("Group %s: invalid header: %s", g.Name, err.Error())
+		}
+		g.OverrideHeaders = canonicalHeaders(g.OverrideHeaders)
+		if g.MethodMap, err = normalizeMethodMap(g.MethodMap); err != nil {
+			return groups, fmt.Errorf("Group %s: invalid method_map: %s", g.Name, err.Error())
+		}
+		if g.AllowedMethods, err = normalizeMethods(g.AllowedMethods); err != nil {
+			return groups, fmt.Errorf("Group %s: invalid allowed_methods: %s", g.Name, err.Error())
+		}
+		if g.SignAlgorithm != "" {
+			if _, err = signAlgorithm(g.SignAlgorithm); err != nil {
+				return groups, fmt.Errorf("Group %s: invalid sign_algorithm %q: %s", g.Name, g.SignAlgorithm, err.Error())
+			}
+		}
 
-	return groups, err
+		for j := range g.Caches {
+			c := &g.Caches[j]
+			if c.StaticHeaders, err = resolveHeaders(c.StaticHeaders); err != nil {
+				return groups, fmt.Errorf("Group %s: invalid header of cache %s: %s", g.Name, c.Name, err.Error())
+			}
+			c.OverrideHeaders = canonicalHeaders(c.OverrideHeaders)
+			if c.MethodMap, err = normalizeMethodMap(c.MethodMap); err != nil {
+				return groups, fmt.Errorf("Group %s: invalid method_map of cache %s: %s", g.Name, c.Name, err.Error())
+			}
+			if c.AllowedMethods, err = normalizeMethods(c.AllowedMethods); err != nil {
+				return groups, fmt.Errorf("Group %s: invalid allowed_methods of cache %s: %s", g.Name, c.Name, err.Error())
+			}
+			g.ApplyDefaults(c)
+		}
+	}
+
+	return groups, resolveGroups(groups)
+}
+
+// groupOptions are the keys of INI sections read as options of the
+// group, which caches can't be named after.
+var groupOptions = map[string]bool{
+	"source": true, "mode": true, "sequential": true, "ordered": true,
+	"stop_on_failure": true, "canary": true, "include": true,
+	"rate_limit": true, "rate_burst": true, "max_inflight": true,
+	"max_response_body": true, "workers": true, "priority": true,
+	"slow_threshold": true, "connect_timeout": true,
+	"tls_handshake_timeout": true, "response_header_timeout": true,
+	"forward_headers": true, "forwarded_headers": true, "method_map": true,
+	"allowed_methods": true, "override_headers": true, "success_codes": true, "retry_on_status": true,
+	"ban_expression": true, "ban_header": true, "tokens": true,
+	"allow_wipes": true, "key_header": true, "sign_secret": true,
+	"sign_header": true, "sign_algorithm": true, "body_transform": true,
+}
+
+// cacheAddress tells whether a value reads as the address of a
+// cache: an SRV name, a URL of a supported scheme or a host:port.
+func cacheAddress(value string) bool {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, srvPrefix) {
+		return true
+	}
+	if i := strings.Index(value, "://"); i > 0 {
+		switch strings.ToLower(value[:i]) {
+		case "http", "https", "unix":
+			return true
+		}
+		return false
+	}
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	return err == nil
 }
 
 func LoadCachesFromIni(configPath string) ([]Group, error) {
@@ -51,16 +417,695 @@ func LoadCachesFromIni(configPath string) ([]Group, error) {
 
 		var g Group
 
+		// Options of individual caches are keyed <cache>.<option>,
+		// they're applied once all the caches of the group are known.
+		var cacheOptions []*ini.Key
+
 		for _, k := range s.Keys() {
-			var c Cache
-			c.Name = k.Name()
-			c.Address = k.Value()
-			g.Caches = append(g.Caches, c)
+			if name := strings.TrimPrefix(k.Name(), "header."); name != k.Name() {
+				// Headers of the group are merged with those of its caches.
+				if err = setStaticHeader(&g.StaticHeaders, name, k.Value()); err != nil {
+					return groups, fmt.Errorf("Group %s: invalid %s %q: %s", s.Name(), k.Name(), k.Value(), err.Error())
+				}
+				continue
+			}
+			if strings.Contains(k.Name(), ".") {
+				cacheOptions = append(cacheOptions, k)
+				continue
+			}
+
+			if groupOptions[k.Name()] && cacheAddress(k.Value()) {
+				return groups, fmt.Errorf("Group %s: %s is an option of the group and can't name cache %s.", s.Name(), k.Name(), k.Value())
+			}
+
+			switch k.Name() {
+			case "source":
+				// The group members are discovered at runtime
+				// rather than listed in the file.
+				g.Source = k.Value()
+			case "mode":
+				g.Mode, err = groupMode(k.Value())
+			case "sequential", "ordered":
+				g.Sequential, err = k.Bool()
+			case "stop_on_failure":
+				g.StopOnFailure, err = k.Bool()
+			case "canary":
+				g.Canary = k.Value()
+			case "include":
+				g.Include = SplitList(k.Value())
+			case "rate_limit":
+				g.RateLimit, err = k.Float64()
+			case "rate_burst":
+				g.RateBurst, err = k.Int()
+			case "max_inflight":
+				g.MaxInFlight, err = k.Int()
+			case "max_response_body":
+				g.MaxResponseBody, err = k.Int64()
+			case "workers":
+				g.Workers, err = k.Int()
+			case "priority":
+				g.Priority, err = k.Int()
+			case "slow_threshold":
+				g.SlowThreshold, err = k.Duration()
+			case "connect_timeout":
+				g.ConnectTimeout, err = k.Duration()
+			case "tls_handshake_timeout":
+				g.TLSHandshakeTimeout, err = k.Duration()
+			case "response_header_timeout":
+				g.ResponseHeaderTimeout, err = k.Duration()
+			case "forward_headers":
+				g.ForwardHeaders = SplitList(k.Value())
+			case "forwarded_headers":
+				g.ForwardedHeaders, err = boolOption(k)
+			case "method_map":
+				g.MethodMap, err = methodMap(k.Value())
+			case "allowed_methods":
+				g.AllowedMethods, err = normalizeMethods(SplitList(k.Value()))
+			case "override_headers":
+				g.OverrideHeaders = canonicalHeaders(SplitList(k.Value()))
+			case "success_codes":
+				g.SuccessCodes, err = ParseStatusCodes(k.Value())
+			case "retry_on_status":
+				g.RetryOnStatus, err = ParseStatusCodes(k.Value())
+			case "ban_expression":
+				g.BanExpression = k.Value()
+			case "ban_header":
+				g.BanHeader = k.Value()
+			case "tokens":
+				g.Tokens = SplitList(k.Value())
+			case "allow_wipes":
+				g.AllowWipes, err = k.Bool()
+			case "key_header":
+				g.KeyHeader = k.Value()
+			case "sign_secret":
+				g.SignSecret, err = resolveSecret(k.Value())
+			case "sign_header":
+				g.SignHeader = k.Value()
+			case "sign_algorithm":
+				g.SignAlgorithm, err = signAlgorithm(k.Value())
+			case "body_transform":
+				g.BodyTransform, err = bodyTransform(k.Value())
+			default:
+				var c Cache
+				c.Name = k.Name()
+				if name := strings.TrimPrefix(k.Value(), srvPrefix); name != k.Value() {
+					c.SRV = name
+				} else {
+					c.Address = k.Value()
+				}
+				g.Caches = append(g.Caches, c)
+			}
+
+			if err != nil {
+				return groups, fmt.Errorf("Group %s: invalid %s %q: %s", s.Name(), k.Name(), k.Value(), err.Error())
+			}
+		}
+
+		for _, k := range cacheOptions {
+			parts := strings.SplitN(k.Name(), ".", 2)
+
+			c := findCache(g.Caches, parts[0])
+			if c == nil {
+				return groups, fmt.Errorf("Group %s: %s configures unknown cache %s.", s.Name(), k.Name(), parts[0])
+			}
+
+			if err = setCacheOption(c, parts[1], k); err != nil {
+				return groups, fmt.Errorf("Group %s: invalid %s %q: %s", s.Name(), k.Name(), k.Value(), err.Error())
+			}
+		}
 
+		for i := range g.Caches {
+			g.ApplyDefaults(&g.Caches[i])
 		}
+
 		g.Name = s.Name()
 		groups = append(groups, g)
 	}
 
-	return groups, nil
+	return groups, resolveGroups(groups)
+}
+
+// resolveGroups normalizes the addresses and tags of the loaded
+// caches and resolves the includes of the groups, then checks their
+// canaries are among their caches.
+func resolveGroups(groups []Group) error {
+	for _, g := range groups {
+		if err := checkMethodMap(g.MethodMap, g.AllowedMethods); err != nil {
+			return fmt.Errorf("Group %s: invalid method_map: %s", g.Name, err.Error())
+		}
+
+		for i := range g.Caches {
+			c := &g.Caches[i]
+
+			if err := checkMethodMap(c.MethodMap, c.AllowedMethods); err != nil {
+				return fmt.Errorf("Group %s: invalid method_map of cache %s: %s", g.Name, c.Name, err.Error())
+			}
+
+			for j := range c.Tags {
+				c.Tags[j] = strings.ToLower(strings.TrimSpace(c.Tags[j]))
+			}
+
+			var err error
+			if c.SRV != "" {
+				if c.SRV = strings.TrimSpace(c.SRV); c.Address != "" || c.SRV == "" {
+					return fmt.Errorf("Group %s: cache %s needs either an address or an SRV name.", g.Name, c.Name)
+				}
+			} else if c.Address, err = NormalizeAddress(c.Address); err != nil {
+				return fmt.Errorf("Group %s: invalid address of cache %s: %s", g.Name, c.Name, err.Error())
+			}
+			if c.FallbackAddress != "" {
+				if c.FallbackAddress, err = NormalizeAddress(c.FallbackAddress); err != nil {
+					return fmt.Errorf("Group %s: invalid fallback of cache %s: %s", g.Name, c.Name, err.Error())
+				}
+			}
+		}
+	}
+
+	if err := ResolveIncludes(groups); err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		if g.Canary != "" && g.Source == "" && findCache(g.Caches, g.Canary) == nil {
+			return fmt.Errorf("Group %s: canary %s isn't a cache of the group.", g.Name, g.Canary)
+		}
+	}
+
+	return nil
+}
+
+// LoadCaches loads the groups of a configuration file, in JSON
+// if its name ends in .json and in INI otherwise. Remote ones,
+// http(s):// URLs, are JSON.
+func LoadCaches(configPath string) ([]Group, error) {
+	if IsRemoteConfig(configPath) {
+		return LoadCachesFromURL(configPath)
+	}
+	if strings.EqualFold(filepath.Ext(configPath), ".json") {
+		return LoadCachesFromJson(configPath)
+	}
+	return LoadCachesFromIni(configPath)
+}
+
+// ResolveIncludes adds the caches of the groups a group includes to
+// its own, transitively, after them and in the order of inclusion. A
+// cache reached through several groups is only added once, with the
+// options of the first. Groups including each other are an error.
+func ResolveIncludes(groups []Group) error {
+	index := make(map[string]int, len(groups))
+	for i, g := range groups {
+		index[g.Name] = i
+	}
+
+	const (
+		resolving = iota + 1
+		resolved
+	)
+	state := make(map[string]int, len(groups))
+
+	var resolve func(name string, chain []string) error
+	resolve = func(name string, chain []string) error {
+		switch state[name] {
+		case resolved:
+			return nil
+		case resolving:
+			for i, n := range chain {
+				if n == name {
+					chain = chain[i:]
+					break
+				}
+			}
+			return fmt.Errorf("Groups include each other: %s -> %s.", strings.Join(chain, " -> "), name)
+		}
+		state[name] = resolving
+		chain = append(chain[:len(chain):len(chain)], name)
+
+		g := &groups[index[name]]
+		if g.Source != "" && len(g.Include) > 0 {
+			return fmt.Errorf("Group %s: groups discovered from %s can't include others.", g.Name, g.Source)
+		}
+
+		for _, included := range g.Include {
+			i, found := index[included]
+			if !found {
+				return fmt.Errorf("Group %s: includes unknown group %s.", g.Name, included)
+			}
+			if groups[i].Source != "" {
+				return fmt.Errorf("Group %s: can't include group %s, discovered from %s.", g.Name, included, groups[i].Source)
+			}
+			if err := resolve(included, chain); err != nil {
+				return err
+			}
+
+			for _, c := range groups[i].Caches {
+				if existing := findCache(g.Caches, c.Name); existing != nil {
+					if existing.Address != c.Address {
+						return fmt.Errorf("Group %s: cache %s is included with different addresses.", g.Name, c.Name)
+					}
+					continue
+				}
+				g.ApplyDefaults(&c)
+				g.Caches = append(g.Caches, c)
+			}
+		}
+
+		state[name] = resolved
+		return nil
+	}
+
+	for _, g := range groups {
+		if err := resolve(g.Name, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplyDefaults sets the options the cache leaves unset
+// to the defaults of the group.
+func (g Group) ApplyDefaults(c *Cache) {
+	if c.MaxInFlight == 0 {
+		c.MaxInFlight = g.MaxInFlight
+	}
+	if c.MaxResponseBody == 0 {
+		c.MaxResponseBody = g.MaxResponseBody
+	}
+	if c.Workers == 0 {
+		c.Workers = g.Workers
+	}
+	if c.Priority == 0 {
+		c.Priority = g.Priority
+	}
+	if c.SlowThreshold == 0 {
+		c.SlowThreshold = g.SlowThreshold
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = g.ConnectTimeout
+	}
+	if c.TLSHandshakeTimeout == 0 {
+		c.TLSHandshakeTimeout = g.TLSHandshakeTimeout
+	}
+	if c.ResponseHeaderTimeout == 0 {
+		c.ResponseHeaderTimeout = g.ResponseHeaderTimeout
+	}
+	if c.ForwardHeaders == nil {
+		c.ForwardHeaders = g.ForwardHeaders
+	}
+	if c.ForwardedHeaders == nil {
+		c.ForwardedHeaders = g.ForwardedHeaders
+	}
+	if c.MethodMap == nil {
+		c.MethodMap = g.MethodMap
+	}
+	if c.AllowedMethods == nil {
+		c.AllowedMethods = g.AllowedMethods
+	}
+	if c.OverrideHeaders == nil {
+		c.OverrideHeaders = g.OverrideHeaders
+	}
+	if c.SuccessCodes == nil {
+		c.SuccessCodes = g.SuccessCodes
+	}
+	if c.RetryOnStatus == nil {
+		c.RetryOnStatus = g.RetryOnStatus
+	}
+	if len(g.StaticHeaders) > 0 {
+		merged := make(SecretHeaders, len(g.StaticHeaders)+len(c.StaticHeaders))
+		for name, value := range g.StaticHeaders {
+			merged[name] = value
+		}
+		for name, value := range c.StaticHeaders {
+			merged[name] = value
+		}
+		c.StaticHeaders = merged
+	}
+	if c.BanExpression == "" {
+		c.BanExpression = g.BanExpression
+	}
+	if c.BanHeader == "" {
+		c.BanHeader = g.BanHeader
+	}
+	if c.KeyHeader == "" {
+		c.KeyHeader = g.KeyHeader
+	}
+	if c.SignSecret == nil {
+		c.SignSecret = g.SignSecret
+	}
+	if c.SignHeader == "" {
+		c.SignHeader = g.SignHeader
+	}
+	if c.SignAlgorithm == "" {
+		c.SignAlgorithm = g.SignAlgorithm
+	}
+	if c.BodyTransform == "" {
+		c.BodyTransform = g.BodyTransform
+	}
+}
+
+// MappedMethod returns the method sent to the cache for a broadcast
+// of the method, as mapped by its MethodMap. Unmapped methods are
+// sent as is.
+func (c Cache) MappedMethod(method string) string {
+	if mapped, found := c.MethodMap[method]; found {
+		return mapped
+	}
+	return method
+}
+
+// methodMap parses a comma-separated list of method mappings,
+// such as GET=PURGE, DELETE=BAN.
+func methodMap(value string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, item := range SplitList(value) {
+		from, to, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s isn't of the form FROM=TO", item)
+		}
+		m[strings.TrimSpace(from)] = strings.TrimSpace(to)
+	}
+	return normalizeMethodMap(m)
+}
+
+// normalizeMethodMap uppercases the methods of the mapping, which
+// must be valid methods so that requests to the caches can be sent.
+func normalizeMethodMap(m map[string]string) (map[string]string, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	normalized := make(map[string]string, len(m))
+	for from, to := range m {
+		for _, method := range []string{from, to} {
+			if !validMethod(method) {
+				return nil, fmt.Errorf("invalid method %q", method)
+			}
+		}
+		normalized[strings.ToUpper(from)] = strings.ToUpper(to)
+	}
+	return normalized, nil
+}
+
+// validMethod tells whether the method is an HTTP token.
+// DefaultAllowedMethods are the methods a MethodMap may map to,
+// unless the cache allows others.
+var DefaultAllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "PURGE", "BAN", "REFRESH"}
+
+// normalizeMethods uppercases a list of methods.
+func normalizeMethods(methods []string) ([]string, error) {
+	if methods == nil {
+		return nil, nil
+	}
+
+	normalized := make([]string, len(methods))
+	for i, method := range methods {
+		if !validMethod(method) {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+		normalized[i] = strings.ToUpper(method)
+	}
+	return normalized, nil
+}
+
+// checkMethodMap checks the methods are mapped to allowed
+// ones, DefaultAllowedMethods if none are.
+func checkMethodMap(m map[string]string, allowed []string) error {
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedMethods
+	}
+
+	for from, to := range m {
+		found := false
+		for _, method := range allowed {
+			found = found || method == to
+		}
+		if !found {
+			return fmt.Errorf("%s=%s maps to a method outside of %s", from, to, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, r := range method {
+		if r >= unicode.MaxASCII || r <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// boolOption parses a boolean option left unset by default.
+func boolOption(k *ini.Key) (*bool, error) {
+	v, err := k.Bool()
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// SplitList splits a comma-separated option value,
+// dropping blank items.
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func findCache(caches []Cache, name string) *Cache {
+	for i := range caches {
+		if caches[i].Name == name {
+			return &caches[i]
+		}
+	}
+	return nil
+}
+
+// setCacheOption applies a <cache>.<option> key to the cache.
+func setCacheOption(c *Cache, option string, k *ini.Key) error {
+	var err error
+
+	switch option {
+	case "fallback":
+		c.FallbackAddress = k.Value()
+	case "path_prefix":
+		if !strings.HasPrefix(k.Value(), "/") {
+			return fmt.Errorf("path_prefix must start with a /")
+		}
+		c.PathPrefix = k.Value()
+	case "path_rewrite":
+		if !strings.HasPrefix(k.Value(), "/") || !strings.Contains(k.Value(), "=") {
+			return fmt.Errorf("path_rewrite must be of the form /from=/to")
+		}
+		c.PathRewrite = k.Value()
+	case "max_inflight":
+		c.MaxInFlight, err = k.Int()
+	case "max_response_body":
+		c.MaxResponseBody, err = k.Int64()
+	case "workers":
+		c.Workers, err = k.Int()
+	case "priority":
+		c.Priority, err = k.Int()
+	case "slow_threshold":
+		c.SlowThreshold, err = k.Duration()
+	case "connect_timeout":
+		c.ConnectTimeout, err = k.Duration()
+	case "tls_handshake_timeout":
+		c.TLSHandshakeTimeout, err = k.Duration()
+	case "response_header_timeout":
+		c.ResponseHeaderTimeout, err = k.Duration()
+	case "sign_secret":
+		c.SignSecret, err = resolveSecret(k.Value())
+	case "sign_header":
+		c.SignHeader = k.Value()
+	case "sign_algorithm":
+		c.SignAlgorithm, err = signAlgorithm(k.Value())
+	case "body_transform":
+		c.BodyTransform, err = bodyTransform(k.Value())
+	case "tags":
+		c.Tags = SplitList(k.Value())
+	case "disabled":
+		c.Disabled, err = k.Bool()
+	case "forwarded_headers":
+		c.ForwardedHeaders, err = boolOption(k)
+	case "method_map":
+		c.MethodMap, err = methodMap(k.Value())
+	case "allowed_methods":
+		c.AllowedMethods, err = normalizeMethods(SplitList(k.Value()))
+	case "override_headers":
+		c.OverrideHeaders = canonicalHeaders(SplitList(k.Value()))
+	case "success_codes":
+		c.SuccessCodes, err = ParseStatusCodes(k.Value())
+	case "retry_on_status":
+		c.RetryOnStatus, err = ParseStatusCodes(k.Value())
+	case "maintenance":
+		c.Maintenance = nil
+		for _, item := range SplitList(k.Value()) {
+			var w Window
+			if w, err = ParseWindow(item); err != nil {
+				break
+			}
+			c.Maintenance = append(c.Maintenance, w)
+		}
+	default:
+		name := strings.TrimPrefix(option, "header.")
+		if name == option {
+			return fmt.Errorf("unknown cache option %s", option)
+		}
+		err = setStaticHeader(&c.StaticHeaders, name, k.Value())
+	}
+
+	return err
+}
+
+// srvPrefix marks the address of a cache naming an SRV
+// record in INI files, e.g. srv:_http._tcp.varnish.internal
+const srvPrefix = "srv:"
+
+// NormalizeAddress returns the base URL of a cache address, which paths
+// are appended to: http:// is assumed when the scheme is missing, the
+// scheme and host are lowercased, and a trailing slash is dropped.
+// Caches listening on a unix domain socket are addressed by its
+// absolute path, e.g. unix:///var/run/varnish.sock
+func NormalizeAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(u.Scheme, "unix") {
+		if u.Host != "" || !strings.HasPrefix(u.Path, "/") || u.RawQuery != "" || u.Fragment != "" {
+			return "", fmt.Errorf("%s isn't the absolute path of a socket, e.g. unix:///var/run/cache.sock", address)
+		}
+		return "unix://" + filepath.Clean(u.Path), nil
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %s, expected http, https or unix", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("%s has no host", address)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%s has a query or fragment", address)
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+
+	return u.String(), nil
+}
+
+// setStaticHeader sets a static header, its name canonicalized.
+func setStaticHeader(headers *SecretHeaders, name, value string) error {
+	if name == "" {
+		return fmt.Errorf("header without name")
+	}
+	v, err := headerValue(value)
+	if err != nil {
+		return err
+	}
+	if *headers == nil {
+		*headers = make(SecretHeaders)
+	}
+	(*headers)[http.CanonicalHeaderKey(name)] = v
+	return nil
+}
+
+// resolveHeaders returns the static headers of a JSON configuration
+// as those of INI files are set.
+func resolveHeaders(headers SecretHeaders) (SecretHeaders, error) {
+	if headers == nil {
+		return nil, nil
+	}
+	resolved := make(SecretHeaders, len(headers))
+	for name, value := range headers {
+		if err := setStaticHeader(&resolved, name, value); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	return resolved, nil
+}
+
+func canonicalHeaders(names []string) []string {
+	for i, name := range names {
+		names[i] = http.CanonicalHeaderKey(name)
+	}
+	return names
+}
+
+// headerValue returns the value of a static header, read as a
+// secret when referenced as file:<path> or env:<variable>.
+func headerValue(value string) (string, error) {
+	if strings.HasPrefix(value, "file:") || strings.HasPrefix(value, "env:") {
+		secret, err := resolveSecret(value)
+		return string(secret), err
+	}
+	return value, nil
+}
+
+// resolveSecret reads a secret referenced as file:<path> or
+// env:<variable>, so that it isn't written in the configuration.
+func resolveSecret(ref string) ([]byte, error) {
+	var secret string
+
+	switch {
+	case strings.HasPrefix(ref, "file:"):
+		content, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimRight(string(content), "\r\n")
+	case strings.HasPrefix(ref, "env:"):
+		secret = os.Getenv(strings.TrimPrefix(ref, "env:"))
+	default:
+		return nil, fmt.Errorf("secrets must be referenced as file:<path> or env:<variable>")
+	}
+
+	if secret == "" {
+		return nil, fmt.Errorf("secret %s is empty", ref)
+	}
+
+	return []byte(secret), nil
+}
+
+func groupMode(name string) (string, error) {
+	switch name {
+	case ModeBroadcast, ModeHash:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown mode %s, expected broadcast or hash", name)
+}
+
+func signAlgorithm(name string) (string, error) {
+	switch name {
+	case "sha1", "sha256", "sha512":
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown algorithm %s, expected sha1, sha256 or sha512", name)
+}
+
+// Transforms of the bodies forwarded to the caches.
+const (
+	BodyTransformNone = "none"
+	BodyTransformGzip = "gzip"
+)
+
+func bodyTransform(name string) (string, error) {
+	switch name {
+	case BodyTransformNone, BodyTransformGzip:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown body transform %s, expected none or gzip", name)
 }
@@ -0,0 +1,593 @@
+package dao
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadTestIni(t *testing.T, content string) ([]Group, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "caches.ini")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadCachesFromIni(path)
+}
+
+func findGroup(groups []Group, name string) Group {
+	for _, g := range groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return Group{}
+}
+
+func cacheNames(g Group) []string {
+	var names []string
+	for _, c := range g.Caches {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestIncludedGroups(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[all-eu]
+include = edge-west, edge-fra
+priority = 5
+
+[edge-west]
+include = edge-ams, edge-lhr
+
+[edge-ams]
+ams1 = "http://ams1"
+ams1.priority = 1
+
+[edge-lhr]
+lhr1 = "http://lhr1"
+ams1 = "http://ams1"
+
+[edge-fra]
+fra1 = "http://fra1"
+ams1 = "http://ams1"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allEU, west := findGroup(groups, "all-eu"), findGroup(groups, "edge-west")
+
+	if got := cacheNames(allEU); !reflect.DeepEqual(got, []string{"ams1", "lhr1", "fra1"}) {
+		t.Errorf("unexpected caches of all-eu %v", got)
+	}
+	if got := cacheNames(west); !reflect.DeepEqual(got, []string{"ams1", "lhr1"}) {
+		t.Errorf("unexpected caches of edge-west %v", got)
+	}
+	if p := allEU.Caches[0].Priority; p != 1 {
+		t.Errorf("expected included caches to keep their options, got priority %d", p)
+	}
+	if p := allEU.Caches[2].Priority; p != 5 {
+		t.Errorf("expected included caches to take the defaults of the group, got priority %d", p)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	tests := []struct {
+		ini, want string
+	}{
+		{"[a]\ninclude = b\n[b]\ninclude = c\n[c]\ninclude = b\n", "b -> c -> b"},
+		{"[a]\ninclude = a\n", "a -> a"},
+		{"[a]\ninclude = missing\n", "unknown group missing"},
+		{"[a]\ninclude = b\n[b]\nsource = consul:varnish\n", "discovered from consul:varnish"},
+		{"[a]\nc1 = \"http://one\"\ninclude = b\n[b]\nc1 = \"http://two\"\n", "different addresses"},
+	}
+
+	for _, tt := range tests {
+		_, err := loadTestIni(t, tt.ini)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected an error about %q, got %v", tt.ini, tt.want, err)
+		}
+	}
+}
+
+func TestJsonMatchesIni(t *testing.T) {
+	t.Setenv("TEST_SIGN_SECRET", "s3cret")
+
+	fromIni, err := loadTestIni(t, `
+[edge]
+mode = hash
+max_inflight = 4
+workers = 2
+key_header = xkey
+slow_threshold = 250ms
+sign_secret = env:TEST_SIGN_SECRET
+c1 = "http://c1"
+c1.tls_handshake_timeout = 2s
+c2 = "http://c2"
+c2.priority = 3
+c2.workers = 1
+c2.path_prefix = /site
+c2.maintenance = Sun 02:00-04:00
+c2.connect_timeout = 1s
+c2.fallback = "http://c2b"
+
+[all]
+include = edge
+canary = c3
+ordered = true
+c3 = "http://c3"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "caches.json")
+	err = ioutil.WriteFile(path, []byte(`[
+  {"name": "edge", "mode": "hash", "max_inflight": 4, "workers": 2, "key_header": "xkey", "slow_threshold": "250ms", "sign_secret": "env:TEST_SIGN_SECRET", "caches": [
+    {"name": "c1", "address": "http://c1", "tls_handshake_timeout": 2000000000},
+    {"name": "c2", "address": "http://c2", "priority": 3, "workers": 1, "path_prefix": "/site", "maintenance": ["Sun 02:00-04:00"], "connect_timeout": "1s", "fallback": "http://c2b"}
+  ]},
+  {"name": "all", "include": ["edge"], "canary": "c3", "ordered": true, "caches": [
+    {"name": "c3", "address": "http://c3"}
+  ]}
+]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJson, err := LoadCaches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := func(groups []Group) map[string]Group {
+		m := make(map[string]Group)
+		for _, g := range groups {
+			// INI files always have a DEFAULT section.
+			if g.Name != "DEFAULT" {
+				m[g.Name] = g
+			}
+		}
+		return m
+	}
+	if got, want := byName(fromJson), byName(fromIni); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the JSON groups to match the INI ones:\n%+v\n%+v", got, want)
+	}
+
+	for _, content := range []string{
+		`[{"name": "edge", "slow_threshold": "soon", "caches": []}]`,
+		`[{"name": "edge", "caches": [{"name": "c1", "address": "http://c1", "sign_secret": "s3cret"}]}]`,
+	} {
+		if _, err := ParseCachesJson([]byte(content)); err == nil {
+			t.Errorf("%s: expected an error", content)
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for address, want := range map[string]string{
+		"http://host/":                       "http://host",
+		"host:8080":                          "http://host:8080",
+		"https://cache.example.com":          "https://cache.example.com",
+		"HTTP://Cache.Example.com/varnish//": "http://cache.example.com/varnish",
+		" localhost:6081 ":                   "http://localhost:6081",
+		"unix:///var/run/varnish.sock":       "unix:///var/run/varnish.sock",
+		"UNIX:///var/run//varnish.sock/":     "unix:///var/run/varnish.sock",
+	} {
+		if got, err := NormalizeAddress(address); err != nil || got != want {
+			t.Errorf("%q: expected %s, got %s %v", address, want, got, err)
+		}
+	}
+
+	for _, address := range []string{"", "ftp://host", "http://", "http://host/?a=b", "http://ho st", "unix://varnish.sock", "unix://"} {
+		if got, err := NormalizeAddress(address); err == nil {
+			t.Errorf("%q: expected an error, got %s", address, got)
+		}
+	}
+}
+
+func TestLoadNormalizesAddresses(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[edge]
+c1 = "http://host/"
+c2 = "host:8080"
+c2.fallback = "Backup:8080/"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caches := findGroup(groups, "edge").Caches
+	if caches[0].Address != "http://host" || caches[1].Address != "http://host:8080" || caches[1].FallbackAddress != "http://backup:8080" {
+		t.Errorf("expected normalized addresses, got %+v", caches)
+	}
+
+	if _, err = loadTestIni(t, "[edge]\nc1 = \"ftp://host\"\n"); err == nil || !strings.Contains(err.Error(), "c1") {
+		t.Errorf("expected an invalid address to be an error, got %v", err)
+	}
+}
+
+func TestStaticHeaders(t *testing.T) {
+	t.Setenv("TEST_PURGE_TOKEN", "s3cret")
+
+	groups, err := loadTestIni(t, `
+[edge]
+c1 = "http://c1"
+c1.header.X-Purge-Token = env:TEST_PURGE_TOKEN
+c1.header.x-tenant = shop
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := findGroup(groups, "edge").Caches[0]
+	if want := (SecretHeaders{"X-Purge-Token": "s3cret", "X-Tenant": "shop"}); !reflect.DeepEqual(c.StaticHeaders, want) {
+		t.Errorf("expected %v, got %v", want, c.StaticHeaders)
+	}
+
+	out, _ := json.Marshal(c)
+	if strings.Contains(string(out), "s3cret") || !strings.Contains(string(out), "X-Purge-Token") {
+		t.Errorf("expected the header value to be redacted, got %s", out)
+	}
+
+	if _, err = loadTestIni(t, "[edge]\nc1 = \"http://c1\"\nc1.header. = x\n"); err == nil {
+		t.Error("expected a header without name to be an error")
+	}
+}
+
+func TestGroupStaticHeaders(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[edge]
+header.X-Purge-Token = s3cret
+header.x-cluster = eu
+override_headers = x-purge-token
+c1 = "http://c1"
+c1.header.X-Cluster = eu-west
+c2 = "http://c2"
+c2.override_headers = X-Cluster
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := findGroup(groups, "edge")
+	if want := (SecretHeaders{"X-Purge-Token": "s3cret", "X-Cluster": "eu-west"}); !reflect.DeepEqual(g.Caches[0].StaticHeaders, want) {
+		t.Errorf("expected c1 to override the group's X-Cluster, got %v", g.Caches[0].StaticHeaders)
+	}
+	if want := (SecretHeaders{"X-Purge-Token": "s3cret", "X-Cluster": "eu"}); !reflect.DeepEqual(g.Caches[1].StaticHeaders, want) {
+		t.Errorf("expected c2 to take the group's headers, got %v", g.Caches[1].StaticHeaders)
+	}
+	if !reflect.DeepEqual(g.Caches[0].OverrideHeaders, []string{"X-Purge-Token"}) || !reflect.DeepEqual(g.Caches[1].OverrideHeaders, []string{"X-Cluster"}) {
+		t.Errorf("expected the override_headers of c1 and c2, got %v and %v", g.Caches[0].OverrideHeaders, g.Caches[1].OverrideHeaders)
+	}
+
+	out, _ := json.Marshal(g)
+	if strings.Contains(string(out), "s3cret") {
+		t.Errorf("expected the group's header values to be redacted, got %s", out)
+	}
+
+	path := filepath.Join(t.TempDir(), "caches.json")
+	err = ioutil.WriteFile(path, []byte(`[{"name": "edge", "headers": {"x-purge-token": "s3cret"}, "caches": [{"name": "c1", "address": "http://c1"}]}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJson, err := LoadCaches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SecretHeaders{"X-Purge-Token": "s3cret"}); !reflect.DeepEqual(fromJson[0].Caches[0].StaticHeaders, want) {
+		t.Errorf("expected c1 to take the group's headers from JSON, got %v", fromJson[0].Caches[0].StaticHeaders)
+	}
+}
+
+func TestCacheTags(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[edge]
+c1 = "http://c1"
+c1.tags = EU, varnish
+c2 = "http://c2"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := findGroup(groups, "edge")
+	if want := []string{"eu", "varnish"}; !reflect.DeepEqual(g.Caches[0].Tags, want) {
+		t.Errorf("expected %v, got %v", want, g.Caches[0].Tags)
+	}
+	if g.Caches[1].Tags != nil {
+		t.Errorf("expected c2 to have no tags, got %v", g.Caches[1].Tags)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[edge]
+c1 = "http://c1"
+c1.disabled = true
+c2 = "http://c2"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := findGroup(groups, "edge")
+	if !g.Caches[0].Disabled || g.Caches[1].Disabled {
+		t.Errorf("expected only c1 to be disabled, got %+v", g.Caches)
+	}
+
+	if _, err := loadTestIni(t, "[edge]\nc1 = \"http://c1\"\nc1.disabled = maybe\n"); err == nil {
+		t.Error("expected an invalid disabled option to be an error")
+	}
+}
+
+func TestForwardedHeadersOption(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[edge]
+forwarded_headers = false
+c1 = "http://c1"
+c2 = "http://c2"
+c2.forwarded_headers = true
+
+[shield]
+c3 = "http://c3"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edge := findGroup(groups, "edge")
+	if c1, c2 := edge.Caches[0], edge.Caches[1]; c1.ForwardedHeaders == nil || *c1.ForwardedHeaders || c2.ForwardedHeaders == nil || !*c2.ForwardedHeaders {
+		t.Errorf("expected c1 to take the group's option and c2 its own, got %+v", edge.Caches)
+	}
+	if c3 := findGroup(groups, "shield").Caches[0]; c3.ForwardedHeaders != nil {
+		t.Errorf("expected c3 to leave the option unset, got %v", *c3.ForwardedHeaders)
+	}
+}
+
+func TestAllowWipes(t *testing.T) {
+	groups, err := loadTestIni(t, "[scratch]\nallow_wipes = true\nc1 = \"http://c1\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !findGroup(groups, "scratch").AllowWipes {
+		t.Error("expected the group to allow wipes")
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[edge]
+c1 = "http://c1"
+c1.maintenance = Sun 02:00-04:00, Mon-Fri 23:30-00:30
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := findGroup(groups, "edge").Caches[0]
+
+	for at, want := range map[string]bool{
+		"2026-10-18T03:00:00Z": true,  // Sunday
+		"2026-10-18T04:00:00Z": false, // Sunday, once over
+		"2026-10-17T03:00:00Z": false, // Saturday
+		"2026-10-16T23:45:00Z": true,  // Friday
+		"2026-10-17T00:15:00Z": true,  // Saturday, started on Friday
+		"2026-10-18T00:15:00Z": false, // Sunday, not started on Saturday
+	} {
+		ts, _ := time.Parse(time.RFC3339, at)
+		if got := c1.InMaintenance(ts); got != want {
+			t.Errorf("%s: expected %v, got %v", at, want, got)
+		}
+	}
+
+	if got := fmt.Sprint(c1.Maintenance); got != "[Sun 02:00-04:00 Mon-Fri 23:30-00:30]" {
+		t.Errorf("expected the windows to print as configured, got %s", got)
+	}
+
+	for _, invalid := range []string{"02:00", "Someday 02:00-04:00", "02:00-02:00", "25:00-26:00"} {
+		if _, err := ParseWindow(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestMethodMap(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[legacy]
+method_map = get=PURGE, DELETE=BAN
+c1 = "http://c1"
+c2 = "http://c2"
+c2.method_map = GET=REFRESH
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := findGroup(groups, "legacy")
+	if want := map[string]string{"GET": "PURGE", "DELETE": "BAN"}; !reflect.DeepEqual(g.Caches[0].MethodMap, want) {
+		t.Errorf("expected c1 to take the group's method_map, got %v", g.Caches[0].MethodMap)
+	}
+	for method, want := range map[string]string{"GET": "PURGE", "DELETE": "BAN", "PURGE": "PURGE"} {
+		if got := g.Caches[0].MappedMethod(method); got != want {
+			t.Errorf("expected %s to be mapped to %s, got %s", method, want, got)
+		}
+	}
+	if got := g.Caches[1].MappedMethod("GET"); got != "REFRESH" {
+		t.Errorf("expected c2 to map GET to REFRESH, got %s", got)
+	}
+
+	for _, invalid := range []string{"GET", "GET=", "GET=PUR GE", "GET=PURGE/1"} {
+		if _, err := loadTestIni(t, "[legacy]\nmethod_map = "+invalid+"\nc1 = \"http://c1\"\n"); err == nil {
+			t.Errorf("expected method_map %q to be an error", invalid)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "caches.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"name": "legacy", "method_map": {"get": "bad method"}, "caches": []}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCaches(path); err == nil {
+		t.Error("expected an invalid JSON method_map to be an error")
+	}
+}
+
+func TestMethodMapAllowedMethods(t *testing.T) {
+	if _, err := loadTestIni(t, "[legacy]\nmethod_map = GET=FOO\nc1 = \"http://c1\"\n"); err == nil || !strings.Contains(err.Error(), "GET=FOO") {
+		t.Errorf("expected a mapping outside of the allowed methods to be an error, got %v", err)
+	}
+
+	groups, err := loadTestIni(t, `
+[legacy]
+c1 = "http://c1"
+c1.method_map = GET=FOO
+c1.allowed_methods = purge, foo
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := findGroup(groups, "legacy").Caches[0]; got.MappedMethod("GET") != "FOO" || !reflect.DeepEqual(got.AllowedMethods, []string{"PURGE", "FOO"}) {
+		t.Errorf("expected c1 to allow FOO, got %+v", got)
+	}
+
+	if _, err := loadTestIni(t, "[legacy]\nallowed_methods = PURGE\nc1 = \"http://c1\"\nc1.method_map = GET=BAN\n"); err == nil {
+		t.Error("expected the allowed methods of the group to apply to its caches")
+	}
+
+	path := filepath.Join(t.TempDir(), "caches.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"name": "legacy", "caches": [{"name": "c1", "address": "http://c1", "method_map": {"GET": "FOO"}}]}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCaches(path); err == nil {
+		t.Error("expected a JSON mapping outside of the allowed methods to be an error")
+	}
+}
+
+func TestSuccessCodes(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[varnish]
+success_codes = 200-299, 404
+c1 = "http://c1"
+c2 = "http://c2"
+c2.success_codes = 200
+retry_on_status = 503
+c2.retry_on_status = none
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := findGroup(groups, "varnish")
+	if c1 := g.Caches[0]; !c1.SuccessCodes.Contains(404) || !c1.SuccessCodes.Contains(204) || c1.SuccessCodes.Contains(500) {
+		t.Errorf("expected c1 to take the group's success codes, got %s", c1.SuccessCodes)
+	}
+	if c2 := g.Caches[1]; c2.SuccessCodes.Contains(404) || !c2.SuccessCodes.Contains(200) {
+		t.Errorf("expected c2 to have its own success codes, got %s", c2.SuccessCodes)
+	}
+
+	if !g.Caches[0].RetryOnStatus.Contains(503) || g.Caches[1].RetryOnStatus == nil || g.Caches[1].RetryOnStatus.Contains(503) {
+		t.Errorf("expected c2 alone to retry no status, got %s and %s", g.Caches[0].RetryOnStatus, g.Caches[1].RetryOnStatus)
+	}
+
+	out, _ := json.Marshal(g)
+	if !strings.Contains(string(out), `"success_codes":"200-299, 404"`) {
+		t.Errorf("expected the success codes to be marshalled as configured, got %s", out)
+	}
+
+	for _, invalid := range []string{"", "2xx", "299-200", "200-999"} {
+		if _, err := ParseStatusCodes(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestLoadCachesFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/caches.json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `[{"name": "edge", "caches": [{"name": "c1", "address": "10.0.0.1:6081"}]}]`)
+	}))
+	defer server.Close()
+
+	if !IsRemoteConfig(server.URL) || IsRemoteConfig("/caches.ini") {
+		t.Error("expected only URLs to be remote configurations")
+	}
+
+	groups, err := LoadCaches(server.URL + "/caches.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0].Caches) != 1 || groups[0].Caches[0].Address != "http://10.0.0.1:6081" {
+		t.Errorf("expected the remote groups to be loaded, got %+v", groups)
+	}
+
+	if _, err := LoadCachesFromURL(server.URL + "/missing.json"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 to be an error, got %v", err)
+	}
+}
+
+func TestSRVCaches(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[edge]
+varnish = "srv:_http._tcp.varnish.internal"
+varnish.max_inflight = 4
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := findGroup(groups, "edge").Caches[0]; c.SRV != "_http._tcp.varnish.internal" || c.Address != "" || c.MaxInFlight != 4 {
+		t.Errorf("expected an SRV cache, got %+v", c)
+	}
+
+	if err := resolveGroups([]Group{{Name: "edge", Caches: []Cache{{Name: "c1", Address: "http://c1", SRV: "_http._tcp.c1"}}}}); err == nil {
+		t.Error("expected a cache with both an address and an SRV name to be an error")
+	}
+}
+
+func TestTimeoutOptions(t *testing.T) {
+	groups, err := loadTestIni(t, `
+[edge]
+connect_timeout = 500ms
+c1 = "http://c1"
+c1.response_header_timeout = 1m
+c2 = "http://c2"
+c2.connect_timeout = 2s
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := findGroup(groups, "edge")
+	if c1 := g.Caches[0]; c1.ConnectTimeout != 500*time.Millisecond || c1.ResponseHeaderTimeout != time.Minute {
+		t.Errorf("expected c1 to take the group's connect timeout, got %+v", c1)
+	}
+	if c2 := g.Caches[1]; c2.ConnectTimeout != 2*time.Second || c2.ResponseHeaderTimeout != 0 {
+		t.Errorf("expected c2 to have its own connect timeout, got %+v", c2)
+	}
+}
+
+func TestCachesNamedAfterOptions(t *testing.T) {
+	t.Setenv("SIGN_SECRET", "secret")
+
+	tests := []string{
+		"[edge]\ncanary = \"http://localhost:6081\"\n",
+		"[edge]\nban_header = \"localhost:6081\"\n",
+		"[edge]\ntokens = \"srv:_http._tcp.varnish\"\n",
+		"[edge]\nkey_header = \"unix:///var/run/varnish.sock\"\n",
+	}
+
+	for _, content := range tests {
+		_, err := loadTestIni(t, content)
+		if err == nil || !strings.Contains(err.Error(), "can't name cache") {
+			t.Errorf("%q: expected an error about the cache name, got %v", content, err)
+		}
+	}
+
+	groups, err := loadTestIni(t, "[edge]\nc1 = \"http://c1\"\nsource = consul:varnish?tag=edge\nsign_secret = env:SIGN_SECRET\nban_header = X-Ban\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := findGroup(groups, "edge"); g.BanHeader != "X-Ban" || len(g.Caches) != 1 {
+		t.Errorf("expected the options to be read, got %+v", g)
+	}
+}
@@ -0,0 +1,151 @@
+package dao
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a recurring maintenance window of a cache, written
+// "[days ]HH:MM-HH:MM" in UTC, e.g. "Sun 02:00-04:00", "Mon-Fri
+// 23:30-00:30" or "03:00-03:15" every day. Windows ending before
+// they start end the following day.
+type Window struct {
+	// Days holds the weekdays the window starts on, every
+	// day when empty.
+	Days []time.Weekday
+
+	// Start and End are times of the day, since midnight.
+	Start, End time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWindow parses a maintenance window.
+func ParseWindow(s string) (Window, error) {
+	var w Window
+
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+	case 2:
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return w, err
+		}
+		w.Days = days
+	default:
+		return w, fmt.Errorf("invalid maintenance window %q, expected [days ]HH:MM-HH:MM", s)
+	}
+
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid maintenance window %q, expected [days ]HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.Start, err = parseTimeOfDay(from); err != nil {
+		return w, err
+	}
+	if w.End, err = parseTimeOfDay(to); err != nil {
+		return w, err
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("empty maintenance window %q", s)
+	}
+	return w, nil
+}
+
+// parseDays parses a weekday, such as Sun, or a range of
+// weekdays, such as Mon-Fri.
+func parseDays(s string) ([]time.Weekday, error) {
+	from, to, isRange := strings.Cut(strings.ToLower(s), "-")
+	first, ok := weekdays[from]
+	if !ok {
+		return nil, fmt.Errorf("unknown weekday %s", from)
+	}
+	if !isRange {
+		return []time.Weekday{first}, nil
+	}
+	last, ok := weekdays[to]
+	if !ok {
+		return nil, fmt.Errorf("unknown weekday %s", to)
+	}
+
+	days := []time.Weekday{first}
+	for d := first; d != last; {
+		d = (d + 1) % 7
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains tells whether t falls within the window.
+func (w Window) Contains(t time.Time) bool {
+	t = t.UTC()
+	sinceMidnight := t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+
+	if w.Start < w.End {
+		return w.startsOn(t.Weekday()) && sinceMidnight >= w.Start && sinceMidnight < w.End
+	}
+	// The window spans midnight, started today or the day before.
+	return (w.startsOn(t.Weekday()) && sinceMidnight >= w.Start) ||
+		(w.startsOn((t.Weekday()+6)%7) && sinceMidnight < w.End)
+}
+
+func (w Window) startsOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) String() string {
+	s := fmt.Sprintf("%02d:%02d-%02d:%02d", int(w.Start.Hours()), int(w.Start.Minutes())%60, int(w.End.Hours()), int(w.End.Minutes())%60)
+	switch len(w.Days) {
+	case 0:
+		return s
+	case 1:
+		return w.Days[0].String()[:3] + " " + s
+	}
+	return w.Days[0].String()[:3] + "-" + w.Days[len(w.Days)-1].String()[:3] + " " + s
+}
+
+func (w Window) MarshalText() ([]byte, error) {
+	return []byte(w.String()), nil
+}
+
+func (w *Window) UnmarshalText(text []byte) error {
+	parsed, err := ParseWindow(string(text))
+	if err != nil {
+		return err
+	}
+	*w = parsed
+	return nil
+}
+
+// InMaintenance tells whether t falls within any of the
+// maintenance windows of the cache.
+func (c Cache) InMaintenance(t time.Time) bool {
+	for _, w := range c.Maintenance {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
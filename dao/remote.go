@@ -0,0 +1,64 @@
+package dao
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// remoteClient fetches remote configurations, which shouldn't
+// hold up a reload for long.
+var remoteClient = &http.Client{Timeout: 10 * time.Second}
+
+// maxRemoteConfigSize caps the size of a remote configuration.
+const maxRemoteConfigSize = 16 << 20
+
+// IsRemoteConfig tells whether the configuration path is an
+// http(s):// URL, e.g. of a service discovery system.
+func IsRemoteConfig(configPath string) bool {
+	lower := strings.ToLower(configPath)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// FetchConfig fetches the content of a remote configuration,
+// answers other than 200 being an error.
+func FetchConfig(configURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Fetching configuration %s failed: %s", configURL, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching configuration %s failed: %s", configURL, resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxRemoteConfigSize))
+	if err != nil {
+		return nil, fmt.Errorf("Fetching configuration %s failed: %s", configURL, err.Error())
+	}
+	return content, nil
+}
+
+// LoadCachesFromURL loads the groups of a JSON configuration
+// served over HTTP(S).
+func LoadCachesFromURL(configURL string) ([]Group, error) {
+	content, err := FetchConfig(configURL)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := ParseCachesJson(content)
+	if err != nil {
+		return nil, fmt.Errorf("Configuration %s: %s", configURL, err.Error())
+	}
+	return groups, nil
+}
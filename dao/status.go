@@ -0,0 +1,97 @@
+package dao
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatusRange is an inclusive range of status codes.
+type StatusRange struct {
+	From, To int
+}
+
+// StatusCodes lists status codes and ranges of status codes, written
+// comma-separated such as "200-299, 404", or "none" for an empty list.
+type StatusCodes []StatusRange
+
+// noStatusCodes is how an empty list of status codes is written.
+const noStatusCodes = "none"
+
+// ParseStatusCodes parses a comma-separated list of status
+// codes and ranges of status codes.
+func ParseStatusCodes(s string) (StatusCodes, error) {
+	if strings.EqualFold(strings.TrimSpace(s), noStatusCodes) {
+		return StatusCodes{}, nil
+	}
+
+	var codes StatusCodes
+	for _, item := range SplitList(s) {
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			to = from
+		}
+
+		r := StatusRange{}
+		var err error
+		if r.From, err = statusCode(from); err != nil {
+			return nil, err
+		}
+		if r.To, err = statusCode(to); err != nil {
+			return nil, err
+		}
+		if r.From > r.To {
+			return nil, fmt.Errorf("invalid status range %s", item)
+		}
+		codes = append(codes, r)
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("no status codes")
+	}
+	return codes, nil
+}
+
+func statusCode(s string) (int, error) {
+	code, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || code < 100 || code > 599 {
+		return 0, fmt.Errorf("invalid status code %q", s)
+	}
+	return code, nil
+}
+
+// Contains tells whether the status code is listed.
+func (c StatusCodes) Contains(code int) bool {
+	for _, r := range c {
+		if code >= r.From && code <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (c StatusCodes) String() string {
+	if len(c) == 0 {
+		return noStatusCodes
+	}
+	items := make([]string, len(c))
+	for i, r := range c {
+		items[i] = strconv.Itoa(r.From)
+		if r.To != r.From {
+			items[i] += "-" + strconv.Itoa(r.To)
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+func (c StatusCodes) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *StatusCodes) UnmarshalText(text []byte) error {
+	parsed, err := ParseStatusCodes(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+)
+
+// Outcomes of the events consumed from message queues.
+const (
+	eventOK      = "ok"
+	eventFailed  = "failed"
+	eventInvalid = "invalid"
+
+	// The broadcast was rejected, rate limited or for lack of room
+	// in the job queues, until the source stopped. Sources keeping
+	// track of the events handled leave such an event unhandled.
+	eventRejected = "rejected"
+)
+
+// eventRetryDelay is how long a rejected event waits before being
+// broadcast again, unless told by its rate limit.
+var eventRetryDelay = time.Second
+
+var (
+	// sourceStops stop the consumers of message queues,
+	// guarded by sourcesLock.
+	sourcesLock sync.Mutex
+	sourceStops []func()
+)
+
+// purgeEvent is a broadcast consumed from a message
+// queue rather than received over HTTP, in JSON.
+type purgeEvent struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Group   string            `json:"group"`
+	Headers map[string]string `json:"headers"`
+}
+
+// parseEvent decodes an event, its method defaulting to PURGE.
+func parseEvent(payload []byte) (purgeEvent, error) {
+	var ev purgeEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return ev, err
+	}
+	if !strings.HasPrefix(ev.Path, "/") {
+		return ev, errors.New("path must start with a /")
+	}
+	if ev.Method == "" {
+		ev.Method = "PURGE"
+	}
+	return ev, nil
+}
+
+// handleEvent broadcasts an event from the source the way requests
+// are, logging its outcome as nobody waits for it, and returns the
+// outcome: ok if it succeeded as decided by the status policy.
+func handleEvent(ctx context.Context, b *broadcaster.Broadcaster, source string, payload []byte) string {
+	ev, err := parseEvent(payload)
+	if err != nil {
+		sendToLogChannel("Invalid ", source, " event ", strconv.Quote(string(payload)), ": ", err.Error(), "\n")
+		return eventInvalid
+	}
+	return broadcastEvent(ctx, b, source, ev)
+}
+
+// broadcastEvent broadcasts a parsed event from the source. Rejected
+// broadcasts are retried until they go through or the context is
+// done, holding up the source rather than dropping the event.
+func broadcastEvent(ctx context.Context, b *broadcaster.Broadcaster, source string, ev purgeEvent) string {
+	markBroadcast()
+
+	header := http.Header{}
+	for k, v := range ev.Headers {
+		header.Set(k, v)
+	}
+
+	var res broadcaster.Results
+	var err error
+retry:
+	for {
+		res, err = b.Broadcast(context.Background(), broadcaster.Request{
+			Method: ev.Method,
+			Path:   ev.Path,
+			Group:  ev.Group,
+			Header: header,
+			Host:   header.Get("Host"),
+			Client: source,
+		})
+
+		wait := eventRetryDelay
+		var rateLimited *broadcaster.RateLimitError
+		switch {
+		case errors.As(err, &rateLimited):
+			if rateLimited.Wait > 0 {
+				wait = rateLimited.Wait
+			}
+		case errors.Is(err, broadcaster.ErrQueueSaturated), errors.Is(err, broadcaster.ErrPaused):
+		default:
+			break retry
+		}
+
+		sendToLogChannel(source, " event ", ev.Method, " ", ev.Path, " rejected, retrying in ", wait.String(), ": ", err.Error(), "\n")
+		select {
+		case <-ctx.Done():
+			sendToLogChannel(source, " event ", ev.Method, " ", ev.Path, " left unhandled, as the consumer stopped\n")
+			return eventRejected
+		case <-time.After(wait):
+		}
+	}
+	if err != nil {
+		sendToLogChannel(source, " event ", ev.Method, " ", ev.Path, " failed: ", err.Error(), "\n")
+		return eventFailed
+	}
+
+	sendToLogChannel(source, " event ", ev.Method, " ", ev.Path, " broadcast: ", strconv.Itoa(res.Status), "\n")
+
+	if res.Status < 200 || res.Status >= 300 {
+		return eventFailed
+	}
+	return eventOK
+}
+
+// addSource registers the stop function of a consumer.
+func addSource(stop func()) {
+	sourcesLock.Lock()
+	sourceStops = append(sourceStops, stop)
+	sourcesLock.Unlock()
+}
+
+// stopSources stops the consumers, letting their broadcasts
+// in flight complete for up to the timeout.
+func stopSources(timeout time.Duration) {
+	sourcesLock.Lock()
+	stops := sourceStops
+	sourceStops = nil
+	sourcesLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, stop := range stops {
+		wg.Add(1)
+		go func(stop func()) {
+			defer wg.Done()
+			stop()
+		}(stop)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
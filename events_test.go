@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestHandleEvent(t *testing.T) {
+	seen := make(chan string, 1)
+	cache := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Method + " " + r.URL.Path + " " + r.Header.Get("Xkey")
+	}))
+	defer cache.Close()
+
+	b, err := broadcaster.New(broadcaster.Config{ProtectedPaths: []string{"/"}, Groups: []dao.Group{
+		{Name: "edge", Caches: []dao.Cache{{Name: "c1", Address: cache.URL}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if got := handleEvent(context.Background(), b, "Test", []byte(`{"path": "/products/42", "group": "edge", "headers": {"xkey": "p42"}}`)); got != eventOK {
+		t.Errorf("expected the event to be broadcast, got %s", got)
+	}
+	if s := <-seen; s != "PURGE /products/42 p42" {
+		t.Errorf("unexpected cache request %q", s)
+	}
+
+	if got := handleEvent(context.Background(), b, "Test", []byte(`{"path": "/", "group": "unknown"}`)); got != eventFailed {
+		t.Errorf("expected an unknown group to fail, got %s", got)
+	}
+	if got := handleEvent(context.Background(), b, "Test", []byte(`{"path": "/", "group": "edge"}`)); got != eventFailed {
+		t.Errorf("expected an unconfirmed protected path to fail, got %s", got)
+	}
+
+	for _, payload := range []string{`not json`, `{"path": "products"}`} {
+		if got := handleEvent(context.Background(), b, "Test", []byte(payload)); got != eventInvalid {
+			t.Errorf("%s: expected an invalid event, got %s", payload, got)
+		}
+	}
+}
+
+func TestNatsEvent(t *testing.T) {
+	for _, c := range []struct {
+		subject, payload string
+		want             purgeEvent
+	}{
+		{"purge.edge", "/products/42", purgeEvent{Method: "PURGE", Path: "/products/42", Group: "edge"}},
+		{"purge.edge.api", " BAN /products/.*\n", purgeEvent{Method: "BAN", Path: "/products/.*", Group: "edge"}},
+		{"purge.api", `{"path": "/", "group": "edge"}`, purgeEvent{Method: "PURGE", Path: "/", Group: "api"}},
+	} {
+		got, err := natsEvent(c.subject, []byte(c.payload))
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %q: expected %+v, got %+v %v", c.subject, c.payload, c.want, got, err)
+		}
+	}
+
+	for _, c := range [][2]string{{"purge", "/"}, {"purge.edge", "products"}, {"purge.edge", "PURGE / now"}, {"purge.edge", "{"}} {
+		if _, err := natsEvent(c[0], []byte(c[1])); err == nil {
+			t.Errorf("%s %q: expected an error", c[0], c[1])
+		}
+	}
+}
+
+func TestRejectedEventsAreRetried(t *testing.T) {
+	seen := make(chan string, 2)
+	cache := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.URL.Path
+	}))
+	defer cache.Close()
+
+	b, err := broadcaster.New(broadcaster.Config{RateLimit: 5, RateBurst: 1, Groups: []dao.Group{
+		{Name: "edge", Caches: []dao.Cache{{Name: "c1", Address: cache.URL}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, path := range []string{"/a", "/b"} {
+		if got := handleEvent(context.Background(), b, "Test", []byte(`{"path": "`+path+`"}`)); got != eventOK {
+			t.Errorf("%s: expected the event to wait for the rate limit, got %s", path, got)
+		}
+		if got := <-seen; got != path {
+			t.Errorf("expected %s to be broadcast, got %s", path, got)
+		}
+	}
+
+	// A stopped source leaves the event unhandled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := handleEvent(ctx, b, "Test", []byte(`{"path": "/c"}`)); got != eventRejected {
+		t.Errorf("expected the event to be rejected once stopped, got %s", got)
+	}
+}
+
+func TestPausedEventsAreRetried(t *testing.T) {
+	defer func(delay time.Duration) { eventRetryDelay = delay }(eventRetryDelay)
+	eventRetryDelay = 10 * time.Millisecond
+
+	seen := make(chan string, 1)
+	cache := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.URL.Path
+	}))
+	defer cache.Close()
+
+	b, err := broadcaster.New(broadcaster.Config{Groups: []dao.Group{
+		{Name: "edge", Caches: []dao.Cache{{Name: "c1", Address: cache.URL}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := b.Pause(broadcaster.PauseQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	outcome := make(chan string, 1)
+	go func() {
+		outcome <- handleEvent(context.Background(), b, "Test", []byte(`{"path": "/a"}`))
+	}()
+
+	select {
+	case path := <-seen:
+		t.Fatalf("expected nothing to be broadcast while paused, got %s", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Resume()
+	if got := <-outcome; got != eventOK {
+		t.Errorf("expected the event to be broadcast once resumed, got %s", got)
+	}
+	if got := <-seen; got != "/a" {
+		t.Errorf("expected /a to be broadcast, got %s", got)
+	}
+}
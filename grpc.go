@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	grpc "github.com/timothyclarke/http-request-broadcaster/grpc"
+	tracing "github.com/timothyclarke/http-request-broadcaster/tracing"
+)
+
+var grpcPort = commandLine.Int("grpc-port", 0, "Port serving the gRPC broadcast API of broadcaster.proto, next to HTTP. Disabled by default.")
+
+// grpcService prefixes the methods of the service of broadcaster.proto.
+const grpcService = "/broadcaster.v1.Broadcaster/"
+
+// grpcRequest is a BroadcastRequest.
+type grpcRequest struct {
+	method  string
+	path    string
+	groups  []string
+	headers map[string]string
+	body    []byte
+	verbose bool
+	dryRun  bool
+}
+
+func decodeGrpcRequest(msg []byte) (grpcRequest, error) {
+	req := grpcRequest{headers: make(map[string]string)}
+
+	err := grpc.Decode(msg, func(f grpc.Field) error {
+		switch f.Number {
+		case 1:
+			req.method = f.String()
+		case 2:
+			req.path = f.String()
+		case 3:
+			req.groups = append(req.groups, f.String())
+		case 4:
+			k, v, err := grpc.DecodeStringMap(f.Bytes)
+			if err != nil {
+				return err
+			}
+			req.headers[k] = v
+		case 5:
+			req.body = f.Bytes
+		case 6:
+			req.verbose = f.Varint != 0
+		case 7:
+			req.dryRun = f.Varint != 0
+		}
+		return nil
+	})
+
+	return req, err
+}
+
+// grpcCacheResult is a CacheResult.
+type grpcCacheResult struct {
+	group  string
+	cache  string
+	result broadcaster.Result
+}
+
+func (c grpcCacheResult) encode() []byte {
+	var e grpc.Encoder
+	e.String(1, c.group)
+	e.String(2, c.cache)
+	e.Uint(3, uint64(c.result.Status))
+	e.String(4, c.result.Reason)
+	e.String(5, c.result.Error)
+	e.String(6, c.result.Endpoint)
+	e.String(7, c.result.URL)
+	if sent := c.result.Sent; sent != nil {
+		var s grpc.Encoder
+		s.String(1, sent.Method)
+		s.StringMap(2, sent.Headers)
+		e.Message(8, s.Encoded())
+	}
+	e.Bool(9, c.result.DryRun)
+	return e.Encoded()
+}
+
+// grpcBroadcast broadcasts the request of a call to its groups, in
+// parallel, passing the result of every cache on to onResult as it's
+// known, one at a time. It returns the highest status of the groups.
+func grpcBroadcast(b *broadcaster.Broadcaster, r *http.Request, msg []byte, onResult func(grpcCacheResult)) (int, error) {
+	req, err := decodeGrpcRequest(msg)
+	if err != nil {
+		return 0, grpc.Errorf(grpc.InvalidArgument, "%s", err.Error())
+	}
+	if !strings.HasPrefix(req.path, "/") {
+		return 0, grpc.Errorf(grpc.InvalidArgument, "path must start with a /")
+	}
+	if req.method == "" {
+		req.method = "PURGE"
+	}
+
+	groups := req.groups
+	if len(groups) == 0 {
+		groups = []string{""}
+	}
+	for _, group := range groups {
+		if denied, ok := deniedGroup(b.Groups(), r, group); ok {
+			sendToLogChannel("Token not allowed to broadcast to group ", denied, "\n")
+			return 0, grpc.Errorf(grpc.PermissionDenied, "token not allowed to broadcast to group %s", denied)
+		}
+	}
+
+	markBroadcast()
+
+	header := http.Header{}
+	for k, v := range req.headers {
+		header.Set(k, v)
+	}
+	path, query, _ := strings.Cut(req.path, "?")
+
+	ctx := tracing.Extract(r.Context(), r.Header)
+	var client string
+	if ip := clientIP(r); ip != nil {
+		client = ip.String()
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	statuses := make([]int, len(groups))
+	errs := make([]error, len(groups))
+
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group string) {
+			defer wg.Done()
+
+			res, err := b.Broadcast(ctx, broadcaster.Request{
+				Method:  req.method,
+				Path:    b.RenderPath(path, query),
+				Group:   group,
+				Header:  header,
+				Host:    header.Get("Host"),
+				Body:    req.body,
+				Verbose: req.verbose,
+				DryRun:  req.dryRun,
+				Client:  client,
+				OnResult: func(cache string, result broadcaster.Result) {
+					mu.Lock()
+					defer mu.Unlock()
+					onResult(grpcCacheResult{group: group, cache: cache, result: result})
+				},
+			})
+			statuses[i], errs[i] = res.Status, err
+		}(i, group)
+	}
+	wg.Wait()
+
+	status := 0
+	for i, err := range errs {
+		var rateLimited *broadcaster.RateLimitError
+		var protected *broadcaster.ProtectedPathError
+		switch {
+		case errors.Is(err, broadcaster.ErrGroupNotFound):
+			return 0, grpc.Errorf(grpc.NotFound, "group %s not found", groups[i])
+		case errors.As(err, &protected):
+			return 0, grpc.Errorf(grpc.FailedPrecondition, "%s", protected.Error())
+		case errors.As(err, &rateLimited):
+			return 0, grpc.Errorf(grpc.ResourceExhausted, "rate limit exceeded, retry in %s", rateLimited.Wait)
+		case errors.Is(err, broadcaster.ErrQueueSaturated):
+			return 0, grpc.Errorf(grpc.Unavailable, "job queue is saturated")
+		case errors.Is(err, broadcaster.ErrPaused):
+			return 0, grpc.Errorf(grpc.Unavailable, "broadcasts paused")
+		case err != nil:
+			return 0, err
+		}
+		if statuses[i] > status {
+			status = statuses[i]
+		}
+	}
+
+	return status, nil
+}
+
+// grpcAPI returns the handler of the gRPC API, authorized
+// as HTTP broadcasts are.
+func grpcAPI(b *broadcaster.Broadcaster) http.Handler {
+	s := grpc.NewServer()
+
+	s.Handle(grpcService+"Broadcast", func(r *http.Request, msg []byte, send func([]byte) error) error {
+		var results []grpcCacheResult
+		status, err := grpcBroadcast(b, r, msg, func(c grpcCacheResult) {
+			results = append(results, c)
+		})
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(results, func(i, j int) bool {
+			if results[i].group != results[j].group {
+				return results[i].group < results[j].group
+			}
+			return results[i].cache < results[j].cache
+		})
+
+		var e grpc.Encoder
+		e.Uint(1, uint64(status))
+		for _, c := range results {
+			e.Message(2, c.encode())
+		}
+		return send(e.Encoded())
+	})
+
+	s.Handle(grpcService+"BroadcastStream", func(r *http.Request, msg []byte, send func([]byte) error) error {
+		// Once a result can't be sent, the client being gone,
+		// the others aren't either.
+		var sendErr error
+		_, err := grpcBroadcast(b, r, msg, func(c grpcCacheResult) {
+			if sendErr == nil {
+				sendErr = send(c.encode())
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sendErr
+	})
+
+	return requireAllowedSource(requireToken("broadcast", currentBroadcastTokens, s.ServeHTTP))
+}
+
+// grpcServer returns the server of the gRPC API on -grpc-port, over
+// TLS when the broadcaster serves https and cleartext HTTP/2 otherwise.
+func grpcServer(handler http.Handler) *http.Server {
+	server := &http.Server{Addr: ":" + strconv.Itoa(*grpcPort), Handler: handler}
+
+	if serverCerts != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: serverCerts.GetCertificate}
+		return server
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server.Protocols = &protocols
+	return server
+}
@@ -0,0 +1,232 @@
+// Package grpc serves gRPC methods over net/http, unary and server
+// streaming ones, leaving the encoding of their messages to them. The
+// HTTP/2 it requires is that of the http.Server serving it.
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Code is the status code of a call.
+type Code uint32
+
+// Codes the servers answer with.
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	Unauthenticated    Code = 16
+)
+
+// maxMessageSize bounds the request messages, as gRPC does by default.
+const maxMessageSize = 4 << 20
+
+// Status is the error a call fails with.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return "grpc: " + s.Message + " (code " + strconv.Itoa(int(s.Code)) + ")"
+}
+
+// Errorf returns the status of a failed call.
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Handler handles the calls of a method, decoding its request message
+// and sending its responses: a single one for unary methods, any number
+// for server streaming ones. Calls failing with errors other than a
+// *Status answer with Internal. The metadata of calls is the header of
+// the request, whose context is done once the call is cancelled or
+// past its deadline.
+type Handler func(r *http.Request, req []byte, send func(msg []byte) error) error
+
+// Server routes the calls to the handlers of their methods.
+type Server struct {
+	methods map[string]Handler
+}
+
+// NewServer returns a server without methods.
+func NewServer() *Server {
+	return &Server{methods: make(map[string]Handler)}
+}
+
+// Handle registers the handler of a method, named
+// /<package>.<service>/<method>.
+func (s *Server) Handle(method string, h Handler) {
+	s.methods[method] = h
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2.", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+") {
+		http.Error(w, "Unsupported content type.", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+
+	h, found := s.methods[r.URL.Path]
+	if !found {
+		writeStatus(w, &Status{Code: Unimplemented, Message: "unknown method " + r.URL.Path})
+		return
+	}
+
+	if v := r.Header.Get("Grpc-Timeout"); v != "" {
+		timeout, err := parseTimeout(v)
+		if err != nil {
+			writeStatus(w, &Status{Code: InvalidArgument, Message: err.Error()})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	req, err := readMessage(r.Body, r.Header.Get("Grpc-Encoding"))
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	send := func(msg []byte) error {
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		if _, err := w.Write(append(frame, msg...)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	err = h(r, req, send)
+	if err == nil {
+		err = &Status{Code: OK}
+	}
+	if ctxErr := r.Context().Err(); ctxErr == context.DeadlineExceeded {
+		err = &Status{Code: DeadlineExceeded, Message: "deadline exceeded"}
+	}
+	writeStatus(w, err)
+}
+
+// readMessage reads the single message of a request,
+// decompressing it as the encoding says.
+func readMessage(body io.Reader, encoding string) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, &Status{Code: InvalidArgument, Message: "missing request message"}
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, &Status{Code: ResourceExhausted, Message: fmt.Sprintf("request message larger than %d bytes", maxMessageSize)}
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, &Status{Code: InvalidArgument, Message: "truncated request message"}
+	}
+
+	if prefix[0] == 0 {
+		return msg, nil
+	}
+	if encoding != "gzip" {
+		return nil, &Status{Code: Unimplemented, Message: "unsupported message encoding " + strconv.Quote(encoding)}
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, &Status{Code: InvalidArgument, Message: err.Error()}
+	}
+	if msg, err = ioutil.ReadAll(io.LimitReader(zr, maxMessageSize+1)); err != nil {
+		return nil, &Status{Code: InvalidArgument, Message: err.Error()}
+	}
+	if len(msg) > maxMessageSize {
+		return nil, &Status{Code: ResourceExhausted, Message: fmt.Sprintf("request message larger than %d bytes", maxMessageSize)}
+	}
+	return msg, nil
+}
+
+// writeStatus ends the call with the status of the error, in the
+// trailers of the response.
+func writeStatus(w http.ResponseWriter, err error) {
+	status, ok := err.(*Status)
+	if !ok {
+		status = &Status{Code: Internal, Message: err.Error()}
+	}
+
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeMessage(status.Message))
+	}
+}
+
+// encodeMessage percent-encodes the status message, as
+// the gRPC protocol asks of grpc-message.
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseTimeout parses a grpc-timeout: up to 8 digits
+// followed by the unit, H, M, S, m, u or n.
+func parseTimeout(v string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	unit, found := units[v[len(v)-1]]
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if !found || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	return time.Duration(n) * unit, nil
+}
@@ -0,0 +1,183 @@
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// call calls the method of the server, returning the messages
+// of the response and its status.
+func call(t *testing.T, server *httptest.Server, method string, header http.Header, frame []byte) ([][]byte, *Status) {
+	t.Helper()
+
+	req, _ := http.NewRequest("POST", server.URL+method, bytes.NewReader(frame))
+	req.Header.Set("Content-Type", "application/grpc")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var msgs [][]byte
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(resp.Body, prefix[:]); err != nil {
+			break
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		io.ReadFull(resp.Body, msg)
+		msgs = append(msgs, msg)
+	}
+
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("expected a grpc-status trailer, got %v", resp.Trailer)
+	}
+	return msgs, &Status{Code: Code(code), Message: resp.Trailer.Get("Grpc-Message")}
+}
+
+func frameOf(compressed bool, msg []byte) []byte {
+	frame := []byte{0, 0, 0, 0, 0}
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	s := NewServer()
+	s.Handle("/test.Echo/Unary", func(r *http.Request, req []byte, send func([]byte) error) error {
+		if len(req) == 0 {
+			return Errorf(InvalidArgument, "empty request: 100%% wrong")
+		}
+		return send(req)
+	})
+	s.Handle("/test.Echo/Stream", func(r *http.Request, req []byte, send func([]byte) error) error {
+		for _, b := range req {
+			if err := send([]byte{b}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.Handle("/test.Echo/Slow", func(r *http.Request, req []byte, send func([]byte) error) error {
+		<-r.Context().Done()
+		return nil
+	})
+
+	server := httptest.NewUnstartedServer(s)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServer(t *testing.T) {
+	server := newTestServer(t)
+
+	msgs, status := call(t, server, "/test.Echo/Unary", nil, frameOf(false, []byte("hello")))
+	if status.Code != OK || !reflect.DeepEqual(msgs, [][]byte{[]byte("hello")}) {
+		t.Errorf("expected the echo, got %q %v", msgs, status)
+	}
+
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write([]byte("zipped"))
+	zw.Close()
+	msgs, status = call(t, server, "/test.Echo/Unary", http.Header{"Grpc-Encoding": {"gzip"}}, frameOf(true, zipped.Bytes()))
+	if status.Code != OK || !reflect.DeepEqual(msgs, [][]byte{[]byte("zipped")}) {
+		t.Errorf("expected the gzipped message to be decompressed, got %q %v", msgs, status)
+	}
+
+	msgs, status = call(t, server, "/test.Echo/Stream", nil, frameOf(false, []byte("abc")))
+	if status.Code != OK || !reflect.DeepEqual(msgs, [][]byte{[]byte("a"), []byte("b"), []byte("c")}) {
+		t.Errorf("expected a streamed message per byte, got %q %v", msgs, status)
+	}
+
+	if _, status = call(t, server, "/test.Echo/Unary", nil, frameOf(false, nil)); status.Code != InvalidArgument || status.Message != "empty request: 100%25 wrong" {
+		t.Errorf("expected the error status, percent-encoded, got %v", status)
+	}
+
+	if _, status = call(t, server, "/test.Echo/Unknown", nil, frameOf(false, nil)); status.Code != Unimplemented {
+		t.Errorf("expected an unknown method to be unimplemented, got %v", status)
+	}
+
+	if _, status = call(t, server, "/test.Echo/Unary", nil, []byte{0, 0, 0}); status.Code != InvalidArgument {
+		t.Errorf("expected a truncated message to be invalid, got %v", status)
+	}
+
+	start := time.Now()
+	if _, status = call(t, server, "/test.Echo/Slow", http.Header{"Grpc-Timeout": {"50m"}}, frameOf(false, nil)); status.Code != DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", status)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("expected the call to end with its timeout, took %s", took)
+	}
+}
+
+func TestProto(t *testing.T) {
+	var inner Encoder
+	inner.String(1, "nested")
+
+	var e Encoder
+	e.Uint(1, 300)
+	e.String(2, "path")
+	e.Uint(3, 0) // left out
+	e.Bool(4, true)
+	e.StringMap(5, map[string]string{"k": "v"})
+	e.Message(6, inner.Encoded())
+	e.Message(7, nil)
+
+	var fields []Field
+	if err := Decode(e.Encoded(), func(f Field) error {
+		fields = append(fields, f)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fields) != 6 {
+		t.Fatalf("expected 6 fields, got %+v", fields)
+	}
+	if fields[0].Number != 1 || fields[0].Varint != 300 || fields[1].String() != "path" || fields[2].Number != 4 || fields[2].Varint != 1 {
+		t.Errorf("unexpected fields %+v", fields)
+	}
+	if k, v, err := DecodeStringMap(fields[3].Bytes); k != "k" || v != "v" || err != nil {
+		t.Errorf("unexpected map entry %s=%s %v", k, v, err)
+	}
+	if fields[5].Number != 7 || len(fields[5].Bytes) != 0 {
+		t.Errorf("expected the empty message to be encoded, got %+v", fields[5])
+	}
+
+	for _, msg := range [][]byte{{0x08}, {0x12, 0x05, 'a'}, {0x0b}, {0x00}} {
+		if err := Decode(msg, func(Field) error { return nil }); err == nil {
+			t.Errorf("%x: expected an error", msg)
+		}
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for v, want := range map[string]time.Duration{"1H": time.Hour, "250m": 250 * time.Millisecond, "10S": 10 * time.Second} {
+		if got, err := parseTimeout(v); err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s %v", v, want, got, err)
+		}
+	}
+	for _, v := range []string{"", "5", "5x", "123456789S", "-1S"} {
+		if _, err := parseTimeout(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
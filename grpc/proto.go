@@ -0,0 +1,152 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Wire types of protobuf fields.
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+	WireFixed32 = 5
+)
+
+var errInvalidMessage = errors.New("grpc: invalid protobuf message")
+
+// Encoder appends the fields of a protobuf message, leaving
+// out those of zero value as proto3 does.
+type Encoder struct {
+	buf []byte
+}
+
+func (e *Encoder) tag(field, wire int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wire))
+}
+
+// Uint encodes a varint field, e.g. of type int32 for
+// positive values, uint32, uint64 or an enum.
+func (e *Encoder) Uint(field int, v uint64) {
+	if v != 0 {
+		e.tag(field, WireVarint)
+		e.buf = binary.AppendUvarint(e.buf, v)
+	}
+}
+
+// Bool encodes a bool field.
+func (e *Encoder) Bool(field int, v bool) {
+	if v {
+		e.Uint(field, 1)
+	}
+}
+
+// Bytes encodes a bytes field.
+func (e *Encoder) Bytes(field int, b []byte) {
+	if len(b) > 0 {
+		e.tag(field, WireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(b)))
+		e.buf = append(e.buf, b...)
+	}
+}
+
+// String encodes a string field.
+func (e *Encoder) String(field int, s string) {
+	e.Bytes(field, []byte(s))
+}
+
+// Message encodes an embedded message field, which is
+// encoded even when empty, unlike Bytes.
+func (e *Encoder) Message(field int, m []byte) {
+	e.tag(field, WireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(m)))
+	e.buf = append(e.buf, m...)
+}
+
+// StringMap encodes a map<string, string> field, as
+// its repeated entries of key 1 and value 2.
+func (e *Encoder) StringMap(field int, m map[string]string) {
+	for k, v := range m {
+		var entry Encoder
+		entry.String(1, k)
+		entry.String(2, v)
+		e.Message(field, entry.Encoded())
+	}
+}
+
+// Encoded returns the encoded message.
+func (e *Encoder) Encoded() []byte {
+	return e.buf
+}
+
+// Field is a field of an encoded message: Varint holds the value
+// of varint and fixed fields, Bytes that of length-delimited ones.
+type Field struct {
+	Number int
+	Wire   int
+	Varint uint64
+	Bytes  []byte
+}
+
+// String returns the value of a string or bytes field.
+func (f Field) String() string {
+	return string(f.Bytes)
+}
+
+// Decode calls f with every field of the message, in order.
+func Decode(msg []byte, f func(Field) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 || tag>>3 == 0 {
+			return errInvalidMessage
+		}
+		msg = msg[n:]
+
+		field := Field{Number: int(tag >> 3), Wire: int(tag & 7)}
+
+		switch field.Wire {
+		case WireVarint:
+			if field.Varint, n = binary.Uvarint(msg); n <= 0 {
+				return errInvalidMessage
+			}
+			msg = msg[n:]
+		case WireFixed64:
+			if len(msg) < 8 {
+				return errInvalidMessage
+			}
+			field.Varint, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case WireFixed32:
+			if len(msg) < 4 {
+				return errInvalidMessage
+			}
+			field.Varint, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case WireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return errInvalidMessage
+			}
+			field.Bytes, msg = msg[n:n+int(size)], msg[n+int(size):]
+		default:
+			return errInvalidMessage
+		}
+
+		if err := f(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeStringMap decodes an entry of a map<string, string> field.
+func DecodeStringMap(entry []byte) (key, value string, err error) {
+	err = Decode(entry, func(f Field) error {
+		switch f.Number {
+		case 1:
+			key = f.String()
+		case 2:
+			value = f.String()
+		}
+		return nil
+	})
+	return key, value, err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	grpc "github.com/timothyclarke/http-request-broadcaster/grpc"
+)
+
+// grpcCall calls a method of the API with the request, returning
+// the messages of the response and its grpc-status.
+func grpcCall(t *testing.T, server *httptest.Server, method, token string, req grpcRequest) ([][]byte, string) {
+	t.Helper()
+
+	var e grpc.Encoder
+	e.String(1, req.method)
+	e.String(2, req.path)
+	for _, g := range req.groups {
+		e.String(3, g)
+	}
+	e.StringMap(4, req.headers)
+	e.Bytes(5, req.body)
+	msg := e.Encoded()
+
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	r, _ := http.NewRequest("POST", server.URL+grpcService+method, bytes.NewReader(append(frame, msg...)))
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := server.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var msgs [][]byte
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(resp.Body, prefix[:]); err != nil {
+			break
+		}
+		m := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		io.ReadFull(resp.Body, m)
+		msgs = append(msgs, m)
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	if resp.StatusCode != http.StatusOK {
+		status = resp.Status
+	}
+	return msgs, status
+}
+
+// decodeCacheResult returns the group, cache, status and
+// reason of a CacheResult.
+func decodeCacheResult(msg []byte) []interface{} {
+	var group, cache, reason string
+	var status uint64
+	grpc.Decode(msg, func(f grpc.Field) error {
+		switch f.Number {
+		case 1:
+			group = f.String()
+		case 2:
+			cache = f.String()
+		case 3:
+			status = f.Varint
+		case 4:
+			reason = f.String()
+		}
+		return nil
+	})
+	return []interface{}{group, cache, status, reason}
+}
+
+func TestGrpcAPI(t *testing.T) {
+	defer func(tokens []namedToken) { broadcastTokens = tokens }(broadcastTokens)
+	broadcastTokens = []namedToken{{name: "cms", value: []byte("abc")}}
+
+	seen := make(chan string, 4)
+	cache := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Method + " " + r.URL.Path + " " + r.Header.Get("Xkey")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer cache.Close()
+
+	b, err := broadcaster.New(broadcaster.Config{Groups: []dao.Group{
+		{Name: "edge", Caches: []dao.Cache{{Name: "c1", Address: cache.URL}, {Name: "c2", Address: cache.URL}}},
+		{Name: "shield", Caches: []dao.Cache{{Name: "c3", Address: cache.URL}}},
+		{Name: "private", Tokens: []string{"deploy"}, Caches: []dao.Cache{{Name: "c4", Address: cache.URL}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	server := httptest.NewUnstartedServer(grpcAPI(b))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	msgs, status := grpcCall(t, server, "Broadcast", "abc", grpcRequest{
+		path:    "/products/42",
+		groups:  []string{"edge", "shield"},
+		headers: map[string]string{"xkey": "p42"},
+	})
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("expected a single response, got %d messages and status %s", len(msgs), status)
+	}
+	for i := 0; i < 3; i++ {
+		if s := <-seen; s != "PURGE /products/42 p42" {
+			t.Errorf("unexpected cache request %q", s)
+		}
+	}
+
+	var results [][]interface{}
+	var code uint64
+	grpc.Decode(msgs[0], func(f grpc.Field) error {
+		switch f.Number {
+		case 1:
+			code = f.Varint
+		case 2:
+			results = append(results, decodeCacheResult(f.Bytes))
+		}
+		return nil
+	})
+	want := [][]interface{}{{"edge", "c1", uint64(200), ""}, {"edge", "c2", uint64(200), ""}, {"shield", "c3", uint64(200), ""}}
+	if code != 200 || !reflect.DeepEqual(results, want) {
+		t.Errorf("expected %v, got %d %v", want, code, results)
+	}
+
+	msgs, status = grpcCall(t, server, "BroadcastStream", "abc", grpcRequest{method: "BAN", path: "/fail", groups: []string{"shield"}})
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("expected a streamed result, got %d messages and status %s", len(msgs), status)
+	}
+	<-seen
+	if got := decodeCacheResult(msgs[0]); !reflect.DeepEqual(got, []interface{}{"shield", "c3", uint64(500), ""}) {
+		t.Errorf("unexpected streamed result %v", got)
+	}
+
+	for _, c := range []struct {
+		token  string
+		req    grpcRequest
+		status string
+	}{
+		{"abc", grpcRequest{path: "/", groups: []string{"private"}}, "7"},
+		{"abc", grpcRequest{path: "/", groups: []string{"unknown"}}, "5"},
+		{"abc", grpcRequest{path: "products"}, "3"},
+		{"wrong", grpcRequest{path: "/"}, "403 Forbidden"},
+	} {
+		if _, status := grpcCall(t, server, "Broadcast", c.token, c.req); status != c.status {
+			t.Errorf("%+v: expected status %s, got %s", c.req, c.status, status)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	idleShutdown = commandLine.Duration("idle-shutdown", 0, "Gracefully shuts the broadcaster down when no broadcast was received for this long. Disabled by default.")
+
+	// lastBroadcast is the time of the latest broadcast,
+	// in nanoseconds since the epoch.
+	lastBroadcast = time.Now().UnixNano()
+)
+
+func markBroadcast() {
+	atomic.StoreInt64(&lastBroadcast, time.Now().UnixNano())
+}
+
+func idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&lastBroadcast)))
+}
+
+// shutdownWhenIdle gracefully shuts the servers down, letting
+// broadcasts in flight complete, once no broadcast was received
+// for the idle duration.
+func shutdownWhenIdle(idle time.Duration, servers ...*http.Server) {
+	ticker := time.NewTicker(idle / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if idleFor() < idle {
+			continue
+		}
+
+		fmt.Printf("No broadcast received for %s, shutting down.\n", idle)
+		sendToLogChannel("No broadcast received for ", idle.String(), ", shutting down.\n")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		for _, server := range servers {
+			server.Shutdown(ctx)
+		}
+		return
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+)
+
+func TestServerShutsDownWhenIdle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := broadcaster.New(broadcaster.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	server := &http.Server{Handler: guardBroadcast(b, b.Handler())}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	markBroadcast()
+	go shutdownWhenIdle(100*time.Millisecond, server)
+
+	// A broadcast keeps the server up.
+	time.Sleep(60 * time.Millisecond)
+	if resp, err := http.Get("http://" + l.Addr().String() + "/"); err == nil {
+		resp.Body.Close()
+	}
+
+	select {
+	case <-served:
+		t.Fatal("expected the broadcast to keep the server up")
+	case <-time.After(80 * time.Millisecond):
+	}
+
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("expected a graceful shutdown, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the idle server to shut down")
+	}
+}
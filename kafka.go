@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+	kafka "github.com/timothyclarke/http-request-broadcaster/kafka"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+)
+
+var (
+	kafkaBrokers       = commandLine.String("kafka-brokers", "", "Comma-separated host:port of the Kafka brokers to consume purge events from. Disabled by default.")
+	kafkaTopic         = commandLine.String("kafka-topic", "", "Kafka topic of the purge events.")
+	kafkaGroup         = commandLine.String("kafka-group", "broadcaster", "Kafka consumer group the broadcasters share the topic's partitions in.")
+	kafkaTLS           = commandLine.Bool("kafka-tls", false, "Connects to the Kafka brokers over TLS.")
+	kafkaSASL          = commandLine.String("kafka-sasl", "", "user:password authenticating to the Kafka brokers with SASL. Unauthenticated by default.")
+	kafkaSASLMechanism = commandLine.String("kafka-sasl-mechanism", kafka.MechanismPlain, "SASL mechanism of -kafka-sasl: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512.")
+
+	kafkaMessages = metrics.NewCounter("broadcaster_kafka_messages_total", "Kafka messages consumed, by outcome: ok, failed, invalid or rejected.", "outcome")
+)
+
+// startKafka consumes the purge events of -kafka-topic, when
+// -kafka-brokers is set, broadcasting them as they come.
+func startKafka(b *broadcaster.Broadcaster) error {
+	if *kafkaBrokers == "" {
+		return nil
+	}
+
+	cfg := kafka.Config{
+		Brokers:  dao.SplitList(*kafkaBrokers),
+		Topic:    *kafkaTopic,
+		Group:    *kafkaGroup,
+		ClientID: "broadcaster/" + version,
+		TLS:      *kafkaTLS,
+		Log:      sendToLogChannel,
+	}
+	if *kafkaSASL != "" {
+		user, password, found := strings.Cut(*kafkaSASL, ":")
+		if user == "" || !found {
+			return errors.New("-kafka-sasl must be of the form user:password.")
+		}
+		cfg.Mechanism, cfg.User, cfg.Password = *kafkaSASLMechanism, user, password
+	}
+
+	consumer, err := kafka.NewConsumer(cfg)
+	if err != nil {
+		return err
+	}
+
+	metrics.NewGauge("broadcaster_kafka_consumer_lag", "Kafka messages of the partitions assigned to the broadcaster not consumed yet.", func() float64 { return float64(consumer.Lag()) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(ctx, func(m kafka.Message) error {
+			outcome := handleEvent(ctx, b, "Kafka", m.Value)
+			kafkaMessages.Inc(outcome)
+			if outcome == eventRejected {
+				return errors.New("broadcast rejected")
+			}
+			return nil
+		})
+	}()
+
+	addSource(func() {
+		cancel()
+		<-done
+	})
+
+	return nil
+}
@@ -0,0 +1,558 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Settings of the group membership: a member is dropped from the
+// group if it doesn't heartbeat for sessionTimeout, and the members
+// have rebalanceTimeout to join a rebalance.
+const (
+	sessionTimeout    = 30 * time.Second
+	rebalanceTimeout  = 60 * time.Second
+	heartbeatInterval = 3 * time.Second
+	assignorName      = "range"
+)
+
+// retryDelay is how long the consumer waits before starting
+// over after losing its connection or its group membership.
+var retryDelay = 2 * time.Second
+
+// Config configures a Consumer.
+type Config struct {
+	// Brokers are the addresses, as host:port, of the
+	// brokers the cluster is discovered from.
+	Brokers []string
+
+	// Topic is consumed as a member of Group.
+	Topic string
+	Group string
+
+	// ClientID identifies the consumer to the brokers.
+	ClientID string
+
+	// TLS connects to the brokers over TLS, verifying
+	// their certificates against the system's roots.
+	TLS bool
+
+	// Mechanism authenticates to the brokers with SASL as User,
+	// MechanismPlain, MechanismSCRAMSHA256 or MechanismSCRAMSHA512,
+	// when set.
+	Mechanism string
+	User      string
+	Password  string
+
+	// Log receives the errors the consumer recovers
+	// from by starting over, when set.
+	Log func(args ...string)
+}
+
+// Consumer consumes a topic as a member of a consumer group.
+// Partitions without committed offset are consumed from their
+// latest offset.
+type Consumer struct {
+	cfg Config
+
+	memberID string
+
+	mu  sync.Mutex
+	lag map[int32]int64
+}
+
+// NewConsumer returns a consumer of the configured topic.
+func NewConsumer(cfg Config) (*Consumer, error) {
+	if len(cfg.Brokers) == 0 || cfg.Topic == "" || cfg.Group == "" {
+		return nil, errors.New("kafka: brokers, topic and group are required")
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "broadcaster"
+	}
+	switch cfg.Mechanism {
+	case "":
+	case MechanismPlain, MechanismSCRAMSHA256, MechanismSCRAMSHA512:
+		if cfg.User == "" {
+			return nil, errors.New("kafka: SASL requires a user")
+		}
+	default:
+		return nil, fmt.Errorf("kafka: unsupported SASL mechanism %s, expected %s, %s or %s", cfg.Mechanism, MechanismPlain, MechanismSCRAMSHA256, MechanismSCRAMSHA512)
+	}
+	return &Consumer{cfg: cfg, lag: make(map[int32]int64)}, nil
+}
+
+// Lag returns the number of messages of the partitions assigned to
+// the consumer which weren't handled yet, as of their last fetch.
+func (c *Consumer) Lag() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lag int64
+	for _, l := range c.lag {
+		lag += l
+	}
+	return lag
+}
+
+func (c *Consumer) setLag(partition int32, lag int64) {
+	c.mu.Lock()
+	c.lag[partition] = lag
+	c.mu.Unlock()
+}
+
+func (c *Consumer) resetLag() {
+	c.mu.Lock()
+	c.lag = make(map[int32]int64)
+	c.mu.Unlock()
+}
+
+func (c *Consumer) log(args ...string) {
+	if c.cfg.Log != nil {
+		c.cfg.Log(args...)
+	}
+}
+
+// Run consumes the topic until the context is done, handing the
+// messages of every partition to handle in order. The offset of a
+// message is committed once handle returned nil, so that messages are
+// handled at least once. A message handle fails, or a record batch
+// which can't be decoded, stops its partition, which is fetched from
+// there again after retryDelay. Run starts over on errors, and leaves
+// the group once the context is done.
+func (c *Consumer) Run(ctx context.Context, handle func(Message) error) {
+	for ctx.Err() == nil {
+		err := c.session(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.log("Kafka consumer of ", c.cfg.Topic, " starting over in ", retryDelay.String(), ": ", err.Error(), "\n")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// cluster holds the connections of a session to the brokers.
+type cluster struct {
+	cfg   Config
+	meta  metadata
+	conns map[string]*conn
+}
+
+func (cl *cluster) conn(ctx context.Context, addr string) (*conn, error) {
+	if c, found := cl.conns[addr]; found {
+		return c, nil
+	}
+	c, err := dial(ctx, addr, cl.cfg)
+	if err != nil {
+		return nil, err
+	}
+	cl.conns[addr] = c
+	return c, nil
+}
+
+func (cl *cluster) close() {
+	for _, c := range cl.conns {
+		c.close()
+	}
+}
+
+// connect discovers the cluster from the first broker answering.
+func (c *Consumer) connect(ctx context.Context) (*cluster, error) {
+	cl := &cluster{cfg: c.cfg, conns: make(map[string]*conn)}
+
+	var err error
+	for _, addr := range c.cfg.Brokers {
+		var bootstrap *conn
+		if bootstrap, err = cl.conn(ctx, addr); err != nil {
+			continue
+		}
+		if cl.meta, err = requestMetadata(bootstrap, c.cfg.Topic); err == nil {
+			return cl, nil
+		}
+	}
+
+	cl.close()
+	return nil, err
+}
+
+// session consumes the topic from joining the group until an
+// error, a rebalance or the context being done.
+func (c *Consumer) session(parent context.Context, handle func(Message) error) error {
+	defer c.resetLag()
+
+	cl, err := c.connect(parent)
+	if err != nil {
+		return err
+	}
+	defer cl.close()
+
+	var addr string
+	for _, bootstrap := range cl.conns {
+		if addr, err = requestCoordinator(bootstrap, c.cfg.Group); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("finding the coordinator of group %s: %w", c.cfg.Group, err)
+	}
+	coordinator, err := cl.conn(parent, addr)
+	if err != nil {
+		return err
+	}
+
+	generation, partitions, err := c.join(coordinator, cl.meta)
+	if err != nil {
+		return fmt.Errorf("joining group %s: %w", c.cfg.Group, err)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	heartbeatErr := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := requestHeartbeat(coordinator, c.cfg.Group, generation, c.memberID); err != nil {
+				heartbeatErr <- err
+				cancel()
+				return
+			}
+		}
+	}()
+
+	err = c.consume(ctx, cl, coordinator, generation, partitions, handle)
+
+	if parent.Err() != nil {
+		requestLeaveGroup(coordinator, c.cfg.Group, c.memberID)
+		return nil
+	}
+	select {
+	case err = <-heartbeatErr:
+	default:
+	}
+	if err == nil {
+		err = errors.New("kafka: session ended")
+	}
+	return err
+}
+
+// join joins the group, assigning the partitions to the members if
+// the consumer is elected leader, and returns the generation of the
+// group along with the partitions assigned to the consumer.
+func (c *Consumer) join(coordinator *conn, meta metadata) (int32, []int32, error) {
+	subscription := encodeSubscription(c.cfg.Topic)
+
+	for attempt := 0; ; attempt++ {
+		j, err := requestJoinGroup(coordinator, c.cfg.Group, c.memberID, subscription)
+		if err == errUnknownMemberID && attempt == 0 {
+			c.memberID = ""
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		c.memberID = j.memberID
+
+		var assignments map[string][]byte
+		if j.leader == j.memberID {
+			assignments = assignRange(c.cfg.Topic, meta, j.members)
+		}
+
+		assignment, err := requestSyncGroup(coordinator, c.cfg.Group, j.generation, c.memberID, assignments)
+		if err == errRebalanceInProgress && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		partitions, err := decodeAssignment(assignment, c.cfg.Topic)
+		return j.generation, partitions, err
+	}
+}
+
+// consume fetches the partitions from their leaders and hands their
+// messages over, committing offsets after every fetch.
+func (c *Consumer) consume(ctx context.Context, cl *cluster, coordinator *conn, generation int32, partitions []int32, handle func(Message) error) error {
+	if len(partitions) == 0 {
+		// More members than partitions, wait for a rebalance.
+		<-ctx.Done()
+		return nil
+	}
+
+	offsets, err := requestCommitted(coordinator, c.cfg.Group, c.cfg.Topic, partitions)
+	if err != nil {
+		return fmt.Errorf("fetching the offsets of group %s: %w", c.cfg.Group, err)
+	}
+
+	// Partitions are grouped by leader, fetched from together.
+	byLeader := make(map[string][]int32)
+	for _, p := range partitions {
+		leader, found := cl.meta.brokers[cl.meta.leaders[p]]
+		if !found {
+			return fmt.Errorf("kafka: no leader for partition %d of %s", p, c.cfg.Topic)
+		}
+		byLeader[leader] = append(byLeader[leader], p)
+	}
+
+	for addr, leaderPartitions := range byLeader {
+		var missing []int32
+		for _, p := range leaderPartitions {
+			if offset, found := offsets[p]; !found || offset < 0 {
+				missing = append(missing, p)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if err = c.resetOffsets(ctx, cl, addr, missing, offsets); err != nil {
+			return err
+		}
+	}
+
+	// Partitions stopped at a message which failed, or
+	// couldn't be decoded, until they're fetched again.
+	stopped := make(map[int32]time.Time)
+
+	for ctx.Err() == nil {
+		fetched := false
+		for addr, leaderPartitions := range byLeader {
+			fetchOffsets := make(map[int32]int64, len(leaderPartitions))
+			for _, p := range leaderPartitions {
+				if time.Now().After(stopped[p]) {
+					fetchOffsets[p] = offsets[p]
+				}
+			}
+			if len(fetchOffsets) == 0 {
+				continue
+			}
+			fetched = true
+
+			leader, err := cl.conn(ctx, addr)
+			if err != nil {
+				return err
+			}
+
+			data, err := requestFetch(leader, c.cfg.Topic, fetchOffsets)
+			if err != nil {
+				return err
+			}
+
+			handled := make(map[int32]int64)
+			var outOfRange []int32
+
+			for p, f := range data {
+				switch f.code {
+				case errNone:
+				case errOffsetOutOfRange:
+					outOfRange = append(outOfRange, p)
+					continue
+				default:
+					return fmt.Errorf("fetching partition %d of %s: %w", p, c.cfg.Topic, f.code)
+				}
+
+				messages, next, err := decodeRecords(p, f.records, offsets[p])
+				if err != nil {
+					c.stop(stopped, p, next, err)
+				}
+
+				done := true
+				for _, m := range messages {
+					if ctx.Err() != nil {
+						// The partition may be reassigned, the
+						// messages left go to its next owner.
+						done = false
+						break
+					}
+					if err := handle(m); err != nil {
+						c.stop(stopped, p, m.Offset, err)
+						done = false
+						break
+					}
+					handled[p] = m.Offset + 1
+				}
+				if done && next > offsets[p] {
+					handled[p] = next
+				}
+
+				if o, found := handled[p]; found {
+					offsets[p] = o
+				}
+				if lag := f.highWatermark - offsets[p]; lag >= 0 {
+					c.setLag(p, lag)
+				}
+			}
+
+			if len(handled) > 0 {
+				if err = requestCommit(coordinator, c.cfg.Group, generation, c.memberID, c.cfg.Topic, handled); err != nil {
+					return fmt.Errorf("committing the offsets of group %s: %w", c.cfg.Group, err)
+				}
+			}
+
+			if len(outOfRange) > 0 {
+				if err = c.resetOffsets(ctx, cl, addr, outOfRange, offsets); err != nil {
+					return err
+				}
+			}
+
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		// Every partition is stopped, wait for the first to resume.
+		if !fetched {
+			select {
+			case <-ctx.Done():
+			case <-time.After(resumeIn(stopped)):
+			}
+		}
+	}
+
+	return nil
+}
+
+// stop stops the partition at the offset, logging why, so that it's
+// fetched from there again after retryDelay rather than skipped.
+func (c *Consumer) stop(stopped map[int32]time.Time, partition int32, offset int64, err error) {
+	c.log("Kafka consumer of ", c.cfg.Topic, " stopped at offset ", strconv.FormatInt(offset, 10), " of partition ", fmt.Sprint(partition), ", retrying in ", retryDelay.String(), ": ", err.Error(), "\n")
+	stopped[partition] = time.Now().Add(retryDelay)
+}
+
+// resumeIn returns the time until the first stopped partition resumes.
+func resumeIn(stopped map[int32]time.Time) time.Duration {
+	var first time.Time
+	for _, t := range stopped {
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+	}
+	return time.Until(first)
+}
+
+// resetOffsets sets the offsets of the partitions led by the broker
+// to their latest offset.
+func (c *Consumer) resetOffsets(ctx context.Context, cl *cluster, addr string, partitions []int32, offsets map[int32]int64) error {
+	leader, err := cl.conn(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	latest, err := requestLatest(leader, c.cfg.Topic, partitions)
+	if err != nil {
+		return fmt.Errorf("listing the offsets of %s: %w", c.cfg.Topic, err)
+	}
+	for p, offset := range latest {
+		offsets[p] = offset
+	}
+	return nil
+}
+
+// encodeSubscription encodes the subscription of
+// a member of a consumer group to the topic.
+func encodeSubscription(topic string) []byte {
+	var e encoder
+	e.int16(0) // version
+	e.arrayLen(1)
+	e.string(topic)
+	e.bytes(nil) // user_data
+	return e.buf
+}
+
+func decodeSubscription(b []byte) []string {
+	d := decoder{buf: b}
+	d.int16() // version
+
+	var topics []string
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		topics = append(topics, d.string())
+	}
+	return topics
+}
+
+func encodeAssignment(topic string, partitions []int32) []byte {
+	var e encoder
+	e.int16(0) // version
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(len(partitions))
+	for _, p := range partitions {
+		e.int32(p)
+	}
+	e.bytes(nil) // user_data
+	return e.buf
+}
+
+// decodeAssignment returns the partitions of
+// the topic assigned to a member of the group.
+func decodeAssignment(b []byte, topic string) ([]int32, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	d := decoder{buf: b}
+	d.int16() // version
+
+	var partitions []int32
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		name := d.string()
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			if p := d.int32(); name == topic {
+				partitions = append(partitions, p)
+			}
+		}
+	}
+	return partitions, d.err
+}
+
+// assignRange spreads the partitions of the topic over the members
+// subscribed to it, in ranges following the order of the members.
+func assignRange(topic string, meta metadata, members map[string][]byte) map[string][]byte {
+	var subscribed []string
+	for member, subscription := range members {
+		for _, t := range decodeSubscription(subscription) {
+			if t == topic {
+				subscribed = append(subscribed, member)
+				break
+			}
+		}
+	}
+	sort.Strings(subscribed)
+
+	var partitions []int32
+	for p := range meta.leaders {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+
+	assignments := make(map[string][]byte, len(members))
+	for member := range members {
+		assignments[member] = encodeAssignment(topic, nil)
+	}
+
+	for i, member := range subscribed {
+		per, extra := len(partitions)/len(subscribed), len(partitions)%len(subscribed)
+		start, end := i*per+extra, (i+1)*per+extra
+		if i < extra {
+			start, end = i*(per+1), (i+1)*(per+1)
+		}
+		assignments[member] = encodeAssignment(topic, partitions[start:end])
+	}
+
+	return assignments
+}
@@ -0,0 +1,650 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// encodeBatch encodes a record batch of the values from the
+// base offset, compressed with the compression, which but for
+// gzip merely stores the records in its format.
+func encodeBatch(baseOffset int64, compression int16, values ...string) []byte {
+	var records encoder
+	for i, v := range values {
+		var r []byte
+		r = append(r, 0)                          // attributes
+		r = binary.AppendVarint(r, int64(i))      // timestamp delta
+		r = binary.AppendVarint(r, int64(i))      // offset delta
+		r = binary.AppendVarint(r, -1)            // null key
+		r = binary.AppendVarint(r, int64(len(v))) // value
+		r = append(r, v...)
+		r = binary.AppendVarint(r, 0) // headers
+		records.buf = binary.AppendVarint(records.buf, int64(len(r)))
+		records.buf = append(records.buf, r...)
+	}
+	n := len(records.buf)
+	switch compression {
+	case compressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(records.buf)
+		zw.Close()
+		records.buf = buf.Bytes()
+	case compressionSnappy:
+		// A literal of 3 bytes of length, in the framing of the Java clients.
+		b := binary.AppendUvarint(nil, uint64(n))
+		b = append(b, 62<<2, byte(n-1), byte((n-1)>>8), byte((n-1)>>16))
+		b = append(b, records.buf...)
+		framed := append(append([]byte(nil), xerialMagic...), 0, 0, 0, 1, 0, 0, 0, 1)
+		framed = binary.BigEndian.AppendUint32(framed, uint32(len(b)))
+		records.buf = append(framed, b...)
+	case compressionLZ4:
+		// An uncompressed block.
+		b := binary.LittleEndian.AppendUint32(nil, lz4Magic)
+		b = append(b, 0x60, 0x40, 0x82)
+		b = binary.LittleEndian.AppendUint32(b, uint32(n)|0x80000000)
+		b = append(b, records.buf...)
+		records.buf = binary.LittleEndian.AppendUint32(b, 0)
+	case compressionZstd:
+		// A raw block.
+		b := binary.LittleEndian.AppendUint32(nil, zstdMagic)
+		b = append(b, 0x00, 0x58, byte(n<<3|1), byte(n>>5), byte(n>>13))
+		records.buf = append(b, records.buf...)
+	}
+
+	var tail encoder
+	tail.int16(compression)
+	tail.int32(int32(len(values) - 1))
+	tail.int64(1600000000000)
+	tail.int64(1600000000000)
+	tail.int64(-1) // producer id
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(int32(len(values)))
+	tail.buf = append(tail.buf, records.buf...)
+
+	var e encoder
+	e.int64(baseOffset)
+	e.int32(int32(4 + 1 + 4 + len(tail.buf)))
+	e.int32(0) // partition leader epoch
+	e.int8(2)  // magic
+	e.int32(int32(crc32.Checksum(tail.buf, castagnoli)))
+	e.buf = append(e.buf, tail.buf...)
+	return e.buf
+}
+
+func values(messages []Message) []string {
+	var v []string
+	for _, m := range messages {
+		v = append(v, strconv.FormatInt(m.Offset, 10)+":"+string(m.Value))
+	}
+	return v
+}
+
+func TestDecodeRecords(t *testing.T) {
+	var data []byte
+	data = append(data, encodeBatch(0, 0, "a", "b")...)
+	data = append(data, encodeBatch(2, compressionGzip, "c", "d")...)
+
+	messages, next, err := decodeRecords(0, data, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := values(messages); !reflect.DeepEqual(got, []string{"1:b", "2:c", "3:d"}) {
+		t.Errorf("unexpected messages %v", got)
+	}
+	if next != 4 {
+		t.Errorf("expected to go on at 4, got %d", next)
+	}
+
+	// A partial batch is fetched again.
+	partial := encodeBatch(4, 0, "e")
+	messages, next, err = decodeRecords(0, append(data, partial[:len(partial)-1]...), 4)
+	if err != nil || len(messages) != 0 || next != 4 {
+		t.Errorf("expected the partial batch to be left, got %v %d %v", values(messages), next, err)
+	}
+
+	// Batches which can't be decoded stop the records, rather
+	// than being skipped.
+	unknown := encodeBatch(1, 5, "x")
+	messages, next, err = decodeRecords(0, append(append(encodeBatch(0, 0, "w"), unknown...), encodeBatch(2, 0, "y")...), 0)
+	if err == nil || !reflect.DeepEqual(values(messages), []string{"0:w"}) || next != 1 {
+		t.Errorf("expected to stop at the batch of unknown compression, got %v %d %v", values(messages), next, err)
+	}
+
+	corrupt := encodeBatch(0, 0, "z")
+	corrupt[len(corrupt)-2] = 'Z'
+	if _, next, err = decodeRecords(0, corrupt, 0); err == nil || next != 0 {
+		t.Errorf("expected to stop at the corrupt batch, got %d %v", next, err)
+	}
+}
+
+func TestDecodeCompressedRecords(t *testing.T) {
+	for _, compression := range []int16{compressionGzip, compressionSnappy, compressionLZ4, compressionZstd} {
+		messages, next, err := decodeRecords(0, encodeBatch(0, compression, "a", "b"), 0)
+		if err != nil || !reflect.DeepEqual(values(messages), []string{"0:a", "1:b"}) || next != 2 {
+			t.Errorf("compression %d: unexpected records %v %d %v", compression, values(messages), next, err)
+		}
+	}
+}
+
+// purges returns n lines of paths,
+// which the test data compresses.
+func purges(n int) []byte {
+	var b []byte
+	for i := 0; i < n; i++ {
+		b = fmt.Appendf(b, "/images/%d.jpg\n", i*i%1000)
+	}
+	return b
+}
+
+func TestDecompress(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name       string
+		decompress func([]byte, int) ([]byte, error)
+		data       []byte
+		want       []byte
+	}{{
+		name:       "snappy",
+		decompress: unsnappy,
+		// A literal and two copies, one overlapping.
+		data: []byte{13, 3 << 2, 'a', 'b', 'c', 'd', 4<<2 | 1, 4, 0, 'X'},
+		want: []byte("abcdabcdabcdX"),
+	}, {
+		name:       "framed snappy",
+		decompress: unsnappy,
+		data: []byte{
+			0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0, 0, 0, 0, 1, 0, 0, 0, 1,
+			0, 0, 0, 9, 8, 3 << 2, 'w', 'x', 'y', 'z', 3<<2 | 2, 4, 0,
+			0, 0, 0, 3, 1, 0, '!',
+		},
+		want: []byte("wxyzwxyz!"),
+	}, {
+		// lz4 -9 of purges(100)
+		name:       "lz4",
+		decompress: unlz4,
+		data: decode(`BCJNGGRAp34BAADkL2ltYWdlcy8wLmpwZwoOABkxDgAZNA4AGjkqABk2DwApMjUPABozHgAa
+NDwAGjZZABo4dgArMTCUABsyIAArNDSKAAuaABs5mwALnAArMjUgABo4QAA7MzI0zAALFgEL
+oAArNDQgABo4QAAqNTJgACo1N4AAGzagABs2IAAbN0AAGzdgABs4gAAbOaAAGznAAAvfAAv+
+AC8xNT4BDAteARszfgEsNDT+AAp+ABs2ngAbNv4BHDcdAgs8Ai85M3kCChwxmAIbMN0BKzA0
+zQEKfwAcNZ8ACyAAGzdAABs4YAAfORgDCxwxvgAL3gAbM/4ALzQ4PgELGzdeARs4fgEbOZ4B
+DxsDDBsz/QEbNB0CGzY8Ai83NnsCCwuaAhsxugIbM9oCHzQaAwwbNyAAGzlAAAtfAC8yNLkD
+Cxs1vgAcNxoDC/4ADxoDDBszXQEbNXwBHDecAR8y+AQLGzL8ARs0HAIbNjwCHzgaAwsbMpoC
+GzS6Ah022gJgMS5qcGcKAAAAAK/JzAY=`),
+		want: purges(100),
+	}, {
+		// zstd -19 --no-check of purges(300), of Huffman coded
+		// literals and sequences of described tables.
+		name:       "zstd",
+		decompress: unzstd,
+		data: decode(`KLUv/WCLEdULANZULBOgKR2Ae2unqsKntJNMMkkJ1bmvKQAlACUAdLrD7Yosvdaf9thoR61M
+cji6a+tfcjJj9izVOucACAhDQIrEgCA4FIoiYqlwRmZLb3aO1sveaJHzPkYHRx6+YzWLenqj
+LmlEhrSEQrKZL3MGS99rr7nc4va6pBER114aHJcG73JKY9qY5bx8B2sk45JGAi43Hy1ufo+2
+45PmlKFUVafTMdP5mjHz1VHiVy5pRKQzO3MGBYEBqFGo3X4GAV+SRM0BEZwQTCF9eSQnejz1
+iTdLqLyvy7Px5srfH8lyP0xN/BU8TK8B2lgWI7VRJHozW3XSu+TxZSjRT1AKikBKbdXSKk8l
+SiwU6dZAtj8N6hI20epsoJGZ9eP7YEzLN6oej2XH4dnueQnD8YYgYCwlgUDNxiBsCwYlO8MU
+RWbzkF8ghHiQCCOlnotSEU7LGEHg4VXE35XpoDQhVuDDaPHgCY4cxfZJ9Ww+nzPokC7s7bZc
+gkWuXfj6BXBWAQ==`),
+		want: purges(300),
+	}}
+
+	for _, tt := range tests {
+		got, err := tt.decompress(tt.data, maxRecordsSize)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: expected %d bytes, got %d %v", tt.name, len(tt.want), len(got), err)
+		}
+
+		// Truncated data and output past the limit are errors.
+		if _, err := tt.decompress(tt.data[:len(tt.data)-1], maxRecordsSize); err == nil {
+			t.Errorf("%s: expected truncated data to fail", tt.name)
+		}
+		if _, err := tt.decompress(tt.data, len(tt.want)-1); err == nil {
+			t.Errorf("%s: expected to stop at %d bytes", tt.name, len(tt.want)-1)
+		}
+	}
+}
+
+func TestAssignRange(t *testing.T) {
+	meta := metadata{leaders: map[int32]int32{0: 1, 1: 1, 2: 1, 3: 1, 4: 1}}
+	members := map[string][]byte{
+		"b": encodeSubscription("purges"),
+		"a": encodeSubscription("purges"),
+		"c": encodeSubscription("other"),
+	}
+
+	assignments := assignRange("purges", meta, members)
+
+	for member, want := range map[string][]int32{"a": {0, 1, 2}, "b": {3, 4}, "c": nil} {
+		got, err := decodeAssignment(assignments[member], "purges")
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v %v", member, want, got, err)
+		}
+	}
+}
+
+// fakeBroker is a single broker cluster of a single partition topic,
+// coordinating the group of a single member.
+type fakeBroker struct {
+	t     *testing.T
+	ln    net.Listener
+	topic string
+	batch []byte
+
+	mu        sync.Mutex
+	committed int64
+	left      bool
+}
+
+func newFakeBroker(t *testing.T, topic string, committed int64, batch []byte) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, ln: ln, topic: topic, batch: batch, committed: committed}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) state() (int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.committed, b.left
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+
+	host, portString, _ := net.SplitHostPort(b.ln.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+
+		d := &decoder{buf: req}
+		api, version, correlationID := d.int16(), d.int16(), d.int32()
+		d.string() // client_id
+		if version != apiVersions[api] {
+			b.t.Errorf("unexpected version %d of request %d", version, api)
+		}
+
+		var e encoder
+		e.int32(correlationID)
+
+		switch api {
+		case apiMetadata:
+			e.int32(0)
+			e.arrayLen(1)
+			e.int32(1)
+			e.string(host)
+			e.int32(int32(port))
+			e.nullString()
+			e.nullString()
+			e.int32(1)
+			e.arrayLen(1)
+			e.int16(0)
+			e.string(b.topic)
+			e.int8(0)
+			e.arrayLen(1)
+			e.int16(0)
+			e.int32(0) // partition
+			e.int32(1) // leader
+			e.arrayLen(0)
+			e.arrayLen(0)
+		case apiFindCoordinator:
+			e.int32(0)
+			e.int16(0)
+			e.nullString()
+			e.int32(1)
+			e.string(host)
+			e.int32(int32(port))
+		case apiJoinGroup:
+			e.int32(0)
+			e.int16(0)
+			e.int32(7) // generation
+			e.string(assignorName)
+			e.string("member-1")
+			e.string("member-1")
+			e.arrayLen(1)
+			e.string("member-1")
+			e.bytes(encodeSubscription(b.topic))
+		case apiSyncGroup:
+			d.string() // group
+			d.int32()  // generation
+			d.string() // member
+			var assignment []byte
+			for i, n := 0, d.arrayLen(); i < n; i++ {
+				if d.string() == "member-1" {
+					assignment = d.bytes()
+				}
+			}
+			e.int32(0)
+			e.int16(0)
+			e.bytes(assignment)
+		case apiHeartbeat, apiLeaveGroup:
+			if api == apiLeaveGroup {
+				b.mu.Lock()
+				b.left = true
+				b.mu.Unlock()
+			}
+			e.int32(0)
+			e.int16(0)
+		case apiOffsetFetch:
+			e.int32(0)
+			e.arrayLen(1)
+			e.string(b.topic)
+			e.arrayLen(1)
+			e.int32(0)
+			committed, _ := b.state()
+			e.int64(committed)
+			e.nullString()
+			e.int16(0)
+			e.int16(0)
+		case apiListOffsets:
+			e.arrayLen(1)
+			e.string(b.topic)
+			e.arrayLen(1)
+			e.int32(0)
+			e.int16(0)
+			e.int64(-1)
+			e.int64(0)
+		case apiOffsetCommit:
+			d.string() // group
+			if generation := d.int32(); generation != 7 {
+				b.t.Errorf("unexpected generation %d", generation)
+			}
+			d.string() // member
+			d.int64()  // retention
+			d.arrayLen()
+			d.string() // topic
+			d.arrayLen()
+			d.int32() // partition
+			b.mu.Lock()
+			b.committed = d.int64()
+			b.mu.Unlock()
+
+			e.arrayLen(1)
+			e.string(b.topic)
+			e.arrayLen(1)
+			e.int32(0)
+			e.int16(0)
+		case apiSaslHandshake:
+			if d.string() == MechanismPlain {
+				e.int16(0)
+			} else {
+				e.int16(int16(errUnsupportedSaslMechanism))
+			}
+			e.arrayLen(1)
+			e.string(MechanismPlain)
+		case apiSaslAuthenticate:
+			if string(d.bytes()) == "\x00user\x00pass" {
+				e.int16(0)
+				e.nullString()
+			} else {
+				e.int16(int16(errSaslAuthenticationFailed))
+				e.string("Invalid username or password")
+			}
+			e.bytes([]byte{})
+		case apiFetch:
+			d.int32() // replica_id
+			wait := d.int32()
+			d.int32() // min_bytes
+			d.int32() // max_bytes
+			d.int8()  // isolation_level
+			d.int32() // session_id
+			d.int32() // session_epoch
+			d.arrayLen()
+			d.string() // topic
+			d.arrayLen()
+			d.int32() // partition
+			d.int32() // current_leader_epoch
+			offset := d.int64()
+
+			records := b.batch
+			if offset >= 3 {
+				// Nothing new, long poll.
+				records = nil
+				time.Sleep(time.Duration(wait) * time.Millisecond / 10)
+			}
+
+			e.int32(0)
+			e.int16(0)
+			e.int32(0) // session id
+			e.arrayLen(1)
+			e.string(b.topic)
+			e.arrayLen(1)
+			e.int32(0)
+			e.int16(0)
+			e.int64(3) // high watermark
+			e.int64(3) // last stable offset
+			e.int64(0) // log start offset
+			e.arrayLen(-1)
+			e.bytes(records)
+		default:
+			b.t.Errorf("unexpected request %d", api)
+			return
+		}
+
+		out := binary.BigEndian.AppendUint32(nil, uint32(len(e.buf)))
+		if _, err := c.Write(append(out, e.buf...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestConsumerCommitsHandledMessages(t *testing.T) {
+	broker := newFakeBroker(t, "purges", 1, encodeBatch(0, 0, "a", "b", "c"))
+
+	c, err := NewConsumer(Config{Brokers: []string{broker.ln.Addr().String()}, Topic: "purges", Group: "broadcaster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan Message, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx, func(m Message) error {
+			// The offset isn't committed before the message is handled.
+			if committed, _ := broker.state(); committed > m.Offset {
+				t.Errorf("offset %d committed before its message was handled", committed)
+			}
+			handled <- m
+			return nil
+		})
+		close(done)
+	}()
+
+	var got []Message
+	for len(got) < 2 {
+		select {
+		case m := <-handled:
+			got = append(got, m)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the messages after the committed offset, got %v", values(got))
+		}
+	}
+	if v := values(got); !reflect.DeepEqual(v, []string{"1:b", "2:c"}) {
+		t.Errorf("unexpected messages %v", v)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for committed, _ := broker.state(); committed != 3 && time.Now().Before(deadline); committed, _ = broker.state() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if committed, _ := broker.state(); committed != 3 {
+		t.Errorf("expected offset 3 to be committed, got %d", committed)
+	}
+	if lag := c.Lag(); lag != 0 {
+		t.Errorf("expected no lag, got %d", lag)
+	}
+
+	cancel()
+	<-done
+	if _, left := broker.state(); !left {
+		t.Error("expected the consumer to leave the group")
+	}
+}
+
+func TestConsumerStopsAtFailedMessages(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = 50 * time.Millisecond
+
+	broker := newFakeBroker(t, "purges", 1, encodeBatch(0, 0, "a", "b", "c"))
+
+	c, err := NewConsumer(Config{Brokers: []string{broker.ln.Addr().String()}, Topic: "purges", Group: "broadcaster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan string, 10)
+	failed := false
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx, func(m Message) error {
+			if m.Offset == 2 && !failed {
+				failed = true
+				if committed, _ := broker.state(); committed > 2 {
+					t.Errorf("offset %d committed past the failed message", committed)
+				}
+				return errors.New("rejected")
+			}
+			handled <- values([]Message{m})[0]
+			return nil
+		})
+		close(done)
+	}()
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case v := <-handled:
+			got = append(got, v)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the failed message to be handled again, got %v", got)
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"1:b", "2:c"}) {
+		t.Errorf("expected the partition to resume at the failed message, got %v", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for committed, _ := broker.state(); committed != 3 && time.Now().Before(deadline); committed, _ = broker.state() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if committed, _ := broker.state(); committed != 3 {
+		t.Errorf("expected offset 3 to be committed, got %d", committed)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestDialAuthenticates(t *testing.T) {
+	b := newFakeBroker(t, "purges", 0, nil)
+	addr := b.ln.Addr().String()
+	cfg := Config{ClientID: "test", Mechanism: MechanismPlain, User: "user", Password: "pass"}
+
+	c, err := dial(context.Background(), addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = requestMetadata(c, "purges"); err != nil {
+		t.Errorf("expected an authenticated connection, got %v", err)
+	}
+	c.close()
+
+	cfg.Password = "wrong"
+	if _, err = dial(context.Background(), addr, cfg); !errors.Is(err, errSaslAuthenticationFailed) {
+		t.Errorf("expected the authentication to fail, got %v", err)
+	}
+
+	cfg.Mechanism = MechanismSCRAMSHA512
+	if _, err = dial(context.Background(), addr, cfg); err == nil || !strings.Contains(err.Error(), "the brokers have PLAIN") {
+		t.Errorf("expected the mechanism to be refused, got %v", err)
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+	// The example of RFC 7677.
+	s := &scram{hash: sha256.New, user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+
+	if first := string(s.first()); first != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("unexpected first message %q", first)
+	}
+
+	final, err := s.final([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; err != nil || string(final) != want {
+		t.Errorf("unexpected final message %q %v", final, err)
+	}
+
+	if err = s.verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Error(err)
+	}
+	if err = s.verify([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Error("expected a wrong server signature to fail")
+	}
+
+	// The nonce of the server must extend that of the client.
+	if _, err = s.final([]byte("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Error("expected a foreign nonce to fail")
+	}
+}
+
+func TestNewConsumerRequiresTopic(t *testing.T) {
+	if _, err := NewConsumer(Config{Brokers: []string{"localhost:9092"}, Group: "broadcaster"}); err == nil {
+		t.Error("expected an error without topic")
+	}
+}
+
+func TestNewConsumerChecksMechanism(t *testing.T) {
+	cfg := Config{Brokers: []string{"localhost:9092"}, Topic: "purges", Group: "broadcaster", Mechanism: "GSSAPI", User: "user"}
+	if _, err := NewConsumer(cfg); err == nil {
+		t.Error("expected an error for an unsupported mechanism")
+	}
+
+	cfg.Mechanism, cfg.User = MechanismSCRAMSHA256, ""
+	if _, err := NewConsumer(cfg); err == nil {
+		t.Error("expected an error without user")
+	}
+}
@@ -0,0 +1,178 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errLZ4 = errors.New("kafka: corrupt lz4 data")
+
+// Magic numbers of lz4 frames, and of the 16 kinds of
+// skippable frames, which zstd shares.
+const (
+	lz4Magic       = 0x184d2204
+	skippableMagic = 0x184d2a50
+)
+
+// unlz4 decompresses lz4 frames, up to max bytes. Checksums
+// aren't verified, the record batch having its own.
+func unlz4(data []byte, max int) ([]byte, error) {
+	var out []byte
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errLZ4
+		}
+		magic := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+
+		if magic&0xfffffff0 == skippableMagic {
+			var ok bool
+			if data, ok = skipFrame(data); !ok {
+				return nil, errLZ4
+			}
+			continue
+		}
+		if magic != lz4Magic || len(data) < 2 {
+			return nil, errLZ4
+		}
+
+		flags := data[0]
+		if flags>>6 != 1 {
+			return nil, errLZ4
+		}
+		blockChecksum := flags&0x10 != 0
+		contentChecksum := flags&0x04 != 0
+
+		// Flags, block descriptor and header checksum,
+		// along with the content size and dictionary id.
+		header := 3
+		if flags&0x08 != 0 {
+			header += 8
+		}
+		if flags&0x01 != 0 {
+			header += 4
+		}
+		if len(data) < header {
+			return nil, errLZ4
+		}
+		data = data[header:]
+
+		start := len(out)
+		for {
+			if len(data) < 4 {
+				return nil, errLZ4
+			}
+			size := binary.LittleEndian.Uint32(data)
+			data = data[4:]
+			if size == 0 {
+				break
+			}
+
+			uncompressed := size&0x80000000 != 0
+			size &= 0x7fffffff
+			if uint64(size) > uint64(len(data)) {
+				return nil, errLZ4
+			}
+
+			var err error
+			if uncompressed {
+				if int(size) > max-len(out) {
+					return nil, errLZ4
+				}
+				out = append(out, data[:size]...)
+			} else if out, err = lz4Block(out, data[:size], start, max); err != nil {
+				return nil, err
+			}
+			data = data[size:]
+
+			if blockChecksum {
+				if len(data) < 4 {
+					return nil, errLZ4
+				}
+				data = data[4:]
+			}
+		}
+
+		if contentChecksum {
+			if len(data) < 4 {
+				return nil, errLZ4
+			}
+			data = data[4:]
+		}
+	}
+
+	return out, nil
+}
+
+// skipFrame returns the data following a skippable frame,
+// past its magic number.
+func skipFrame(data []byte) ([]byte, bool) {
+	if len(data) < 4 {
+		return nil, false
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if uint64(size) > uint64(len(data)-4) {
+		return nil, false
+	}
+	return data[4+size:], true
+}
+
+// lz4Block appends the decompressed block to out, whose matches
+// can reach back to the start of the frame.
+func lz4Block(out, block []byte, start, max int) ([]byte, error) {
+	for i := 0; i < len(block); {
+		token := block[i]
+		i++
+
+		litLen, ok := lz4Length(block, &i, int(token>>4))
+		if !ok || litLen > len(block)-i || litLen > max-len(out) {
+			return nil, errLZ4
+		}
+		out = append(out, block[i:i+litLen]...)
+		i += litLen
+
+		// The last sequence only has literals.
+		if i == len(block) {
+			break
+		}
+
+		if len(block)-i < 2 {
+			return nil, errLZ4
+		}
+		offset := int(binary.LittleEndian.Uint16(block[i:]))
+		i += 2
+
+		matchLen, ok := lz4Length(block, &i, int(token&0x0f))
+		matchLen += 4
+		if !ok || offset == 0 || offset > len(out)-start || matchLen > max-len(out) {
+			return nil, errLZ4
+		}
+		// Matches may overlap what they append.
+		from := len(out) - offset
+		for j := 0; j < matchLen; j++ {
+			out = append(out, out[from+j])
+		}
+	}
+
+	return out, nil
+}
+
+// lz4Length reads the rest of a length of the token,
+// continued in the bytes following it when 15.
+func lz4Length(block []byte, i *int, length int) (int, bool) {
+	if length != 15 {
+		return length, true
+	}
+	for {
+		if *i >= len(block) {
+			return 0, false
+		}
+		b := block[*i]
+		*i++
+		length += int(b)
+		if b != 255 {
+			return length, true
+		}
+	}
+}
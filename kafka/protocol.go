@@ -0,0 +1,325 @@
+// Package kafka is a minimal consumer of a Kafka topic, as a member
+// of a consumer group. It speaks the parts of the Kafka protocol it
+// needs, in the oldest versions current brokers still support, but
+// for fetches: brokers only return zstd batches from version 10.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Keys of the requests sent to the brokers.
+const (
+	apiFetch            int16 = 1
+	apiListOffsets      int16 = 2
+	apiMetadata         int16 = 3
+	apiOffsetCommit     int16 = 8
+	apiOffsetFetch      int16 = 9
+	apiFindCoordinator  int16 = 10
+	apiJoinGroup        int16 = 11
+	apiHeartbeat        int16 = 12
+	apiLeaveGroup       int16 = 13
+	apiSyncGroup        int16 = 14
+	apiSaslHandshake    int16 = 17
+	apiSaslAuthenticate int16 = 36
+)
+
+// apiVersions are the versions of the requests sent, whose
+// encodings the request and response functions follow.
+var apiVersions = map[int16]int16{
+	apiFetch:            10,
+	apiListOffsets:      1,
+	apiMetadata:         4,
+	apiOffsetCommit:     2,
+	apiOffsetFetch:      3,
+	apiFindCoordinator:  1,
+	apiJoinGroup:        2,
+	apiHeartbeat:        1,
+	apiLeaveGroup:       1,
+	apiSyncGroup:        1,
+	apiSaslHandshake:    1,
+	apiSaslAuthenticate: 0,
+}
+
+// maxResponseSize bounds the responses read from the brokers.
+const maxResponseSize = 64 << 20
+
+var errShortResponse = errors.New("kafka: short response")
+
+// Error is the error code of a response.
+type Error int16
+
+// Error codes the consumer handles.
+const (
+	errNone                      Error = 0
+	errOffsetOutOfRange          Error = 1
+	errUnknownTopicOrPartition   Error = 3
+	errLeaderNotAvailable        Error = 5
+	errNotLeaderForPartition     Error = 6
+	errCoordinatorLoadInProgress Error = 14
+	errCoordinatorNotAvailable   Error = 15
+	errNotCoordinator            Error = 16
+	errIllegalGeneration         Error = 22
+	errUnknownMemberID           Error = 25
+	errRebalanceInProgress       Error = 27
+	errUnsupportedSaslMechanism  Error = 33
+	errSaslAuthenticationFailed  Error = 58
+)
+
+var errorNames = map[Error]string{
+	errOffsetOutOfRange:          "offset out of range",
+	errUnknownTopicOrPartition:   "unknown topic or partition",
+	errLeaderNotAvailable:        "leader not available",
+	errNotLeaderForPartition:     "not leader for partition",
+	errCoordinatorLoadInProgress: "coordinator load in progress",
+	errCoordinatorNotAvailable:   "coordinator not available",
+	errNotCoordinator:            "not coordinator",
+	errIllegalGeneration:         "illegal generation",
+	errUnknownMemberID:           "unknown member id",
+	errRebalanceInProgress:       "rebalance in progress",
+	errUnsupportedSaslMechanism:  "unsupported SASL mechanism",
+	errSaslAuthenticationFailed:  "SASL authentication failed",
+}
+
+func (e Error) Error() string {
+	if name, found := errorNames[e]; found {
+		return "kafka: " + name
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+// err returns the code as an error, nil for no error.
+func (e Error) err() error {
+	if e == errNone {
+		return nil
+	}
+	return e
+}
+
+// encoder appends the big-endian encoding of request fields.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8)   { e.buf = append(e.buf, byte(v)) }
+func (e *encoder) int16(v int16) { e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v)) }
+func (e *encoder) int32(v int32) { e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v)) }
+func (e *encoder) int64(v int64) { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// nullString encodes a null nullable string.
+func (e *encoder) nullString() { e.int16(-1) }
+
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) arrayLen(n int) { e.int32(int32(n)) }
+
+// decoder reads the fields of a response, the first error
+// sticking and zero values being read past it.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errShortResponse
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) errorCode() Error { return Error(d.int16()) }
+
+// string reads a string, nullable strings being read as empty.
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// bytes reads bytes, nil for null ones.
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// arrayLen reads the length of an array, null arrays being empty.
+// Every element taking a byte at least, longer arrays are invalid.
+func (d *decoder) arrayLen() int {
+	n := int(d.int32())
+	if n < 0 {
+		return 0
+	}
+	if d.err == nil && n > len(d.buf) {
+		d.err = errShortResponse
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errShortResponse
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// varBytes reads bytes of a record, nil for null ones.
+func (d *decoder) varBytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// conn is a connection to a broker, serializing requests.
+type conn struct {
+	mu            sync.Mutex
+	nc            net.Conn
+	clientID      string
+	correlationID int32
+}
+
+// dial connects to the broker, over TLS and authenticated
+// as configured.
+func dial(ctx context.Context, addr string, cfg Config) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		tc := tls.Client(nc, &tls.Config{ServerName: host})
+		if err = tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	c := &conn{nc: nc, clientID: cfg.ClientID}
+	if cfg.Mechanism != "" {
+		if err = authenticate(c, cfg); err != nil {
+			c.close()
+			return nil, fmt.Errorf("authenticating to %s: %w", addr, err)
+		}
+	}
+	return c, nil
+}
+
+// request sends the body of a request and returns a decoder
+// of the response, past its header.
+func (c *conn) request(api int16, body []byte, timeout time.Duration) (*decoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.correlationID++
+
+	e := encoder{buf: make([]byte, 4, 64+len(body))}
+	e.int16(api)
+	e.int16(apiVersions[api])
+	e.int32(c.correlationID)
+	e.string(c.clientID)
+	e.buf = append(e.buf, body...)
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+
+	c.nc.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := c.nc.Write(e.buf); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.nc, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxResponseSize {
+		return nil, fmt.Errorf("kafka: invalid response size %d", n)
+	}
+
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.nc, resp); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{buf: resp}
+	if id := d.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("kafka: response %d to request %d", id, c.correlationID)
+	}
+	return d, nil
+}
+
+func (c *conn) close() error {
+	return c.nc.Close()
+}
@@ -0,0 +1,164 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Message is a record of the consumed topic.
+type Message struct {
+	Partition int32
+	Offset    int64
+	Time      time.Time
+	Key       []byte
+	Value     []byte
+}
+
+// Attributes of record batches.
+const (
+	compressionMask   = 0x07
+	compressionGzip   = 1
+	compressionSnappy = 2
+	compressionLZ4    = 3
+	compressionZstd   = 4
+	controlAttribute  = 0x20
+	recordBatchHeader = 61
+)
+
+// maxRecordsSize bounds the decompressed records of a batch.
+const maxRecordsSize = 64 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// decodeRecords returns the messages of the record batches fetched
+// from the partition, starting at the offset, along with the offset
+// following the last complete batch. Brokers may end the records
+// with a partial batch, which is fetched again next time. A batch
+// which can't be decoded stops the records, and is returned as an
+// error along with the messages before it and its offset, for the
+// batch not to be skipped.
+func decodeRecords(partition int32, data []byte, offset int64) ([]Message, int64, error) {
+	var messages []Message
+	next := offset
+
+	for len(data) >= 17 {
+		size := int(int32(binary.BigEndian.Uint32(data[8:])))
+		if size < 5 || len(data) < 12+size {
+			break
+		}
+
+		batchMessages, end, err := decodeBatch(partition, data[:12+size], next)
+		if err != nil {
+			return messages, next, err
+		}
+		messages = append(messages, batchMessages...)
+		if end > next {
+			next = end
+		}
+
+		data = data[12+size:]
+	}
+
+	return messages, next, nil
+}
+
+// decodeBatch returns the messages of the batch from the offset,
+// along with the offset following the batch.
+func decodeBatch(partition int32, batch []byte, offset int64) ([]Message, int64, error) {
+	baseOffset := int64(binary.BigEndian.Uint64(batch))
+
+	if magic := batch[16]; magic != 2 {
+		return nil, baseOffset + 1, fmt.Errorf("kafka: unsupported message format %d at offset %d", magic, baseOffset)
+	}
+	if len(batch) < recordBatchHeader {
+		return nil, baseOffset + 1, fmt.Errorf("kafka: short record batch at offset %d", baseOffset)
+	}
+
+	attributes := binary.BigEndian.Uint16(batch[21:])
+	lastOffsetDelta := int32(binary.BigEndian.Uint32(batch[23:]))
+	baseTime := int64(binary.BigEndian.Uint64(batch[27:]))
+	count := int(int32(binary.BigEndian.Uint32(batch[57:])))
+	records := batch[recordBatchHeader:]
+
+	end := baseOffset + int64(lastOffsetDelta) + 1
+
+	if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], castagnoli) {
+		return nil, end, fmt.Errorf("kafka: corrupt record batch at offset %d", baseOffset)
+	}
+
+	// Control batches only mark transactions.
+	if end <= offset || attributes&controlAttribute != 0 {
+		return nil, end, nil
+	}
+
+	var err error
+	switch attributes & compressionMask {
+	case 0:
+	case compressionGzip:
+		records, err = gunzip(records, maxRecordsSize)
+	case compressionSnappy:
+		records, err = unsnappy(records, maxRecordsSize)
+	case compressionLZ4:
+		records, err = unlz4(records, maxRecordsSize)
+	case compressionZstd:
+		records, err = unzstd(records, maxRecordsSize)
+	default:
+		return nil, end, fmt.Errorf("kafka: unsupported compression %d at offset %d", attributes&compressionMask, baseOffset)
+	}
+	if err != nil {
+		return nil, end, fmt.Errorf("%w in batch at offset %d", err, baseOffset)
+	}
+
+	var messages []Message
+
+	d := decoder{buf: records}
+	for i := 0; i < count; i++ {
+		record := decoder{buf: d.take(int(d.varint()))}
+
+		record.int8() // attributes
+		timeDelta := record.varint()
+		offsetDelta := record.varint()
+		key := record.varBytes()
+		value := record.varBytes()
+		// Headers are ignored.
+
+		if d.err != nil || record.err != nil {
+			return messages, end, fmt.Errorf("kafka: corrupt record in batch at offset %d", baseOffset)
+		}
+
+		if o := baseOffset + offsetDelta; o >= offset {
+			messages = append(messages, Message{
+				Partition: partition,
+				Offset:    o,
+				Time:      time.Unix(0, (baseTime+timeDelta)*int64(time.Millisecond)),
+				Key:       key,
+				Value:     value,
+			})
+		}
+	}
+
+	return messages, end, nil
+}
+
+// gunzip decompresses gzipped records, up to max bytes.
+func gunzip(data []byte, max int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	records, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > max {
+		return nil, errors.New("kafka: gzipped records too large")
+	}
+	return records, nil
+}
@@ -0,0 +1,400 @@
+package kafka
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// Timeouts of the requests, JoinGroup waiting for the
+// other members of the group to join.
+const (
+	requestTimeout = 30 * time.Second
+	joinTimeout    = rebalanceTimeout + requestTimeout
+)
+
+// metadata is the part of a Metadata response the consumer uses.
+type metadata struct {
+	brokers map[int32]string
+
+	// leaders holds the broker leading
+	// every partition of the topic.
+	leaders map[int32]int32
+}
+
+func requestMetadata(c *conn, topic string) (metadata, error) {
+	var e encoder
+	e.arrayLen(1)
+	e.string(topic)
+	e.int8(0) // allow_auto_topic_creation
+
+	d, err := c.request(apiMetadata, e.buf, requestTimeout)
+	if err != nil {
+		return metadata{}, err
+	}
+
+	m := metadata{brokers: make(map[int32]string), leaders: make(map[int32]int32)}
+
+	d.int32() // throttle_time_ms
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // rack
+		m.brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster_id
+	d.int32()  // controller_id
+
+	var topicErr error = errUnknownTopicOrPartition
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code, name := d.errorCode(), d.string()
+		d.int8() // is_internal
+
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			partitionCode, partition, leader := d.errorCode(), d.int32(), d.int32()
+			for k, nr := 0, d.arrayLen(); k < nr; k++ {
+				d.int32() // replica_nodes
+			}
+			for k, ni := 0, d.arrayLen(); k < ni; k++ {
+				d.int32() // isr_nodes
+			}
+			if name == topic && partitionCode != errLeaderNotAvailable {
+				m.leaders[partition] = leader
+			}
+		}
+
+		if name == topic {
+			topicErr = code.err()
+		}
+	}
+
+	if d.err != nil {
+		return m, d.err
+	}
+	return m, topicErr
+}
+
+func requestCoordinator(c *conn, group string) (string, error) {
+	var e encoder
+	e.string(group)
+	e.int8(0) // key_type, a group
+
+	d, err := c.request(apiFindCoordinator, e.buf, requestTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	d.int32() // throttle_time_ms
+	code := d.errorCode()
+	d.string() // error_message
+	d.int32()  // node_id
+	host, port := d.string(), d.int32()
+
+	if d.err != nil {
+		return "", d.err
+	}
+	if err = code.err(); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// joined is the part of a JoinGroup response the consumer uses.
+type joined struct {
+	generation int32
+	leader     string
+	memberID   string
+
+	// members holds the subscription of every member,
+	// only sent to the leader.
+	members map[string][]byte
+}
+
+func requestJoinGroup(c *conn, group, memberID string, subscription []byte) (joined, error) {
+	var e encoder
+	e.string(group)
+	e.int32(int32(sessionTimeout / time.Millisecond))
+	e.int32(int32(rebalanceTimeout / time.Millisecond))
+	e.string(memberID)
+	e.string("consumer")
+	e.arrayLen(1)
+	e.string(assignorName)
+	e.bytes(subscription)
+
+	d, err := c.request(apiJoinGroup, e.buf, joinTimeout)
+	if err != nil {
+		return joined{}, err
+	}
+
+	d.int32() // throttle_time_ms
+	code := d.errorCode()
+	j := joined{members: make(map[string][]byte)}
+	j.generation = d.int32()
+	d.string() // protocol_name
+	j.leader = d.string()
+	j.memberID = d.string()
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		member := d.string()
+		j.members[member] = d.bytes()
+	}
+
+	if d.err != nil {
+		return j, d.err
+	}
+	return j, code.err()
+}
+
+func requestSyncGroup(c *conn, group string, generation int32, memberID string, assignments map[string][]byte) ([]byte, error) {
+	var e encoder
+	e.string(group)
+	e.int32(generation)
+	e.string(memberID)
+	e.arrayLen(len(assignments))
+	for member, assignment := range assignments {
+		e.string(member)
+		e.bytes(assignment)
+	}
+
+	d, err := c.request(apiSyncGroup, e.buf, joinTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	d.int32() // throttle_time_ms
+	code := d.errorCode()
+	assignment := d.bytes()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return assignment, code.err()
+}
+
+func requestHeartbeat(c *conn, group string, generation int32, memberID string) error {
+	var e encoder
+	e.string(group)
+	e.int32(generation)
+	e.string(memberID)
+
+	d, err := c.request(apiHeartbeat, e.buf, requestTimeout)
+	if err != nil {
+		return err
+	}
+
+	d.int32() // throttle_time_ms
+	code := d.errorCode()
+
+	if d.err != nil {
+		return d.err
+	}
+	return code.err()
+}
+
+func requestLeaveGroup(c *conn, group, memberID string) error {
+	var e encoder
+	e.string(group)
+	e.string(memberID)
+
+	d, err := c.request(apiLeaveGroup, e.buf, requestTimeout)
+	if err != nil {
+		return err
+	}
+
+	d.int32() // throttle_time_ms
+	code := d.errorCode()
+
+	if d.err != nil {
+		return d.err
+	}
+	return code.err()
+}
+
+// requestCommitted returns the offsets committed by the group for
+// the partitions, -1 standing for partitions without offset.
+func requestCommitted(c *conn, group, topic string, partitions []int32) (map[int32]int64, error) {
+	var e encoder
+	e.string(group)
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(len(partitions))
+	for _, p := range partitions {
+		e.int32(p)
+	}
+
+	d, err := c.request(apiOffsetFetch, e.buf, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	var partitionErr error
+
+	d.int32() // throttle_time_ms
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // name
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			partition, offset := d.int32(), d.int64()
+			d.string() // metadata
+			if code := d.errorCode(); code != errNone {
+				partitionErr = code
+			}
+			offsets[partition] = offset
+		}
+	}
+	code := d.errorCode()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err = code.err(); err != nil {
+		return nil, err
+	}
+	return offsets, partitionErr
+}
+
+func requestCommit(c *conn, group string, generation int32, memberID, topic string, offsets map[int32]int64) error {
+	var e encoder
+	e.string(group)
+	e.int32(generation)
+	e.string(memberID)
+	e.int64(-1) // retention_time_ms, the broker's default
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(len(offsets))
+	for p, offset := range offsets {
+		e.int32(p)
+		e.int64(offset)
+		e.nullString()
+	}
+
+	d, err := c.request(apiOffsetCommit, e.buf, requestTimeout)
+	if err != nil {
+		return err
+	}
+
+	var commitErr error
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // name
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			d.int32() // partition_index
+			if code := d.errorCode(); code != errNone {
+				commitErr = code
+			}
+		}
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	return commitErr
+}
+
+// requestLatest returns the offset the next
+// message of the partitions will be written at.
+func requestLatest(c *conn, topic string, partitions []int32) (map[int32]int64, error) {
+	var e encoder
+	e.int32(-1) // replica_id
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(len(partitions))
+	for _, p := range partitions {
+		e.int32(p)
+		e.int64(-1) // timestamp, the latest offset
+	}
+
+	d, err := c.request(apiListOffsets, e.buf, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	var partitionErr error
+
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // name
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			partition, code := d.int32(), d.errorCode()
+			d.int64() // timestamp
+			offset := d.int64()
+			if code != errNone {
+				partitionErr = code
+				continue
+			}
+			offsets[partition] = offset
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return offsets, partitionErr
+}
+
+// fetched is the data of a partition of a Fetch response.
+type fetched struct {
+	code          Error
+	highWatermark int64
+	records       []byte
+}
+
+// Limits of a fetch: it waits up to fetchWait for
+// data and returns up to fetchMaxBytes a partition.
+const (
+	fetchWait     = 500 * time.Millisecond
+	fetchMaxBytes = 1 << 20
+)
+
+func requestFetch(c *conn, topic string, offsets map[int32]int64) (map[int32]fetched, error) {
+	var e encoder
+	e.int32(-1) // replica_id
+	e.int32(int32(fetchWait / time.Millisecond))
+	e.int32(1) // min_bytes
+	e.int32(int32(len(offsets)) * fetchMaxBytes)
+	e.int8(0)   // isolation_level, read uncommitted
+	e.int32(0)  // session_id, no fetch session
+	e.int32(-1) // session_epoch
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(len(offsets))
+	for p, offset := range offsets {
+		e.int32(p)
+		e.int32(-1) // current_leader_epoch
+		e.int64(offset)
+		e.int64(-1) // log_start_offset
+		e.int32(fetchMaxBytes)
+	}
+	e.arrayLen(0) // forgotten_topics_data
+
+	d, err := c.request(apiFetch, e.buf, requestTimeout+fetchWait)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make(map[int32]fetched, len(offsets))
+
+	d.int32() // throttle_time_ms
+	code := d.errorCode()
+	d.int32() // session_id
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // topic
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			partition := d.int32()
+			f := fetched{code: d.errorCode(), highWatermark: d.int64()}
+			d.int64() // last_stable_offset
+			d.int64() // log_start_offset
+			for k, na := 0, d.arrayLen(); k < na; k++ {
+				d.int64() // producer_id
+				d.int64() // first_offset
+			}
+			f.records = d.bytes()
+			partitions[partition] = f
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err = code.err(); err != nil {
+		return nil, err
+	}
+	return partitions, nil
+}
@@ -0,0 +1,195 @@
+package kafka
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SASL mechanisms the consumer authenticates with.
+const (
+	MechanismPlain       = "PLAIN"
+	MechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	MechanismSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// authenticate authenticates the connection as the configured user.
+func authenticate(c *conn, cfg Config) error {
+	var e encoder
+	e.string(cfg.Mechanism)
+
+	d, err := c.request(apiSaslHandshake, e.buf, requestTimeout)
+	if err != nil {
+		return err
+	}
+	code := d.errorCode()
+	var mechanisms []string
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		mechanisms = append(mechanisms, d.string())
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if code == errUnsupportedSaslMechanism {
+		return fmt.Errorf("kafka: SASL mechanism %s isn't enabled, the brokers have %s", cfg.Mechanism, strings.Join(mechanisms, ", "))
+	}
+	if err = code.err(); err != nil {
+		return err
+	}
+
+	switch cfg.Mechanism {
+	case MechanismPlain:
+		_, err = saslAuthenticate(c, []byte("\x00"+cfg.User+"\x00"+cfg.Password))
+		return err
+	case MechanismSCRAMSHA256:
+		return authenticateSCRAM(c, &scram{hash: sha256.New, user: cfg.User, password: cfg.Password})
+	case MechanismSCRAMSHA512:
+		return authenticateSCRAM(c, &scram{hash: sha512.New, user: cfg.User, password: cfg.Password})
+	}
+	return fmt.Errorf("kafka: unsupported SASL mechanism %s", cfg.Mechanism)
+}
+
+// saslAuthenticate sends the authentication bytes of the
+// mechanism and returns those the broker answered.
+func saslAuthenticate(c *conn, auth []byte) ([]byte, error) {
+	var e encoder
+	e.bytes(auth)
+
+	d, err := c.request(apiSaslAuthenticate, e.buf, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	code := d.errorCode()
+	message := d.string()
+	auth = d.bytes()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if code != errNone && message != "" {
+		return nil, fmt.Errorf("%w: %s", code, message)
+	}
+	return auth, code.err()
+}
+
+func authenticateSCRAM(c *conn, s *scram) error {
+	serverFirst, err := saslAuthenticate(c, s.first())
+	if err != nil {
+		return err
+	}
+	final, err := s.final(serverFirst)
+	if err != nil {
+		return err
+	}
+	serverFinal, err := saslAuthenticate(c, final)
+	if err != nil {
+		return err
+	}
+	return s.verify(serverFinal)
+}
+
+var errSCRAM = errors.New("kafka: invalid SCRAM message")
+
+// scram is a client of the SCRAM exchange of RFC 5802,
+// without channel binding.
+type scram struct {
+	hash           func() hash.Hash
+	user, password string
+	nonce          string
+
+	firstBare   string
+	salted      []byte
+	authMessage string
+}
+
+// first returns the first message of the client.
+func (s *scram) first() []byte {
+	if s.nonce == "" {
+		var b [24]byte
+		rand.Read(b[:])
+		s.nonce = base64.RawStdEncoding.EncodeToString(b[:])
+	}
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.user)
+	s.firstBare = "n=" + user + ",r=" + s.nonce
+	return []byte("n,," + s.firstBare)
+}
+
+// final returns the final message of the client,
+// proving it knows the password salted by the server.
+func (s *scram) final(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttributes(serverFirst)
+	nonce, salt64, iterations := attrs["r"], attrs["s"], attrs["i"]
+
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return nil, errSCRAM
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, errSCRAM
+	}
+	i, err := strconv.Atoi(iterations)
+	if err != nil || i < 1 {
+		return nil, errSCRAM
+	}
+
+	if s.salted, err = pbkdf2.Key(s.hash, s.password, salt, i, s.hash().Size()); err != nil {
+		return nil, err
+	}
+
+	withoutProof := "c=biws,r=" + nonce // biws is n,, in base64
+	s.authMessage = s.firstBare + "," + string(serverFirst) + "," + withoutProof
+
+	clientKey := s.hmac(s.salted, "Client Key")
+	h := s.hash()
+	h.Write(clientKey)
+	signature := s.hmac(h.Sum(nil), s.authMessage)
+
+	proof := make([]byte, len(clientKey))
+	for j := range proof {
+		proof[j] = clientKey[j] ^ signature[j]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server knows the password too.
+func (s *scram) verify(serverFinal []byte) error {
+	attrs := scramAttributes(serverFinal)
+	if e, found := attrs["e"]; found {
+		return fmt.Errorf("kafka: SCRAM authentication failed: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return errSCRAM
+	}
+
+	serverKey := s.hmac(s.salted, "Server Key")
+	if !hmac.Equal(signature, s.hmac(serverKey, s.authMessage)) {
+		return errors.New("kafka: SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+func (s *scram) hmac(key []byte, message string) []byte {
+	mac := hmac.New(s.hash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramAttributes returns the attributes of a message by name.
+func scramAttributes(message []byte) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range bytes.Split(message, []byte(",")) {
+		if name, value, found := strings.Cut(string(attr), "="); found {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,123 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errSnappy = errors.New("kafka: corrupt snappy data")
+
+// xerialMagic starts the snappy records of the Java clients, framed
+// as a header followed by blocks, each prefixed with its size.
+var xerialMagic = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+
+// unsnappy decompresses snappy records, up to max bytes, either a
+// single block or blocks framed by the Java clients.
+func unsnappy(data []byte, max int) ([]byte, error) {
+	if !bytes.HasPrefix(data, xerialMagic) {
+		return snappyBlock(nil, data, max)
+	}
+	if len(data) < 16 {
+		return nil, errSnappy
+	}
+	data = data[16:] // magic, version and compatible version
+
+	var out []byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errSnappy
+		}
+		size := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint64(size) > uint64(len(data)) {
+			return nil, errSnappy
+		}
+
+		var err error
+		if out, err = snappyBlock(out, data[:size], max); err != nil {
+			return nil, err
+		}
+		data = data[size:]
+	}
+	return out, nil
+}
+
+// snappyBlock appends the decompressed block to out, which copies
+// can't reach before the block.
+func snappyBlock(out, block []byte, max int) ([]byte, error) {
+	length, n := binary.Uvarint(block)
+	if n <= 0 || length > uint64(max-len(out)) {
+		return nil, errSnappy
+	}
+	block = block[n:]
+
+	start := len(out)
+	end := start + int(length)
+
+	for len(block) > 0 {
+		tag := block[0]
+
+		var offset, copyLen int
+		switch tag & 3 {
+		case 0:
+			litLen := int(tag >> 2)
+			if litLen < 60 {
+				block = block[1:]
+			} else {
+				// The length follows in 1 to 4 bytes.
+				size := litLen - 59
+				if len(block) < 1+size {
+					return nil, errSnappy
+				}
+				litLen = 0
+				for i := size; i >= 1; i-- {
+					litLen = litLen<<8 | int(block[i])
+				}
+				block = block[1+size:]
+			}
+			litLen++
+			if litLen <= 0 || litLen > len(block) || litLen > end-len(out) {
+				return nil, errSnappy
+			}
+			out = append(out, block[:litLen]...)
+			block = block[litLen:]
+			continue
+		case 1:
+			if len(block) < 2 {
+				return nil, errSnappy
+			}
+			copyLen = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(block[1])
+			block = block[2:]
+		case 2:
+			if len(block) < 3 {
+				return nil, errSnappy
+			}
+			copyLen = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(block[1:]))
+			block = block[3:]
+		case 3:
+			if len(block) < 5 {
+				return nil, errSnappy
+			}
+			copyLen = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(block[1:]))
+			block = block[5:]
+		}
+
+		if offset <= 0 || offset > len(out)-start || copyLen > end-len(out) {
+			return nil, errSnappy
+		}
+		// Copies may overlap what they append.
+		from := len(out) - offset
+		for i := 0; i < copyLen; i++ {
+			out = append(out, out[from+i])
+		}
+	}
+
+	if len(out) != end {
+		return nil, errSnappy
+	}
+	return out, nil
+}
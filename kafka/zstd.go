@@ -0,0 +1,846 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+var errZstd = errors.New("kafka: corrupt zstd data")
+
+const (
+	zstdMagic     = 0xfd2fb528
+	zstdBlockSize = 128 << 10
+)
+
+// Kinds of the sequence tables of zstd blocks.
+const (
+	literalsTable = iota
+	offsetsTable
+	matchesTable
+)
+
+// Literal lengths and match lengths of their codes, plus a number
+// of bits read from the sequences.
+var (
+	literalsBase = [36]int{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512,
+		1024, 2048, 4096, 8192, 16384, 32768, 65536,
+	}
+	literalsBits = [36]int{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	}
+	matchesBase = [53]int{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515,
+		1027, 2051, 4099, 8195, 16387, 32771, 65539,
+	}
+	matchesBits = [53]int{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	}
+)
+
+// Largest accuracy logs and symbols of the sequence tables.
+var (
+	zstdMaxLog    = [3]int{9, 8, 9}
+	zstdMaxSymbol = [3]int{35, 31, 52}
+)
+
+// zstdPredefined are the sequence tables blocks may use
+// without describing them.
+var zstdPredefined = [3]fseTable{
+	mustFSETable([]int{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2,
+		2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1,
+	}, 6),
+	mustFSETable([]int{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1, -1,
+	}, 5),
+	mustFSETable([]int{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}, 6),
+}
+
+// unzstd decompresses zstd frames, which don't use dictionaries,
+// up to max bytes. Checksums aren't verified, the record batch
+// having its own.
+func unzstd(data []byte, max int) ([]byte, error) {
+	d := zstdDecoder{max: max}
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errZstd
+		}
+		magic := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+
+		var err error
+		switch {
+		case magic&0xfffffff0 == skippableMagic:
+			var ok bool
+			if data, ok = skipFrame(data); !ok {
+				return nil, errZstd
+			}
+		case magic == zstdMagic:
+			if data, err = d.frame(data); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errZstd
+		}
+	}
+
+	return d.out, nil
+}
+
+// zstdDecoder keeps what the blocks of a frame share.
+type zstdDecoder struct {
+	out   []byte
+	start int // of the frame in out
+	max   int
+
+	huffman huffmanTable
+	tables  [3]fseTable
+	repeats [3]int
+}
+
+// frame decodes the frame past its magic number,
+// and returns the data following it.
+func (d *zstdDecoder) frame(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errZstd
+	}
+	descriptor := data[0]
+	data = data[1:]
+
+	if descriptor&0x08 != 0 {
+		return nil, errZstd
+	}
+	singleSegment := descriptor&0x20 != 0
+	checksum := descriptor&0x04 != 0
+
+	if !singleSegment {
+		if len(data) < 1 {
+			return nil, errZstd
+		}
+		data = data[1:] // window descriptor
+	}
+
+	dictionary := []int{0, 1, 2, 4}[descriptor&0x03]
+	if len(data) < dictionary {
+		return nil, errZstd
+	}
+	for _, b := range data[:dictionary] {
+		if b != 0 {
+			return nil, errors.New("kafka: zstd dictionaries are unsupported")
+		}
+	}
+	data = data[dictionary:]
+
+	contentSize := []int{0, 2, 4, 8}[descriptor>>6]
+	if contentSize == 0 && singleSegment {
+		contentSize = 1
+	}
+	if len(data) < contentSize {
+		return nil, errZstd
+	}
+	data = data[contentSize:]
+
+	d.start = len(d.out)
+	d.huffman = huffmanTable{}
+	d.tables = [3]fseTable{}
+	d.repeats = [3]int{1, 4, 8}
+
+	for last := false; !last; {
+		if len(data) < 3 {
+			return nil, errZstd
+		}
+		header := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		data = data[3:]
+
+		last = header&1 != 0
+		size := header >> 3
+
+		switch header >> 1 & 3 {
+		case 0:
+			if len(data) < size || size > d.max-len(d.out) {
+				return nil, errZstd
+			}
+			d.out = append(d.out, data[:size]...)
+			data = data[size:]
+		case 1:
+			if len(data) < 1 || size > d.max-len(d.out) {
+				return nil, errZstd
+			}
+			d.out = append(d.out, bytes.Repeat(data[:1], size)...)
+			data = data[1:]
+		case 2:
+			if len(data) < size || size > zstdBlockSize {
+				return nil, errZstd
+			}
+			if err := d.block(data[:size]); err != nil {
+				return nil, err
+			}
+			data = data[size:]
+		default:
+			return nil, errZstd
+		}
+	}
+
+	if checksum {
+		if len(data) < 4 {
+			return nil, errZstd
+		}
+		data = data[4:]
+	}
+	return data, nil
+}
+
+// block decodes a compressed block.
+func (d *zstdDecoder) block(block []byte) error {
+	literals, block, err := d.literals(block)
+	if err != nil {
+		return err
+	}
+
+	if len(block) < 1 {
+		return errZstd
+	}
+	count := int(block[0])
+	block = block[1:]
+	switch {
+	case count == 0:
+		if len(literals) > d.max-len(d.out) {
+			return errZstd
+		}
+		d.out = append(d.out, literals...)
+		return nil
+	case count == 255:
+		if len(block) < 2 {
+			return errZstd
+		}
+		count = int(block[0]) + int(block[1])<<8 + 0x7f00
+		block = block[2:]
+	case count >= 128:
+		if len(block) < 1 {
+			return errZstd
+		}
+		count = (count-128)<<8 + int(block[0])
+		block = block[1:]
+	}
+
+	if len(block) < 1 {
+		return errZstd
+	}
+	modes := block[0]
+	block = block[1:]
+	if modes&0x03 != 0 {
+		return errZstd
+	}
+	for kind, shift := range []uint{6, 4, 2} {
+		n, err := d.table(kind, modes>>shift&3, block)
+		if err != nil {
+			return err
+		}
+		block = block[n:]
+	}
+
+	return d.sequences(block, literals, count)
+}
+
+// literals returns the literals section of the block,
+// along with the rest of the block.
+func (d *zstdDecoder) literals(block []byte) ([]byte, []byte, error) {
+	if len(block) < 1 {
+		return nil, nil, errZstd
+	}
+	kind := block[0] & 0x03
+	format := block[0] >> 2 & 0x03
+
+	// Raw and repeated literals.
+	if kind < 2 {
+		var size, header int
+		switch format {
+		case 1:
+			header = 2
+		case 3:
+			header = 3
+		default:
+			header = 1
+		}
+		if len(block) < header {
+			return nil, nil, errZstd
+		}
+		switch header {
+		case 1:
+			size = int(block[0] >> 3)
+		case 2:
+			size = int(block[0]>>4) | int(block[1])<<4
+		case 3:
+			size = int(block[0]>>4) | int(block[1])<<4 | int(block[2])<<12
+		}
+		block = block[header:]
+
+		if kind == 0 {
+			if len(block) < size {
+				return nil, nil, errZstd
+			}
+			return block[:size], block[size:], nil
+		}
+		if len(block) < 1 || size > zstdBlockSize {
+			return nil, nil, errZstd
+		}
+		return bytes.Repeat(block[:1], size), block[1:], nil
+	}
+
+	// Huffman coded literals, with or without their tree.
+	header, sizeBits, streams := 3, 10, 4
+	switch format {
+	case 0:
+		streams = 1
+	case 2:
+		header, sizeBits = 4, 14
+	case 3:
+		header, sizeBits = 5, 18
+	}
+	if len(block) < header {
+		return nil, nil, errZstd
+	}
+	var sizes uint64
+	for i := header - 1; i >= 0; i-- {
+		sizes = sizes<<8 | uint64(block[i])
+	}
+	mask := uint64(1)<<sizeBits - 1
+	size := int(sizes >> 4 & mask)
+	compressed := int(sizes >> (4 + sizeBits) & mask)
+	block = block[header:]
+
+	if len(block) < compressed || size > zstdBlockSize {
+		return nil, nil, errZstd
+	}
+	data, rest := block[:compressed], block[compressed:]
+
+	if kind == 2 {
+		table, n, err := readHuffmanTable(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.huffman = table
+		data = data[n:]
+	} else if d.huffman.entries == nil {
+		return nil, nil, errZstd
+	}
+
+	literals := make([]byte, 0, size)
+	if streams == 1 {
+		literals, err := d.huffman.decode(literals, data, size)
+		return literals, rest, err
+	}
+
+	if len(data) < 6 {
+		return nil, nil, errZstd
+	}
+	var lengths [4]int
+	lengths[3] = len(data) - 6
+	for i := 0; i < 3; i++ {
+		lengths[i] = int(binary.LittleEndian.Uint16(data[2*i:]))
+		lengths[3] -= lengths[i]
+	}
+	if lengths[3] < 0 {
+		return nil, nil, errZstd
+	}
+	data = data[6:]
+
+	quarter := (size + 3) / 4
+	if 3*quarter > size {
+		return nil, nil, errZstd
+	}
+	for i, length := range lengths {
+		n := quarter
+		if i == 3 {
+			n = size - 3*quarter
+		}
+		var err error
+		if literals, err = d.huffman.decode(literals, data[:length], n); err != nil {
+			return nil, nil, err
+		}
+		data = data[length:]
+	}
+	return literals, rest, nil
+}
+
+// table reads the sequence table of the kind in the mode,
+// and returns the size of its description.
+func (d *zstdDecoder) table(kind int, mode byte, data []byte) (int, error) {
+	switch mode {
+	case 0:
+		d.tables[kind] = zstdPredefined[kind]
+		return 0, nil
+	case 1:
+		if len(data) < 1 || int(data[0]) > zstdMaxSymbol[kind] {
+			return 0, errZstd
+		}
+		d.tables[kind] = fseTable{entries: []fseEntry{{symbol: data[0]}}}
+		return 1, nil
+	case 2:
+		table, n, err := readFSETable(data, zstdMaxLog[kind], zstdMaxSymbol[kind])
+		if err != nil {
+			return 0, err
+		}
+		d.tables[kind] = table
+		return n, nil
+	default:
+		// The table of the previous block.
+		if d.tables[kind].entries == nil {
+			return 0, errZstd
+		}
+		return 0, nil
+	}
+}
+
+// sequences executes the sequences of the block,
+// appending the literals and matches.
+func (d *zstdDecoder) sequences(data, literals []byte, count int) error {
+	r, err := newReverseBits(data)
+	if err != nil {
+		return err
+	}
+
+	literalsState := fseState{table: &d.tables[literalsTable]}
+	offsetsState := fseState{table: &d.tables[offsetsTable]}
+	matchesState := fseState{table: &d.tables[matchesTable]}
+	literalsState.init(&r)
+	offsetsState.init(&r)
+	matchesState.init(&r)
+
+	for i := 0; i < count; i++ {
+		offsetCode := int(offsetsState.symbol())
+		matchCode := int(matchesState.symbol())
+		literalCode := int(literalsState.symbol())
+		if offsetCode > 31 {
+			return errZstd
+		}
+
+		offset := 1<<offsetCode + int(r.read(offsetCode))
+		matchLen := matchesBase[matchCode] + int(r.read(matchesBits[matchCode]))
+		literalLen := literalsBase[literalCode] + int(r.read(literalsBits[literalCode]))
+
+		if offset > 3 {
+			offset -= 3
+			d.repeats = [3]int{offset, d.repeats[0], d.repeats[1]}
+		} else {
+			repeat := offset - 1
+			if literalLen == 0 {
+				repeat++
+			}
+			switch repeat {
+			case 0:
+				offset = d.repeats[0]
+			case 1:
+				offset = d.repeats[1]
+				d.repeats[1] = d.repeats[0]
+				d.repeats[0] = offset
+			default:
+				if repeat == 2 {
+					offset = d.repeats[2]
+				} else {
+					offset = d.repeats[0] - 1
+				}
+				d.repeats = [3]int{offset, d.repeats[0], d.repeats[1]}
+			}
+		}
+
+		if i < count-1 {
+			literalsState.update(&r)
+			matchesState.update(&r)
+			offsetsState.update(&r)
+		}
+		if r.overflowed() {
+			return errZstd
+		}
+
+		if literalLen > len(literals) || literalLen+matchLen > d.max-len(d.out) {
+			return errZstd
+		}
+		d.out = append(d.out, literals[:literalLen]...)
+		literals = literals[literalLen:]
+
+		if offset <= 0 || offset > len(d.out)-d.start {
+			return errZstd
+		}
+		// Matches may overlap what they append.
+		from := len(d.out) - offset
+		for j := 0; j < matchLen; j++ {
+			d.out = append(d.out, d.out[from+j])
+		}
+	}
+
+	if r.pos != 0 || len(literals) > d.max-len(d.out) {
+		return errZstd
+	}
+	d.out = append(d.out, literals...)
+	return nil
+}
+
+// fseTable decodes finite state entropy, the state
+// indexing its entries.
+type fseTable struct {
+	log     int
+	entries []fseEntry
+}
+
+type fseEntry struct {
+	symbol byte
+	bits   uint8
+	base   uint16
+}
+
+// readFSETable reads the description of a table, and returns the
+// table along with the size of the description.
+func readFSETable(data []byte, maxLog, maxSymbol int) (fseTable, int, error) {
+	f := forwardBits{data: data}
+
+	log := int(f.read(4)) + 5
+	if log > maxLog {
+		return fseTable{}, 0, errZstd
+	}
+
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	size := log + 1
+
+	var counts []int
+	previousZero := false
+	for remaining > 1 && len(counts) <= maxSymbol {
+		if previousZero {
+			// Zeros repeated 3 at a time, then the rest.
+			zeros := 0
+			for {
+				repeat := int(f.read(2))
+				zeros += repeat
+				if repeat != 3 {
+					break
+				}
+			}
+			if len(counts)+zeros > maxSymbol {
+				return fseTable{}, 0, errZstd
+			}
+			for ; zeros > 0; zeros-- {
+				counts = append(counts, 0)
+			}
+		}
+
+		max := 2*threshold - 1 - remaining
+		count := int(f.peek(size - 1))
+		if count < max {
+			f.pos += size - 1
+		} else {
+			count = int(f.peek(size))
+			if count >= threshold {
+				count -= max
+			}
+			f.pos += size
+		}
+		count-- // -1 for less than 1
+
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		counts = append(counts, count)
+		previousZero = count == 0
+
+		for remaining < threshold {
+			size--
+			threshold >>= 1
+		}
+	}
+
+	if remaining != 1 || f.pos > 8*len(data) {
+		return fseTable{}, 0, errZstd
+	}
+	table, err := buildFSETable(counts, log)
+	return table, (f.pos + 7) / 8, err
+}
+
+// buildFSETable spreads the symbols over the states by their
+// normalized counts, which add up to 1 << log.
+func buildFSETable(counts []int, log int) (fseTable, error) {
+	size := 1 << log
+	entries := make([]fseEntry, size)
+	next := make([]int, len(counts))
+
+	// Symbols of less than 1 take the last states.
+	high := size - 1
+	for symbol, count := range counts {
+		if count == -1 {
+			entries[high].symbol = byte(symbol)
+			high--
+			next[symbol] = 1
+		} else {
+			next[symbol] = count
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	position := 0
+	for symbol, count := range counts {
+		for i := 0; i < count; i++ {
+			entries[position].symbol = byte(symbol)
+			position = (position + step) & (size - 1)
+			for position > high {
+				position = (position + step) & (size - 1)
+			}
+		}
+	}
+	if position != 0 {
+		return fseTable{}, errZstd
+	}
+
+	for i := range entries {
+		n := next[entries[i].symbol]
+		next[entries[i].symbol]++
+		entries[i].bits = uint8(log + 1 - bits.Len(uint(n)))
+		entries[i].base = uint16(n<<entries[i].bits - size)
+	}
+
+	return fseTable{log: log, entries: entries}, nil
+}
+
+func mustFSETable(counts []int, log int) fseTable {
+	table, err := buildFSETable(counts, log)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+type fseState struct {
+	table *fseTable
+	state int
+}
+
+func (s *fseState) init(r *reverseBits) {
+	s.state = int(r.read(s.table.log))
+}
+
+func (s *fseState) symbol() byte {
+	return s.table.entries[s.state].symbol
+}
+
+func (s *fseState) update(r *reverseBits) {
+	e := s.table.entries[s.state]
+	s.state = int(e.base) + int(r.read(int(e.bits)))
+}
+
+// huffmanTable decodes literals, the next bits
+// indexing its entries.
+type huffmanTable struct {
+	log     int
+	entries []huffmanEntry
+}
+
+type huffmanEntry struct {
+	symbol byte
+	bits   uint8
+}
+
+// readHuffmanTable reads the description of a table, and returns
+// the table along with the size of the description.
+func readHuffmanTable(data []byte) (huffmanTable, int, error) {
+	if len(data) < 1 {
+		return huffmanTable{}, 0, errZstd
+	}
+	header := int(data[0])
+
+	var weights []byte
+	var n int
+	if header < 128 {
+		// Weights compressed with finite state entropy.
+		n = 1 + header
+		if len(data) < n {
+			return huffmanTable{}, 0, errZstd
+		}
+		var err error
+		if weights, err = huffmanWeights(data[1:n]); err != nil {
+			return huffmanTable{}, 0, err
+		}
+	} else {
+		// Weights of 4 bits.
+		count := header - 127
+		n = 1 + (count+1)/2
+		if len(data) < n {
+			return huffmanTable{}, 0, errZstd
+		}
+		weights = make([]byte, count)
+		for i := range weights {
+			if b := data[1+i/2]; i%2 == 0 {
+				weights[i] = b >> 4
+			} else {
+				weights[i] = b & 0x0f
+			}
+		}
+	}
+
+	table, err := buildHuffmanTable(weights)
+	return table, n, err
+}
+
+// huffmanWeights decodes weights compressed with two
+// interleaved states.
+func huffmanWeights(data []byte) ([]byte, error) {
+	table, n, err := readFSETable(data, 6, 255)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReverseBits(data[n:])
+	if err != nil {
+		return nil, err
+	}
+
+	states := [2]fseState{{table: &table}, {table: &table}}
+	states[0].init(&r)
+	states[1].init(&r)
+
+	var weights []byte
+	for i := 0; ; i ^= 1 {
+		if len(weights) > 254 {
+			return nil, errZstd
+		}
+		weights = append(weights, states[i].symbol())
+		states[i].update(&r)
+		if r.overflowed() {
+			return append(weights, states[i^1].symbol()), nil
+		}
+	}
+}
+
+// buildHuffmanTable builds the table of the weights of the symbols,
+// but the last one, whose weight completes a power of 2.
+func buildHuffmanTable(weights []byte) (huffmanTable, error) {
+	total := 0
+	for _, w := range weights {
+		if w > 11 {
+			return huffmanTable{}, errZstd
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return huffmanTable{}, errZstd
+	}
+
+	log := bits.Len(uint(total))
+	rest := 1<<log - total
+	if log > 11 || rest&(rest-1) != 0 {
+		return huffmanTable{}, errZstd
+	}
+	weights = append(weights, byte(bits.Len(uint(rest))))
+
+	// Lower weights, of longer codes, take the lower states.
+	entries := make([]huffmanEntry, 1<<log)
+	position := 0
+	for w := 1; w <= log; w++ {
+		for symbol, weight := range weights {
+			if int(weight) != w {
+				continue
+			}
+			e := huffmanEntry{symbol: byte(symbol), bits: uint8(log + 1 - w)}
+			for i := 0; i < 1<<(w-1); i++ {
+				entries[position] = e
+				position++
+			}
+		}
+	}
+
+	return huffmanTable{log: log, entries: entries}, nil
+}
+
+// decode appends the n symbols of the stream to out.
+func (t huffmanTable) decode(out, stream []byte, n int) ([]byte, error) {
+	r, err := newReverseBits(stream)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		e := t.entries[r.peek(t.log)]
+		out = append(out, e.symbol)
+		r.pos -= int(e.bits)
+	}
+	if r.pos != 0 {
+		return nil, errZstd
+	}
+	return out, nil
+}
+
+// reverseBits reads a stream from its end, past the padding which
+// ends with its highest bit set.
+type reverseBits struct {
+	data []byte
+	pos  int // bits left
+}
+
+func newReverseBits(data []byte) (reverseBits, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return reverseBits{}, errZstd
+	}
+	return reverseBits{
+		data: data,
+		pos:  8*(len(data)-1) + bits.Len8(data[len(data)-1]) - 1,
+	}, nil
+}
+
+// peek returns the next n bits, zeros past the start of the stream.
+func (r *reverseBits) peek(n int) uint64 {
+	var v uint64
+	for i := 1; i <= n; i++ {
+		v <<= 1
+		if p := r.pos - i; p >= 0 {
+			v |= uint64(r.data[p/8] >> (p % 8) & 1)
+		}
+	}
+	return v
+}
+
+func (r *reverseBits) read(n int) uint64 {
+	v := r.peek(n)
+	r.pos -= n
+	return v
+}
+
+func (r *reverseBits) overflowed() bool {
+	return r.pos < 0
+}
+
+// forwardBits reads a stream from its start, low bits first.
+type forwardBits struct {
+	data []byte
+	pos  int // bits read
+}
+
+func (f *forwardBits) peek(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		if p := f.pos + i; p/8 < len(f.data) {
+			v |= uint64(f.data[p/8]>>(p%8)&1) << i
+		}
+	}
+	return v
+}
+
+func (f *forwardBits) read(n int) uint64 {
+	v := f.peek(n)
+	f.pos += n
+	return v
+}
@@ -2,133 +2,153 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
-	"errors"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"hash/fnv"
 	"io"
-	"io/ioutil"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
 	dao "github.com/timothyclarke/http-request-broadcaster/dao"
-)
-
-const (
-	maxIdleConnections int = 100
-	requestTimeout     int = 5
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
 )
 
 var (
-	locker    sync.RWMutex
-	allCaches []dao.Cache
-
-	groups  = make(map[string]dao.Group)
-	clients = make(map[string]*http.Client)
-
-	commandLine   = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	port          = commandLine.Int("port", 8088, "Broadcaster port.")
-	httpsPort     = commandLine.Int("https-port", 8443, "Broadcaster https port.")
-	grCount       = commandLine.Int("goroutines", 8, "Job handling goroutines pool. Higher is not implicitly better!")
-	reqRetries    = commandLine.Int("retries", 1, "Request retry times against a cache - should the first attempt fail.")
-	cachesCfgFile = commandLine.String("cfg", "/caches.ini", "Path pointing to the caches configuration file.")
-	logFilePath   = commandLine.String("log-file", "", "Log file path.")
-	enforceStatus = commandLine.Bool("enforce", false, "Enforces the status code of a request to be the first encountered non-200 received from a cache. Disabled by default.")
-	enableLog     = commandLine.Bool("enable-log", false, "Switches logging on/off. Disabled by default.")
-	crtFile       = commandLine.String("crt", "", "CRT file used for HTTPS support.")
-	keyFile       = commandLine.String("key", "", "KEY file used for HTTPS support.")
-
-	jobChannel = make(chan *Job, 2<<12)
+	locker sync.RWMutex
+
+	commandLine      = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	port             = commandLine.Int("port", 8088, "Broadcaster port.")
+	httpsPort        = commandLine.Int("https-port", 8443, "Broadcaster https port.")
+	grCount          = commandLine.Int("goroutines", 1, "Job handling goroutines of every cache. Purges only reach a cache in order with a single one.")
+	maxConcurrency   = commandLine.Int("max-concurrency", 0, "Maximum number of requests in flight across all caches, those to caches of a higher priority being sent first once it's reached. Unbounded by default.")
+	reqRetries       = commandLine.Int("retries", 1, "Request retry times against a cache - should the first attempt fail.")
+	maxRetries       = commandLine.Int("max-retries", 10, "Maximum number of retries a broadcast may ask for with the X-Retries header, higher ones being clamped.")
+	retryBudget      = commandLine.Int("retry-budget", 0, "Maximum number of retries of all the requests of a broadcast, bounding the requests of broadcasts to many failing caches. Unbounded when 0.")
+	cacheDeadline    = commandLine.Duration("cache-deadline", 0, "Upper bound of the time spent on a cache by a broadcast, retries, their backoff and the fallback included. Unbounded by default.")
+	instanceID       = commandLine.String("instance-id", "", "Identifies the broadcaster in the X-Broadcaster header of its requests, to detect loops between broadcasters. Defaults to hostname:port.")
+	maxHops          = commandLine.Int("max-hops", 8, "Number of broadcasters a request may go through, listed by X-Broadcaster, before being rejected as caught in a loop. Unbounded when 0.")
+	retryUnsafe      = commandLine.Bool("retry-unsafe", false, "Retries failed requests of non-idempotent methods, such as POST, too. Only GET, HEAD, PUT, DELETE, PURGE and BAN are retried by default.")
+	cachesCfgFile    = commandLine.String("cfg", "/caches.ini", "Path pointing to the caches configuration file, INI or JSON if ending in .json, or http(s):// URL serving it in JSON.")
+	configPoll       = commandLine.Duration("config-poll", 0, "Interval at which -cfg is loaded again, the groups being reloaded when they changed. Disabled when 0.")
+	requireCaches    = commandLine.Bool("require-caches", false, "Refuses to start, or to reload, a configuration defining no caches, which is only warned about by default.")
+	logFilePath      = commandLine.String("log-file", "", "Log file path.")
+	broadcastTimeout = commandLine.Duration("broadcast-timeout", 0, "Upper bound of a whole broadcast, caches which haven't answered by then are reported as cancelled. Unbounded by default.")
+	maxReqTimeout    = commandLine.Duration("max-request-timeout", 30*time.Second, "Upper bound of the timeout a broadcast may set with X-Broadcast-Timeout, longer ones are clamped.")
+	enforceStatus    = commandLine.Bool("enforce", false, "Enforces the status code of a request to be the first encountered non-200 received from a cache. Disabled by default.")
+	statusPolicy     = commandLine.String("status-policy", "ok", "How the status code of a broadcast is derived from the caches: ok, first-error, all-ok, majority or worst. -enforce implies first-error.")
+	retryOnStatus    = statusCodesFlag("retry-on-status", "502,503,504", "Comma-separated statuses of the caches retried like connection failures, within -retries and -retry-budget, honouring their Retry-After. none to retry connection failures only. Groups may override them with retry_on_status.")
+	successCodes     = statusCodesFlag("success-codes", "200-299", "Comma-separated statuses of the caches counted as successes, e.g. 200-299,404 for caches answering 404 to the PURGE of objects they don't hold. Groups may override them with success_codes.")
+	enableLog        = commandLine.Bool("enable-log", false, "Switches logging on/off. Disabled by default.")
+	crtFile          = commandLine.String("crt", "", "CRT file used for HTTPS support.")
+	keyFile          = commandLine.String("key", "", "KEY file used for HTTPS support.")
+	serveHTTP        = commandLine.Bool("serve-http", false, "Keeps serving plain http on the http port next to https when crt and key are set.")
+	redirectHTTPS    = commandLine.Bool("redirect-https", false, "Redirects plain http requests on the http port to https when crt and key are set.")
+
+	connectTimeout        = commandLine.Duration("connect-timeout", 30*time.Second, "How long connecting to a cache may take.")
+	tlsHandshakeTimeout   = commandLine.Duration("tls-handshake-timeout", 10*time.Second, "How long the TLS handshake with a cache may take.")
+	responseHeaderTimeout = commandLine.Duration("response-header-timeout", 5*time.Second, "How long a cache may take to answer once the request is sent, until its response headers arrive.")
+	keepaliveProbe        = commandLine.Duration("keepalive-probe", 0, "Interval of the HEAD requests sent to every cache to keep its pooled connections from going stale, e.g. behind a firewall dropping idle connections. Disabled by default.")
+	dnsRefresh            = commandLine.Duration("dns-refresh", 30*time.Second, "Interval at which the SRV names of caches are resolved again, the caches following their targets.")
+	maxRedirects          = commandLine.Int("max-redirects", 0, "Number of redirects followed by requests to the caches. Redirects aren't followed by default.")
+	requestTimeout        = commandLine.Duration("request-timeout", 0, "Upper bound of a whole request to a cache, including reading its response. Unbounded by default.")
+	maxResponseBody       = commandLine.Int64("max-response-body", 4<<10, "Bytes of the response bodies of the caches read, their status being all that matters. Caches may set their own max_response_body.")
+	responseBodyTimeout   = commandLine.Duration("response-body-timeout", 5*time.Second, "How long reading the response body of a cache may take, the cache's status standing when it runs out.")
+
+	enqueueTimeout    = commandLine.Duration("enqueue-timeout", 0, "How long a broadcast may wait for room in the job queues before being rejected with a 503. Doesn't wait by default.")
+	queueFull         = commandLine.String("queue-full", "reject", "What a broadcast finding the job queues full does: reject it with a 503 once -enqueue-timeout passed, block until there's room or drop-oldest queued jobs.")
+	cacheQueueTimeout = commandLine.Duration("cache-queue-timeout", 10*time.Second, "How long a job may wait for its cache to process earlier jobs.")
+	rateLimit         = commandLine.Float64("rate-limit", 0, "Maximum number of broadcasts per second. Disabled when 0.")
+	rateBurst         = commandLine.Int("rate-burst", 0, "Number of broadcasts allowed to exceed the rate limit in a burst. Defaults to the rate limit.")
+	forwardHeaders    = commandLine.String("forward-headers", "", "Comma-separated allowlist of the incoming headers sent on to the caches, * for all. Forwards all headers by default.")
+	protectedPaths    = commandLine.String("protected-paths", "/,.*", "Comma-separated paths only broadcast with the X-Broadcast-Confirm: yes-i-mean-it header, e.g. wiping the caches. Empty to protect none.")
+	userAgent         = commandLine.String("user-agent", "broadcaster/"+version, "User-Agent of the requests sent to the caches. An incoming User-Agent is kept only if explicitly forwarded.")
+	maxBodySize       = commandLine.Int64("max-body-size", 1<<20, "Largest body of a broadcast sent on to the caches, in bytes. Unbounded when 0.")
+	batchMaxSize      = commandLine.Int("batch-max-size", 10000, "Maximum number of paths of a batch.")
+	batchConcurrency  = commandLine.Int("batch-concurrency", 8, "Number of paths of a batch broadcast at once.")
+	slowThreshold     = commandLine.Duration("slow-threshold", 2*time.Second, "Duration past which broadcasts and requests to caches are logged as slow. Caches may set their own slow_threshold.")
+	pathGroups        = commandLine.Bool("path-groups", false, "Lets requests name their group in their path, under -path-groups-prefix, for clients which can't set X-Group.")
+	pathTemplate      = commandLine.String("path-template", "", "Path broadcast to the caches, {path} and {query} standing for the path and query of the request, e.g. /invalidate{path}?{query}. The path of the request by default.")
+	pathGroupsPrefix  = commandLine.String("path-groups-prefix", "/_group/", "Path prefix of requests naming their group, /_group/edge/products/42 broadcasting /products/42 to edge.")
+	defaultGroup      = commandLine.String("default-group", "", "Group of the broadcasts which don't name theirs, all caches by default. Broadcasts naming the * group reach all caches regardless.")
+	dryRun            = commandLine.Bool("dry-run", false, "Reports what every broadcast would send to the caches without sending anything, e.g. for staging.")
+	resultWebhook     = commandLine.String("result-webhook", "", "URL posted the JSON result of every broadcast, once answered, e.g. for auditing. Disabled by default.")
+	webhookTimeout    = commandLine.Duration("result-webhook-timeout", 5*time.Second, "Timeout of the posts to -result-webhook.")
+	stateDir          = commandLine.String("state-dir", "", "Directory keeping the requests failed by the caches, to replay them once the caches are back. Disabled by default.")
+	replayMaxAge      = commandLine.Duration("replay-max-age", time.Hour, "Age past which failed requests aren't replayed any more, with -state-dir.")
+	deadLetterFile    = commandLine.String("dead-letter-file", "", "File appended the requests failed by the caches, after their retries, as JSON lines. Disabled by default.")
+	journalFile       = commandLine.String("journal-file", "", "Write-ahead log of the broadcasts, telling on startup which were cut short by a crash and which caches they reached. Disabled by default.")
+	journalSync       = commandLine.String("journal-sync", "periodic", "When the journal is synced to disk: always, on every write, periodic, every second, or never, leaving it to the system.")
+	journalMaxSize    = commandLine.Int64("journal-max-size", 64<<20, "Size of the journal, in bytes, past which it's rewritten with the incomplete broadcasts only.")
+	recoverMode       = commandLine.String("recover-mode", "report", "What becomes of the broadcasts left incomplete in the journal: report, listing them on /admin/recovery, or replay, sending them on startup to the caches they didn't reach.")
+	resultCacheTTL    = commandLine.Duration("result-cache-ttl", 0, "How long the results of GET broadcasts answer identical ones, with X-Cache: HIT, rather than sending them to the caches again. Disabled when 0.")
+	historySize       = commandLine.Int("history-size", 1000, "Number of broadcasts kept in memory for /admin/history, 0 disabling the history.")
+	pauseQueueSize    = commandLine.Int("pause-queue-size", 10000, "Number of broadcasts held while paused with /admin/pause?mode=queue, later ones being rejected.")
+
+	consulAddr  = commandLine.String("consul-addr", "", "Consul agent address. Defaults to $CONSUL_HTTP_ADDR or 127.0.0.1:8500.")
+	consulToken = commandLine.String("consul-token", "", "Consul ACL token. Defaults to $CONSUL_HTTP_TOKEN.")
+	consulDC    = commandLine.String("consul-dc", "", "Consul datacenter to query. Defaults to $CONSUL_DATACENTER or the agent's own datacenter.")
+	consulWait  = commandLine.Duration("consul-wait", 5*time.Minute, "Maximum duration of a consul blocking query.")
+
 	logChannel = make(chan []string, 2<<12)
 	sigChannel = make(chan os.Signal, 1)
 	hupChannel = make(chan os.Signal, 1)
 
 	logBuffer bytes.Buffer
 	logFile   *os.File
-
-	defaultLocalAddr = net.IPAddr{IP: net.IPv4zero}
 )
 
-func createHTTPClient() *http.Client {
-	d := &net.Dialer{
-		LocalAddr: &net.TCPAddr{IP: defaultLocalAddr.IP, Zone: defaultLocalAddr.Zone},
-		KeepAlive: 2 * time.Minute,
-		Timeout:   30 * time.Second,
-	}
-
-	client := &http.Client{
-		Transport: &http.Transport{
-			DisableCompression:  true,
-			Proxy:               http.ProxyFromEnvironment,
-			MaxIdleConnsPerHost: maxIdleConnections,
-			DisableKeepAlives:   false,
-			Dial:                d.Dial,
-		},
-		Timeout: time.Duration(requestTimeout) * time.Second,
+func sendToLogChannel(args ...string) {
+	if *enableLog {
+		select {
+		case logChannel <- args:
+		default:
+			// Broadcasts aren't held up by a slow log.
+			atomic.AddUint64(&droppedLogEntries, 1)
+		}
 	}
-
-	return client
-}
-
-type Job struct {
-	Cache  dao.Cache
-	Status chan int
-	Result chan []byte
-}
-
-func newJob(cache dao.Cache) *Job {
-	job := Job{}
-	job.Cache = cache
-	job.Result = make(chan []byte, 1)
-	job.Status = make(chan int, 1)
-	return &job
-}
-
-func hash(s string) string {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return fmt.Sprintf("%v", h.Sum32())
 }
 
-func sendToLogChannel(args ...string) {
-	if *enableLog {
-		logChannel <- args
+// reloadConfig loads the groups and reloads the broadcaster with
+// them, then the auth tokens. The current groups and tokens are
+// kept on errors, e.g. an empty configuration with -require-caches.
+func reloadConfig(b *broadcaster.Broadcaster, load func() ([]dao.Group, error)) error {
+	groupList, err := load()
+	if err != nil {
+		return err
+	}
+	if err = b.Reload(groupList); err != nil {
+		return err
 	}
+	return loadAuthTokens()
 }
 
 // notifySigHup spawns a goroutine which will keep
 // "listening" for hang-up signals. When such a signal
 // occurs the configuration is reloaded from disk.
-func notifySigHup() {
+func notifySigHup(b *broadcaster.Broadcaster) {
 	signal.Notify(hupChannel, syscall.SIGHUP)
 
 	go func() {
 		for range hupChannel {
 			sendToLogChannel("Sighup notification, reloading configuration.\n")
 
-			err := readConfiguredCaches()
-			if err != nil {
+			if err := reloadConfig(b, loadGroups); err != nil {
 				fmt.Println(err.Error())
-				os.Exit(1)
+				sendToLogChannel("ERROR Reloading the configuration failed, keeping the current one: ", err.Error(), "\n")
 			}
 
-			sendToLogChannel("Warming up connections.\n")
-
-			err = setUpHttpClients()
-
-			if err != nil {
-				fmt.Println(err.Error())
-				os.Exit(1)
+			if serverCerts != nil {
+				if err := serverCerts.reload(); err != nil {
+					sendToLogChannel("Reloading certificate failed, keeping the current one: ", err.Error(), "\n")
+				}
 			}
 		}
 	}()
@@ -141,12 +161,16 @@ func notifySigChannel() {
 
 	go func(f *os.File) {
 		<-sigChannel
+		stopSources(30 * time.Second)
+
 		if *enableLog {
 			if f != nil {
 				f.Close()
 			}
 		}
 
+		tracer.Shutdown()
+
 		fmt.Println("Broadcaster exited succesfully.")
 		os.Exit(0)
 	}(logFile)
@@ -184,233 +208,241 @@ func startLog() error {
 	return nil
 }
 
-func doRequest(cache dao.Cache) (int, error) {
-	locker.Lock()
-	client := clients[cache.Name]
-	locker.Unlock()
-
-	reqString := cache.Address + cache.Item
-	r, err := http.NewRequest(cache.Method, reqString, nil)
-
-	// Preserve the headers
-	for k, v := range cache.Headers {
-	  r.Header.Set(k,strings.Join(v," "))
+func startBroadcastServer(b *broadcaster.Broadcaster) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withCORS(requireAllowedSource(requireToken("broadcast", currentBroadcastTokens, guardBroadcast(b, b.Handler())))))
+	mux.HandleFunc("/metrics", requireToken("metrics", flagToken(metricsAuthToken), metrics.Handler))
+	mux.HandleFunc("/batch", withCORS(requireAllowedSource(requireToken("broadcast", currentBroadcastTokens, guardBroadcast(b, b.BatchHandler())))))
+	mux.HandleFunc("/admin/disable", requireToken("admin", flagToken(adminAuthToken), b.AdminStateHandler(true)))
+	mux.HandleFunc("/admin/enable", requireToken("admin", flagToken(adminAuthToken), b.AdminStateHandler(false)))
+	mux.HandleFunc("/admin/caches/", requireToken("admin", flagToken(adminAuthToken), b.AdminCacheStateHandler))
+	mux.HandleFunc("/admin/pause", requireToken("admin", flagToken(adminAuthToken), b.AdminPauseHandler(true)))
+	mux.HandleFunc("/admin/resume", requireToken("admin", flagToken(adminAuthToken), b.AdminPauseHandler(false)))
+	mux.HandleFunc("/admin/version", requireToken("admin", flagToken(adminAuthToken), versionHandler))
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/healthz", healthzHandler(b))
+	mux.HandleFunc("/admin/groups", requireToken("admin", flagToken(adminAuthToken), b.AdminGroupsHandler))
+	mux.HandleFunc("/admin/replay", requireToken("admin", flagToken(adminAuthToken), b.AdminReplayHandler))
+	mux.HandleFunc("/admin/recovery", requireToken("admin", flagToken(adminAuthToken), b.AdminRecoveryHandler))
+	mux.HandleFunc("/admin/history", requireToken("admin", flagToken(adminAuthToken), b.AdminHistoryHandler))
+	mux.HandleFunc("/admin/stats", requireToken("admin", flagToken(adminAuthToken), statsHandler(b)))
+	mux.HandleFunc("/debug/stats", requireToken("admin", flagToken(adminAuthToken), statsHandler(b)))
+	if *debug {
+		handleProfiles(mux, func(h http.HandlerFunc) http.HandlerFunc {
+			return requireToken("admin", flagToken(adminAuthToken), h)
+		})
 	}
-	// The "Host" header is the hardest
-	r.Header.Set("X-Host", cache.Headers.Get("Host"))
-	r.Host = cache.Headers.Get("Host")
 
-	if err != nil {
-		return http.StatusInternalServerError, err
+	var handler http.Handler = mux
+	grpcHandler := grpcAPI(b)
+	if *accessLogPath != "" {
+		accessLog, err := openAccessLog()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		handler = accessLog.wrap(handler)
+		grpcHandler = accessLog.wrap(grpcHandler)
 	}
 
-	resp, err := client.Do(r)
-
+	servers, err := broadcastServers(handler)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		fmt.Println(err)
+		os.Exit(1)
 	}
-
-	_, err = io.Copy(ioutil.Discard, resp.Body)
-
-	if err != nil {
-		return http.StatusInternalServerError, err
+	if *grpcPort > 0 {
+		servers = append(servers, grpcServer(grpcHandler))
 	}
 
-	resp.Body.Close()
-
-	return resp.StatusCode, err
+	if *idleShutdown > 0 {
+		go shutdownWhenIdle(*idleShutdown, servers...)
+	}
 
+	if err = runServers(servers); err != nil {
+		fmt.Println(err)
+	}
 }
 
-// jobWorker listens on the jobs channel and handles
-// any incoming job.
-func jobWorker(jobs <-chan *Job) {
-	for job := range jobs {
-		var out int
-		var err error
-
-		for i := 0; i <= *reqRetries; i++ {
-			out, err = doRequest(job.Cache)
-			if err == nil {
-				break
-			} else {
-				// TODO: still need to decide what to do here.
-				err = warmUpHttpClient(job.Cache)
-				if err != nil {
-					break
-				}
-			}
-		}
+// broadcastServers returns the servers of the broadcaster: an https
+// one if both crt and key are set, a plain http one otherwise or
+// next to it with -serve-http. With -redirect-https the http one
+// redirects to https instead.
+func broadcastServers(handler http.Handler) ([]*http.Server, error) {
+	var servers []*http.Server
 
+	if *crtFile != "" && *keyFile != "" {
+		var err error
+		serverCerts, err = newCertReloader(*crtFile, *keyFile)
 		if err != nil {
-			job.Result <- []byte(err.Error())
-			continue
+			return nil, err
 		}
-		job.Status <- out
-	}
-}
 
-// reqHandler handles any incoming http request. Its main purpose
-// is to distribute the request further to all required caches.
-func reqHandler(w http.ResponseWriter, r *http.Request) {
-
-	var (
-		groupName       string
-		reqId           string
-		broadcastCaches []dao.Cache
-		reqStatusCode   = http.StatusOK
-		respBody        = make(map[string]int)
-	)
-
-	for k, v := range r.Header {
-		if strings.ToLower(k) == "x-group" {
-			groupName = v[0]
-			break
+		servers = append(servers, &http.Server{
+			Addr:      ":" + strconv.Itoa(*httpsPort),
+			Handler:   handler,
+			TLSConfig: &tls.Config{GetCertificate: serverCerts.GetCertificate},
+		})
+
+		if *redirectHTTPS {
+			servers = append(servers, &http.Server{Addr: ":" + strconv.Itoa(*port), Handler: http.HandlerFunc(redirectToHTTPS)})
+			return servers, nil
 		}
-	}
 
-	//for k, v := range r.Header {
-	//  sendToLogChannel(reqId, " ", k, " : ", strings.Join(v," "), "\n")
-	//}
-
-	if groupName == "" {
-		broadcastCaches = allCaches
-	} else {
-		locker.Lock()
-		if _, found := groups[groupName]; !found {
-			var errText = fmt.Sprintf("Group %s not found.", groupName)
-			sendToLogChannel(errText)
-			http.Error(w, errText, http.StatusNotFound)
-			locker.Unlock()
-			return
+		if !*serveHTTP {
+			return servers, nil
 		}
-		broadcastCaches = groups[groupName].Caches
-		locker.Unlock()
 	}
 
-	var cacheCount = len(broadcastCaches)
+	servers = append(servers, &http.Server{Addr: ":" + strconv.Itoa(*port), Handler: handler})
 
-	if cacheCount == 0 {
-		sendToLogChannel("Group ", groupName, " has no configured caches.")
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-
-	var jobs = make([]*Job, cacheCount)
+	return servers, nil
+}
 
-	for idx, bc := range broadcastCaches {
-		bc.Method = r.Method
-		bc.Item = r.URL.Path
-		bc.Headers = r.Header
-		if len(r.Host) != 0 {
-			bc.Headers.Add("Host", r.Host)
-		}
+// runServers serves on all the servers until they're shut down. Should
+// any of them fail, the others are closed and its error is returned.
+func runServers(servers []*http.Server) error {
+	errs := make(chan error, len(servers))
 
-		job := newJob(bc)
-		jobs[idx] = job
-		jobChannel <- job
-	}
+	for _, server := range servers {
+		fmt.Fprintf(os.Stdout, "Broadcaster serving on %s...\n", strings.TrimPrefix(server.Addr, ":"))
 
-	if *enableLog {
-		reqId = hash(hash(time.Now().String()))
+		go func(server *http.Server) {
+			if server.TLSConfig != nil {
+				errs <- server.ListenAndServeTLS("", "")
+			} else {
+				errs <- server.ListenAndServe()
+			}
+		}(server)
 	}
 
-	for _, job := range jobs {
-
-		jobStatusCode := <-job.Status
-
-		if *enforceStatus && reqStatusCode == http.StatusOK {
-			reqStatusCode = jobStatusCode
+	var failure error
+	for range servers {
+		if err := <-errs; err != http.ErrServerClosed && failure == nil {
+			failure = err
+			for _, server := range servers {
+				server.Close()
+			}
 		}
-
-		respBody[job.Cache.Name] = jobStatusCode
-		sendToLogChannel(reqId, " ", r.Method, " ", job.Cache.Address, r.URL.Path, " ", "\n")
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(reqStatusCode)
-
-	out, _ := json.MarshalIndent(respBody, "", "  ")
-	w.Write(out)
+	return failure
 }
 
-func startBroadcastServer() {
-	http.HandleFunc("/", reqHandler)
-
-	if *crtFile != "" && *keyFile != "" {
-
-		_, err := os.Stat(*crtFile)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		_, err = os.Stat(*keyFile)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		fmt.Fprintf(os.Stdout, "Broadcaster serving on %s...\n", strconv.Itoa(*httpsPort))
-		fmt.Println(http.ListenAndServeTLS(":"+strconv.Itoa(*httpsPort), *crtFile, *keyFile, nil))
-
-	} else {
-		fmt.Fprintf(os.Stdout, "Broadcaster serving on %s...\n", strconv.Itoa(*port))
-		fmt.Println(http.ListenAndServe(":"+strconv.Itoa(*port), nil))
-
+// statusCodesFlag defines a flag of comma-separated status
+// codes and ranges of status codes.
+func statusCodesFlag(name, value, usage string) *dao.StatusCodes {
+	codes, err := dao.ParseStatusCodes(value)
+	if err != nil {
+		panic(err)
 	}
+	commandLine.TextVar(&codes, name, codes, usage)
+	return &codes
 }
 
-// setUpCaches reads the configured caches from the .ini file
-// and populates a map having group name as key and slice of caches
-// as values.
-func readConfiguredCaches() error {
-	locker.Lock()
-	defer locker.Unlock()
-
-	groupList, err := dao.LoadCachesFromIni(*cachesCfgFile)
-
-	for _, g := range groupList {
-		groups[g.Name] = g
-
-		for _, cache := range g.Caches {
-			_, err = url.Parse(cache.Address)
-
-			if err != nil {
-				return err
-			}
+// broadcasterConfig configures the broadcaster of
+// the groups from the command line.
+func broadcasterConfig(groupList []dao.Group) broadcaster.Config {
+	cfg := broadcaster.Config{
+		Groups:                groupList,
+		Workers:               *grCount,
+		MaxConcurrency:        *maxConcurrency,
+		Retries:               *reqRetries,
+		RetryBudget:           *retryBudget,
+		CacheDeadline:         *cacheDeadline,
+		MaxRetries:            *maxRetries,
+		SuccessCodes:          *successCodes,
+		RetryOnStatus:         *retryOnStatus,
+		RetryUnsafe:           *retryUnsafe,
+		ConnectTimeout:        *connectTimeout,
+		TLSHandshakeTimeout:   *tlsHandshakeTimeout,
+		ResponseHeaderTimeout: *responseHeaderTimeout,
+		MaxResponseBody:       *maxResponseBody,
+		ResponseBodyTimeout:   *responseBodyTimeout,
+		RequestTimeout:        *requestTimeout,
+		MaxRedirects:          *maxRedirects,
+		KeepaliveProbe:        *keepaliveProbe,
+		RequireCaches:         *requireCaches,
+		DNSRefresh:            *dnsRefresh,
+		BroadcastTimeout:      *broadcastTimeout,
+		MaxRequestTimeout:     *maxReqTimeout,
+		StatusPolicy:          effectiveStatusPolicy(),
+		EnqueueTimeout:        *enqueueTimeout,
+		CacheQueueTimeout:     *cacheQueueTimeout,
+		QueueFull:             *queueFull,
+		RateLimit:             *rateLimit,
+		RateBurst:             *rateBurst,
+		ForwardHeaders:        dao.SplitList(*forwardHeaders),
+		ProtectedPaths:        dao.SplitList(*protectedPaths),
+		UserAgent:             *userAgent,
+		PathTemplate:          *pathTemplate,
+		MaxBodySize:           *maxBodySize,
+		BatchMaxSize:          *batchMaxSize,
+		BatchConcurrency:      *batchConcurrency,
+		Consul: broadcaster.ConsulConfig{
+			Addr:       *consulAddr,
+			Token:      *consulToken,
+			Datacenter: *consulDC,
+			Wait:       *consulWait,
+		},
+		SlowThreshold:  *slowThreshold,
+		DryRun:         *dryRun,
+		ResultWebhook:  *resultWebhook,
+		WebhookTimeout: *webhookTimeout,
+		StateDir:       *stateDir,
+		ReplayMaxAge:   *replayMaxAge,
+		DeadLetterFile: *deadLetterFile,
+		JournalFile:    *journalFile,
+		JournalSync:    *journalSync,
+		JournalMaxSize: *journalMaxSize,
+		RecoverMode:    *recoverMode,
+		HistorySize:    *historySize,
+		ResultCacheTTL: *resultCacheTTL,
+		PauseQueueSize: *pauseQueueSize,
+		DefaultGroup:   *defaultGroup,
+		ClientIP:       clientIP,
+		TrustProxy:     *trustProxy,
+		Tracer:         tracer,
+		InstanceID:     currentInstanceID(),
+		MaxHops:        *maxHops,
+		Log:            sendToLogChannel,
+	}
 
-			allCaches = append(allCaches, cache)
-		}
+	if *pathGroups {
+		cfg.PathGroupsPrefix = *pathGroupsPrefix
 	}
 
-	return err
+	return cfg
 }
 
-func warmUpHttpClient(cache dao.Cache) error {
-	locker.Lock()
-	client := createHTTPClient()
-
-	clients[cache.Name] = client
-	defer locker.Unlock()
+// currentInstanceID returns the -instance-id of the broadcaster,
+// defaulting to its hostname and http port.
+func currentInstanceID() string {
+	if *instanceID != "" {
+		return *instanceID
+	}
 
-	return nil
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return hostname + ":" + strconv.Itoa(*port)
 }
 
-func setUpHttpClients() error {
-
-	for _, cache := range allCaches {
-		err := warmUpHttpClient(cache)
-		if err != nil {
-			return errors.New(fmt.Sprintf("* Cache [%s] encountered an error when warming up connections.\n    - %s\n", cache.Name, err.Error()))
-		}
+// effectiveStatusPolicy returns the configured policy, honouring
+// the older -enforce flag.
+func effectiveStatusPolicy() string {
+	if *enforceStatus && *statusPolicy == "ok" {
+		return "first-error"
 	}
-	return nil
+	return *statusPolicy
 }
 
 func main() {
 	var err error
 
-	runtime.GOMAXPROCS(runtime.NumCPU() - 1)
+	if len(os.Args) > 1 && os.Args[1] == "send" {
+		os.Exit(runSend(os.Args[2:], os.Stdout, os.Stderr))
+	}
 
 	commandLine.Usage = func() {
 		fmt.Fprint(os.Stdout, "Usage of the broadcaster:\n")
@@ -422,6 +454,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *showVersion {
+		fmt.Println(currentBuildInfo())
+		os.Exit(0)
+	}
+
+	if *validateOnly {
+		os.Exit(runValidate(os.Stdout))
+	}
+
 	if *enableLog {
 		err = startLog()
 		if err != nil {
@@ -432,14 +473,36 @@ func main() {
 		defer logFile.Close()
 	}
 
+	if *serveHTTP && *redirectHTTPS {
+		fmt.Println("Only one of -serve-http and -redirect-https can be set.")
+		os.Exit(1)
+	}
+
+	if err = loadAuthTokens(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if err = startTracing(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
 	if *cachesCfgFile == "" {
 		fmt.Println("No configuration file specified. Use the -cfg parameter to specify one.")
 		os.Exit(1)
 	}
 
+	fmt.Println("Starting", currentBuildInfo())
+	sendToLogChannel("Starting ", currentBuildInfo().String(), "\n")
+
+	procs := setMaxProcs()
+	fmt.Println("Running Go code on", procs, "CPUs (GOMAXPROCS).")
+	sendToLogChannel("Running Go code on ", strconv.Itoa(procs), " CPUs (GOMAXPROCS).\n")
+
 	fmt.Println("Loading configuration.")
 
-	err = readConfiguredCaches()
+	groupList, err := loadGroups()
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
@@ -447,19 +510,36 @@ func main() {
 
 	fmt.Println("Warming up connections.")
 
-	err = setUpHttpClients()
-
+	b, err := broadcaster.New(broadcasterConfig(groupList))
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
-	notifySigHup()
+	if b.Stats().Caches == 0 {
+		fmt.Println("WARNING: The configuration defines no caches, broadcasts will reach none. Use -require-caches to refuse to start.")
+	}
+
+	notifySigHup(b)
 	notifySigChannel()
+	pollConfig(b, groupList)
+
+	if err = startKafka(b); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if err = startNats(b); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
 
-	for i := 0; i < (*grCount); i++ {
-		go jobWorker(jobChannel)
+	if err = startRedis(b); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
 	}
 
-	startBroadcastServer()
+	startBroadcastServer(b)
+	stopSources(30 * time.Second)
+	tracer.Shutdown()
 }
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestEffectiveStatusPolicy(t *testing.T) {
+	defer func(enforce bool, policy string) { *enforceStatus, *statusPolicy = enforce, policy }(*enforceStatus, *statusPolicy)
+
+	*enforceStatus, *statusPolicy = true, "ok"
+	if got := effectiveStatusPolicy(); got != "first-error" {
+		t.Errorf("expected -enforce to imply first-error, got %s", got)
+	}
+
+	*statusPolicy = "worst"
+	if got := effectiveStatusPolicy(); got != "worst" {
+		t.Errorf("expected an explicit policy to win over -enforce, got %s", got)
+	}
+}
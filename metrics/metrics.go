@@ -0,0 +1,127 @@
+// Package metrics keeps the counters and gauges of the broadcaster
+// and exposes them in the prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Counter is a monotonically increasing metric, optionally
+// partitioned by the values of a single label.
+type Counter struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// Gauge is a metric whose current value is sampled
+// when the metrics are scraped.
+type Gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+var (
+	metricsLock sync.Mutex
+	counters    []*Counter
+	gauges      []*Gauge
+)
+
+func NewCounter(name, help, label string) *Counter {
+	c := &Counter{name: name, help: help, label: label, values: make(map[string]uint64)}
+
+	metricsLock.Lock()
+	counters = append(counters, c)
+	metricsLock.Unlock()
+
+	return c
+}
+
+// NewGauge registers a gauge, replacing any
+// earlier gauge of the same name.
+func NewGauge(name, help string, value func() float64) *Gauge {
+	g := &Gauge{name: name, help: help, value: value}
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	for i := range gauges {
+		if gauges[i].name == name {
+			gauges[i] = g
+			return g
+		}
+	}
+	gauges = append(gauges, g)
+
+	return g
+}
+
+// Inc increments the counter for the given label value. Unlabelled
+// counters are incremented with an empty label value.
+func (c *Counter) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+func (c *Counter) Add(labelValue string, n uint64) {
+	c.mu.Lock()
+	c.values[labelValue] += n
+	c.mu.Unlock()
+}
+
+func (c *Counter) Value(labelValue string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %d\n", c.name, c.values[""])
+		return
+	}
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, k, c.values[k])
+	}
+}
+
+func (g *Gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+// Handler exposes all metrics in the prometheus text format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	var out strings.Builder
+
+	metricsLock.Lock()
+	for _, c := range counters {
+		c.write(&out)
+	}
+	for _, g := range gauges {
+		g.write(&out)
+	}
+	metricsLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, out.String())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+	nats "github.com/timothyclarke/http-request-broadcaster/nats"
+)
+
+var (
+	natsURL     = commandLine.String("nats-url", "", "URL of the NATS server to subscribe to invalidations on, nats:// or tls://. Disabled by default.")
+	natsSubject = commandLine.String("nats-subject", "purge.>", "NATS subject of the invalidations, wildcards included. Its second token names the group.")
+	natsQueue   = commandLine.String("nats-queue", "", "NATS queue group the broadcasters share the invalidations in, rather than each receiving them all.")
+
+	natsMessages = metrics.NewCounter("broadcaster_nats_messages_total", "NATS messages received, by outcome: ok, failed, invalid or rejected.", "outcome")
+)
+
+// natsEvent returns the event of a message, whose subject's second token
+// names the group, e.g. purge.edge. The payload is either a JSON event or
+// a path, optionally preceded by the method.
+func natsEvent(subject string, payload []byte) (purgeEvent, error) {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) < 2 || tokens[1] == "" {
+		return purgeEvent{}, errors.New("subject has no group token")
+	}
+
+	var ev purgeEvent
+	payload = bytes.TrimSpace(payload)
+
+	if bytes.HasPrefix(payload, []byte("{")) {
+		var err error
+		if ev, err = parseEvent(payload); err != nil {
+			return ev, err
+		}
+	} else {
+		switch fields := strings.Fields(string(payload)); len(fields) {
+		case 1:
+			ev.Method, ev.Path = "PURGE", fields[0]
+		case 2:
+			ev.Method, ev.Path = fields[0], fields[1]
+		default:
+			return ev, errors.New("expected a path, optionally preceded by the method")
+		}
+		if !strings.HasPrefix(ev.Path, "/") {
+			return ev, errors.New("path must start with a /")
+		}
+	}
+
+	ev.Group = tokens[1]
+	return ev, nil
+}
+
+// handleNatsMessage broadcasts the event of a message, returning its outcome.
+func handleNatsMessage(ctx context.Context, b *broadcaster.Broadcaster, m nats.Msg) string {
+	ev, err := natsEvent(m.Subject, m.Data)
+	if err != nil {
+		sendToLogChannel("Invalid NATS event ", strconv.Quote(string(m.Data)), " on ", m.Subject, ": ", err.Error(), "\n")
+		return eventInvalid
+	}
+	return broadcastEvent(ctx, b, "NATS", ev)
+}
+
+// startNats subscribes to the invalidations of -nats-subject, when
+// -nats-url is set, broadcasting them as they come.
+func startNats(b *broadcaster.Broadcaster) error {
+	if *natsURL == "" {
+		return nil
+	}
+
+	subscriber, err := nats.NewSubscriber(nats.Config{
+		URL:     *natsURL,
+		Subject: *natsSubject,
+		Queue:   *natsQueue,
+		Name:    "broadcaster/" + version,
+		Log:     sendToLogChannel,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		subscriber.Run(ctx, func(m nats.Msg) {
+			natsMessages.Inc(handleNatsMessage(ctx, b, m))
+		})
+	}()
+
+	addSource(func() {
+		cancel()
+		<-done
+	})
+
+	return nil
+}
@@ -0,0 +1,330 @@
+// Package nats is a minimal subscriber to NATS subjects, speaking
+// the parts of the NATS client protocol it needs. It reconnects on
+// errors and unsubscribes when done.
+package nats
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retryDelay is how long the subscriber waits
+// before reconnecting after an error.
+var retryDelay = 2 * time.Second
+
+// Timeouts of connecting, including the handshake,
+// and of writing to the server.
+const (
+	connectTimeout = 10 * time.Second
+	writeTimeout   = 10 * time.Second
+	maxPayload     = 64 << 20
+)
+
+// Config configures a Subscriber.
+type Config struct {
+	// URL of the server, nats://[user:password@]host:port, or tls://
+	// for TLS. A user without password is taken as a token.
+	URL string
+
+	// Subject is subscribed to, wildcards included. Subscribers
+	// of the same Queue share its messages, each going to one.
+	Subject string
+	Queue   string
+
+	// Name identifies the connection to the server.
+	Name string
+
+	// Log receives the errors the subscriber
+	// recovers from by reconnecting, when set.
+	Log func(args ...string)
+}
+
+// Msg is a message published to the subject.
+type Msg struct {
+	Subject string
+	Data    []byte
+}
+
+// Subscriber receives the messages of a subject.
+type Subscriber struct {
+	cfg  Config
+	addr string
+	tls  bool
+	auth map[string]string
+}
+
+// NewSubscriber returns a subscriber of the configured subject.
+func NewSubscriber(cfg Config) (*Subscriber, error) {
+	if cfg.URL == "" || cfg.Subject == "" {
+		return nil, errors.New("nats: url and subject are required")
+	}
+	if strings.ContainsAny(cfg.Subject, " \t\r\n") || strings.ContainsAny(cfg.Queue, " \t\r\n") {
+		return nil, fmt.Errorf("nats: invalid subject %q", cfg.Subject)
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Subscriber{cfg: cfg, addr: u.Host, auth: make(map[string]string)}
+
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		s.tls = true
+	default:
+		return nil, fmt.Errorf("nats: unsupported scheme %q, expected nats or tls", u.Scheme)
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			s.auth["user"], s.auth["pass"] = u.User.Username(), password
+		} else {
+			s.auth["auth_token"] = u.User.Username()
+		}
+	}
+
+	return s, nil
+}
+
+// Run receives the messages of the subject until the context is done,
+// handing them to handle one at a time, in order. It reconnects after
+// errors, and unsubscribes once the context is done, the messages
+// already received being handled before it returns.
+func (s *Subscriber) Run(ctx context.Context, handle func(Msg)) {
+	for ctx.Err() == nil {
+		err := s.session(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.log("NATS subscriber of ", s.cfg.Subject, " reconnecting in ", retryDelay.String(), ": ", err.Error(), "\n")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+func (s *Subscriber) log(args ...string) {
+	if s.cfg.Log != nil {
+		s.cfg.Log(args...)
+	}
+}
+
+// conn is a connection to the server, serializing writes.
+type conn struct {
+	mu sync.Mutex
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func (c *conn) write(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := io.WriteString(c.nc, line)
+	return err
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// serverInfo is the part of the INFO of the server the subscriber uses.
+type serverInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// connect connects and authenticates to the server.
+func (s *Subscriber) connect(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: connectTimeout}
+	nc, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(connectTimeout))
+
+	c := &conn{nc: nc, r: bufio.NewReader(nc)}
+
+	line, err := c.readLine()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		nc.Close()
+		return nil, fmt.Errorf("nats: unexpected greeting %q", line)
+	}
+
+	var info serverInfo
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if s.tls || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(s.addr)
+		tc := tls.Client(nc, &tls.Config{ServerName: host})
+		if err = tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		c.nc, c.r = tc, bufio.NewReader(tc)
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"lang":     "go",
+		"version":  "0",
+		"protocol": 1,
+		"name":     s.cfg.Name,
+	}
+	for k, v := range s.auth {
+		options[k] = v
+	}
+	connect, _ := json.Marshal(options)
+
+	// The PONG confirms the server accepted the connection,
+	// which otherwise answers with an -ERR.
+	if err = c.write("CONNECT " + string(connect) + "\r\nPING\r\n"); err != nil {
+		c.nc.Close()
+		return nil, err
+	}
+	for {
+		if line, err = c.readLine(); err != nil {
+			c.nc.Close()
+			return nil, err
+		}
+		switch {
+		case line == "PONG":
+			c.nc.SetDeadline(time.Time{})
+			return c, nil
+		case strings.HasPrefix(line, "-ERR"):
+			c.nc.Close()
+			return nil, fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// session subscribes on a new connection, until an
+// error or the context being done.
+func (s *Subscriber) session(ctx context.Context, handle func(Msg)) error {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	sub := "SUB " + s.cfg.Subject
+	if s.cfg.Queue != "" {
+		sub += " " + s.cfg.Queue
+	}
+	if err = c.write(sub + " 1\r\n"); err != nil {
+		c.nc.Close()
+		return err
+	}
+
+	// Messages are handled aside, so that the server's
+	// PINGs are answered during long broadcasts.
+	msgs := make(chan Msg, 1024)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		for m := range msgs {
+			handle(m)
+		}
+	}()
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- s.read(c, msgs)
+	}()
+
+	select {
+	case err = <-readErr:
+	case <-ctx.Done():
+		// The server confirms the unsubscription with the PONG, the
+		// messages it sent before being received by then.
+		c.write("UNSUB 1\r\nPING\r\n")
+		select {
+		case <-readErr:
+		case <-time.After(writeTimeout):
+			c.nc.Close()
+			<-readErr
+		}
+	}
+
+	c.nc.Close()
+	close(msgs)
+	<-handled
+	return err
+}
+
+// read receives the messages of the connection until an error
+// or the PONG of an unsubscription.
+func (s *Subscriber) read(c *conn, msgs chan<- Msg) error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+
+		op := line
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			op = line[:i]
+		}
+
+		switch strings.ToUpper(op) {
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <size>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || len(fields) > 5 {
+				return fmt.Errorf("nats: invalid message %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 || size > maxPayload {
+				return fmt.Errorf("nats: invalid message %q", line)
+			}
+			data := make([]byte, size+2)
+			if _, err = io.ReadFull(c.r, data); err != nil {
+				return err
+			}
+			msgs <- Msg{Subject: fields[1], Data: data[:size]}
+		case "PING":
+			if err = c.write("PONG\r\n"); err != nil {
+				return err
+			}
+		case "PONG":
+			// The answer to the PING of an unsubscription.
+			return nil
+		case "-ERR":
+			s.log("NATS subscriber of ", s.cfg.Subject, ": ", line, "\n")
+		case "INFO", "+OK":
+		default:
+			return fmt.Errorf("nats: unexpected %q", line)
+		}
+	}
+}
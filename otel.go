@@ -0,0 +1,22 @@
+package main
+
+import (
+	tracing "github.com/timothyclarke/http-request-broadcaster/tracing"
+)
+
+var (
+	otelEndpoint    = commandLine.String("otel-endpoint", "", "OTLP/HTTP endpoint of an OpenTelemetry collector to export traces to, e.g. http://localhost:4318. Tracing is disabled by default.")
+	otelServiceName = commandLine.String("otel-service-name", "broadcaster", "Service name of the exported traces.")
+
+	// tracer traces the broadcasts, nil
+	// when tracing is disabled.
+	tracer *tracing.Tracer
+)
+
+// startTracing sets up the tracer of the broadcasts
+// when an OTLP endpoint is configured.
+func startTracing() error {
+	var err error
+	tracer, err = tracing.New(*otelEndpoint, *otelServiceName)
+	return err
+}
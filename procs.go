@@ -0,0 +1,17 @@
+package main
+
+import (
+	"runtime"
+)
+
+var gomaxprocs = commandLine.Int("gomaxprocs", 0, "Caps the number of CPUs running Go code at once. Defaults to the runtime's, which follows the CPU quota of the container.")
+
+// setMaxProcs sets GOMAXPROCS to -gomaxprocs when set, leaving the
+// runtime's default, or $GOMAXPROCS, alone otherwise. It returns the
+// effective value.
+func setMaxProcs() int {
+	if *gomaxprocs > 0 {
+		runtime.GOMAXPROCS(*gomaxprocs)
+	}
+	return runtime.GOMAXPROCS(0)
+}
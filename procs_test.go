@@ -0,0 +1,21 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestSetMaxProcs(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	defer func(n int) { *gomaxprocs = n }(*gomaxprocs)
+
+	*gomaxprocs = 0
+	if got := setMaxProcs(); got != runtime.GOMAXPROCS(0) {
+		t.Errorf("expected the runtime's default, got %d", got)
+	}
+
+	*gomaxprocs = 1
+	if got := setMaxProcs(); got != 1 {
+		t.Errorf("expected -gomaxprocs to be applied, got %d", got)
+	}
+}
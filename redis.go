@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	metrics "github.com/timothyclarke/http-request-broadcaster/metrics"
+	redis "github.com/timothyclarke/http-request-broadcaster/redis"
+)
+
+var (
+	redisURL     = commandLine.String("redis-url", "", "URL of the Redis server to subscribe to purge events on, redis:// or rediss://. Disabled by default.")
+	redisChannel = commandLine.String("redis-channel", "purges", "Redis pub/sub channel of the purge events.")
+
+	redisMessages = metrics.NewCounter("broadcaster_redis_messages_total", "Redis messages received, by outcome: ok, failed, invalid or rejected.", "outcome")
+)
+
+// startRedis subscribes to the purge events of -redis-channel, when
+// -redis-url is set, broadcasting them one at a time as they come.
+func startRedis(b *broadcaster.Broadcaster) error {
+	if *redisURL == "" {
+		return nil
+	}
+
+	subscriber, err := redis.NewSubscriber(redis.Config{
+		URL:     *redisURL,
+		Channel: *redisChannel,
+		Log:     sendToLogChannel,
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics.NewGauge("broadcaster_redis_subscribed", "Whether the broadcaster is subscribed to the Redis channel, 1, or reconnecting, 0.", func() float64 {
+		if subscriber.Subscribed() {
+			return 1
+		}
+		return 0
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Messages are read once the previous one was broadcast,
+		// so that a flood of them waits in Redis rather than here.
+		subscriber.Run(ctx, func(m redis.Message) {
+			redisMessages.Inc(handleEvent(ctx, b, "Redis", m.Payload))
+		})
+	}()
+
+	addSource(func() {
+		cancel()
+		<-done
+	})
+
+	return nil
+}
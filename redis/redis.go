@@ -0,0 +1,308 @@
+// Package redis is a minimal subscriber to a Redis pub/sub channel,
+// speaking the parts of RESP it needs. It reconnects with backoff on
+// errors and unsubscribes when done.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Delays between reconnections, doubling from minRetryDelay
+// up to maxRetryDelay while connecting fails.
+var (
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+const (
+	timeout     = 10 * time.Second
+	maxBulkSize = 64 << 20
+)
+
+var errProtocol = errors.New("redis: protocol error")
+
+// Config configures a Subscriber.
+type Config struct {
+	// URL of the server, redis://[[user]:password@]host:port,
+	// or rediss:// for TLS.
+	URL string
+
+	// Channel is subscribed to.
+	Channel string
+
+	// Log receives the errors the subscriber
+	// recovers from by reconnecting, when set.
+	Log func(args ...string)
+}
+
+// Message is a message published to the channel.
+type Message struct {
+	Channel string
+	Payload []byte
+}
+
+// Subscriber receives the messages of a channel.
+type Subscriber struct {
+	cfg        Config
+	addr       string
+	tls        bool
+	auth       []string
+	subscribed int32
+}
+
+// NewSubscriber returns a subscriber of the configured channel.
+func NewSubscriber(cfg Config) (*Subscriber, error) {
+	if cfg.URL == "" || cfg.Channel == "" {
+		return nil, errors.New("redis: url and channel are required")
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Subscriber{cfg: cfg, addr: u.Host}
+
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		s.tls = true
+	default:
+		return nil, fmt.Errorf("redis: unsupported scheme %q, expected redis or rediss", u.Scheme)
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			if u.User.Username() != "" {
+				s.auth = []string{"AUTH", u.User.Username(), password}
+			} else {
+				s.auth = []string{"AUTH", password}
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Subscribed tells whether the subscriber is currently subscribed.
+func (s *Subscriber) Subscribed() bool {
+	return atomic.LoadInt32(&s.subscribed) == 1
+}
+
+// Run receives the messages of the channel until the context is done,
+// handing them to handle as they are read. Messages aren't read while
+// one is handled, Redis buffering them meanwhile. Run reconnects after
+// errors, and unsubscribes once the context is done, the message being
+// handled then completing before it returns.
+func (s *Subscriber) Run(ctx context.Context, handle func(Message)) {
+	delay := minRetryDelay
+
+	for ctx.Err() == nil {
+		subscribed, err := s.session(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		if subscribed {
+			delay = minRetryDelay
+		}
+
+		s.log("Redis subscriber of ", s.cfg.Channel, " reconnecting in ", delay.String(), ": ", err.Error(), "\n")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (s *Subscriber) log(args ...string) {
+	if s.cfg.Log != nil {
+		s.cfg.Log(args...)
+	}
+}
+
+// conn is a connection to the server.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// command sends a command, as an array of bulk strings.
+func (c *conn) command(args ...string) error {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+
+	c.nc.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := io.WriteString(c.nc, b.String())
+	return err
+}
+
+// read reads a reply: a string, bulk strings being
+// read as []byte, an int64, an error or an array.
+func (c *conn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errProtocol
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return errors.New("redis: " + line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxBulkSize {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		var values []interface{}
+		for i := 0; i < n; i++ {
+			v, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	return nil, errProtocol
+}
+
+// connect connects and authenticates to the server.
+func (s *Subscriber) connect(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	nc, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.tls {
+		host, _, _ := net.SplitHostPort(s.addr)
+		tc := tls.Client(nc, &tls.Config{ServerName: host})
+		if err = tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	c := &conn{nc: nc, r: bufio.NewReader(nc)}
+
+	if s.auth != nil {
+		nc.SetReadDeadline(time.Now().Add(timeout))
+		if err = c.command(s.auth...); err == nil {
+			var reply interface{}
+			if reply, err = c.read(); err == nil {
+				err, _ = reply.(error)
+			}
+		}
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// session subscribes on a new connection, until an error or the
+// context being done, telling whether it was subscribed.
+func (s *Subscriber) session(ctx context.Context, handle func(Message)) (bool, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.nc.Close()
+
+	if err = c.command("SUBSCRIBE", s.cfg.Channel); err != nil {
+		return false, err
+	}
+
+	// Reads are interrupted once the context is done, after
+	// unsubscribing, without waiting for the confirmation
+	// as messages may still come before it.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.command("UNSUBSCRIBE", s.cfg.Channel)
+			c.nc.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	subscribed := false
+	defer atomic.StoreInt32(&s.subscribed, 0)
+
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return subscribed, err
+		}
+
+		values, _ := reply.([]interface{})
+		if len(values) != 3 {
+			if err, ok := reply.(error); ok {
+				return subscribed, err
+			}
+			return subscribed, errProtocol
+		}
+		kind, _ := values[0].([]byte)
+		channel, _ := values[1].([]byte)
+
+		switch string(kind) {
+		case "subscribe":
+			subscribed = true
+			atomic.StoreInt32(&s.subscribed, 1)
+		case "message":
+			payload, _ := values[2].([]byte)
+			if ctx.Err() == nil {
+				handle(Message{Channel: string(channel), Payload: payload})
+			}
+		case "unsubscribe":
+			return subscribed, errors.New("redis: unsubscribed")
+		}
+	}
+}
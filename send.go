@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+// runSend implements the send subcommand, broadcasting a single path
+// without starting the server:
+//
+//	broadcaster send -cfg caches.ini -group edge -method PURGE /products/42
+//
+// It takes the flags of the server along with its own, and returns
+// the exit code: 1 if the broadcast failed as decided by the status
+// policy, 2 for invalid arguments.
+func runSend(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	group := flags.String("group", "", "Group to broadcast to. All caches by default.")
+	method := flags.String("method", "PURGE", "Method of the broadcast.")
+	host := flags.String("host", "", "Host header sent to the caches.")
+	asJSON := flags.Bool("json", false, "Prints the results as JSON.")
+	confirm := flags.Bool("confirm", false, "Confirms the broadcast of a protected path, see -protected-paths.")
+
+	commandLine.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+
+	flags.Usage = func() {
+		fmt.Fprint(stderr, "Usage: broadcaster send [flags] <path>\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	groupList, err := dao.LoadCaches(*cachesCfgFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 2
+	}
+
+	if err = startTracing(); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 2
+	}
+	defer tracer.Shutdown()
+
+	cfg := broadcasterConfig(groupList)
+	cfg.Log = nil
+
+	// A one-shot broadcast has nobody to report failures to but
+	// its exit code, all caches have to succeed unless a status
+	// policy is asked for.
+	explicitPolicy := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "status-policy" || f.Name == "enforce" {
+			explicitPolicy = true
+		}
+	})
+	if !explicitPolicy {
+		cfg.StatusPolicy = "all-ok"
+	}
+
+	b, err := broadcaster.New(cfg)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 2
+	}
+	defer b.Close()
+
+	header := http.Header{}
+	if *confirm {
+		header.Set("X-Broadcast-Confirm", "yes-i-mean-it")
+	}
+
+	res, err := b.Broadcast(context.Background(), broadcaster.Request{
+		Method:  *method,
+		Path:    flags.Arg(0),
+		Group:   *group,
+		Header:  header,
+		Host:    *host,
+		Verbose: true,
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(res.Caches, "", "  ")
+		fmt.Fprintln(stdout, string(out))
+	} else {
+		printResults(stdout, res.Caches)
+	}
+
+	if res.Status < 200 || res.Status >= 300 {
+		return 1
+	}
+	return 0
+}
+
+// printResults writes a line per cache, in the
+// order of their names.
+func printResults(w io.Writer, results map[string]broadcaster.Result) {
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		r := results[name]
+
+		status := "-"
+		if r.Status != 0 {
+			status = strconv.Itoa(r.Status)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s", name, status, r.URL)
+		if r.Reason != "" {
+			fmt.Fprintf(tw, "\t%s", r.Reason)
+		}
+		if r.Error != "" {
+			fmt.Fprintf(tw, ": %s", r.Error)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+)
+
+func TestSendSubcommand(t *testing.T) {
+	defer func(cfg, policy string) { *cachesCfgFile, *statusPolicy = cfg, policy }(*cachesCfgFile, *statusPolicy)
+
+	seen := make(chan string, 4)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Method + " " + r.URL.Path
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	cfg := filepath.Join(t.TempDir(), "caches.ini")
+	ini := "[edge]\nc1 = \"" + ok.URL + "\"\n\n[shield]\nc2 = \"" + failing.URL + "\"\n"
+	if err := ioutil.WriteFile(cfg, []byte(ini), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := runSend(append([]string{"-cfg", cfg}, args...), &stdout, &stderr)
+		return code, stdout.String() + stderr.String()
+	}
+
+	code, out := send("-group", "edge", "-method", "BAN", "/products/42")
+	if code != 0 {
+		t.Fatalf("expected the broadcast to succeed, got %d: %s", code, out)
+	}
+	if s := <-seen; s != "BAN /products/42" {
+		t.Errorf("unexpected cache request %q", s)
+	}
+	if !strings.HasPrefix(out, "c1") || !strings.Contains(out, "200") {
+		t.Errorf("expected the result of c1 to be printed, got %q", out)
+	}
+
+	code, out = send("-json", "/products/42")
+	if code != 1 {
+		t.Errorf("expected a failing cache to fail the broadcast, got %d", code)
+	}
+	<-seen
+
+	var results map[string]broadcaster.Result
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatalf("expected JSON results, got %q", out)
+	}
+	if results["c1"].Status != http.StatusOK || results["c2"].Status != http.StatusInternalServerError {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	if code, _ = send("-status-policy", "ok", "/products/42"); code != 0 {
+		t.Errorf("expected the ok policy to ignore the failing cache, got %d", code)
+	}
+	<-seen
+
+	if code, _ = send("-group", "edge"); code != 2 {
+		t.Errorf("expected a missing path to be rejected, got %d", code)
+	}
+	if code, _ = send("-group", "unknown", "/"); code != 1 {
+		t.Errorf("expected an unknown group to fail, got %d", code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+)
+
+var (
+	debug = commandLine.Bool("debug", false, "Serves the net/http/pprof profiles under /debug/pprof/, behind the admin token.")
+
+	// droppedLogEntries counts the log entries dropped
+	// because the log couldn't keep up.
+	droppedLogEntries uint64
+)
+
+type debugStats struct {
+	broadcaster.Stats
+	DroppedLogEntries uint64 `json:"dropped_log_entries"`
+	Uptime            string `json:"uptime"`
+	GOMAXPROCS        int    `json:"gomaxprocs"`
+}
+
+// statsHandler serves /admin/stats and /debug/stats, a cheap
+// look into the broadcaster for when prometheus isn't at hand.
+func statsHandler(b *broadcaster.Broadcaster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out, _ := json.MarshalIndent(debugStats{
+			Stats:             b.Stats(),
+			DroppedLogEntries: atomic.LoadUint64(&droppedLogEntries),
+			Uptime:            time.Since(startTime).Round(time.Second).String(),
+			GOMAXPROCS:        runtime.GOMAXPROCS(0),
+		}, "", "  ")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+}
+
+// healthStatus is the verbose answer of /healthz.
+type healthStatus struct {
+	Status          string `json:"status"`
+	Paused          bool   `json:"paused"`
+	PauseMode       string `json:"pause_mode,omitempty"`
+	HeldBroadcasts  int    `json:"held_broadcasts"`
+	LastReloadError string `json:"last_reload_error,omitempty"`
+	Uptime          string `json:"uptime"`
+}
+
+// healthzHandler serves /healthz, answering OK as long as the
+// broadcaster runs, paused or not, for load balancers and probes.
+// ?verbose=1 details its state as JSON.
+func healthzHandler(b *broadcaster.Broadcaster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("verbose") == "" {
+			io.WriteString(w, "OK\n")
+			return
+		}
+
+		stats := b.Stats()
+		status := healthStatus{
+			Status:          "ok",
+			Paused:          stats.PauseMode != "",
+			PauseMode:       stats.PauseMode,
+			HeldBroadcasts:  stats.HeldBroadcasts,
+			LastReloadError: stats.LastReloadError,
+			Uptime:          time.Since(startTime).Round(time.Second).String(),
+		}
+		if status.Paused {
+			status.Status = "paused"
+		}
+
+		out, _ := json.MarshalIndent(status, "", "  ")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+}
+
+// handleProfiles serves the profiles of net/http/pprof
+// on the mux, each guarded by the given wrapper.
+func handleProfiles(mux *http.ServeMux, guard func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("/debug/pprof/", guard(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", guard(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", guard(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", guard(pprof.Trace))
+}
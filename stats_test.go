@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+func TestStatsHandler(t *testing.T) {
+	b, err := broadcaster.New(broadcaster.Config{Groups: []dao.Group{
+		{Name: "edge", Caches: []dao.Cache{{Name: "c1", Address: "http://127.0.0.1:1"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	w := httptest.NewRecorder()
+	statsHandler(b)(w, httptest.NewRequest("GET", "/debug/stats", nil))
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected body %q: %v", w.Body.String(), err)
+	}
+
+	for _, k := range []string{"queued_jobs", "groups", "caches", "last_reload", "cache_stats", "requests_served", "jobs_processed", "jobs_failed", "workers", "dropped_log_entries", "uptime", "gomaxprocs"} {
+		if _, found := body[k]; !found {
+			t.Errorf("expected %s to be reported, got %v", k, body)
+		}
+	}
+	if body["caches"] != 1.0 {
+		t.Errorf("expected a single cache, got %v", body["caches"])
+	}
+}
+
+func TestHealthzHandler(t *testing.T) {
+	b, err := broadcaster.New(broadcaster.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	w := httptest.NewRecorder()
+	healthzHandler(b)(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 || w.Body.String() != "OK\n" {
+		t.Errorf("expected OK, got %d %q", w.Code, w.Body.String())
+	}
+
+	b.Pause(broadcaster.PauseQueue)
+
+	w = httptest.NewRecorder()
+	healthzHandler(b)(w, httptest.NewRequest("GET", "/healthz?verbose=1", nil))
+
+	var status healthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("unexpected body %q: %v", w.Body.String(), err)
+	}
+	if status.Status != "paused" || !status.Paused || status.PauseMode != broadcaster.PauseQueue {
+		t.Errorf("expected the pause to be reported, got %+v", status)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// certCheckInterval is how often the certificate files
+	// are checked for changes, at most.
+	certCheckInterval = 10 * time.Second
+
+	// serverCerts serves the certificate of the https listener,
+	// nil when serving plain http.
+	serverCerts *certReloader
+)
+
+// certReloader serves a certificate loaded from disk, reloading
+// it once its files change so renewals take effect without a
+// restart. A failed reload keeps the current certificate.
+type certReloader struct {
+	crtFile string
+	keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(crtFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{crtFile: crtFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// filesModTime returns the latest modification time of the files.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range []string{c.crtFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// reload loads the certificate from disk.
+func (c *certReloader) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.crtFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+// GetCertificate serves the current certificate, reloading it
+// first if its files changed since it was loaded.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	stale := time.Since(c.checked) >= certCheckInterval
+	if stale {
+		c.checked = time.Now()
+	}
+	loaded := c.modTime
+	c.mu.Unlock()
+
+	if stale {
+		if modTime, err := c.filesModTime(); err == nil && !modTime.Equal(loaded) {
+			if err = c.reload(); err != nil {
+				sendToLogChannel("Reloading certificate ", c.crtFile, " failed, keeping the current one: ", err.Error(), "\n")
+			} else {
+				sendToLogChannel("Reloaded certificate ", c.crtFile, "\n")
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// redirectToHTTPS permanently redirects a plain http
+// request to the same URL on the https port.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+
+	if *httpsPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(*httpsPort))
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate with
+// the given serial number along with its key.
+func writeTestCert(t *testing.T, crtFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func TestRenewedCertificateIsServed(t *testing.T) {
+	defer func(d time.Duration) { certCheckInterval = d }(certCheckInterval)
+	certCheckInterval = 0
+
+	dir := t.TempDir()
+	crtFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, crtFile, keyFile, 1)
+
+	certs, err := newCertReloader(crtFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: certs.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	servedSerial := func() int64 {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if serial := servedSerial(); serial != 1 {
+		t.Fatalf("expected certificate 1 to be served, got %d", serial)
+	}
+
+	writeTestCert(t, crtFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(crtFile, later, later)
+
+	if serial := servedSerial(); serial != 2 {
+		t.Errorf("expected the renewed certificate to be served, got %d", serial)
+	}
+
+	// A broken renewal keeps the current certificate.
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+
+	if serial := servedSerial(); serial != 2 {
+		t.Errorf("expected the current certificate to be kept, got %d", serial)
+	}
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServesHTTPAndHTTPS(t *testing.T) {
+	defer func(crt, key string, p, hp int, serve bool) {
+		*crtFile, *keyFile, *port, *httpsPort, *serveHTTP = crt, key, p, hp, serve
+		serverCerts = nil
+	}(*crtFile, *keyFile, *port, *httpsPort, *serveHTTP)
+
+	dir := t.TempDir()
+	*crtFile, *keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, *crtFile, *keyFile, 1)
+	*port, *httpsPort, *serveHTTP = freePort(t), freePort(t), true
+
+	servers, err := broadcastServers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("expected an http and an https server, got %d", len(servers))
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- runServers(servers) }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	get := func(url string) error {
+		var err error
+		for i := 0; i < 50; i++ {
+			var resp *http.Response
+			if resp, err = client.Get(url); err == nil {
+				resp.Body.Close()
+				return nil
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return err
+	}
+
+	if err := get(fmt.Sprintf("http://127.0.0.1:%d/", *port)); err != nil {
+		t.Errorf("expected the http port to respond: %v", err)
+	}
+	if err := get(fmt.Sprintf("https://127.0.0.1:%d/", *httpsPort)); err != nil {
+		t.Errorf("expected the https port to respond: %v", err)
+	}
+
+	for _, server := range servers {
+		server.Shutdown(context.Background())
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestRedirectsHTTPToHTTPS(t *testing.T) {
+	defer func(crt, key string, hp int, redirect bool) {
+		*crtFile, *keyFile, *httpsPort, *redirectHTTPS = crt, key, hp, redirect
+		serverCerts = nil
+	}(*crtFile, *keyFile, *httpsPort, *redirectHTTPS)
+
+	dir := t.TempDir()
+	*crtFile, *keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, *crtFile, *keyFile, 1)
+	*httpsPort, *redirectHTTPS = 8443, true
+
+	servers, err := broadcastServers(http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || servers[1].TLSConfig != nil {
+		t.Fatalf("expected an https and a plain http server, got %d", len(servers))
+	}
+
+	tests := []struct {
+		httpsPort int
+		host      string
+		location  string
+	}{
+		{8443, "broadcaster.internal:8088", "https://broadcaster.internal:8443/foo?x=1"},
+		{443, "broadcaster.internal", "https://broadcaster.internal/foo?x=1"},
+	}
+
+	for _, tt := range tests {
+		*httpsPort = tt.httpsPort
+
+		r := httptest.NewRequest("PURGE", "http://"+tt.host+"/foo?x=1", nil)
+		w := httptest.NewRecorder()
+		servers[1].Handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.location {
+			t.Errorf("expected a redirect to %s, got %d %s", tt.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
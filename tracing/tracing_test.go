@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent(incoming)
+	if !ok || !sc.Sampled {
+		t.Fatalf("expected %s to parse, got %+v", incoming, sc)
+	}
+	if s := sc.Traceparent(); s != incoming {
+		t.Errorf("expected %s, got %s", incoming, s)
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-zzf067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(s); ok {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestNilTracerIsNoop(t *testing.T) {
+	tracer, err := New("", "broadcaster")
+	if err != nil || tracer != nil {
+		t.Fatalf("expected no tracer without endpoint, got %v %v", tracer, err)
+	}
+
+	ctx, span := tracer.Start(context.Background(), "broadcast", KindServer)
+	span.SetAttribute("broadcaster.group", "edge")
+	span.End()
+
+	h := http.Header{}
+	Inject(ctx, h)
+	if h.Get("traceparent") != "" {
+		t.Error("expected nothing to be injected")
+	}
+	tracer.Shutdown()
+}
+
+func TestSpansAreExported(t *testing.T) {
+	exported := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected export to %s", r.URL.Path)
+		}
+		var req otlpRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		exported <- req
+	}))
+	defer collector.Close()
+
+	tracer, err := New(collector.URL, "broadcaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := http.Header{}
+	h.Set("traceparent", incoming)
+
+	ctx, parent := tracer.Start(Extract(context.Background(), h), "broadcast", KindServer)
+	ctx, child := tracer.Start(ctx, "cache request", KindClient)
+	child.SetAttribute("http.response.status_code", 200)
+
+	out := http.Header{}
+	Inject(ctx, out)
+	if sc, _ := ParseTraceparent(out.Get("traceparent")); sc != child.Context() {
+		t.Errorf("expected the child span to be injected, got %s", out.Get("traceparent"))
+	}
+
+	child.End()
+	parent.End()
+	tracer.Shutdown()
+
+	spans := (<-exported).ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %+v", spans)
+	}
+	if spans[1].TraceID != incoming[3:35] || spans[1].ParentSpanID != incoming[36:52] {
+		t.Errorf("expected the broadcast to continue the incoming trace, got %+v", spans[1])
+	}
+	if spans[0].ParentSpanID != spans[1].SpanID || spans[0].Attributes[0].Value.IntValue != "200" {
+		t.Errorf("expected the cache request to be a child of the broadcast, got %+v", spans[0])
+	}
+}
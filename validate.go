@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	broadcaster "github.com/timothyclarke/http-request-broadcaster/broadcaster"
+	dao "github.com/timothyclarke/http-request-broadcaster/dao"
+)
+
+var validateOnly = commandLine.Bool("validate", false, "Validates the configuration, the groups of -cfg and the flags, then exits, non-zero listing the errors. The port isn't bound.")
+
+// runValidate validates the configuration without starting the
+// broadcaster, printing its errors, and returns the exit status.
+func runValidate(stdout io.Writer) int {
+	errs := validateConfig()
+	if len(errs) == 0 {
+		fmt.Fprintf(stdout, "Configuration %s is valid.\n", *cachesCfgFile)
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Configuration %s is invalid:\n", *cachesCfgFile)
+	for _, err := range errs {
+		fmt.Fprintf(stdout, "  - %s\n", err)
+	}
+	return 1
+}
+
+// validateConfig returns the errors of the groups of -cfg and of
+// the flags the broadcaster would fail to start with.
+func validateConfig() []error {
+	var errs []error
+
+	if *cachesCfgFile == "" {
+		errs = append(errs, fmt.Errorf("No configuration file specified. Use the -cfg parameter to specify one."))
+	} else if groupList, err := dao.LoadCaches(*cachesCfgFile); err != nil {
+		errs = append(errs, err)
+	} else {
+		errs = append(errs, broadcaster.Validate(broadcasterConfig(groupList))...)
+	}
+
+	if *serveHTTP && *redirectHTTPS {
+		errs = append(errs, fmt.Errorf("Only one of -serve-http and -redirect-https can be set."))
+	}
+	switch {
+	case (*crtFile == "") != (*keyFile == ""):
+		errs = append(errs, fmt.Errorf("-crt and -key must be set together."))
+	case *crtFile != "":
+		if _, err := newCertReloader(*crtFile, *keyFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := loadAuthTokens(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	defer func(cfg, policy, crt, key string) {
+		*cachesCfgFile, *statusPolicy, *crtFile, *keyFile = cfg, policy, crt, key
+	}(*cachesCfgFile, *statusPolicy, *crtFile, *keyFile)
+
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.ini")
+	bad := filepath.Join(dir, "bad.ini")
+	if err := ioutil.WriteFile(good, []byte("[edge]\nc1 = \"http://c1\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bad, []byte("[edge]\nc1 = \"ftp://c1\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	crt, key := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, crt, key, 1)
+
+	for _, tc := range []struct {
+		name      string
+		cfg       string
+		policy    string
+		crt, key  string
+		wantCode  int
+		wantErrs  int
+		wantLines []string
+	}{
+		{"good", good, "ok", crt, key, 0, 0, []string{"is valid"}},
+		{"bad groups", bad, "ok", "", "", 1, 1, []string{"unsupported scheme ftp"}},
+		{"missing file", filepath.Join(dir, "missing.ini"), "ok", "", "", 1, 1, []string{"missing.ini"}},
+		{"bad flags", good, "sometimes", filepath.Join(dir, "missing.crt"), key, 1, 2, []string{"Unknown status policy", "missing.crt"}},
+		{"lone crt", good, "ok", crt, "", 1, 1, []string{"-crt and -key must be set together"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*cachesCfgFile, *statusPolicy, *crtFile, *keyFile = tc.cfg, tc.policy, tc.crt, tc.key
+
+			var out bytes.Buffer
+			if code := runValidate(&out); code != tc.wantCode {
+				t.Errorf("expected exit status %d, got %d: %s", tc.wantCode, code, out.String())
+			}
+			if errs := strings.Count(out.String(), "\n  - "); errs != tc.wantErrs {
+				t.Errorf("expected %d errors, got %d: %s", tc.wantErrs, errs, out.String())
+			}
+			for _, want := range tc.wantLines {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("expected the output to mention %q, got %s", want, out.String())
+				}
+			}
+		})
+	}
+}
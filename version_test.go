@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "0a1b2c3", "2020-01-02T03:04:05Z"
+
+	w := httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest("GET", "/admin/version", nil))
+
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected body %q: %v", w.Body.String(), err)
+	}
+
+	want := map[string]string{"version": "1.2.0", "commit": "0a1b2c3", "build_date": "2020-01-02T03:04:05Z"}
+	for k, v := range want {
+		if body[k] != v {
+			t.Errorf("expected %s %q, got %q", k, v, body[k])
+		}
+	}
+	if body["go_version"] == "" || body["uptime"] == "" {
+		t.Error("expected the go version and uptime to be reported")
+	}
+
+	w = httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest("PURGE", "/version", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected only GET to be served, got %d", w.Code)
+	}
+}